@@ -15,25 +15,42 @@
 package apidQuota
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/apid/apid-core"
 	"github.com/apid/apidQuota/constants"
 	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/metrics"
 	"github.com/apid/apidQuota/quotaBucket"
+	quotaServices "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/tracing"
 	"github.com/apid/apidQuota/util"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 )
 
 func InitAPI(services apid.Services) {
 	globalVariables.Log.Debug("initializing apidQuota plugin APIs")
 	quotaBasePath := globalVariables.Config.GetString(constants.ConfigQuotaBasePath)
 	services.API().HandleFunc(quotaBasePath, checkQuotaLimitExceeded).Methods("POST")
+	services.API().HandleFunc(quotaBasePath+constants.CounterServiceEndpointsPath, getCounterServiceEndpoints).Methods("GET")
+	services.API().Handle(quotaBasePath+globalVariables.Config.GetString(constants.ConfigMetricsPath), metrics.Handler()).Methods("GET")
+	services.API().HandleFunc(quotaBasePath+constants.HealthPath, getHealth).Methods("GET")
+	services.API().HandleFunc(quotaBasePath+constants.ReadyPath, getReady).Methods("GET")
+	if adminToken := globalVariables.Config.GetString(constants.ConfigAdminToken); adminToken != "" {
+		services.API().HandleFunc(quotaBasePath+constants.CachedBucketsPath, util.RequireAdminToken(adminToken, getCachedBuckets)).Methods("GET")
+	}
 
 }
 
 func checkQuotaLimitExceeded(res http.ResponseWriter, req *http.Request) {
 
+	//the spans join the trace of the caller, when the request carries a traceparent.
+	traceCtx, span := tracing.Start(tracing.Extract(req.Context(), req.Header), "checkQuotaLimitExceeded")
+	defer span.End()
+
 	bodyBytes, err := ioutil.ReadAll(req.Body)
 	defer req.Body.Close()
 	if err != nil {
@@ -47,20 +64,59 @@ func checkQuotaLimitExceeded(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// parse the request body into the QuotaBucket struct
-	qBucket := new(quotaBucket.QuotaBucket)
-	if err = qBucket.FromAPIRequest(quotaBucketMap); err != nil {
-		util.WriteErrorResponse(http.StatusBadRequest, constants.ErrorConvertReqBodyToEntity, err.Error(), res, req)
-		return
+	// parse the request body into a QuotaBucket, or into a HierarchicalQuota when it names a chain of levels
+	_, parseSpan := tracing.Start(traceCtx, "FromAPIRequest")
+	var increment func(ctx context.Context) (map[string]interface{}, error)
+	if quotaBucket.IsHierarchicalAPIRequest(quotaBucketMap) {
+		hQuota := new(quotaBucket.HierarchicalQuota)
+		err = hQuota.FromAPIRequest(quotaBucketMap)
+		tracing.End(parseSpan, err)
+		if err != nil {
+			util.WriteErrorResponse(http.StatusBadRequest, constants.ErrorConvertReqBodyToEntity, err.Error(), res, req)
+			return
+		}
+		increment = func(ctx context.Context) (map[string]interface{}, error) {
+			results, err := hQuota.IncrementQuotaLimit(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return results.ToAPIResponse(), nil
+		}
+	} else {
+		qBucket := new(quotaBucket.QuotaBucket)
+		err = qBucket.FromAPIRequest(quotaBucketMap)
+		tracing.End(parseSpan, err)
+		if err != nil {
+			util.WriteErrorResponse(http.StatusBadRequest, constants.ErrorConvertReqBodyToEntity, err.Error(), res, req)
+			return
+		}
+		increment = func(ctx context.Context) (map[string]interface{}, error) {
+			results, err := qBucket.IncrementQuotaLimit(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return results.ToAPIResponse(), nil
+		}
 	}
 
-	results, err := qBucket.IncrementQuotaLimit()
+	//the calls to the counter service are cancelled when the client goes away or the request budget is spent.
+	ctx, cancel := withRequestTimeout(traceCtx)
+	defer cancel()
+
+	respMap, err := increment(ctx)
+	if err != nil && err.Error() == constants.QuotaShuttingDown {
+		util.WriteErrorResponse(http.StatusServiceUnavailable, constants.QuotaShuttingDown, "apidQuota is shutting down and not accepting new increments", res, req)
+		return
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		util.WriteErrorResponse(http.StatusGatewayTimeout, constants.QuotaRequestTimeout, "quota check did not complete within the request budget: "+err.Error(), res, req)
+		return
+	}
 	if err != nil {
 		util.WriteErrorResponse(http.StatusBadRequest, constants.ErrorCheckingQuotaLimit, "error retrieving count for the give identifier: "+err.Error(), res, req)
 		return
 	}
 
-	respMap := results.ToAPIResponse()
 	respbytes, err := json.Marshal(respMap)
 
 	res.Header().Set("Content-Type", "application/json")
@@ -68,3 +124,108 @@ func checkQuotaLimitExceeded(res http.ResponseWriter, req *http.Request) {
 	res.Write(respbytes)
 
 }
+
+// withRequestTimeout bounds ctx by the request budget. a budget of 0 or less sets no deadline.
+func withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := globalVariables.Config.GetDuration(constants.ConfigRequestTimeout); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// getCounterServiceEndpoints returns the health and latency of the counter service endpoints.
+func getCounterServiceEndpoints(res http.ResponseWriter, req *http.Request) {
+	respMap := make(map[string]interface{})
+	respMap["endpoints"] = quotaServices.GetCounterServiceEndpointStates()
+	respMap["circuitOpen"] = quotaServices.IsCircuitOpen()
+	respbytes, err := json.Marshal(respMap)
+	if err != nil {
+		util.WriteErrorResponse(http.StatusInternalServerError, constants.MarshalJSONError, "unable to marshal response: "+err.Error(), res, req)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(respbytes)
+}
+
+// getCachedBuckets returns the cached quotaBuckets and their live state, per org.
+// the edgeOrgID and idPrefix query parameters narrow down the quotaBuckets returned.
+func getCachedBuckets(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	respMap := make(map[string]interface{})
+	respMap["buckets"] = quotaBucket.GetCachedBucketStates(query.Get("edgeOrgID"), query.Get("idPrefix"))
+	respbytes, err := json.Marshal(respMap)
+	if err != nil {
+		util.WriteErrorResponse(http.StatusInternalServerError, constants.MarshalJSONError, "unable to marshal response: "+err.Error(), res, req)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(respbytes)
+}
+
+// getHealth answers as long as the plugin is up, whatever the state of the counter service.
+func getHealth(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write([]byte(`{"status":"ok"}`))
+}
+
+// getReady answers 200 when the node can take quota checks, and 503 otherwise, with the result of each check:
+// the counter backend config is valid, the counter backend can be reached,
+// and the weight the aSyncQuotaBuckets have not synced yet is below the configured backlog.
+func getReady(res http.ResponseWriter, req *http.Request) {
+	ready := true
+	checks := make(map[string]interface{})
+	check := func(name string, err error) map[string]interface{} {
+		result := map[string]interface{}{"ok": err == nil}
+		if err != nil {
+			ready = false
+			result["error"] = err.Error()
+		}
+		checks[name] = result
+		return result
+	}
+
+	if quotaBucket.IsShuttingDown() {
+		check("shutdown", errors.New(constants.QuotaShuttingDown))
+	}
+
+	configErr := quotaServices.CheckCounterBackendConfig()
+	check("config", configErr)
+	if configErr != nil {
+		check("counterService", errors.New("not checked, the counter backend config is invalid"))
+	} else {
+		check("counterService", quotaServices.PingCounterBackend(req.Context()))
+	}
+
+	backlog := quotaBucket.GetAsyncSyncBacklog()
+	maxBacklog := int64(globalVariables.Config.GetInt(constants.ConfigReadyMaxAsyncBacklog))
+	var backlogErr error
+	if maxBacklog > 0 && backlog > maxBacklog {
+		backlogErr = errors.New("weight not synced with the counter service: " + strconv.FormatInt(backlog, 10) +
+			" is above the max backlog: " + strconv.FormatInt(maxBacklog, 10))
+	}
+	backlogResult := check("asyncBacklog", backlogErr)
+	backlogResult["backlog"] = backlog
+	backlogResult["maxBacklog"] = maxBacklog
+
+	respMap := make(map[string]interface{})
+	respMap["ready"] = ready
+	respMap["checks"] = checks
+	respbytes, err := json.Marshal(respMap)
+	if err != nil {
+		util.WriteErrorResponse(http.StatusInternalServerError, constants.MarshalJSONError, "unable to marshal response: "+err.Error(), res, req)
+		return
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(respbytes)
+}
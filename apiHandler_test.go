@@ -0,0 +1,163 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidQuota_test
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/apid/apidQuota"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	"github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Test quota check handler", func() {
+	testUtil.UseConfig()
+
+	Context("against the counter service", func() {
+		var server *httptest.Server
+
+		checkQuota := func(edgeOrgID string) *httptest.ResponseRecorder {
+			reqBody, err := json.Marshal(map[string]interface{}{
+				"edgeOrgID":             edgeOrgID,
+				"id":                    "app",
+				"interval":              1,
+				"timeUnit":              "hour",
+				"type":                  "calendar",
+				"preciseAtSecondsLevel": false,
+				"startTimestamp":        time.Now().UTC().AddDate(0, -1, 0).Unix(),
+				"maxCount":              10,
+				"weight":                1,
+				"distributed":           true,
+				"synchronous":           true,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			res := httptest.NewRecorder()
+			CheckQuotaLimitExceeded(res, httptest.NewRequest("POST", "/quota", bytes.NewReader(reqBody)))
+			return res
+		}
+
+		BeforeEach(func() {
+			server = httptest.NewServer(counterService.NewCounterService(counterService.NewMemoryStore()))
+			testUtil.UseCounterService(server.URL)
+			services.SetCounterBackend(services.NewHTTPCounterBackend())
+		})
+
+		AfterEach(func() {
+			testUtil.ResetCounterService()
+			server.Close()
+		})
+
+		It("test quota check within the request timeout", func() {
+			testUtil.GetConfig().Set(constants.ConfigRequestTimeout, 10*time.Second)
+			Expect(checkQuota("timeoutOrg").Code).To(Equal(http.StatusOK))
+		})
+
+		It("test request timeout of 0 or less sets no deadline", func() {
+			testUtil.GetConfig().Set(constants.ConfigRequestTimeout, time.Duration(0))
+			Expect(checkQuota("timeoutOrgZero").Code).To(Equal(http.StatusOK))
+			testUtil.GetConfig().Set(constants.ConfigRequestTimeout, -time.Second)
+			Expect(checkQuota("timeoutOrgNegative").Code).To(Equal(http.StatusOK))
+		})
+
+		It("test quota check past the request timeout is answered with 504", func() {
+			testUtil.GetConfig().Set(constants.ConfigRequestTimeout, time.Nanosecond)
+			res := checkQuota("timeoutOrgExpired")
+			Expect(res.Code).To(Equal(http.StatusGatewayTimeout))
+			Expect(res.Body.String()).To(ContainSubstring(constants.QuotaRequestTimeout))
+		})
+	})
+})
+
+var _ = Describe("Test health and readiness handlers", func() {
+	testUtil.UseConfig()
+
+	getReady := func() (int, map[string]interface{}) {
+		res := httptest.NewRecorder()
+		GetReady(res, httptest.NewRequest("GET", "/ready", nil))
+		respMap := make(map[string]interface{})
+		Expect(json.Unmarshal(res.Body.Bytes(), &respMap)).To(Succeed())
+		return res.Code, respMap
+	}
+
+	check := func(respMap map[string]interface{}, name string) map[string]interface{} {
+		return respMap["checks"].(map[string]interface{})[name].(map[string]interface{})
+	}
+
+	It("test health answers while the process is up", func() {
+		res := httptest.NewRecorder()
+		GetHealth(res, httptest.NewRequest("GET", "/health", nil))
+		Expect(res.Code).To(Equal(http.StatusOK))
+		Expect(res.Body.String()).To(Equal(`{"status":"ok"}`))
+	})
+
+	It("test not ready without a counter service url", func() {
+		services.SetCounterBackend(services.NewHTTPCounterBackend())
+		code, respMap := getReady()
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(respMap["ready"]).To(BeFalse())
+		Expect(check(respMap, "config")["error"]).To(Equal(constants.URLCounterServiceNotSet))
+		Expect(check(respMap, "counterService")["ok"]).To(BeFalse())
+		Expect(check(respMap, "asyncBacklog")["ok"]).To(BeTrue())
+	})
+
+	Context("against the counter service", func() {
+		var server *httptest.Server
+		var down bool
+
+		BeforeEach(func() {
+			down = false
+			service := counterService.NewCounterService(counterService.NewMemoryStore())
+			server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				if down {
+					res.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				service.ServeHTTP(res, req)
+			}))
+			testUtil.UseCounterService(server.URL)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHealthCheckPath, constants.DefaultCounterServiceHealthCheckPath)
+			services.SetCounterBackend(services.NewHTTPCounterBackend())
+		})
+
+		AfterEach(func() {
+			testUtil.ResetCounterService()
+			server.Close()
+		})
+
+		It("test ready while the counter service answers", func() {
+			code, respMap := getReady()
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(respMap["ready"]).To(BeTrue())
+			Expect(check(respMap, "config")["ok"]).To(BeTrue())
+			Expect(check(respMap, "counterService")["ok"]).To(BeTrue())
+		})
+
+		It("test not ready while the counter service fails its health check", func() {
+			down = true
+			code, respMap := getReady()
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(respMap["ready"]).To(BeFalse())
+			Expect(check(respMap, "config")["ok"]).To(BeTrue())
+			Expect(check(respMap, "counterService")["error"]).To(ContainSubstring("no counter service endpoint is reachable"))
+		})
+	})
+})
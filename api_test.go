@@ -218,4 +218,60 @@ var _ = Describe("Api Tests", func() {
 
 	})
 
+	It("test Synchronous quota - retried requestId is counted once", func() {
+		requestData := make(map[string]interface{})
+		uuid, err := uuid.NewUUID()
+		if err != nil {
+			Fail("error getting uuid")
+		}
+
+		requestData["edgeOrgID"] = testValidOrg
+		requestData["id"] = "testID" + uuid.String()
+		requestData["interval"] = 1
+		requestData["timeUnit"] = "HOUR"
+		requestData["type"] = "CALENDAR"
+		requestData["preciseAtSecondsLevel"] = false
+		requestData["maxCount"] = 5
+		requestData["weight"] = 2
+		requestData["distributed"] = true
+		requestData["synchronous"] = true
+		requestData["requestId"] = "testRequestID" + uuid.String()
+
+		reqBytes, err := json.Marshal(requestData)
+		if err != nil {
+			Fail("error converting requestBody into bytes: " + err.Error())
+		}
+
+		remainingCounts := make([]float64, 0)
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("POST", testQuotaAPIURL, ioutil.NopCloser(bytes.NewReader(reqBytes)))
+			if err != nil {
+				Fail("error getting newRequest: " + err.Error())
+			}
+
+			res, err := testhttpClient.Do(req)
+			if err != nil {
+				Fail("error calling the api: " + err.Error())
+			}
+
+			// Check the status code is 200 OK.
+			if status := res.StatusCode; status != http.StatusOK {
+				Fail("wrong status code: " + res.Status)
+			}
+
+			respBodyBytes, err := ioutil.ReadAll(res.Body)
+			respBody := make(map[string]interface{})
+			err = json.Unmarshal(respBodyBytes, &respBody)
+			if err != nil {
+				Fail("error: " + err.Error())
+			}
+			remainingCounts = append(remainingCounts, respBody["remainingCount"].(float64))
+		}
+
+		//the retried request should return the original results.
+		if remainingCounts[0] != remainingCounts[1] {
+			Fail("retried requestId was counted twice")
+		}
+	})
+
 })
@@ -0,0 +1,106 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Entry is the record of one quota decision, kept to settle billing disputes.
+type Entry struct {
+	Timestamp        int64  `json:"timestamp"` //unix time of the decision, in milliseconds
+	EdgeOrgID        string `json:"edgeOrgID"`
+	ID               string `json:"id"`
+	Level            string `json:"level,omitempty"` //level of a hierarchical quota
+	Decision         string `json:"decision"`        //allowed or denied
+	Weight           int64  `json:"weight"`
+	CountBefore      int64  `json:"countBefore"`
+	CountAfter       int64  `json:"countAfter"`
+	MaxCount         int64  `json:"maxCount"`
+	StartTimestamp   int64  `json:"startTimestamp"`
+	ExpiresTimestamp int64  `json:"expiresTimestamp"`
+	Mode             string `json:"mode"`
+	Degraded         bool   `json:"degraded"` //decided without the counter service
+}
+
+var loggerLock sync.RWMutex
+var auditLogger *Logger
+
+func getLogger() *Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return auditLogger
+}
+
+// Init starts the audit log as per the config, written to a rotating file. the audit log is disabled when no file is set.
+func Init() error {
+	config := globalVariables.Config
+	filePath := config.GetString(constants.ConfigAuditFilePath)
+	if filePath == "" {
+		SetLogger(nil)
+		return nil
+	}
+	allowSampleRatio := config.GetFloat64(constants.ConfigAuditAllowSampleRatio)
+	denySampleRatio := config.GetFloat64(constants.ConfigAuditDenySampleRatio)
+	for key, ratio := range map[string]float64{constants.ConfigAuditAllowSampleRatio: allowSampleRatio, constants.ConfigAuditDenySampleRatio: denySampleRatio} {
+		if ratio < 0 || ratio > 1 {
+			return errors.New(constants.InvalidAuditConfig + " : " + key + " should be between 0 and 1, got: " + strconv.FormatFloat(ratio, 'f', -1, 64))
+		}
+	}
+
+	sink, err := NewFileSink(filePath, int64(config.GetInt(constants.ConfigAuditFileMaxSize)), config.GetInt(constants.ConfigAuditFileMaxBackups))
+	if err != nil {
+		return errors.New(constants.InvalidAuditConfig + " : " + err.Error())
+	}
+	logger := NewLogger(sink, config.GetInt(constants.ConfigAuditQueueSize), allowSampleRatio, denySampleRatio)
+	logger.logError = globalVariables.Log.Error
+	SetLogger(logger)
+	return nil
+}
+
+// SetLogger replaces the audit logger, nil disables the audit log. the replaced logger is stopped.
+func SetLogger(logger *Logger) {
+	loggerLock.Lock()
+	previous := auditLogger
+	auditLogger = logger
+	loggerLock.Unlock()
+	if previous != nil && previous != logger {
+		previous.stop(0)
+	}
+}
+
+// Record queues the entry to be written, if it is sampled. it never blocks the request path,
+// entries are dropped when the queue is full.
+func Record(entry Entry) {
+	logger := getLogger()
+	if logger == nil {
+		return
+	}
+	logger.record(entry)
+}
+
+// Shutdown writes the queued entries, waiting at most timeout, and closes the sink.
+func Shutdown(timeout time.Duration) error {
+	logger := getLogger()
+	if logger == nil {
+		return nil
+	}
+	return logger.stop(timeout)
+}
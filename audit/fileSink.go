@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"os"
+	"strconv"
+)
+
+// FileSink writes the entries as JSON lines. the file is rotated before it grows past maxSize:
+// it is renamed to <path>.1, the older files are shifted up to <path>.<maxBackups> and the oldest one is removed.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink opens path for appending. values of 0 or less are replaced by the defaults.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if maxSize <= 0 {
+		maxSize = constants.DefaultAuditFileMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = constants.DefaultAuditFileMaxBackups
+	}
+	sink := &FileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return errors.New("unable to open audit file: " + err.Error())
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.New("unable to read audit file size: " + err.Error())
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(entries []Entry) error {
+	buf := bytes.Buffer{}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return errors.New("unable to marshal audit entry: " + err.Error())
+		}
+		line = append(line, '\n')
+		pendingSize := s.size + int64(buf.Len())
+		if pendingSize > 0 && pendingSize+int64(len(line)) > s.maxSize {
+			if err := s.flush(&buf); err != nil {
+				return err
+			}
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		buf.Write(line)
+	}
+	return s.flush(&buf)
+}
+
+func (s *FileSink) flush(buf *bytes.Buffer) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+	written, err := s.file.Write(buf.Bytes())
+	s.size += int64(written)
+	buf.Reset()
+	if err != nil {
+		return errors.New("unable to write audit file: " + err.Error())
+	}
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return errors.New("unable to close audit file: " + err.Error())
+	}
+	os.Remove(s.backupPath(s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(s.backupPath(i), s.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.New("unable to rotate audit file: " + err.Error())
+		}
+	}
+	if err := os.Rename(s.path, s.backupPath(1)); err != nil {
+		return errors.New("unable to rotate audit file: " + err.Error())
+	}
+	return s.open()
+}
+
+func (s *FileSink) backupPath(backup int) string {
+	return s.path + "." + strconv.Itoa(backup)
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
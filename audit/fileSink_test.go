@@ -0,0 +1,106 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	. "github.com/apid/apidQuota/audit"
+	"github.com/apid/apidQuota/constants"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// readEntries returns the JSON lines of an audit file.
+func readEntries(path string) []Entry {
+	file, err := os.Open(path)
+	Expect(err).NotTo(HaveOccurred())
+	defer file.Close()
+	entries := make([]Entry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := Entry{}
+		Expect(json.Unmarshal(scanner.Bytes(), &entry)).To(Succeed())
+		entries = append(entries, entry)
+	}
+	Expect(scanner.Err()).NotTo(HaveOccurred())
+	return entries
+}
+
+var _ = Describe("Test audit FileSink", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "apidQuotaAudit")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("test entries are written as JSON lines and appended across restarts", func() {
+		path := filepath.Join(dir, "audit.log")
+		sink, err := NewFileSink(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		entry := decision("sampleID", constants.AuditDecisionDenied)
+		entry.CountBefore = 10
+		entry.CountAfter = 10
+		entry.Degraded = true
+		Expect(sink.Write([]Entry{entry})).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		sink, err = NewFileSink(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sink.Write([]Entry{decision("otherID", constants.AuditDecisionAllowed)})).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		entries := readEntries(path)
+		Expect(entries).To(Equal([]Entry{entry, decision("otherID", constants.AuditDecisionAllowed)}))
+	})
+
+	It("test file is rotated and old files removed", func() {
+		path := filepath.Join(dir, "audit.log")
+		line, err := json.Marshal(decision("sampleID0", constants.AuditDecisionDenied))
+		Expect(err).NotTo(HaveOccurred())
+		//two entries fit in a file.
+		sink, err := NewFileSink(path, int64(2*(len(line)+1)), 2)
+		Expect(err).NotTo(HaveOccurred())
+
+		entries := make([]Entry, 0)
+		for i := 0; i < 7; i++ {
+			entries = append(entries, decision("sampleID"+strconv.Itoa(i), constants.AuditDecisionDenied))
+		}
+		Expect(sink.Write(entries[:3])).To(Succeed())
+		Expect(sink.Write(entries[3:])).To(Succeed())
+		Expect(sink.Close()).To(Succeed())
+
+		Expect(readEntries(path)).To(Equal(entries[6:]))
+		Expect(readEntries(path + ".1")).To(Equal(entries[4:6]))
+		Expect(readEntries(path + ".2")).To(Equal(entries[2:4]))
+		_, err = os.Stat(path + ".3")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("test invalid path is reported", func() {
+		_, err := NewFileSink(filepath.Join(dir, "missing", "audit.log"), 0, 0)
+		Expect(err).To(HaveOccurred())
+	})
+})
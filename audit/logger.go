@@ -0,0 +1,164 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	mathrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sink is where the audit entries end up. Write is only called from one goroutine at a time.
+type Sink interface {
+	Write(entries []Entry) error
+	Close() error
+}
+
+// Logger writes the sampled entries to its sink, in batches, off the request path.
+type Logger struct {
+	sink             Sink
+	allowSampleRatio float64
+	denySampleRatio  float64
+
+	queue chan Entry
+	done  chan struct{} //closed once the queued entries were written and the sink is closed.
+
+	lock    sync.RWMutex
+	stopped bool //no entry is queued once set, so the queue can be closed.
+
+	written  int64
+	dropped  int64
+	logError func(args ...interface{}) //nil when nothing should be logged.
+}
+
+// NewLogger starts a logger writing to sink. every admitted request is recorded with a probability of allowSampleRatio,
+// every rejected one with a probability of denySampleRatio. a queueSize of 0 or less is replaced by the default.
+func NewLogger(sink Sink, queueSize int, allowSampleRatio float64, denySampleRatio float64) *Logger {
+	if queueSize <= 0 {
+		queueSize = constants.DefaultAuditQueueSize
+	}
+	logger := &Logger{
+		sink:             sink,
+		allowSampleRatio: allowSampleRatio,
+		denySampleRatio:  denySampleRatio,
+		queue:            make(chan Entry, queueSize),
+		done:             make(chan struct{}),
+	}
+	go logger.run()
+	return logger
+}
+
+func (l *Logger) isSampled(entry *Entry) bool {
+	ratio := l.allowSampleRatio
+	if entry.Decision == constants.AuditDecisionDenied {
+		ratio = l.denySampleRatio
+	}
+	return ratio >= 1 || (ratio > 0 && mathrand.Float64() < ratio)
+}
+
+func (l *Logger) record(entry Entry) {
+	if !l.isSampled(&entry) {
+		return
+	}
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().UTC().UnixNano() / int64(time.Millisecond)
+	}
+
+	//the lock keeps the queue open while the entry is sent, stop closes it.
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.stopped {
+		return
+	}
+	select {
+	case l.queue <- entry:
+	default:
+		if atomic.AddInt64(&l.dropped, 1) == 1 {
+			l.log("audit queue is full, dropping entries, first dropped for quotaBucket: ", entry.EdgeOrgID+constants.CacheKeyDelimiter+entry.ID)
+		}
+	}
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	batch := make([]Entry, 0, constants.AuditBatchSize)
+	for entry := range l.queue {
+		batch = append(batch[:0], entry)
+		//whatever else is queued goes in the same write.
+	fill:
+		for len(batch) < constants.AuditBatchSize {
+			select {
+			case next, ok := <-l.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, next)
+			default:
+				break fill
+			}
+		}
+		l.write(batch)
+	}
+	if err := l.sink.Close(); err != nil {
+		l.log("error closing audit sink: ", err.Error())
+	}
+}
+
+func (l *Logger) write(batch []Entry) {
+	if err := l.sink.Write(batch); err != nil {
+		atomic.AddInt64(&l.dropped, int64(len(batch)))
+		l.log("error writing ", len(batch), " audit entries: ", err.Error())
+		return
+	}
+	atomic.AddInt64(&l.written, int64(len(batch)))
+}
+
+// stop waits at most timeout for the queued entries to be written. the sink is closed once they are.
+func (l *Logger) stop(timeout time.Duration) error {
+	l.lock.Lock()
+	if l.stopped {
+		l.lock.Unlock()
+		return nil
+	}
+	l.stopped = true
+	close(l.queue)
+	l.lock.Unlock()
+
+	select {
+	case <-l.done:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("audit entries still queued after: " + timeout.String())
+	}
+}
+
+// Written returns the number of entries the sink accepted.
+func (l *Logger) Written() int64 {
+	return atomic.LoadInt64(&l.written)
+}
+
+// Dropped returns the number of sampled entries lost, when the queue was full or the sink failed.
+func (l *Logger) Dropped() int64 {
+	return atomic.LoadInt64(&l.dropped)
+}
+
+func (l *Logger) log(args ...interface{}) {
+	if l.logError != nil {
+		l.logError(args...)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit_test
+
+import (
+	"errors"
+	. "github.com/apid/apidQuota/audit"
+	"github.com/apid/apidQuota/constants"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memorySink keeps the entries it is given. writes wait while the sink is blocked.
+type memorySink struct {
+	lock    sync.Mutex
+	entries []Entry
+	blocked chan struct{}
+	closed  bool
+	failing bool
+}
+
+func newMemorySink() *memorySink {
+	blocked := make(chan struct{})
+	close(blocked)
+	return &memorySink{blocked: blocked}
+}
+
+func (s *memorySink) Write(entries []Entry) error {
+	<-s.getBlocked()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failing {
+		return errors.New("sink unavailable")
+	}
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *memorySink) getBlocked() chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.blocked
+}
+
+func (s *memorySink) block() func() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.blocked = make(chan struct{})
+	return func() { close(s.blocked) }
+}
+
+func (s *memorySink) written() []Entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Entry{}, s.entries...)
+}
+
+func (s *memorySink) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func decision(id string, decision string) Entry {
+	return Entry{
+		EdgeOrgID: "sampleOrg",
+		ID:        id,
+		Decision:  decision,
+		Weight:    1,
+		MaxCount:  10,
+		Mode:      constants.AuditModeSynchronous,
+	}
+}
+
+var _ = Describe("Test audit Logger", func() {
+	var sink *memorySink
+
+	BeforeEach(func() {
+		sink = newMemorySink()
+	})
+
+	AfterEach(func() {
+		SetLogger(nil)
+	})
+
+	It("test denies are recorded and allows are sampled", func() {
+		SetLogger(NewLogger(sink, 100, 0, 1))
+		for i := 0; i < 10; i++ {
+			Record(decision("sampleID"+strconv.Itoa(i), constants.AuditDecisionAllowed))
+			Record(decision("sampleID"+strconv.Itoa(i), constants.AuditDecisionDenied))
+		}
+		Expect(Shutdown(time.Second)).To(Succeed())
+
+		entries := sink.written()
+		Expect(entries).To(HaveLen(10))
+		for i, entry := range entries {
+			Expect(entry.Decision).To(Equal(constants.AuditDecisionDenied))
+			Expect(entry.ID).To(Equal("sampleID" + strconv.Itoa(i)))
+			Expect(entry.Timestamp).NotTo(BeZero())
+		}
+		Expect(sink.isClosed()).To(BeTrue())
+
+		//nothing is recorded after shutdown.
+		Record(decision("otherID", constants.AuditDecisionDenied))
+		Expect(sink.written()).To(HaveLen(10))
+	})
+
+	It("test allows are recorded with their sample ratio", func() {
+		logger := NewLogger(sink, 10000, 0.5, 1)
+		SetLogger(logger)
+		for i := 0; i < 2000; i++ {
+			Record(decision("sampleID", constants.AuditDecisionAllowed))
+		}
+		Expect(Shutdown(time.Second)).To(Succeed())
+		Expect(len(sink.written())).To(BeNumerically("~", 1000, 200))
+		Expect(logger.Written()).To(Equal(int64(len(sink.written()))))
+	})
+
+	It("test recording does not block when the sink is slow", func() {
+		unblock := sink.block()
+		logger := NewLogger(sink, 5, 1, 1)
+		SetLogger(logger)
+
+		recorded := make(chan struct{})
+		go func() {
+			for i := 0; i < 100; i++ {
+				Record(decision("sampleID", constants.AuditDecisionDenied))
+			}
+			close(recorded)
+		}()
+		Eventually(recorded).Should(BeClosed())
+		Expect(logger.Dropped()).To(BeNumerically(">", 0))
+
+		unblock()
+		Expect(Shutdown(time.Second)).To(Succeed())
+		Expect(logger.Written() + logger.Dropped()).To(Equal(int64(100)))
+	})
+
+	It("test failed writes are counted as dropped", func() {
+		sink.failing = true
+		logger := NewLogger(sink, 10, 1, 1)
+		SetLogger(logger)
+		Record(decision("sampleID", constants.AuditDecisionDenied))
+		Expect(Shutdown(time.Second)).To(Succeed())
+		Expect(logger.Dropped()).To(Equal(int64(1)))
+		Expect(logger.Written()).To(BeZero())
+	})
+})
@@ -0,0 +1,93 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// HashRing assigns every key to one of the nodes with consistent hashing.
+// each node is placed on the ring replicas times, so that adding or removing a node
+// only moves the keys of that node, spread evenly over the others.
+type HashRing struct {
+	replicas int
+	hashes   []uint32
+	owners   map[uint32]string
+	nodes    []string
+}
+
+func NewHashRing(nodes []string, replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = 1
+	}
+	ring := &HashRing{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+		nodes:    make([]string, 0, len(nodes)),
+	}
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if node == "" || seen[node] {
+			continue
+		}
+		seen[node] = true
+		ring.nodes = append(ring.nodes, node)
+		for i := 0; i < replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + node))
+			if _, taken := ring.owners[hash]; taken {
+				continue
+			}
+			ring.owners[hash] = node
+			ring.hashes = append(ring.hashes, hash)
+		}
+	}
+	sort.Strings(ring.nodes)
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// Owner returns the node owning key, empty when the ring has no nodes.
+func (ring *HashRing) Owner(key string) string {
+	if len(ring.hashes) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= hash })
+	if i == len(ring.hashes) {
+		i = 0
+	}
+	return ring.owners[ring.hashes[i]]
+}
+
+// Nodes returns the nodes of the ring, sorted.
+func (ring *HashRing) Nodes() []string {
+	return ring.nodes
+}
+
+// SameNodes reports if the ring has exactly the given nodes.
+func (ring *HashRing) SameNodes(nodes []string) bool {
+	other := NewHashRing(nodes, 1).Nodes()
+	if len(other) != len(ring.nodes) {
+		return false
+	}
+	for i := range other {
+		if other[i] != ring.nodes[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster_test
+
+import (
+	. "github.com/apid/apidQuota/cluster"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+)
+
+var _ = Describe("Test HashRing", func() {
+	nodes := []string{"http://node1:9000", "http://node2:9000", "http://node3:9000"}
+
+	It("test every node owns part of the keys", func() {
+		ring := NewHashRing(nodes, 100)
+		owned := make(map[string]int)
+		for i := 0; i < 3000; i++ {
+			owner := ring.Owner("testOrg|testKey" + strconv.Itoa(i))
+			Expect(nodes).To(ContainElement(owner))
+			owned[owner]++
+		}
+		for _, node := range nodes {
+			Expect(owned[node]).To(BeNumerically(">", 500))
+		}
+	})
+
+	It("test owner does not depend on the order of the nodes", func() {
+		ring := NewHashRing(nodes, 100)
+		reversed := NewHashRing([]string{nodes[2], nodes[1], nodes[0], nodes[1]}, 100)
+		Expect(reversed.Nodes()).To(Equal(ring.Nodes()))
+		Expect(ring.SameNodes(reversed.Nodes())).To(BeTrue())
+		for i := 0; i < 100; i++ {
+			key := "testOrg|testKey" + strconv.Itoa(i)
+			Expect(reversed.Owner(key)).To(Equal(ring.Owner(key)))
+		}
+	})
+
+	It("test adding a node only moves keys to the new node", func() {
+		ring := NewHashRing(nodes, 100)
+		grown := NewHashRing(append(nodes, "http://node4:9000"), 100)
+		Expect(ring.SameNodes(grown.Nodes())).To(BeFalse())
+		moved := 0
+		for i := 0; i < 1000; i++ {
+			key := "testOrg|testKey" + strconv.Itoa(i)
+			if ring.Owner(key) != grown.Owner(key) {
+				Expect(grown.Owner(key)).To(Equal("http://node4:9000"))
+				moved++
+			}
+		}
+		Expect(moved).To(BeNumerically(">", 0))
+		Expect(moved).To(BeNumerically("<", 500))
+	})
+
+	It("test empty ring", func() {
+		Expect(NewHashRing(nil, 100).Owner("testOrg|testKey")).To(Equal(""))
+	})
+})
+
+var _ = Describe("Test DiscoverPeers", func() {
+	It("test static peers", func() {
+		peers, err := DiscoverPeers([]string{" http://node2:9000/", "http://node1:9000", ""}, "", "http", "9000")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(peers).To(Equal([]string{"http://node1:9000", "http://node2:9000"}))
+	})
+
+	It("test dns peers", func() {
+		peers, err := DiscoverPeers(nil, "localhost", "http", "9000")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(peers).NotTo(BeEmpty())
+		for _, peer := range peers {
+			Expect(peer).To(HaveSuffix(":9000"))
+		}
+	})
+})
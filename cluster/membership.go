@@ -0,0 +1,47 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+)
+
+// DiscoverPeers returns the urls of the cluster nodes: the static peers when there are any,
+// else one url per address dnsName resolves to, with the given scheme and port.
+func DiscoverPeers(staticPeers []string, dnsName string, scheme string, port string) ([]string, error) {
+	peers := make([]string, 0)
+	for _, peer := range staticPeers {
+		if peer = strings.TrimSuffix(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	if len(peers) > 0 || dnsName == "" {
+		sort.Strings(peers)
+		return peers, nil
+	}
+
+	addresses, err := net.LookupHost(dnsName)
+	if err != nil {
+		return nil, errors.New("unable to resolve cluster peers from: " + dnsName + ", error: " + err.Error())
+	}
+	for _, address := range addresses {
+		peers = append(peers, scheme+"://"+net.JoinHostPort(address, port))
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// counterService runs the embedded counter service standalone, for running apidQuota offline:
+//
+//	counterService -listen 127.0.0.1:9010 -store file -path /tmp/counters.db
+package main
+
+import (
+	"flag"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	"log"
+	"net/http"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:9010", "address to listen on")
+	storeType := flag.String("store", constants.CounterStoreMemory, "where to keep the counts: memory or file")
+	path := flag.String("path", constants.EmbeddedCounterServiceFileName, "file of the file store")
+	flag.Parse()
+
+	store, err := counterService.NewStore(*storeType, *path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service := counterService.NewCounterService(store)
+	defer service.Close()
+
+	log.Println("counter service listening on: " + *listen)
+	if err := http.ListenAndServe(*listen, service); err != nil {
+		log.Println(err)
+	}
+}
@@ -18,8 +18,102 @@ import "time"
 
 const (
 	//config variables.
-	ApigeeSyncBearerToken = "apigeesync_bearer_token"
-	ConfigCounterServiceBasePath = "apidquota_counterService_base_path"
+	ApigeeSyncBearerToken         = "apigeesync_bearer_token"
+	ConfigCounterServiceBasePath  = "apidquota_counterService_base_path" //one url, a comma separated list or a list of urls
+	ConfigCounterServiceBatchPath = "apidquota_counterService_batch_path"
+	ConfigSyncConcurrency         = "apidquota_sync_concurrency"
+	ConfigSyncJitterPercent       = "apidquota_sync_jitter_percent"
+	ConfigShutdownFlushTimeout    = "apidquota_shutdown_flush_timeout"
+	ConfigWALEnabled              = "apidquota_wal_enabled"
+	ConfigLocalStoragePath        = "local_storage_path" //apid data directory
+
+	ConfigCounterServiceMaxRetries     = "apidquota_counterService_max_retries"
+	ConfigCounterServiceRetryBaseDelay = "apidquota_counterService_retry_base_delay"
+	ConfigCounterServiceRetryMaxDelay  = "apidquota_counterService_retry_max_delay"
+	ConfigCounterServiceAttemptTimeout = "apidquota_counterService_attempt_timeout"
+	ConfigIdempotencyCacheSize         = "apidquota_idempotency_cache_size"
+
+	ConfigCircuitBreakerFailureThreshold = "apidquota_counterService_breaker_failure_threshold"
+	ConfigCircuitBreakerOpenTimeout      = "apidquota_counterService_breaker_open_timeout"
+	ConfigDefaultDegradationMode         = "apidquota_default_degradation_mode"
+	ConfigRequestTimeout                 = "apidquota_request_timeout" //0 for no deadline
+	ConfigHierarchicalRollbackTimeout    = "apidquota_hierarchical_rollback_timeout"
+
+	ConfigCounterServiceCABundle            = "apidquota_counterService_ca_bundle"
+	ConfigCounterServiceClientCert          = "apidquota_counterService_client_cert"
+	ConfigCounterServiceClientKey           = "apidquota_counterService_client_key"
+	ConfigCounterServiceMaxIdleConns        = "apidquota_counterService_max_idle_conns"
+	ConfigCounterServiceMaxIdleConnsPerHost = "apidquota_counterService_max_idle_conns_per_host"
+	ConfigCounterServiceIdleConnTimeout     = "apidquota_counterService_idle_conn_timeout"
+	ConfigCounterServiceKeepAlive           = "apidquota_counterService_keep_alive" //negative to disable keep-alive
+	ConfigCounterServiceHTTP2               = "apidquota_counterService_http2"
+	ConfigCounterServiceProxyURL            = "apidquota_counterService_proxy_url"
+
+	ConfigCounterServiceAuthType           = "apidquota_counterService_auth_type"
+	ConfigCounterServiceAuthToken          = "apidquota_counterService_auth_token" //for the static auth type
+	ConfigCounterServiceOAuth2TokenURL     = "apidquota_counterService_oauth2_token_url"
+	ConfigCounterServiceOAuth2ClientID     = "apidquota_counterService_oauth2_client_id"
+	ConfigCounterServiceOAuth2ClientSecret = "apidquota_counterService_oauth2_client_secret"
+	ConfigCounterServiceOAuth2Scopes       = "apidquota_counterService_oauth2_scopes" //space separated
+	ConfigCounterServiceHMACKeyID          = "apidquota_counterService_hmac_key_id"
+	ConfigCounterServiceHMACSecret         = "apidquota_counterService_hmac_secret"
+
+	ConfigCounterServiceHealthCheckInterval = "apidquota_counterService_health_check_interval" //0 to disable
+	ConfigCounterServiceHealthCheckTimeout  = "apidquota_counterService_health_check_timeout"
+	ConfigCounterServiceHealthCheckPath     = "apidquota_counterService_health_check_path"
+	ConfigCounterServiceUnhealthyThreshold  = "apidquota_counterService_unhealthy_threshold"
+
+	ConfigEmbeddedCounterServiceEnabled  = "apidquota_embedded_counterService_enabled"
+	ConfigEmbeddedCounterServiceStore    = "apidquota_embedded_counterService_store" //memory or file
+	ConfigEmbeddedCounterServiceBasePath = "apidquota_embedded_counterService_base_path"
+	ConfigAPIListen                      = "api_listen" //apid api listen address
+
+	ConfigCounterBackend = "apidquota_counter_backend" //http or redis
+	ConfigRedisAddress   = "apidquota_redis_address"   //host:port
+	ConfigRedisPassword  = "apidquota_redis_password"
+	ConfigRedisDB        = "apidquota_redis_db"
+	ConfigRedisKeyPrefix = "apidquota_redis_key_prefix"
+	ConfigRedisMaxIdle   = "apidquota_redis_max_idle"
+	ConfigRedisTLS       = "apidquota_redis_tls"
+
+	ConfigClusterSelf            = "apidquota_cluster_self"     //url the other members reach this node at
+	ConfigClusterPeers           = "apidquota_cluster_peers"    //comma separated urls of the members
+	ConfigClusterDNSName         = "apidquota_cluster_dns_name" //resolves to the members, when no peers are listed
+	ConfigClusterDNSScheme       = "apidquota_cluster_dns_scheme"
+	ConfigClusterDNSPort         = "apidquota_cluster_dns_port"
+	ConfigClusterRefreshInterval = "apidquota_cluster_refresh_interval"
+	ConfigClusterVirtualNodes    = "apidquota_cluster_virtual_nodes"
+
+	ConfigLeaseChunkPercent = "apidquota_lease_chunk_percent" //default size of the chunks leased by leased quotaBuckets
+
+	ConfigAdaptiveSyncHeadroomPercent = "apidquota_adaptive_sync_headroom_percent"
+
+	ConfigNotifierWebhookURL      = "apidquota_notifier_webhook_url" //notifications are disabled when not set
+	ConfigNotifierWebhookSecret   = "apidquota_notifier_webhook_secret"
+	ConfigNotifierQueueSize       = "apidquota_notifier_queue_size"
+	ConfigNotifierMaxRetries      = "apidquota_notifier_max_retries"
+	ConfigNotifierRetryBaseDelay  = "apidquota_notifier_retry_base_delay"
+	ConfigNotifierRetryMaxDelay   = "apidquota_notifier_retry_max_delay"
+	ConfigNotifierDeliveryTimeout = "apidquota_notifier_delivery_timeout"
+
+	ConfigMetricsPath    = "apidquota_metrics_path" //under the quota base path
+	ConfigMetricsMaxOrgs = "apidquota_metrics_max_orgs"
+
+	ConfigTracingExporter     = "apidquota_tracing_exporter" //none, otlp or stdout
+	ConfigTracingOTLPEndpoint = "apidquota_tracing_otlp_endpoint"
+	ConfigTracingOTLPInsecure = "apidquota_tracing_otlp_insecure" //export over http instead of https
+	ConfigTracingSampleRatio  = "apidquota_tracing_sample_ratio"  //of the traces started by apidQuota, the callers' sampling decisions are kept
+
+	ConfigAuditFilePath         = "apidquota_audit_file_path" //the audit log is disabled when not set
+	ConfigAuditFileMaxSize      = "apidquota_audit_file_max_size"
+	ConfigAuditFileMaxBackups   = "apidquota_audit_file_max_backups"
+	ConfigAuditQueueSize        = "apidquota_audit_queue_size"
+	ConfigAuditAllowSampleRatio = "apidquota_audit_allow_sample_ratio" //of the admitted requests recorded
+	ConfigAuditDenySampleRatio  = "apidquota_audit_deny_sample_ratio"  //of the rejected requests recorded
+
+	ConfigAdminToken = "apidquota_admin_token" //bearer token of the admin endpoints, they are disabled when not set
+
+	ConfigReadyMaxAsyncBacklog = "apidquota_ready_max_async_backlog" //pending async weight above which the node is not ready, 0 to disable
 
 	//add to acceptedTimeUnitList in init() if case any other new timeUnit is added
 	TimeUnitSECOND = "second"
@@ -33,24 +127,197 @@ const (
 	InvalidQuotaTimeUnitType = "invalidQuotaTimeUnitType"
 	InvalidQuotaType         = "invalidQuotaType"
 	InvalidQuotaPeriod       = "invalidQuotaPeriod"
-	AsyncQuotaBucketEmpty = "AsyncDetails_for_quotaBucket_are_empty"
+	AsyncQuotaBucketEmpty    = "AsyncDetails_for_quotaBucket_are_empty"
+	AsyncQuotaBucketEvicted  = "async_quota_bucket_evicted"
+	QuotaShuttingDown        = "quota_shutting_down"
+	InvalidDegradationMode   = "invalidDegradationMode"
+	InvalidAuthType          = "invalidAuthType"
+	InvalidCounterBackend    = "invalidCounterBackend"
+	CounterResetNotSupported = "counter_reset_not_supported"
+	RedisAddressNotSet       = "redis_address_not_set"
+	ClusterSelfNotSet        = "cluster_self_not_set"
+	ClusterLocalStoreNotSet  = "cluster_local_store_not_set"
+	InvalidLeaseChunkPercent = "invalidLeaseChunkPercent"
+	LeaseNotSupported        = "lease_not_supported"
+	InvalidAdaptiveSync      = "invalidAdaptiveSync"
+	InvalidMaxStaleness      = "invalidMaxStaleness"
+	InvalidSoftLimit         = "invalidSoftLimit"
+	InvalidThresholds        = "invalidThresholds"
+	InvalidNotifierConfig    = "invalidNotifierConfig"
+	InvalidTracingConfig     = "invalidTracingConfig"
+	InvalidAuditConfig       = "invalidAuditConfig"
+
+	//where the embedded counter service keeps the counts
+	CounterStoreMemory = "memory"
+	CounterStoreFile   = "file"
+
+	//where the distributed counts are kept
+	CounterBackendHTTP    = "http"    // the counter service
+	CounterBackendRedis   = "redis"   // a redis compatible store
+	CounterBackendCluster = "cluster" // the apid nodes, each owning part of the keys
+
+	//how requests to the counter service are authorized
+	AuthTypeApigeeSync = "apigeesync" // bearer token managed by apidApigeeSync
+	AuthTypeStatic     = "static"     // configured bearer token
+	AuthTypeOAuth2     = "oauth2"     // oauth2 client credentials grant
+	AuthTypeHMAC       = "hmac"       // requests signed with a shared secret
+	AuthTypeNone       = "none"
 
 	QuotaTypeCalendar      = "calendar"      // after start time
 	QuotaTypeRollingWindow = "rollingwindow" // in the past "window" time
 
+	//how a quotaBucket decides while the counter service is unavailable
+	DegradationModeFailOpen      = "failopen"      // allow and count locally
+	DegradationModeFailClosed    = "failclosed"    // deny
+	DegradationModeLocalEstimate = "localestimate" // count locally against the last known count, reconcile later
+
+	//what a notification is about
+	NotificationEventThreshold = "threshold" // the count reached a threshold of the quotaBucket
+	NotificationEventExceeded  = "exceeded"  // a request was rejected
+
 	CacheKeyDelimiter    = "|"
 	CacheTTL             = time.Minute * 1
 	DefaultQuotaSyncTime = 300 //in seconds
 	DefaultCount         = 0
 
+	DefaultSyncConcurrency   = 10 //number of workers syncing aSyncQuotaBuckets with the counter service
+	DefaultSyncJitterPercent = 10 //max jitter added to each sync, as percentage of the sync interval
+	MaxIdleSyncCount         = 3  //aSyncQuotaBucket is removed from cache after these many syncs without local traffic
+
+	DefaultShutdownFlushTimeout = time.Second * 5
+
+	DefaultCounterServiceMaxRetries     = 3
+	DefaultCounterServiceRetryBaseDelay = time.Millisecond * 100
+	DefaultCounterServiceRetryMaxDelay  = time.Second * 2
+	DefaultCounterServiceAttemptTimeout = time.Second * 10
+
+	DefaultIdempotencyCacheSize = 10000 //number of recent requestIds remembered to deduplicate retried requests
+
+	DefaultCircuitBreakerFailureThreshold = 5 //consecutive failed calls to the counter service before the circuit opens
+	DefaultCircuitBreakerOpenTimeout      = time.Second * 30
+
+	DefaultRequestTimeout = time.Second * 60 //budget for a quota check, including all the calls to the counter service
+
+	DefaultHierarchicalRollbackTimeout = time.Second * 10 //budget for taking back the increments of a rejected hierarchical request
+
+	DefaultCounterServiceMaxIdleConns        = 100
+	DefaultCounterServiceMaxIdleConnsPerHost = 100
+	DefaultCounterServiceIdleConnTimeout     = time.Second * 90
+	DefaultCounterServiceKeepAlive           = time.Second * 30
+	DefaultCounterServiceDialTimeout         = time.Second * 30
+
+	DefaultOAuth2TokenLifetime = time.Minute * 5  //when the token response has no expires_in
+	OAuth2TokenExpiryMargin    = time.Second * 30 //oauth2 tokens are renewed this long before they expire
+
+	DefaultCounterServiceHealthCheckInterval = time.Second * 10
+	DefaultCounterServiceHealthCheckTimeout  = time.Second * 2
+	DefaultCounterServiceHealthCheckPath     = "/health" //as served by the counter service
+	DefaultCounterServiceUnhealthyThreshold  = 2         //consecutive failures before an endpoint is marked unhealthy
+
+	CounterServiceEndpointsPath = "/counterService/endpoints" //diagnostics, under the quota base path
+	CachedBucketsPath           = "/admin/buckets"            //admin, under the quota base path
+	HealthPath                  = "/health"                   //liveness, under the quota base path
+	ReadyPath                   = "/ready"                    //readiness, under the quota base path
+
+	DefaultReadyMaxAsyncBacklog = 100000
+
+	DefaultRedisKeyPrefix = "apidquota:"
+	DefaultRedisMaxIdle   = 10
+
+	DefaultClusterRefreshInterval = time.Second * 30
+	DefaultClusterVirtualNodes    = 100 //places of each member on the hash ring
+	DefaultClusterDNSScheme       = "http"
+	DefaultClusterDNSPort         = "9000"
+
+	DefaultLeaseChunkPercent = 10 //percentage of the quota left at the counter service leased at once
+
+	DefaultAdaptiveSyncHeadroomPercent = 10 //adaptive aSyncQuotaBuckets sync once the weight not synced reaches this percentage of the headroom
+
+	DefaultNotifierQueueSize       = 1000 //notifications waiting to be delivered, new ones are dropped when full
+	DefaultNotifierMaxRetries      = 5
+	DefaultNotifierRetryBaseDelay  = time.Second * 1
+	DefaultNotifierRetryMaxDelay   = time.Minute * 1
+	DefaultNotifierDeliveryTimeout = time.Second * 10
+	NotifierPurgeInterval          = time.Minute * 1 //how often the notifications of past periods are forgotten
+	NotifierDateHeader             = "X-Apid-Date"
+	NotifierSignatureHeader        = "X-Apid-Signature" //HMAC-SHA256 of the date header and the body, hex encoded
+
+	MetricsPathDefault     = "/metrics"
+	DefaultMetricsMaxOrgs  = 100     //orgs with their own decision series, the others are counted together
+	MetricsOtherOrgs       = "other" //org label of the orgs over the limit
+	MetricsDecisionAllowed = "allowed"
+	MetricsDecisionDenied  = "denied"
+	MetricsCacheHit        = "hit"
+	MetricsCacheMiss       = "miss"
+
+	MetricsCounterServiceUnavailable = "unavailable" //error status of the calls which could not reach the counts
+	MetricsCounterServiceCancelled   = "cancelled"   //error status of the calls given up on by the caller
+	MetricsCounterServiceFailed      = "failed"      //error status of the other failed calls
+	MetricsCounterServiceOther       = "other"       //backend label of the backends set by SetCounterBackend
+	MetricsOperationIncrement        = "increment"
+	MetricsOperationBatchIncrement   = "batch_increment"
+
+	//where the spans are exported
+	TracingExporterNone   = "none"
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+
+	DefaultTracingOTLPEndpoint = "localhost:4318"
+	DefaultTracingSampleRatio  = 1.0
+	TracingServiceName         = "apidQuota"
+	TracerName                 = "github.com/apid/apidQuota"
+
+	DefaultAuditFileMaxSize      = 100 * 1024 * 1024 //bytes, the audit file is rotated before it grows past it
+	DefaultAuditFileMaxBackups   = 5                 //rotated audit files kept, as <path>.1 to <path>.n
+	DefaultAuditQueueSize        = 10000             //entries waiting to be written, new ones are dropped when full
+	DefaultAuditAllowSampleRatio = 0.0
+	DefaultAuditDenySampleRatio  = 1.0
+	AuditBatchSize               = 100 //entries written to the sink at once
+	AuditDecisionAllowed         = "allowed"
+	AuditDecisionDenied          = "denied"
+
+	//how the quotaBucket of an audited decision is counted
+	AuditModeSynchronous    = "synchronous"
+	AuditModeAsynchronous   = "asynchronous"
+	AuditModeLeased         = "leased"
+	AuditModeNonDistributed = "nonDistributed"
+	AuditModeHierarchical   = "hierarchical"
+
+	WALFileName            = "apidQuota_async.wal"
+	WALCompactionThreshold = 1000        //records appended to the write-ahead log before it is compacted
+	WALReplayRetryInterval = time.Minute //between retries of the increments the counter service did not accept during replay
+
 	UnableToParseBody           = "unable_to_parse_body"
 	UnMarshalJSONError          = "unmarshal_json_error"
 	ErrorConvertReqBodyToEntity = "error_convert_reqBody_to_entity"
 	ConfigQuotaBasePath         = "quota_base_path"
 	ErrorCheckingQuotaLimit     = "error_checking_quota_limit"
+	QuotaRequestTimeout         = "quota_request_timeout"
 	QuotaBasePathDefault        = "/quota"
+	Unauthorized                = "unauthorized"
+
+	URLCounterServiceNotSet  = "url_counter_service_not_set"
+	URLCounterServiceInvalid = "url_counter_service_invalid"
+	MarshalJSONError         = "marshal_JSON_error"
+
+	CounterServiceCircuitOpen = "counter_service_circuit_open"
+
+	CounterServiceBatchPathDefault = "/batch"
+	CounterServiceAdjustPath       = "/adjust"         //batch of authenticated peers only, for the counters handed off in cluster mode
+	IdempotencyKeyHeader           = "Idempotency-Key" //retries of an increment carry the same key
+
+	HMACDateHeader   = "X-Apid-Date"
+	HMACAlgorithm    = "HMAC-SHA256"
+	HMACMaxClockSkew = time.Minute * 5 //signed requests dated further from now are rejected
 
-	URLCounterServiceNotSet      = "url_counter_service_not_set"
-	URLCounterServiceInvalid     = "url_counter_service_invalid"
-	MarshalJSONError             = "marshal_JSON_error"
+	EmbeddedCounterServiceBasePathDefault = "/counterService"
+	EmbeddedCounterServiceHealthPath      = "/health"
+	EmbeddedCounterServiceFileName        = "apidQuota_counters.db"
+	EmbeddedCounterServiceCacheSize       = 10000           //idempotency keys remembered by the embedded counter service
+	EmbeddedCounterServiceKeyLocks        = 64              //locks the idempotency keys are spread over
+	EmbeddedCounterServicePurgeInterval   = time.Minute * 1 //how often counters of past periods are removed
+	DefaultAPIListen                      = "127.0.0.1:9000"
+	InvalidCounterStore                   = "invalidCounterStore"
+	InvalidCounterEntry                   = "invalid_counter_entry"
+	ErrorIncrementingCounter              = "error_incrementing_counter"
 )
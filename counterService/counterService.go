@@ -0,0 +1,239 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package counterService
+
+import (
+	"container/list"
+	"encoding/json"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/util"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CounterService serves the counter service protocol on top of a Store:
+//
+//	POST <base>        {orgId, key, delta, startTime, endTime} -> {count}
+//	POST <base>/batch  {entries: [...]}                         -> {entries: [{count}]}
+//	POST <base>/adjust {entries: [...]}                         -> {entries: [{count}]}
+//	GET  <base>/health
+//
+// increments sent again with the same Idempotency-Key get the original response.
+// the increments are verified with the peer authenticator, when set. deltas may only be negative once verified by it:
+// it is how leases and rollbacks give weight back, on any path, and cluster members hand off counters, on the adjust path.
+type CounterService struct {
+	store         Store
+	authenticator PeerAuthenticator //set before serving.
+
+	//an increment holds the lock of its idempotency key, so a retry arriving meanwhile waits for the original
+	//instead of counting again. increments with keys on other locks go ahead.
+	keyLocks []sync.Mutex
+
+	lock            sync.Mutex //guards the stored responses.
+	responses       map[string]*list.Element
+	responsesByAge  *list.List
+	maxResponseSize int
+}
+
+type idempotentResponse struct {
+	idempotencyKey string
+	body           []byte
+}
+
+func NewCounterService(store Store) *CounterService {
+	return &CounterService{
+		store:           store,
+		keyLocks:        make([]sync.Mutex, constants.EmbeddedCounterServiceKeyLocks),
+		responses:       make(map[string]*list.Element),
+		responsesByAge:  list.New(),
+		maxResponseSize: constants.EmbeddedCounterServiceCacheSize,
+	}
+}
+
+// ServeHTTP routes the requests relative to the base path, for running the counter service standalone.
+func (s *CounterService) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == "GET" && strings.HasSuffix(req.URL.Path, constants.EmbeddedCounterServiceHealthPath):
+		s.HandleHealth(res, req)
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, constants.CounterServiceAdjustPath):
+		s.HandleAdjust(res, req)
+	case req.Method == "POST" && strings.HasSuffix(req.URL.Path, constants.CounterServiceBatchPathDefault):
+		s.HandleBatchIncrement(res, req)
+	case req.Method == "POST":
+		s.HandleIncrement(res, req)
+	default:
+		res.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *CounterService) HandleHealth(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write([]byte(`{"status":"ok"}`))
+}
+
+func (s *CounterService) HandleIncrement(res http.ResponseWriter, req *http.Request) {
+	entry := Entry{}
+	if !s.readRequestBody(res, req, &entry) {
+		return
+	}
+
+	s.increment(res, req, []Entry{entry}, s.authenticator != nil, func(counts []int64) interface{} {
+		return map[string]interface{}{"count": counts[0]}
+	})
+}
+
+func (s *CounterService) HandleBatchIncrement(res http.ResponseWriter, req *http.Request) {
+	s.batchIncrement(res, req, s.authenticator != nil)
+}
+
+// HandleAdjust is HandleBatchIncrement for authenticated peers only, which cluster members hand off counters on.
+func (s *CounterService) HandleAdjust(res http.ResponseWriter, req *http.Request) {
+	if s.authenticator == nil {
+		util.WriteErrorResponse(http.StatusForbidden, constants.Unauthorized, "adjusting counters needs peer authentication", res, req)
+		return
+	}
+	s.batchIncrement(res, req, true)
+}
+
+func (s *CounterService) batchIncrement(res http.ResponseWriter, req *http.Request, adjust bool) {
+	batch := struct {
+		Entries []Entry `json:"entries"`
+	}{}
+	if !s.readRequestBody(res, req, &batch) {
+		return
+	}
+
+	s.increment(res, req, batch.Entries, adjust, func(counts []int64) interface{} {
+		respEntries := make([]map[string]interface{}, 0, len(counts))
+		for _, count := range counts {
+			respEntries = append(respEntries, map[string]interface{}{"count": count})
+		}
+		return map[string]interface{}{"entries": respEntries}
+	})
+}
+
+// SetPeerAuthenticator makes the increments need the credentials verified by authenticator.
+func (s *CounterService) SetPeerAuthenticator(authenticator PeerAuthenticator) {
+	s.authenticator = authenticator
+}
+
+// increment applies the entries and writes the response, or the stored response when the idempotency key was seen before.
+// adjust lets the deltas be negative.
+func (s *CounterService) increment(res http.ResponseWriter, req *http.Request, entries []Entry, adjust bool, toResponse func([]int64) interface{}) {
+	idempotencyKey := req.Header.Get(constants.IdempotencyKeyHeader)
+	if idempotencyKey != "" {
+		keyLock := s.getKeyLock(idempotencyKey)
+		keyLock.Lock()
+		defer keyLock.Unlock()
+		if respBytes, ok := s.getResponse(idempotencyKey); ok {
+			writeResponse(res, respBytes)
+			return
+		}
+	}
+
+	var counts []int64
+	var err error
+	if adjust {
+		counts, err = s.store.Adjust(entries)
+	} else {
+		counts, err = s.store.Increment(entries)
+	}
+	if err != nil {
+		util.WriteErrorResponse(http.StatusBadRequest, constants.ErrorIncrementingCounter, err.Error(), res, req)
+		return
+	}
+
+	respBytes, err := json.Marshal(toResponse(counts))
+	if err != nil {
+		util.WriteErrorResponse(http.StatusInternalServerError, constants.MarshalJSONError, err.Error(), res, req)
+		return
+	}
+
+	if idempotencyKey != "" {
+		s.putResponse(idempotencyKey, respBytes)
+	}
+	writeResponse(res, respBytes)
+}
+
+func (s *CounterService) getKeyLock(idempotencyKey string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(idempotencyKey))
+	return &s.keyLocks[h.Sum32()%uint32(len(s.keyLocks))]
+}
+
+// getResponse returns the stored response of the idempotency key.
+func (s *CounterService) getResponse(idempotencyKey string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	element, ok := s.responses[idempotencyKey]
+	if !ok {
+		return nil, false
+	}
+	s.responsesByAge.MoveToFront(element)
+	return element.Value.(*idempotentResponse).body, true
+}
+
+// putResponse stores the response of the idempotency key, forgetting the oldest ones beyond maxResponseSize.
+func (s *CounterService) putResponse(idempotencyKey string, respBytes []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.responses[idempotencyKey] = s.responsesByAge.PushFront(&idempotentResponse{idempotencyKey: idempotencyKey, body: respBytes})
+	for s.responsesByAge.Len() > s.maxResponseSize {
+		oldest := s.responsesByAge.Back()
+		s.responsesByAge.Remove(oldest)
+		delete(s.responses, oldest.Value.(*idempotentResponse).idempotencyKey)
+	}
+}
+
+// readRequestBody reads the request body into v, once the request is verified by the peer authenticator.
+func (s *CounterService) readRequestBody(res http.ResponseWriter, req *http.Request, v interface{}) bool {
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	defer req.Body.Close()
+	if err != nil {
+		util.WriteErrorResponse(http.StatusBadRequest, constants.UnableToParseBody, "unable to read request body: "+err.Error(), res, req)
+		return false
+	}
+	if s.authenticator != nil {
+		if err := s.authenticator.Verify(req, bodyBytes); err != nil {
+			util.WriteErrorResponse(http.StatusUnauthorized, constants.Unauthorized, err.Error(), res, req)
+			return false
+		}
+	}
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		util.WriteErrorResponse(http.StatusBadRequest, constants.InvalidCounterEntry, "unable to convert request body to an object: "+err.Error(), res, req)
+		return false
+	}
+	return true
+}
+
+func writeResponse(res http.ResponseWriter, respBytes []byte) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(respBytes)
+}
+
+// Store returns the store the counts are kept in.
+func (s *CounterService) Store() Store {
+	return s.store
+}
+
+// Close closes the store.
+func (s *CounterService) Close() error {
+	return s.store.Close()
+}
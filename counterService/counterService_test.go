@@ -0,0 +1,245 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package counterService_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/apid/apidQuota/constants"
+	. "github.com/apid/apidQuota/counterService"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// blockingStore holds the increments of blockedKey until release is closed.
+type blockingStore struct {
+	Store
+	blockedKey string
+	blocked    chan struct{}
+	release    chan struct{}
+}
+
+func (s *blockingStore) Increment(entries []Entry) ([]int64, error) {
+	if entries[0].Key == s.blockedKey {
+		s.blocked <- struct{}{}
+		<-s.release
+	}
+	return s.Store.Increment(entries)
+}
+
+func postToTestServer(url string, reqBody interface{}, idempotencyKey string) (int, map[string]interface{}) {
+	reqBytes, err := json.Marshal(reqBody)
+	Expect(err).NotTo(HaveOccurred())
+	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBytes))
+	Expect(err).NotTo(HaveOccurred())
+	if idempotencyKey != "" {
+		req.Header.Set(constants.IdempotencyKeyHeader, idempotencyKey)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	Expect(err).NotTo(HaveOccurred())
+	defer res.Body.Close()
+	respBytes, err := ioutil.ReadAll(res.Body)
+	Expect(err).NotTo(HaveOccurred())
+	respBody := make(map[string]interface{})
+	Expect(json.Unmarshal(respBytes, &respBody)).To(Succeed())
+	return res.StatusCode, respBody
+}
+
+func testEntry(key string, delta int64) map[string]interface{} {
+	startTime := time.Now().UTC().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+	return map[string]interface{}{
+		"orgId":     "testOrg",
+		"key":       key,
+		"delta":     delta,
+		"startTime": startTime,
+		"endTime":   startTime + int64(time.Hour/time.Millisecond),
+	}
+}
+
+var _ = Describe("Test CounterService", func() {
+	var service *CounterService
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		service = NewCounterService(NewMemoryStore())
+		server = httptest.NewServer(service)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		service.Close()
+	})
+
+	It("test increment and get count", func() {
+		entry := testEntry("testKey", 2)
+		status, respBody := postToTestServer(server.URL, entry, "")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(2)))
+
+		status, respBody = postToTestServer(server.URL, entry, "")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(4)))
+
+		//delta 0 only gets the count.
+		entry["delta"] = 0
+		status, respBody = postToTestServer(server.URL, entry, "")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(4)))
+
+		//another period has its own count.
+		entry["delta"] = 1
+		entry["startTime"] = entry["endTime"]
+		entry["endTime"] = entry["endTime"].(int64) + int64(time.Hour/time.Millisecond)
+		status, respBody = postToTestServer(server.URL, entry, "")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(1)))
+	})
+
+	It("test batch increment", func() {
+		reqBody := map[string]interface{}{
+			"entries": []interface{}{testEntry("testKey1", 1), testEntry("testKey2", 3), testEntry("testKey1", 2)},
+		}
+		status, respBody := postToTestServer(server.URL+constants.CounterServiceBatchPathDefault, reqBody, "")
+		Expect(status).To(Equal(http.StatusOK))
+
+		respEntries := respBody["entries"].([]interface{})
+		Expect(len(respEntries)).To(Equal(3))
+		Expect(respEntries[0].(map[string]interface{})["count"]).To(Equal(float64(1)))
+		Expect(respEntries[1].(map[string]interface{})["count"]).To(Equal(float64(3)))
+		Expect(respEntries[2].(map[string]interface{})["count"]).To(Equal(float64(3)))
+	})
+
+	It("test retried increment is counted once", func() {
+		entry := testEntry("testKey", 2)
+		status, respBody := postToTestServer(server.URL, entry, "testIdempotencyKey")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(2)))
+
+		status, respBody = postToTestServer(server.URL, entry, "testIdempotencyKey")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(2)))
+
+		status, respBody = postToTestServer(server.URL, entry, "anotherIdempotencyKey")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(4)))
+	})
+
+	It("test concurrent retries of an increment are counted once", func() {
+		entry := testEntry("testKey", 1)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				status, respBody := postToTestServer(server.URL, entry, "testIdempotencyKey")
+				Expect(status).To(Equal(http.StatusOK))
+				Expect(respBody["count"]).To(Equal(float64(1)))
+			}()
+		}
+		wg.Wait()
+
+		entry["delta"] = 0
+		_, respBody := postToTestServer(server.URL, entry, "")
+		Expect(respBody["count"]).To(Equal(float64(1)))
+	})
+
+	It("test increment in flight does not hold up increments with other idempotency keys", func() {
+		store := &blockingStore{Store: NewMemoryStore(), blockedKey: "blockedKey",
+			blocked: make(chan struct{}, 1), release: make(chan struct{})}
+		blockingServer := httptest.NewServer(NewCounterService(store))
+		defer blockingServer.Close()
+
+		done := make(chan float64, 1)
+		go func() {
+			defer GinkgoRecover()
+			_, respBody := postToTestServer(blockingServer.URL, testEntry("blockedKey", 1), "blockedIdempotencyKey")
+			done <- respBody["count"].(float64)
+		}()
+		Eventually(store.blocked, 5*time.Second).Should(Receive())
+
+		status, respBody := postToTestServer(blockingServer.URL, testEntry("testKey", 2), "otherIdempotencyKey")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(2)))
+		Consistently(done).ShouldNot(Receive())
+
+		close(store.release)
+		Eventually(done, 5*time.Second).Should(Receive(Equal(float64(1))))
+	})
+
+	It("test invalid entries", func() {
+		entry := testEntry("", 2)
+		status, respBody := postToTestServer(server.URL, entry, "")
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(respBody["error"]).To(Equal(constants.ErrorIncrementingCounter))
+
+		//a batch with an invalid entry is not applied at all.
+		reqBody := map[string]interface{}{
+			"entries": []interface{}{testEntry("testKey", 1), testEntry("", 1)},
+		}
+		status, _ = postToTestServer(server.URL+constants.CounterServiceBatchPathDefault, reqBody, "")
+		Expect(status).To(Equal(http.StatusBadRequest))
+
+		entry = testEntry("testKey", 0)
+		_, respBody = postToTestServer(server.URL, entry, "")
+		Expect(respBody["count"]).To(Equal(float64(0)))
+	})
+
+	It("test health", func() {
+		res, err := http.Get(server.URL + constants.EmbeddedCounterServiceHealthPath)
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+})
+
+var _ = Describe("Test CounterStore", func() {
+	It("test invalid store type", func() {
+		_, err := NewStore("invalidStore", "")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(constants.InvalidCounterStore))
+	})
+
+	It("test file store keeps counts across restarts", func() {
+		dir, err := ioutil.TempDir("", "counterService")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, constants.EmbeddedCounterServiceFileName)
+
+		entry := Entry{OrgID: "testOrg", Key: "testKey", Delta: 3, StartTime: 0, EndTime: 1 << 62}
+		store, err := NewStore(constants.CounterStoreFile, path)
+		Expect(err).NotTo(HaveOccurred())
+		counts, err := store.Increment([]Entry{entry, entry})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counts).To(Equal([]int64{3, 6}))
+		Expect(store.Close()).To(Succeed())
+
+		store, err = NewStore(constants.CounterStoreFile, path)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		entry.Delta = 1
+		counts, err = store.Increment([]Entry{entry})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counts).To(Equal([]int64{7}))
+	})
+})
@@ -0,0 +1,194 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package counterService
+
+import (
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one {orgId, key, delta, startTime, endTime} increment. times are in milliseconds.
+type Entry struct {
+	OrgID     string `json:"orgId"`
+	Key       string `json:"key"`
+	Delta     int64  `json:"delta"`
+	StartTime int64  `json:"startTime"`
+	EndTime   int64  `json:"endTime"`
+}
+
+// validate rejects negative deltas unless allowNegativeDelta: only authenticated peers may take weight back.
+func (e Entry) validate(allowNegativeDelta bool) error {
+	if e.OrgID == "" {
+		return errors.New(`field 'orgId' cannot be empty`)
+	}
+	if e.Key == "" {
+		return errors.New(`field 'key' cannot be empty`)
+	}
+	if e.EndTime < e.StartTime {
+		return errors.New(`field 'endTime' cannot be before 'startTime'`)
+	}
+	if e.Delta < 0 && !allowNegativeDelta {
+		return errors.New(`field 'delta' cannot be negative`)
+	}
+	return nil
+}
+
+func validateEntries(entries []Entry, allowNegativeDelta bool) error {
+	for _, entry := range entries {
+		if err := entry.validate(allowNegativeDelta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// counterKey identifies the counter of an entry: one counter per org, key and period.
+func (e Entry) counterKey() string {
+	return strings.Join([]string{e.OrgID, e.Key, strconv.FormatInt(e.StartTime, 10), strconv.FormatInt(e.EndTime, 10)},
+		constants.CacheKeyDelimiter)
+}
+
+// entryFromCounterKey parses a counterKey back into its entry, without the delta.
+func entryFromCounterKey(counterKey string) (Entry, bool) {
+	parts := strings.Split(counterKey, constants.CacheKeyDelimiter)
+	if len(parts) < 4 {
+		return Entry{}, false
+	}
+	startTime, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return Entry{}, false
+	}
+	endTime, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return Entry{}, false
+	}
+	return Entry{
+		OrgID:     parts[0],
+		Key:       strings.Join(parts[1:len(parts)-2], constants.CacheKeyDelimiter),
+		StartTime: startTime,
+		EndTime:   endTime,
+	}, true
+}
+
+// Store keeps the counters of the embedded counter service.
+type Store interface {
+	// Increment adds the deltas of all the entries at once and returns the counts, in the same order as the entries.
+	// negative deltas are rejected.
+	Increment(entries []Entry) ([]int64, error)
+	// Adjust is Increment taking negative deltas too, for the weight given back by leases and rollbacks
+	// and the counters handed off between cluster members.
+	Adjust(entries []Entry) ([]int64, error)
+	// Take removes the counters matching filter and returns them, with their count as the delta.
+	Take(filter func(Entry) bool) ([]Entry, error)
+	Close() error
+}
+
+// NewStore returns the store of the given type. path is only used by the file store.
+func NewStore(storeType string, path string) (Store, error) {
+	switch strings.ToLower(storeType) {
+	case constants.CounterStoreMemory:
+		return NewMemoryStore(), nil
+	case constants.CounterStoreFile:
+		return NewFileStore(path)
+	}
+	return nil, errors.New(constants.InvalidCounterStore + " : " + storeType)
+}
+
+type memoryCounter struct {
+	entry Entry //the delta is the count.
+}
+
+// memoryStore keeps the counters in memory. counters of past periods are purged periodically.
+type memoryStore struct {
+	lock       sync.Mutex
+	counters   map[string]*memoryCounter
+	lastPurged time.Time
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		counters:   make(map[string]*memoryCounter),
+		lastPurged: time.Now(),
+	}
+}
+
+func (m *memoryStore) Increment(entries []Entry) ([]int64, error) {
+	if err := validateEntries(entries, false); err != nil {
+		return nil, err
+	}
+	return m.add(entries), nil
+}
+
+func (m *memoryStore) Adjust(entries []Entry) ([]int64, error) {
+	if err := validateEntries(entries, true); err != nil {
+		return nil, err
+	}
+	return m.add(entries), nil
+}
+
+func (m *memoryStore) add(entries []Entry) []int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.purgeExpired()
+
+	counts := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		counter, ok := m.counters[entry.counterKey()]
+		if !ok {
+			counter = &memoryCounter{entry: entry}
+			counter.entry.Delta = 0
+			m.counters[entry.counterKey()] = counter
+		}
+		counter.entry.Delta += entry.Delta
+		counts = append(counts, counter.entry.Delta)
+	}
+	return counts
+}
+
+func (m *memoryStore) Take(filter func(Entry) bool) ([]Entry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	taken := make([]Entry, 0)
+	for counterKey, counter := range m.counters {
+		if filter(counter.entry) {
+			taken = append(taken, counter.entry)
+			delete(m.counters, counterKey)
+		}
+	}
+	return taken, nil
+}
+
+// purgeExpired must be called with the lock held.
+func (m *memoryStore) purgeExpired() {
+	now := time.Now()
+	if now.Sub(m.lastPurged) < constants.EmbeddedCounterServicePurgeInterval {
+		return
+	}
+	m.lastPurged = now
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+	for counterKey, counter := range m.counters {
+		if counter.entry.EndTime < nowMillis {
+			delete(m.counters, counterKey)
+		}
+	}
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
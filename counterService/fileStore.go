@@ -0,0 +1,162 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package counterService
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var countersBucket = []byte("counters")
+
+// fileStore keeps the counters in a bolt database, so they survive restarts.
+// a counter is stored as its count followed by the end of its period, both big endian int64.
+type fileStore struct {
+	db         *bolt.DB
+	lock       sync.Mutex
+	lastPurged time.Time
+}
+
+func NewFileStore(path string) (Store, error) {
+	if path == "" {
+		return nil, errors.New(constants.InvalidCounterStore + " : path of the file store cannot be empty")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.New("unable to open counter store: " + err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(countersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.New("unable to create counters bucket: " + err.Error())
+	}
+	return &fileStore{db: db, lastPurged: time.Now()}, nil
+}
+
+func (f *fileStore) Increment(entries []Entry) ([]int64, error) {
+	if err := validateEntries(entries, false); err != nil {
+		return nil, err
+	}
+	return f.add(entries)
+}
+
+func (f *fileStore) Adjust(entries []Entry) ([]int64, error) {
+	if err := validateEntries(entries, true); err != nil {
+		return nil, err
+	}
+	return f.add(entries)
+}
+
+func (f *fileStore) add(entries []Entry) ([]int64, error) {
+	f.purgeExpired()
+
+	counts := make([]int64, 0, len(entries))
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(countersBucket)
+		for _, entry := range entries {
+			counterKey := []byte(entry.counterKey())
+			count := int64(0)
+			if value := bucket.Get(counterKey); len(value) == 16 {
+				count = int64(binary.BigEndian.Uint64(value[:8]))
+			}
+			count += entry.Delta
+
+			value := make([]byte, 16)
+			binary.BigEndian.PutUint64(value[:8], uint64(count))
+			binary.BigEndian.PutUint64(value[8:], uint64(entry.EndTime))
+			if err := bucket.Put(counterKey, value); err != nil {
+				return err
+			}
+			counts = append(counts, count)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("unable to update counter store: " + err.Error())
+	}
+	return counts, nil
+}
+
+func (f *fileStore) Take(filter func(Entry) bool) ([]Entry, error) {
+	taken := make([]Entry, 0)
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(countersBucket)
+		takenKeys := make([][]byte, 0)
+		bucket.ForEach(func(counterKey []byte, value []byte) error {
+			entry, ok := entryFromCounterKey(string(counterKey))
+			if !ok || len(value) != 16 {
+				return nil
+			}
+			entry.Delta = int64(binary.BigEndian.Uint64(value[:8]))
+			if filter(entry) {
+				taken = append(taken, entry)
+				takenKeys = append(takenKeys, append([]byte(nil), counterKey...))
+			}
+			return nil
+		})
+		for _, counterKey := range takenKeys {
+			if err := bucket.Delete(counterKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New("unable to update counter store: " + err.Error())
+	}
+	return taken, nil
+}
+
+// purgeExpired removes the counters of past periods, at most once per purge interval.
+func (f *fileStore) purgeExpired() {
+	f.lock.Lock()
+	now := time.Now()
+	if now.Sub(f.lastPurged) < constants.EmbeddedCounterServicePurgeInterval {
+		f.lock.Unlock()
+		return
+	}
+	f.lastPurged = now
+	f.lock.Unlock()
+
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+	f.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(countersBucket)
+		//deleting while iterating with a cursor skips keys, so collect them first.
+		expired := make([][]byte, 0)
+		bucket.ForEach(func(counterKey []byte, value []byte) error {
+			if len(value) == 16 && int64(binary.BigEndian.Uint64(value[8:])) < nowMillis {
+				expired = append(expired, append([]byte(nil), counterKey...))
+			}
+			return nil
+		})
+		for _, counterKey := range expired {
+			if err := bucket.Delete(counterKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (f *fileStore) Close() error {
+	return f.db.Close()
+}
@@ -0,0 +1,118 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package counterService
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PeerAuthenticator verifies the credentials of a request to the counter service.
+// body is the request body, for the signatures covering it.
+type PeerAuthenticator interface {
+	Verify(req *http.Request, body []byte) error
+}
+
+// HMACSignature signs a request to the counter service with secret:
+// HMAC-SHA256 over the method, path, date header and the sha256 of the body, base64 encoded.
+func HMACSignature(secret []byte, method string, requestURI string, date string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + date + "\n" + hex.EncodeToString(bodyHash[:])))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hmacAuthenticator accepts the requests signed with its key, dated within the clock skew of now.
+type hmacAuthenticator struct {
+	keyID  string
+	secret []byte
+}
+
+func NewHMACAuthenticator(keyID string, secret []byte) PeerAuthenticator {
+	return &hmacAuthenticator{keyID: keyID, secret: secret}
+}
+
+func (a *hmacAuthenticator) Verify(req *http.Request, body []byte) error {
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, constants.HMACAlgorithm+" ") {
+		return errors.New("request is not signed with " + constants.HMACAlgorithm)
+	}
+	var keyID, signature string
+	for _, param := range strings.Split(strings.TrimPrefix(authorization, constants.HMACAlgorithm+" "), ",") {
+		switch {
+		case strings.HasPrefix(param, "keyId="):
+			keyID = strings.TrimPrefix(param, "keyId=")
+		case strings.HasPrefix(param, "signature="):
+			signature = strings.TrimPrefix(param, "signature=")
+		}
+	}
+	if keyID != a.keyID {
+		return errors.New("request is signed with unknown key id: " + keyID)
+	}
+
+	date := req.Header.Get(constants.HMACDateHeader)
+	signedAt, err := http.ParseTime(date)
+	if err != nil {
+		return errors.New("invalid " + constants.HMACDateHeader + " header: " + date)
+	}
+	if skew := time.Since(signedAt); skew > constants.HMACMaxClockSkew || skew < -constants.HMACMaxClockSkew {
+		return errors.New("request is dated too far from now: " + date)
+	}
+
+	expected := HMACSignature(a.secret, req.Method, req.URL.RequestURI(), date, body)
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) != 1 {
+		return errors.New("invalid request signature")
+	}
+	return nil
+}
+
+// bearerAuthenticator accepts the requests carrying the bearer token returned by token.
+type bearerAuthenticator struct {
+	token func() string
+}
+
+// NewBearerAuthenticator checks the bearer token against token, called for every request so a rotated token is picked up.
+func NewBearerAuthenticator(token func() string) PeerAuthenticator {
+	return &bearerAuthenticator{token: token}
+}
+
+func (a *bearerAuthenticator) Verify(req *http.Request, body []byte) error {
+	token := a.token()
+	authorization := req.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(authorization, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) != 1 {
+		return errors.New("a valid bearer token is required")
+	}
+	return nil
+}
+
+// openAuthenticator accepts every request, for peers which do not authenticate to each other.
+type openAuthenticator struct{}
+
+func NewOpenAuthenticator() PeerAuthenticator {
+	return &openAuthenticator{}
+}
+
+func (a *openAuthenticator) Verify(req *http.Request, body []byte) error {
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package counterService_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/apid/apidQuota/constants"
+	. "github.com/apid/apidQuota/counterService"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// postSigned posts reqBody to url, signed as of signedAt with secret, and returns the status and the response body.
+func postSigned(url string, reqBody interface{}, secret string, signedAt time.Time) (int, map[string]interface{}) {
+	reqBytes, err := json.Marshal(reqBody)
+	Expect(err).NotTo(HaveOccurred())
+	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBytes))
+	Expect(err).NotTo(HaveOccurred())
+	date := signedAt.UTC().Format(http.TimeFormat)
+	req.Header.Set(constants.HMACDateHeader, date)
+	req.Header.Set("Authorization", constants.HMACAlgorithm+" keyId=testKeyID,signature="+
+		HMACSignature([]byte(secret), req.Method, req.URL.RequestURI(), date, reqBytes))
+
+	res, err := http.DefaultClient.Do(req)
+	Expect(err).NotTo(HaveOccurred())
+	defer res.Body.Close()
+	respBytes, err := ioutil.ReadAll(res.Body)
+	Expect(err).NotTo(HaveOccurred())
+	respBody := make(map[string]interface{})
+	Expect(json.Unmarshal(respBytes, &respBody)).To(Succeed())
+	return res.StatusCode, respBody
+}
+
+var _ = Describe("Test CounterService peer authentication", func() {
+	var service *CounterService
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		service = NewCounterService(NewMemoryStore())
+		server = httptest.NewServer(service)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		service.Close()
+	})
+
+	//the entries are of the same period, for their counts to add up.
+	var period map[string]interface{}
+	BeforeEach(func() {
+		period = testEntry("testKey", 0)
+	})
+
+	periodEntry := func(delta int64) map[string]interface{} {
+		entry := map[string]interface{}{}
+		for field, value := range period {
+			entry[field] = value
+		}
+		entry["delta"] = delta
+		return entry
+	}
+
+	adjustBody := func(delta int64) map[string]interface{} {
+		return map[string]interface{}{"entries": []interface{}{periodEntry(delta)}}
+	}
+
+	It("test negative delta is only taken from an authenticated peer", func() {
+		status, respBody := postToTestServer(server.URL, periodEntry(-1), "")
+		Expect(status).To(Equal(http.StatusBadRequest))
+		Expect(respBody["errorDescription"]).To(ContainSubstring("'delta' cannot be negative"))
+
+		status, _ = postToTestServer(server.URL+constants.CounterServiceBatchPathDefault, adjustBody(-1), "")
+		Expect(status).To(Equal(http.StatusBadRequest))
+
+		//without a peer authenticator, nobody is a peer.
+		status, _ = postToTestServer(server.URL+constants.CounterServiceAdjustPath, adjustBody(-1), "")
+		Expect(status).To(Equal(http.StatusForbidden))
+
+		//weight given back by leases and rollbacks comes on the increment paths, counters handed off on the adjust path.
+		service.SetPeerAuthenticator(NewOpenAuthenticator())
+		status, respBody = postToTestServer(server.URL, periodEntry(4), "")
+		Expect(status).To(Equal(http.StatusOK))
+		status, respBody = postToTestServer(server.URL, periodEntry(-1), "")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(3)))
+		status, respBody = postToTestServer(server.URL+constants.CounterServiceBatchPathDefault, adjustBody(-1), "")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["entries"]).To(Equal([]interface{}{map[string]interface{}{"count": float64(2)}}))
+		status, respBody = postToTestServer(server.URL+constants.CounterServiceAdjustPath, adjustBody(-1), "")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["entries"]).To(Equal([]interface{}{map[string]interface{}{"count": float64(1)}}))
+	})
+
+	It("test hmac authenticator takes the requests signed with its key", func() {
+		service.SetPeerAuthenticator(NewHMACAuthenticator("testKeyID", []byte("secret")))
+
+		status, respBody := postSigned(server.URL, periodEntry(3), "secret", time.Now())
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(3)))
+
+		status, respBody = postSigned(server.URL+constants.CounterServiceAdjustPath, adjustBody(-1), "secret", time.Now())
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["entries"]).To(Equal([]interface{}{map[string]interface{}{"count": float64(2)}}))
+
+		status, respBody = postToTestServer(server.URL, periodEntry(1), "")
+		Expect(status).To(Equal(http.StatusUnauthorized))
+		Expect(respBody["error"]).To(Equal(constants.Unauthorized))
+
+		status, _ = postSigned(server.URL+constants.CounterServiceBatchPathDefault, adjustBody(1), "wrongSecret", time.Now())
+		Expect(status).To(Equal(http.StatusUnauthorized))
+
+		status, _ = postSigned(server.URL+constants.CounterServiceAdjustPath, adjustBody(-1), "secret", time.Now().Add(-2*constants.HMACMaxClockSkew))
+		Expect(status).To(Equal(http.StatusUnauthorized))
+
+		//none of the rejected requests were counted.
+		status, respBody = postSigned(server.URL, periodEntry(0), "secret", time.Now())
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(respBody["count"]).To(Equal(float64(2)))
+	})
+
+	It("test bearer authenticator takes the requests with its current token", func() {
+		token := "token1"
+		service.SetPeerAuthenticator(NewBearerAuthenticator(func() string { return token }))
+
+		post := func(bearer string) int {
+			reqBytes, _ := json.Marshal(periodEntry(1))
+			req, err := http.NewRequest("POST", server.URL, bytes.NewReader(reqBytes))
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+bearer)
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			return res.StatusCode
+		}
+		Expect(post("token1")).To(Equal(http.StatusOK))
+		Expect(post("token2")).To(Equal(http.StatusUnauthorized))
+
+		token = "token2"
+		Expect(post("token2")).To(Equal(http.StatusOK))
+		Expect(post("token1")).To(Equal(http.StatusUnauthorized))
+	})
+})
+
+var _ = Describe("Test CounterStore adjustments", func() {
+	It("test negative deltas are only taken by Adjust", func() {
+		store := NewMemoryStore()
+		entry := Entry{OrgID: "testOrg", Key: "testKey", Delta: 3, StartTime: 0, EndTime: 1 << 62}
+		_, err := store.Increment([]Entry{entry})
+		Expect(err).NotTo(HaveOccurred())
+
+		entry.Delta = -1
+		_, err = store.Increment([]Entry{entry})
+		Expect(err).To(HaveOccurred())
+		counts, err := store.Adjust([]Entry{entry})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counts).To(Equal([]int64{2}))
+	})
+})
@@ -0,0 +1,116 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidQuota
+
+import (
+	"errors"
+	"github.com/apid/apid-core"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	"github.com/apid/apidQuota/globalVariables"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+var embeddedCounterService *counterService.CounterService
+
+// initEmbeddedCounterService serves the embedded counter service on the apid api, when enabled or in cluster mode.
+// it is used as the counter service when no counter service url is configured.
+func initEmbeddedCounterService(services apid.Services) error {
+	clusterMode := strings.ToLower(globalVariables.Config.GetString(constants.ConfigCounterBackend)) == constants.CounterBackendCluster
+	if !globalVariables.Config.GetBool(constants.ConfigEmbeddedCounterServiceEnabled) && !clusterMode {
+		return nil
+	}
+
+	storePath := filepath.Join(globalVariables.Config.GetString(constants.ConfigLocalStoragePath), constants.EmbeddedCounterServiceFileName)
+	store, err := counterService.NewStore(globalVariables.Config.GetString(constants.ConfigEmbeddedCounterServiceStore), storePath)
+	if err != nil {
+		return err
+	}
+	authenticator, err := getPeerAuthenticator()
+	if err != nil {
+		store.Close()
+		return err
+	}
+	embeddedCounterService = counterService.NewCounterService(store)
+	embeddedCounterService.SetPeerAuthenticator(authenticator)
+
+	basePath := globalVariables.Config.GetString(constants.ConfigEmbeddedCounterServiceBasePath)
+	services.API().HandleFunc(basePath, embeddedCounterService.HandleIncrement).Methods("POST")
+	services.API().HandleFunc(basePath+constants.CounterServiceBatchPathDefault, embeddedCounterService.HandleBatchIncrement).Methods("POST")
+	services.API().HandleFunc(basePath+constants.CounterServiceAdjustPath, embeddedCounterService.HandleAdjust).Methods("POST")
+	services.API().HandleFunc(basePath+constants.EmbeddedCounterServiceHealthPath, embeddedCounterService.HandleHealth).Methods("GET")
+
+	if len(globalVariables.CounterServiceURLs) == 0 {
+		globalVariables.CounterServiceURL = getEmbeddedCounterServiceURL(globalVariables.Config.GetString(constants.ConfigAPIListen), basePath)
+		globalVariables.CounterServiceURLs = []string{globalVariables.CounterServiceURL}
+	}
+	globalVariables.Log.Info("serving embedded counter service at: ", basePath)
+	return nil
+}
+
+// getPeerAuthenticator verifies the requests to the embedded counter service with the credentials
+// the counter service client of this node sends, as the peers share the auth config.
+func getPeerAuthenticator() (counterService.PeerAuthenticator, error) {
+	authType := strings.ToLower(globalVariables.Config.GetString(constants.ConfigCounterServiceAuthType))
+	switch authType {
+	case constants.AuthTypeApigeeSync:
+		return counterService.NewBearerAuthenticator(func() string {
+			return globalVariables.Config.GetString(constants.ApigeeSyncBearerToken)
+		}), nil
+	case constants.AuthTypeStatic:
+		token := globalVariables.Config.GetString(constants.ConfigCounterServiceAuthToken)
+		return counterService.NewBearerAuthenticator(func() string { return token }), nil
+	case constants.AuthTypeHMAC:
+		return counterService.NewHMACAuthenticator(globalVariables.Config.GetString(constants.ConfigCounterServiceHMACKeyID),
+			[]byte(globalVariables.Config.GetString(constants.ConfigCounterServiceHMACSecret))), nil
+	case constants.AuthTypeNone:
+		globalVariables.Log.Warn("embedded counter service does not authenticate its callers, as the auth type is: ", constants.AuthTypeNone)
+		return counterService.NewOpenAuthenticator(), nil
+	}
+	//oauth2 tokens are issued for the counter service, the embedded one has no way to check them.
+	return nil, errors.New(constants.InvalidAuthType + " : " + authType + " cannot be verified by the embedded counter service")
+}
+
+// getEmbeddedCounterServiceURL returns the url the embedded counter service is called at, on the api listen address.
+// a listen address without a host, or with the unspecified one, is called on the loopback address.
+func getEmbeddedCounterServiceURL(apiListen string, basePath string) string {
+	host, port, err := net.SplitHostPort(apiListen)
+	if err != nil {
+		return "http://" + apiListen + basePath
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + basePath
+}
+
+// getEmbeddedCounterStore returns the store of the embedded counter service, nil when it is not running.
+func getEmbeddedCounterStore() counterService.Store {
+	if embeddedCounterService == nil {
+		return nil
+	}
+	return embeddedCounterService.Store()
+}
+
+func closeEmbeddedCounterService() {
+	if embeddedCounterService == nil {
+		return
+	}
+	if err := embeddedCounterService.Close(); err != nil {
+		globalVariables.Log.Error("error closing embedded counter service: ", err.Error())
+	}
+}
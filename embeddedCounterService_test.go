@@ -0,0 +1,35 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apidQuota_test
+
+import (
+	. "github.com/apid/apidQuota"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Test embedded counter service", func() {
+	It("test url is on the loopback address when the api listens without a host", func() {
+		Expect(GetEmbeddedCounterServiceURL(":9000", "/counterService")).To(Equal("http://127.0.0.1:9000/counterService"))
+		Expect(GetEmbeddedCounterServiceURL("0.0.0.0:9000", "/counterService")).To(Equal("http://127.0.0.1:9000/counterService"))
+		Expect(GetEmbeddedCounterServiceURL("[::]:9000", "/counterService")).To(Equal("http://127.0.0.1:9000/counterService"))
+	})
+
+	It("test url keeps the host the api listens on", func() {
+		Expect(GetEmbeddedCounterServiceURL("localhost:9000", "/counterService")).To(Equal("http://localhost:9000/counterService"))
+		Expect(GetEmbeddedCounterServiceURL("10.0.0.1:9000", "/counterService")).To(Equal("http://10.0.0.1:9000/counterService"))
+		Expect(GetEmbeddedCounterServiceURL("[::1]:9000", "/counterService")).To(Equal("http://[::1]:9000/counterService"))
+	})
+})
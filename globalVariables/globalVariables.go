@@ -19,7 +19,8 @@ import (
 )
 
 var (
-	Log               apid.LogService
-	Config            apid.ConfigService
-	CounterServiceURL string
+	Log                apid.LogService
+	Config             apid.ConfigService
+	CounterServiceURL  string   //first of CounterServiceURLs
+	CounterServiceURLs []string //all the counter service endpoints
 )
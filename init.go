@@ -16,9 +16,16 @@ package apidQuota
 
 import (
 	"github.com/apid/apid-core"
+	"github.com/apid/apidQuota/audit"
 	"github.com/apid/apidQuota/constants"
 	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/metrics"
+	"github.com/apid/apidQuota/notifier"
+	"github.com/apid/apidQuota/quotaBucket"
+	quotaServices "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/tracing"
 	"reflect"
+	"strings"
 )
 
 func init() {
@@ -30,8 +37,56 @@ func initPlugin(services apid.Services) (apid.PluginData, error) {
 	globalVariables.Log.Debug("start init for apidQuota")
 
 	setConfig(services)
+	if err := initEmbeddedCounterService(services); err != nil {
+		return pluginData, err
+	}
+	if err := quotaServices.InitCounterServiceClient(); err != nil {
+		return pluginData, err
+	}
+	if err := quotaServices.InitCounterServiceAuth(); err != nil {
+		return pluginData, err
+	}
+	if err := quotaServices.InitCounterServiceEndpoints(globalVariables.CounterServiceURLs); err != nil {
+		return pluginData, err
+	}
+	if err := quotaServices.InitCounterBackend(getEmbeddedCounterStore()); err != nil {
+		return pluginData, err
+	}
+	metrics.Init()
+	if err := tracing.Init(); err != nil {
+		return pluginData, err
+	}
+	if err := notifier.Init(); err != nil {
+		return pluginData, err
+	}
+	if err := audit.Init(); err != nil {
+		return pluginData, err
+	}
+	if err := quotaBucket.InitWAL(); err != nil {
+		return pluginData, err
+	}
 	InitAPI(services)
 
+	services.Events().ListenOnceFunc(apid.ShutdownEventSelector, func(event apid.Event) {
+		globalVariables.Log.Debug("flushing pending async quota increments before shutdown")
+		flushTimeout := globalVariables.Config.GetDuration(constants.ConfigShutdownFlushTimeout)
+		if err := quotaBucket.Shutdown(flushTimeout); err != nil {
+			globalVariables.Log.Error("error during apidQuota shutdown: ", err.Error())
+		}
+		if err := notifier.Shutdown(flushTimeout); err != nil {
+			globalVariables.Log.Error("error delivering quota notifications before shutdown: ", err.Error())
+		}
+		if err := audit.Shutdown(flushTimeout); err != nil {
+			globalVariables.Log.Error("error writing quota audit log before shutdown: ", err.Error())
+		}
+		quotaServices.StopCounterServiceHealthChecks()
+		quotaServices.ShutdownCounterBackend(flushTimeout)
+		closeEmbeddedCounterService()
+		if err := tracing.Shutdown(flushTimeout); err != nil {
+			globalVariables.Log.Error("error exporting quota spans before shutdown: ", err.Error())
+		}
+	})
+
 	return pluginData, nil
 }
 
@@ -40,13 +95,86 @@ func setConfig(services apid.Services) {
 	globalVariables.Config = services.Config()
 	// set plugin config defaults
 	globalVariables.Config.SetDefault(constants.ConfigQuotaBasePath, constants.QuotaBasePathDefault)
+	globalVariables.Config.SetDefault(constants.ConfigSyncConcurrency, constants.DefaultSyncConcurrency)
+	globalVariables.Config.SetDefault(constants.ConfigSyncJitterPercent, constants.DefaultSyncJitterPercent)
+	globalVariables.Config.SetDefault(constants.ConfigShutdownFlushTimeout, constants.DefaultShutdownFlushTimeout)
+	globalVariables.Config.SetDefault(constants.ConfigWALEnabled, false)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceMaxRetries, constants.DefaultCounterServiceMaxRetries)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceRetryBaseDelay, constants.DefaultCounterServiceRetryBaseDelay)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceRetryMaxDelay, constants.DefaultCounterServiceRetryMaxDelay)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceAttemptTimeout, constants.DefaultCounterServiceAttemptTimeout)
+	globalVariables.Config.SetDefault(constants.ConfigIdempotencyCacheSize, constants.DefaultIdempotencyCacheSize)
+	globalVariables.Config.SetDefault(constants.ConfigCircuitBreakerFailureThreshold, constants.DefaultCircuitBreakerFailureThreshold)
+	globalVariables.Config.SetDefault(constants.ConfigCircuitBreakerOpenTimeout, constants.DefaultCircuitBreakerOpenTimeout)
+	globalVariables.Config.SetDefault(constants.ConfigDefaultDegradationMode, "")
+	globalVariables.Config.SetDefault(constants.ConfigRequestTimeout, constants.DefaultRequestTimeout)
+	globalVariables.Config.SetDefault(constants.ConfigHierarchicalRollbackTimeout, constants.DefaultHierarchicalRollbackTimeout)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceMaxIdleConns, constants.DefaultCounterServiceMaxIdleConns)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceMaxIdleConnsPerHost, constants.DefaultCounterServiceMaxIdleConnsPerHost)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceIdleConnTimeout, constants.DefaultCounterServiceIdleConnTimeout)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceKeepAlive, constants.DefaultCounterServiceKeepAlive)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceHTTP2, true)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceAuthType, constants.AuthTypeApigeeSync)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceHealthCheckInterval, constants.DefaultCounterServiceHealthCheckInterval)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceHealthCheckTimeout, constants.DefaultCounterServiceHealthCheckTimeout)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceHealthCheckPath, constants.DefaultCounterServiceHealthCheckPath)
+	globalVariables.Config.SetDefault(constants.ConfigCounterServiceUnhealthyThreshold, constants.DefaultCounterServiceUnhealthyThreshold)
+	globalVariables.Config.SetDefault(constants.ConfigEmbeddedCounterServiceEnabled, false)
+	globalVariables.Config.SetDefault(constants.ConfigEmbeddedCounterServiceStore, constants.CounterStoreMemory)
+	globalVariables.Config.SetDefault(constants.ConfigEmbeddedCounterServiceBasePath, constants.EmbeddedCounterServiceBasePathDefault)
+	globalVariables.Config.SetDefault(constants.ConfigAPIListen, constants.DefaultAPIListen)
+	globalVariables.Config.SetDefault(constants.ConfigCounterBackend, constants.CounterBackendHTTP)
+	globalVariables.Config.SetDefault(constants.ConfigRedisKeyPrefix, constants.DefaultRedisKeyPrefix)
+	globalVariables.Config.SetDefault(constants.ConfigRedisMaxIdle, constants.DefaultRedisMaxIdle)
+	globalVariables.Config.SetDefault(constants.ConfigClusterRefreshInterval, constants.DefaultClusterRefreshInterval)
+	globalVariables.Config.SetDefault(constants.ConfigClusterVirtualNodes, constants.DefaultClusterVirtualNodes)
+	globalVariables.Config.SetDefault(constants.ConfigClusterDNSScheme, constants.DefaultClusterDNSScheme)
+	globalVariables.Config.SetDefault(constants.ConfigClusterDNSPort, constants.DefaultClusterDNSPort)
+	globalVariables.Config.SetDefault(constants.ConfigLeaseChunkPercent, constants.DefaultLeaseChunkPercent)
+	globalVariables.Config.SetDefault(constants.ConfigAdaptiveSyncHeadroomPercent, constants.DefaultAdaptiveSyncHeadroomPercent)
+	globalVariables.Config.SetDefault(constants.ConfigNotifierQueueSize, constants.DefaultNotifierQueueSize)
+	globalVariables.Config.SetDefault(constants.ConfigNotifierMaxRetries, constants.DefaultNotifierMaxRetries)
+	globalVariables.Config.SetDefault(constants.ConfigNotifierRetryBaseDelay, constants.DefaultNotifierRetryBaseDelay)
+	globalVariables.Config.SetDefault(constants.ConfigNotifierRetryMaxDelay, constants.DefaultNotifierRetryMaxDelay)
+	globalVariables.Config.SetDefault(constants.ConfigNotifierDeliveryTimeout, constants.DefaultNotifierDeliveryTimeout)
+	globalVariables.Config.SetDefault(constants.ConfigMetricsPath, constants.MetricsPathDefault)
+	globalVariables.Config.SetDefault(constants.ConfigMetricsMaxOrgs, constants.DefaultMetricsMaxOrgs)
+	globalVariables.Config.SetDefault(constants.ConfigTracingExporter, constants.TracingExporterNone)
+	globalVariables.Config.SetDefault(constants.ConfigTracingOTLPEndpoint, constants.DefaultTracingOTLPEndpoint)
+	globalVariables.Config.SetDefault(constants.ConfigTracingOTLPInsecure, false)
+	globalVariables.Config.SetDefault(constants.ConfigTracingSampleRatio, constants.DefaultTracingSampleRatio)
+	globalVariables.Config.SetDefault(constants.ConfigAuditFileMaxSize, constants.DefaultAuditFileMaxSize)
+	globalVariables.Config.SetDefault(constants.ConfigAuditFileMaxBackups, constants.DefaultAuditFileMaxBackups)
+	globalVariables.Config.SetDefault(constants.ConfigAuditQueueSize, constants.DefaultAuditQueueSize)
+	globalVariables.Config.SetDefault(constants.ConfigAuditAllowSampleRatio, constants.DefaultAuditAllowSampleRatio)
+	globalVariables.Config.SetDefault(constants.ConfigAuditDenySampleRatio, constants.DefaultAuditDenySampleRatio)
+	globalVariables.Config.SetDefault(constants.ConfigReadyMaxAsyncBacklog, constants.DefaultReadyMaxAsyncBacklog)
 
 	counterServiceBasePath := globalVariables.Config.Get(constants.ConfigCounterServiceBasePath)
 	if counterServiceBasePath != nil {
-		if reflect.TypeOf(counterServiceBasePath).Kind() != reflect.String {
-			globalVariables.Log.Fatal("value of: " + constants.ConfigCounterServiceBasePath + " in the config should be string")
+		globalVariables.CounterServiceURLs = make([]string, 0)
+		switch reflect.TypeOf(counterServiceBasePath).Kind() {
+		case reflect.String:
+			for _, counterServiceURL := range strings.Split(counterServiceBasePath.(string), ",") {
+				if counterServiceURL = strings.TrimSpace(counterServiceURL); counterServiceURL != "" {
+					globalVariables.CounterServiceURLs = append(globalVariables.CounterServiceURLs, counterServiceURL)
+				}
+			}
+		case reflect.Slice:
+			urls := reflect.ValueOf(counterServiceBasePath)
+			for i := 0; i < urls.Len(); i++ {
+				counterServiceURL, ok := urls.Index(i).Interface().(string)
+				if !ok {
+					globalVariables.Log.Fatal("value of: " + constants.ConfigCounterServiceBasePath + " in the config should be a list of strings")
+				}
+				globalVariables.CounterServiceURLs = append(globalVariables.CounterServiceURLs, strings.TrimSpace(counterServiceURL))
+			}
+		default:
+			globalVariables.Log.Fatal("value of: " + constants.ConfigCounterServiceBasePath + " in the config should be string or a list of strings")
+		}
+		if len(globalVariables.CounterServiceURLs) > 0 {
+			globalVariables.CounterServiceURL = globalVariables.CounterServiceURLs[0]
 		}
-		globalVariables.CounterServiceURL = counterServiceBasePath.(string)
 	}
 
 }
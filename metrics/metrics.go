@@ -0,0 +1,194 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const namespace = "apidquota"
+
+// registry holds the apidQuota metrics only, so they do not clash with the metrics of other apid plugins.
+var registry = prometheus.NewRegistry()
+
+var (
+	decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decisions_total",
+		Help:      "Quota decisions by org and decision, allowed or denied.",
+	}, []string{"org", "decision"})
+
+	counterServiceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "counter_service_request_duration_seconds",
+		Help:      "Latency of the calls to the counter backend, retries included, by backend and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+
+	counterServiceErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "counter_service_errors_total",
+		Help:      "Failed calls to the counter backend, by backend, operation and error kind.",
+	}, []string{"backend", "operation", "status"})
+
+	asyncSyncLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "async_sync_lag_seconds",
+		Help:      "Age of the global count of aSyncQuotaBuckets when they are synced with the counter service.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800},
+	})
+
+	asyncPendingWeight = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "async_sync_pending_weight",
+		Help:      "Weight counted locally by aSyncQuotaBuckets and sent to the counter service by a sync.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	})
+
+	asyncStaleRefreshFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "async_stale_refresh_failures_total",
+		Help:      "Refreshes of a global count older than maxStaleness which failed, so the request was decided on the cached count.",
+	})
+
+	asyncScheduledBuckets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "async_scheduled_buckets",
+		Help:      "aSyncQuotaBuckets scheduled for periodic sync with the counter service.",
+	})
+
+	cacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cache_size",
+		Help:      "quotaBuckets in the cache.",
+	})
+
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Lookups of quotaBuckets in the cache, by result, hit or miss.",
+	}, []string{"result"})
+
+	cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_evictions_total",
+		Help:      "quotaBuckets removed from the cache.",
+	})
+)
+
+func init() {
+	registry.MustRegister(decisions, counterServiceDuration, counterServiceErrors, asyncSyncLag, asyncPendingWeight,
+		asyncStaleRefreshFailures, asyncScheduledBuckets, cacheSize, cacheLookups, cacheEvictions,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// orgLimiter bounds the number of orgs with their own decision series, the orgs seen after maxOrgs are counted together.
+type orgLimiter struct {
+	lock    sync.Mutex
+	maxOrgs int
+	orgs    map[string]bool
+}
+
+var decisionOrgs = &orgLimiter{maxOrgs: constants.DefaultMetricsMaxOrgs, orgs: make(map[string]bool)}
+
+func (l *orgLimiter) label(orgID string) string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.orgs[orgID] {
+		return orgID
+	}
+	if len(l.orgs) >= l.maxOrgs {
+		return constants.MetricsOtherOrgs
+	}
+	l.orgs[orgID] = true
+	return orgID
+}
+
+// Init reads the metrics config.
+func Init() {
+	if maxOrgs := globalVariables.Config.GetInt(constants.ConfigMetricsMaxOrgs); maxOrgs > 0 {
+		SetMaxOrgs(maxOrgs)
+	}
+}
+
+// SetMaxOrgs sets the number of orgs with their own decision series.
+func SetMaxOrgs(maxOrgs int) {
+	decisionOrgs.lock.Lock()
+	decisionOrgs.maxOrgs = maxOrgs
+	decisionOrgs.lock.Unlock()
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RecordDecision counts a quota decision of an org.
+func RecordDecision(orgID string, exceeded bool) {
+	decision := constants.MetricsDecisionAllowed
+	if exceeded {
+		decision = constants.MetricsDecisionDenied
+	}
+	decisions.WithLabelValues(decisionOrgs.label(orgID), decision).Inc()
+}
+
+// ObserveCounterServiceRequest records the latency of a call to the counter backend.
+func ObserveCounterServiceRequest(backend string, operation string, latency time.Duration) {
+	counterServiceDuration.WithLabelValues(backend, operation).Observe(latency.Seconds())
+}
+
+// RecordCounterServiceError counts a failed call to the counter backend.
+// status is the kind of error: unavailable, cancelled or failed.
+func RecordCounterServiceError(backend string, operation string, status string) {
+	counterServiceErrors.WithLabelValues(backend, operation, status).Inc()
+}
+
+// ObserveAsyncSync records the age of the global count of an aSyncQuotaBucket and the weight sent when it is synced.
+func ObserveAsyncSync(lag time.Duration, pendingWeight int64) {
+	asyncSyncLag.Observe(lag.Seconds())
+	asyncPendingWeight.Observe(float64(pendingWeight))
+}
+
+// RecordStaleRefreshFailure counts a request decided on a stale global count, as its refresh failed.
+func RecordStaleRefreshFailure() {
+	asyncStaleRefreshFailures.Inc()
+}
+
+func SetAsyncScheduledBuckets(count int) {
+	asyncScheduledBuckets.Set(float64(count))
+}
+
+func SetCacheSize(size int) {
+	cacheSize.Set(float64(size))
+}
+
+func RecordCacheLookup(hit bool) {
+	result := constants.MetricsCacheMiss
+	if hit {
+		result = constants.MetricsCacheHit
+	}
+	cacheLookups.WithLabelValues(result).Inc()
+}
+
+func RecordCacheEviction() {
+	cacheEvictions.Inc()
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"github.com/apid/apidQuota/constants"
+	. "github.com/apid/apidQuota/metrics"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Test metrics", func() {
+
+	scrape := func() string {
+		server := httptest.NewServer(Handler())
+		defer server.Close()
+		res, err := server.Client().Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return string(body)
+	}
+
+	It("test metrics are exposed", func() {
+		RecordDecision("sampleOrg", false)
+		RecordDecision("sampleOrg", true)
+		ObserveCounterServiceRequest("http", "increment", 10*time.Millisecond)
+		RecordCounterServiceError("http", "increment", "unavailable")
+		ObserveAsyncSync(2*time.Second, 5)
+		RecordStaleRefreshFailure()
+		SetAsyncScheduledBuckets(3)
+		SetCacheSize(4)
+		RecordCacheLookup(true)
+		RecordCacheLookup(false)
+		RecordCacheEviction()
+
+		body := scrape()
+		Expect(body).To(ContainSubstring(`apidquota_decisions_total{decision="allowed",org="sampleOrg"} 1`))
+		Expect(body).To(ContainSubstring(`apidquota_decisions_total{decision="denied",org="sampleOrg"} 1`))
+		Expect(body).To(ContainSubstring(`apidquota_counter_service_request_duration_seconds_count{backend="http",operation="increment"} 1`))
+		Expect(body).To(ContainSubstring(`apidquota_counter_service_errors_total{backend="http",operation="increment",status="unavailable"} 1`))
+		Expect(body).To(ContainSubstring(`apidquota_async_sync_lag_seconds_count 1`))
+		Expect(body).To(ContainSubstring(`apidquota_async_sync_pending_weight_sum 5`))
+		Expect(body).To(ContainSubstring(`apidquota_async_stale_refresh_failures_total 1`))
+		Expect(body).To(ContainSubstring(`apidquota_async_scheduled_buckets 3`))
+		Expect(body).To(ContainSubstring(`apidquota_cache_size 4`))
+		Expect(body).To(ContainSubstring(`apidquota_cache_lookups_total{result="hit"} 1`))
+		Expect(body).To(ContainSubstring(`apidquota_cache_lookups_total{result="miss"} 1`))
+		Expect(body).To(ContainSubstring(`apidquota_cache_evictions_total 1`))
+		Expect(body).To(ContainSubstring(`go_goroutines`))
+	})
+
+	It("test orgs over the limit share one series", func() {
+		SetMaxOrgs(2)
+		defer SetMaxOrgs(constants.DefaultMetricsMaxOrgs)
+		for _, org := range []string{"org1", "org2", "org3", "org4"} {
+			RecordDecision(org, false)
+		}
+
+		body := scrape()
+		Expect(body).To(ContainSubstring(`apidquota_decisions_total{decision="allowed",org="other"} 3`))
+		Expect(body).NotTo(ContainSubstring(`org="org3"`))
+		Expect(body).NotTo(ContainSubstring(`org="org4"`))
+	})
+})
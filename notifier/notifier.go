@@ -0,0 +1,110 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifier
+
+import (
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Notification tells the systems outside apid that a quotaBucket reached a threshold or rejected a request.
+type Notification struct {
+	Event            string `json:"event"` //threshold or exceeded
+	EdgeOrgID        string `json:"edgeOrgID"`
+	ID               string `json:"id"`
+	Threshold        int64  `json:"threshold,omitempty"` //percentage of maxCount, for threshold notifications
+	Count            int64  `json:"count"`
+	MaxCount         int64  `json:"maxCount"`
+	StartTimestamp   int64  `json:"startTimestamp"`
+	ExpiresTimestamp int64  `json:"expiresTimestamp"`
+	Timestamp        int64  `json:"timestamp"`
+}
+
+// dedupKey identifies the notification within its period, it is sent once until the period expires.
+func (n *Notification) dedupKey() string {
+	threshold := ""
+	if n.Event == constants.NotificationEventThreshold {
+		threshold = constants.CacheKeyDelimiter + strconv.FormatInt(n.Threshold, 10)
+	}
+	return n.Event + constants.CacheKeyDelimiter + n.EdgeOrgID + constants.CacheKeyDelimiter + n.ID + threshold
+}
+
+var notifierLock sync.RWMutex
+var quotaNotifier *WebhookNotifier
+
+func getNotifier() *WebhookNotifier {
+	notifierLock.RLock()
+	defer notifierLock.RUnlock()
+	return quotaNotifier
+}
+
+// Init starts the webhook notifier as per the config. notifications are disabled when no webhook url is set.
+func Init() error {
+	config := globalVariables.Config
+	webhookURL := config.GetString(constants.ConfigNotifierWebhookURL)
+	if webhookURL == "" {
+		SetNotifier(nil)
+		return nil
+	}
+	if parsedURL, err := url.Parse(webhookURL); err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return errors.New(constants.InvalidNotifierConfig + " : invalid " + constants.ConfigNotifierWebhookURL + ": " + webhookURL)
+	}
+	secret := config.GetString(constants.ConfigNotifierWebhookSecret)
+	if secret == "" {
+		return errors.New(constants.InvalidNotifierConfig + " : " + constants.ConfigNotifierWebhookSecret + " should be set to sign the notifications")
+	}
+
+	webhook := NewWebhookNotifier(webhookURL, secret, config.GetInt(constants.ConfigNotifierQueueSize),
+		config.GetInt(constants.ConfigNotifierMaxRetries), config.GetDuration(constants.ConfigNotifierRetryBaseDelay),
+		config.GetDuration(constants.ConfigNotifierRetryMaxDelay), config.GetDuration(constants.ConfigNotifierDeliveryTimeout))
+	webhook.logError = globalVariables.Log.Error
+	SetNotifier(webhook)
+	return nil
+}
+
+// SetNotifier replaces the notifier, nil disables the notifications. the replaced notifier is stopped.
+func SetNotifier(webhook *WebhookNotifier) {
+	notifierLock.Lock()
+	previous := quotaNotifier
+	quotaNotifier = webhook
+	notifierLock.Unlock()
+	if previous != nil && previous != webhook {
+		previous.stop(0)
+	}
+}
+
+// Notify queues the notification for delivery, unless it was already sent in its period.
+// it never blocks the request path, notifications are dropped when the queue is full.
+func Notify(n Notification) {
+	webhook := getNotifier()
+	if webhook == nil {
+		return
+	}
+	webhook.notify(n)
+}
+
+// Shutdown delivers the queued notifications, waiting at most timeout, and stops the notifier.
+func Shutdown(timeout time.Duration) error {
+	webhook := getNotifier()
+	if webhook == nil {
+		return nil
+	}
+	return webhook.stop(timeout)
+}
@@ -0,0 +1,284 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifier
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// delivery is a notification on its way to the webhook.
+type delivery struct {
+	notification Notification
+	attempt      int
+}
+
+// WebhookNotifier posts notifications as signed JSON to a webhook. failed deliveries go back to the queue
+// after a backoff, until maxRetries.
+type WebhookNotifier struct {
+	webhookURL string
+	secret     []byte
+	client     *http.Client
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+
+	queue   chan *delivery
+	pending sync.WaitGroup //deliveries queued or waiting to be retried.
+	done    chan struct{}
+
+	lock    sync.Mutex
+	sent    map[string]int64 //dedup key of the notifications sent, to the end of their period.
+	stopped bool             //no notification is queued once set, so pending can be waited on.
+
+	delivered int64
+	dropped   int64
+	logError  func(args ...interface{}) //nil when nothing should be logged.
+}
+
+// NewWebhookNotifier starts a notifier posting to webhookURL, with the payloads signed with secret.
+// values of 0 or less are replaced by the defaults.
+func NewWebhookNotifier(webhookURL string, secret string, queueSize int, maxRetries int,
+	baseDelay time.Duration, maxDelay time.Duration, deliveryTimeout time.Duration) *WebhookNotifier {
+	if queueSize <= 0 {
+		queueSize = constants.DefaultNotifierQueueSize
+	}
+	if maxRetries < 0 {
+		maxRetries = constants.DefaultNotifierMaxRetries
+	}
+	if baseDelay <= 0 {
+		baseDelay = constants.DefaultNotifierRetryBaseDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = constants.DefaultNotifierRetryMaxDelay
+	}
+	if deliveryTimeout <= 0 {
+		deliveryTimeout = constants.DefaultNotifierDeliveryTimeout
+	}
+
+	webhook := &WebhookNotifier{
+		webhookURL: webhookURL,
+		secret:     []byte(secret),
+		client:     &http.Client{Timeout: deliveryTimeout},
+		maxRetries: maxRetries,
+		baseDelay:  baseDelay,
+		maxDelay:   maxDelay,
+		queue:      make(chan *delivery, queueSize),
+		done:       make(chan struct{}),
+		sent:       make(map[string]int64),
+	}
+	go webhook.run()
+	return webhook
+}
+
+func (w *WebhookNotifier) notify(n Notification) {
+	if n.Timestamp == 0 {
+		n.Timestamp = time.Now().UTC().Unix()
+	}
+
+	key := n.dedupKey()
+	w.lock.Lock()
+	if w.stopped {
+		w.lock.Unlock()
+		return
+	}
+	if expiresAt, ok := w.sent[key]; ok && n.Timestamp < expiresAt {
+		w.lock.Unlock()
+		return
+	}
+	w.sent[key] = n.ExpiresTimestamp
+	w.pending.Add(1)
+	w.lock.Unlock()
+
+	select {
+	case w.queue <- &delivery{notification: n}:
+	default:
+		w.drop(&n)
+		w.log("notification queue is full, dropping notification for quotaBucket: ", n.EdgeOrgID+constants.CacheKeyDelimiter+n.ID)
+	}
+}
+
+// drop gives up on a notification. it is forgotten, so the next one for its quotaBucket and period is sent again.
+func (w *WebhookNotifier) drop(n *Notification) {
+	key := n.dedupKey()
+	w.lock.Lock()
+	if expiresAt, ok := w.sent[key]; ok && expiresAt == n.ExpiresTimestamp {
+		delete(w.sent, key)
+	}
+	w.lock.Unlock()
+	atomic.AddInt64(&w.dropped, 1)
+	w.pending.Done()
+}
+
+func (w *WebhookNotifier) isStopped() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.stopped
+}
+
+func (w *WebhookNotifier) run() {
+	purge := time.NewTicker(constants.NotifierPurgeInterval)
+	defer purge.Stop()
+	for {
+		select {
+		case d := <-w.queue:
+			w.deliver(d)
+		case <-purge.C:
+			w.purge()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *WebhookNotifier) deliver(d *delivery) {
+	err := w.post(&d.notification)
+	if err == nil {
+		atomic.AddInt64(&w.delivered, 1)
+		w.pending.Done()
+		return
+	}
+	//once stopping, failed notifications are not retried, so the shutdown is not held back by the webhook.
+	if d.attempt >= w.maxRetries || w.isStopped() {
+		w.drop(&d.notification)
+		w.log("giving up on notification for quotaBucket: ", d.notification.EdgeOrgID+constants.CacheKeyDelimiter+d.notification.ID,
+			" after ", d.attempt+1, " attempts: ", err.Error())
+		return
+	}
+
+	//the retry waits off the queue, so the other notifications are not held back.
+	d.attempt++
+	time.AfterFunc(w.backoff(d.attempt-1), func() {
+		select {
+		case w.queue <- d:
+		default:
+			w.drop(&d.notification)
+		}
+	})
+}
+
+func (w *WebhookNotifier) post(n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return errors.New("unable to marshal notification: " + err.Error())
+	}
+	req, err := http.NewRequest(http.MethodPost, w.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(constants.NotifierDateHeader, date)
+	req.Header.Set(constants.NotifierSignatureHeader, Sign(w.secret, date, body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New("webhook responded with status: " + strconv.Itoa(res.StatusCode))
+	}
+	return nil
+}
+
+// backoff returns the delay before retry number attempt+1: exponential in the attempt, capped at maxDelay, with full jitter.
+func (w *WebhookNotifier) backoff(attempt int) time.Duration {
+	delay := w.baseDelay
+	for i := 0; i < attempt && delay < w.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > w.maxDelay {
+		delay = w.maxDelay
+	}
+	return time.Duration(mathrand.Int63n(int64(delay)) + 1)
+}
+
+// purge forgets the notifications of past periods.
+func (w *WebhookNotifier) purge() {
+	now := time.Now().UTC().Unix()
+	w.lock.Lock()
+	for key, expiresAt := range w.sent {
+		if expiresAt <= now {
+			delete(w.sent, key)
+		}
+	}
+	w.lock.Unlock()
+}
+
+// stop waits at most timeout for the queued notifications to be delivered, and stops the notifier.
+func (w *WebhookNotifier) stop(timeout time.Duration) error {
+	w.lock.Lock()
+	if w.stopped {
+		w.lock.Unlock()
+		return nil
+	}
+	w.stopped = true
+	w.lock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		w.pending.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		err = errors.New("notifications still queued after: " + timeout.String())
+	}
+	close(w.done)
+	return err
+}
+
+// Delivered returns the number of notifications the webhook accepted.
+func (w *WebhookNotifier) Delivered() int64 {
+	return atomic.LoadInt64(&w.delivered)
+}
+
+// Dropped returns the number of notifications given up on, when the queue was full or after maxRetries.
+func (w *WebhookNotifier) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+func (w *WebhookNotifier) log(args ...interface{}) {
+	if w.logError != nil {
+		w.logError(args...)
+	}
+}
+
+// Sign returns the signature of a notification, the HMAC-SHA256 of the date header and the body, hex encoded.
+// receivers check it against the X-Apid-Signature header.
+func Sign(secret []byte, date string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(date + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notifier_test
+
+import (
+	"encoding/json"
+	"github.com/apid/apidQuota/constants"
+	. "github.com/apid/apidQuota/notifier"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// webhookReceiver records the notifications it accepts, after failing the first failures requests.
+type webhookReceiver struct {
+	lock          sync.Mutex
+	failures      int
+	requests      int
+	notifications []Notification
+	signatures    []bool
+}
+
+func (r *webhookReceiver) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests++
+	if r.requests <= r.failures {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	Expect(err).NotTo(HaveOccurred())
+	notification := Notification{}
+	Expect(json.Unmarshal(body, &notification)).To(Succeed())
+	signature := Sign([]byte("secret"), req.Header.Get(constants.NotifierDateHeader), body)
+	r.signatures = append(r.signatures, signature == req.Header.Get(constants.NotifierSignatureHeader))
+	r.notifications = append(r.notifications, notification)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (r *webhookReceiver) failFirst(failures int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures = failures
+}
+
+func (r *webhookReceiver) received() []Notification {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Notification{}, r.notifications...)
+}
+
+func (r *webhookReceiver) validSignatures() []bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]bool{}, r.signatures...)
+}
+
+func (r *webhookReceiver) requestCount() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests
+}
+
+var _ = Describe("Test WebhookNotifier", func() {
+	var receiver *webhookReceiver
+	var server *httptest.Server
+	var webhook *WebhookNotifier
+	periodEnd := time.Now().UTC().Add(time.Hour).Unix()
+
+	exceeded := func(id string) Notification {
+		return Notification{
+			Event:            constants.NotificationEventExceeded,
+			EdgeOrgID:        "sampleOrg",
+			ID:               id,
+			Count:            10,
+			MaxCount:         10,
+			StartTimestamp:   periodEnd - 3600,
+			ExpiresTimestamp: periodEnd,
+		}
+	}
+
+	BeforeEach(func() {
+		receiver = &webhookReceiver{}
+		server = httptest.NewServer(receiver)
+		webhook = NewWebhookNotifier(server.URL, "secret", 10, 3, time.Millisecond, 10*time.Millisecond, time.Second)
+		SetNotifier(webhook)
+	})
+
+	AfterEach(func() {
+		SetNotifier(nil)
+		server.Close()
+	})
+
+	It("test notifications are signed and sent once per period", func() {
+		Notify(exceeded("sampleID"))
+		Notify(exceeded("sampleID"))
+		threshold := exceeded("sampleID")
+		threshold.Event = constants.NotificationEventThreshold
+		threshold.Threshold = 80
+		Notify(threshold)
+		Notify(threshold)
+
+		//the next period is notified again.
+		nextPeriod := exceeded("sampleID")
+		nextPeriod.Timestamp = periodEnd
+		nextPeriod.StartTimestamp = periodEnd
+		nextPeriod.ExpiresTimestamp = periodEnd + 3600
+		Notify(nextPeriod)
+
+		Expect(Shutdown(time.Second)).To(Succeed())
+		notifications := receiver.received()
+		Expect(notifications).To(HaveLen(3))
+		Expect(receiver.validSignatures()).To(Equal([]bool{true, true, true}))
+
+		Expect(notifications[0].Event).To(Equal(constants.NotificationEventExceeded))
+		Expect(notifications[0].EdgeOrgID).To(Equal("sampleOrg"))
+		Expect(notifications[0].ID).To(Equal("sampleID"))
+		Expect(notifications[0].Count).To(Equal(int64(10)))
+		Expect(notifications[0].ExpiresTimestamp).To(Equal(periodEnd))
+		Expect(notifications[0].Timestamp).NotTo(BeZero())
+		Expect(notifications[1].Threshold).To(Equal(int64(80)))
+		Expect(notifications[2].StartTimestamp).To(Equal(periodEnd))
+		Expect(webhook.Delivered()).To(Equal(int64(3)))
+
+		//nothing is sent after shutdown.
+		Notify(exceeded("otherID"))
+		Expect(receiver.received()).To(HaveLen(3))
+	})
+
+	It("test failed notifications are retried", func() {
+		receiver.failFirst(2)
+		Notify(exceeded("sampleID"))
+		Eventually(receiver.received).Should(HaveLen(1))
+		Expect(receiver.requestCount()).To(Equal(3))
+		Expect(webhook.Dropped()).To(BeZero())
+	})
+
+	It("test notifications are dropped after max retries", func() {
+		receiver.failFirst(100)
+		Notify(exceeded("sampleID"))
+		Eventually(webhook.Dropped).Should(Equal(int64(1)))
+		Expect(receiver.requestCount()).To(Equal(4))
+		Expect(webhook.Delivered()).To(BeZero())
+	})
+
+	It("test dropped notifications are sent again for the same period", func() {
+		receiver.failFirst(4)
+		Notify(exceeded("sampleID"))
+		Eventually(webhook.Dropped).Should(Equal(int64(1)))
+
+		Notify(exceeded("sampleID"))
+		Eventually(receiver.received).Should(HaveLen(1))
+		Expect(webhook.Delivered()).To(Equal(int64(1)))
+	})
+
+	It("test notifications dropped from a full queue are sent again for the same period", func() {
+		release := make(chan struct{})
+		var entered int32
+		server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&entered, 1)
+			<-release
+			receiver.ServeHTTP(res, req)
+		})
+		webhook = NewWebhookNotifier(server.URL, "secret", 1, 0, time.Millisecond, 10*time.Millisecond, time.Second)
+		SetNotifier(webhook)
+
+		//the first notification holds up the delivery, the second fills the queue.
+		Notify(exceeded("firstID"))
+		Eventually(func() int32 { return atomic.LoadInt32(&entered) }).Should(Equal(int32(1)))
+		Notify(exceeded("secondID"))
+		Notify(exceeded("sampleID"))
+		Expect(webhook.Dropped()).To(Equal(int64(1)))
+
+		close(release)
+		Eventually(receiver.received).Should(HaveLen(2))
+		Notify(exceeded("sampleID"))
+		Eventually(receiver.received).Should(HaveLen(3))
+		Expect(receiver.received()[2].ID).To(Equal("sampleID"))
+	})
+})
@@ -17,6 +17,7 @@ package quotaBucket
 import (
 	"errors"
 	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
 	"reflect"
 	"time"
 )
@@ -25,16 +26,21 @@ const (
 	reqEdgeOrgID = "edgeOrgID"
 	reqID        = "id"
 	reqMaxCount  = "maxCount"
+	reqRequestID = "requestId"
 )
 
 type QuotaBucketResults struct {
-	EdgeOrgID        string
-	ID               string
-	MaxCount         int64
-	exceeded         bool
-	remainingCount   int64
-	startTimestamp   int64
-	expiresTimestamp int64
+	EdgeOrgID         string
+	ID                string
+	MaxCount          int64
+	exceeded          bool
+	remainingCount    int64
+	startTimestamp    int64
+	expiresTimestamp  int64
+	degraded          bool    //set when the results were decided without the counter service.
+	currentCount      int64   //count of the period after the request, as seen by this node.
+	overage           bool    //set when the request was admitted over maxCount by the soft limit.
+	crossedThresholds []int64 //thresholds reached by this request, each is reported once per period.
 }
 
 func (qBucketRequest *QuotaBucket) FromAPIRequest(quotaBucketMap map[string]interface{}) error {
@@ -67,6 +73,15 @@ func (qBucketRequest *QuotaBucket) FromAPIRequest(quotaBucketMap map[string]inte
 	//build cacheKey - to retrieve from or add to quotaCache
 	cacheKey = edgeOrgID + constants.CacheKeyDelimiter + id
 
+	//requestId is optional, retried requests with the same requestId are counted once.
+	value, ok = quotaBucketMap[reqRequestID]
+	if ok {
+		if requestIDType := reflect.TypeOf(value); requestIDType.Kind() != reflect.String {
+			return errors.New(`invalid type : 'requestId' should be a string`)
+		}
+		qBucketRequest.requestID = value.(string)
+	}
+
 	value, ok = quotaBucketMap["interval"]
 	if !ok {
 		return errors.New(`missing field: 'interval' is required`)
@@ -141,6 +156,45 @@ func (qBucketRequest *QuotaBucket) FromAPIRequest(quotaBucketMap map[string]inte
 	weightFloat := value.(float64)
 	weight = int64(weightFloat)
 
+	//degradationMode is optional, defaults to the configured mode.
+	degradationMode := ""
+	if globalVariables.Config != nil {
+		degradationMode = globalVariables.Config.GetString(constants.ConfigDefaultDegradationMode)
+	}
+	value, ok = quotaBucketMap["degradationMode"]
+	if ok {
+		if degradationModeType := reflect.TypeOf(value); degradationModeType.Kind() != reflect.String {
+			return errors.New(`invalid type : 'degradationMode' should be a string`)
+		}
+		degradationMode = value.(string)
+	}
+
+	//softLimit is optional, the overage admitted over maxCount as percentage of maxCount.
+	softLimit := int64(0)
+	value, ok = quotaBucketMap["softLimit"]
+	if ok {
+		if softLimitType := reflect.TypeOf(value); softLimitType.Kind() != reflect.Float64 {
+			return errors.New(`invalid type : 'softLimit' should be a number`)
+		}
+		softLimit = int64(value.(float64))
+	}
+
+	//thresholds is optional, percentages of maxCount reported once per period when reached.
+	thresholds := make([]int64, 0)
+	value, ok = quotaBucketMap["thresholds"]
+	if ok {
+		thresholdList, ok := value.([]interface{})
+		if !ok {
+			return errors.New(`invalid type : 'thresholds' should be a list of numbers`)
+		}
+		for _, threshold := range thresholdList {
+			if thresholdType := reflect.TypeOf(threshold); thresholdType == nil || thresholdType.Kind() != reflect.Float64 {
+				return errors.New(`invalid type : 'thresholds' should be a list of numbers`)
+			}
+			thresholds = append(thresholds, int64(threshold.(float64)))
+		}
+	}
+
 	value, ok = quotaBucketMap["distributed"]
 	if !ok {
 		return errors.New(`missing field: 'distributed' is required`)
@@ -150,8 +204,53 @@ func (qBucketRequest *QuotaBucket) FromAPIRequest(quotaBucketMap map[string]inte
 	}
 	distributed = value.(bool)
 
-	//if distributed check for sync or async Quota
+	//if distributed check for leased, sync or async Quota
 	if distributed {
+		value, ok = quotaBucketMap["leased"]
+		if ok {
+			if leasedType := reflect.TypeOf(value); leasedType.Kind() != reflect.Bool {
+				return errors.New(`invalid type : 'leased' should be boolean`)
+			}
+		}
+		if ok && value.(bool) {
+			//leaseChunkPercent is optional, defaults to the configured percentage.
+			leaseChunkPercent := int64(constants.DefaultLeaseChunkPercent)
+			if globalVariables.Config != nil {
+				leaseChunkPercent = int64(globalVariables.Config.GetInt(constants.ConfigLeaseChunkPercent))
+			}
+			value, ok = quotaBucketMap["leaseChunkPercent"]
+			if ok {
+				if leaseChunkPercentType := reflect.TypeOf(value); leaseChunkPercentType.Kind() != reflect.Float64 {
+					return errors.New(`invalid type : 'leaseChunkPercent' should be a number`)
+				}
+				leaseChunkPercent = int64(value.(float64))
+			}
+
+			//try to retrieve from cache
+			newQBucket, ok = getFromCache(cacheKey, weight)
+
+			if !ok {
+				newQBucket, err = NewLeasedQuotaBucket(edgeOrgID, id, interval, timeUnit, quotaType, preciseAtSecondsLevel,
+					startTime, maxCount, weight, leaseChunkPercent)
+				if err != nil {
+					return errors.New("error creating quotaBucket: " + err.Error())
+				}
+				qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
+				qBucketRequest.setDegradationMode(degradationMode)
+				if err := qBucketRequest.setLimits(softLimit, thresholds); err != nil {
+					return errors.New("error creating quotaBucket: " + err.Error())
+				}
+
+				if err := qBucketRequest.Validate(); err != nil {
+					return errors.New("error validating quotaBucket: " + err.Error())
+				}
+				addToCache(qBucketRequest)
+				return nil
+			}
+			qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
+			return nil
+		}
+
 		value, ok = quotaBucketMap["synchronous"]
 		if !ok {
 			return errors.New(`missing field: 'synchronous' is required`)
@@ -166,73 +265,88 @@ func (qBucketRequest *QuotaBucket) FromAPIRequest(quotaBucketMap map[string]inte
 			syncTimeValue, syncTimeOK := quotaBucketMap["syncTimeInSec"]
 			syncMsgCountValue, syncMsgCountOK := quotaBucketMap["syncMessageCount"]
 
-			if syncTimeOK && syncMsgCountOK {
-				return errors.New(`either syncTimeInSec or syncMessageCount should be present but not both.`)
+			//adaptiveSync is optional, adaptive aSyncQuotaBuckets also sync as per the headroom left before maxCount.
+			adaptiveSync := false
+			value, ok = quotaBucketMap["adaptiveSync"]
+			if ok {
+				if adaptiveSyncType := reflect.TypeOf(value); adaptiveSyncType.Kind() != reflect.Bool {
+					return errors.New(`invalid type : 'adaptiveSync' should be boolean`)
+				}
+				adaptiveSync = value.(bool)
+			}
+			adaptiveSyncPercent := int64(constants.DefaultAdaptiveSyncHeadroomPercent)
+			if globalVariables.Config != nil {
+				adaptiveSyncPercent = int64(globalVariables.Config.GetInt(constants.ConfigAdaptiveSyncHeadroomPercent))
 			}
 
-			if !syncTimeOK && !syncMsgCountOK {
+			if !syncTimeOK && !syncMsgCountOK && !adaptiveSync {
 				return errors.New(`either syncTimeInSec or syncMessageCount should be present. both cant be empty.`)
 			}
 
+			//syncTimeInSec and syncMessageCount can both be set, the bucket is synced on whichever fires first.
+			//adaptive aSyncQuotaBuckets may have neither, they are synced every DefaultQuotaSyncTime and as per their headroom.
+			syncTimeInt := int64(-1)
 			if syncTimeOK {
 				if syncTimeType := reflect.TypeOf(syncTimeValue); syncTimeType.Kind() != reflect.Float64 {
 					return errors.New(`invalid type : 'syncTimeInSec' should be a number`)
 				}
 				syncTimeFloat := syncTimeValue.(float64)
-				syncTimeInt := int64(syncTimeFloat)
-
-				//try to retrieve from cache
-				newQBucket, ok = getFromCache(cacheKey, weight)
-
-				if !ok {
-					newQBucket, err = NewQuotaBucket(edgeOrgID, id, interval, timeUnit, quotaType, preciseAtSecondsLevel,
-						startTime, maxCount, weight, distributed, synchronous, syncTimeInt, -1)
-					if err != nil {
-						return errors.New("error creating quotaBucket: " + err.Error())
-					}
-
-					qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
-
-					if err := qBucketRequest.Validate(); err != nil {
-						return errors.New("error validating quotaBucket: " + err.Error())
-					}
+				syncTimeInt = int64(syncTimeFloat)
+			}
+			syncMsgCountInt := int64(-1)
+			if syncMsgCountOK {
+				if syncMsgCountType := reflect.TypeOf(syncMsgCountValue); syncMsgCountType.Kind() != reflect.Float64 {
+					return errors.New(`invalid type : 'syncMessageCount' should be a number`)
+				}
+				syncMsgCountFloat := syncMsgCountValue.(float64)
+				syncMsgCountInt = int64(syncMsgCountFloat)
+			}
 
-					addToCache(qBucketRequest)
-					return nil
+			//maxStalenessInSec is optional, the global count is refreshed at least this often.
+			maxStalenessValue, maxStalenessOK := quotaBucketMap["maxStalenessInSec"]
+			if maxStalenessOK {
+				if maxStalenessType := reflect.TypeOf(maxStalenessValue); maxStalenessType.Kind() != reflect.Float64 {
+					return errors.New(`invalid type : 'maxStalenessInSec' should be a number`)
 				}
-				qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
+			}
 
-				return nil
+			//try to retrieve from cache
+			newQBucket, ok = getFromCache(cacheKey, weight)
 
-			} else if syncMsgCountOK {
-				if syncMsgCountType := reflect.TypeOf(syncMsgCountValue); syncMsgCountType.Kind() != reflect.Float64 {
-					return errors.New(`invalid type : 'syncTimeInSec' should be a number`)
+			if !ok {
+				newQBucket, err = NewQuotaBucket(edgeOrgID, id, interval, timeUnit, quotaType, preciseAtSecondsLevel,
+					startTime, maxCount, weight, distributed, synchronous, syncTimeInt, syncMsgCountInt)
+				if err != nil {
+					return errors.New("error creating quotaBucket: " + err.Error())
 				}
-				syncMsgCountFloat := syncMsgCountValue.(float64)
-				syncMsgCountInt := int64(syncMsgCountFloat)
-				//try to retrieve from cache
-				newQBucket, ok = getFromCache(cacheKey, weight)
-
-				if !ok {
-					newQBucket, err = NewQuotaBucket(edgeOrgID, id, interval, timeUnit, quotaType, preciseAtSecondsLevel,
-						startTime, maxCount, weight, distributed, synchronous, -1, syncMsgCountInt)
-					if err != nil {
+				if adaptiveSync {
+					if err := newQBucket.SetAdaptiveSync(adaptiveSyncPercent); err != nil {
 						return errors.New("error creating quotaBucket: " + err.Error())
 					}
-					qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
-
-					if err := qBucketRequest.Validate(); err != nil {
-						return errors.New("error validating quotaBucket: " + err.Error())
+				}
+				if maxStalenessOK {
+					maxStaleness := time.Duration(maxStalenessValue.(float64) * float64(time.Second))
+					if err := newQBucket.SetMaxStaleness(maxStaleness); err != nil {
+						return errors.New("error creating quotaBucket: " + err.Error())
 					}
+				}
 
-					addToCache(qBucketRequest)
-					return nil
+				qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
+				qBucketRequest.setDegradationMode(degradationMode)
+				if err := qBucketRequest.setLimits(softLimit, thresholds); err != nil {
+					return errors.New("error creating quotaBucket: " + err.Error())
+				}
 
+				if err := qBucketRequest.Validate(); err != nil {
+					return errors.New("error validating quotaBucket: " + err.Error())
 				}
-				qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
 
+				addToCache(qBucketRequest)
 				return nil
 			}
+			qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
+
+			return nil
 		}
 
 		//try to retrieve from cache
@@ -246,6 +360,10 @@ func (qBucketRequest *QuotaBucket) FromAPIRequest(quotaBucketMap map[string]inte
 				return errors.New("error creating quotaBucket: " + err.Error())
 			}
 			qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
+			qBucketRequest.setDegradationMode(degradationMode)
+			if err := qBucketRequest.setLimits(softLimit, thresholds); err != nil {
+				return errors.New("error creating quotaBucket: " + err.Error())
+			}
 
 			if err := qBucketRequest.Validate(); err != nil {
 				return errors.New("error validating quotaBucket: " + err.Error())
@@ -272,6 +390,10 @@ func (qBucketRequest *QuotaBucket) FromAPIRequest(quotaBucketMap map[string]inte
 		}
 
 		qBucketRequest.quotaBucketData = newQBucket.quotaBucketData
+		qBucketRequest.setDegradationMode(degradationMode)
+		if err := qBucketRequest.setLimits(softLimit, thresholds); err != nil {
+			return errors.New("error creating quotaBucket: " + err.Error())
+		}
 
 		if err := qBucketRequest.Validate(); err != nil {
 			return errors.New("error validating quotaBucket: " + err.Error())
@@ -294,6 +416,13 @@ func (qBucketResults *QuotaBucketResults) ToAPIResponse() map[string]interface{}
 	resultsMap["remainingCount"] = qBucketResults.remainingCount
 	resultsMap["startTimestamp"] = qBucketResults.startTimestamp
 	resultsMap["expiresTimestamp"] = qBucketResults.expiresTimestamp
+	resultsMap["degraded"] = qBucketResults.degraded
+	resultsMap["overage"] = qBucketResults.overage
+	crossedThresholds := qBucketResults.crossedThresholds
+	if crossedThresholds == nil {
+		crossedThresholds = []int64{}
+	}
+	resultsMap["crossedThresholds"] = crossedThresholds
 
 	return resultsMap
 }
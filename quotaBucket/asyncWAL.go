@@ -0,0 +1,365 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/services"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	walOpIncrement = "inc"
+	walOpAck       = "ack"
+)
+
+// walRecord is one line of the write-ahead log.
+// 'inc' records an accepted async increment, 'ack' records weight synced with the counter service.
+// the sequence of an 'inc' record is the idempotency key of its replays, along with its quota key and period.
+type walRecord struct {
+	Op        string `json:"op"`
+	OrgID     string `json:"orgId"`
+	Key       string `json:"key"`
+	Delta     int64  `json:"delta"`
+	StartTime int64  `json:"startTime,omitempty"`
+	EndTime   int64  `json:"endTime,omitempty"`
+	Seq       int64  `json:"seq,omitempty"`
+}
+
+// asyncWAL is an append-only log of the async increments not yet synced with the counter service,
+// so they can be re-sent after a crash. it is rewritten with just the pending increments once all of them are acked,
+// or after WALCompactionThreshold records, so it holds the pending increments plus at most that many records.
+type asyncWAL struct {
+	lock                   sync.Mutex
+	path                   string
+	file                   *os.File
+	pending                map[string][]walRecord //increments not yet synced per cacheKey, oldest first.
+	unreplayed             []walRecord            //increments of a previous run the counter service did not accept during replay.
+	appendsSinceCompaction int
+	lastSeq                int64 //sequence of the last 'inc' record, above the ones of the previous runs.
+}
+
+// quotaWAL is nil when the write-ahead log is disabled.
+var quotaWAL *asyncWAL
+
+// InitWAL opens the write-ahead log under the apid data directory, when enabled in the config,
+// and re-sends the increments left pending by the previous run to the counter service.
+// it fails when the log is enabled but cannot be opened, as async increments would not survive a crash.
+func InitWAL() error {
+	if !globalVariables.Config.GetBool(constants.ConfigWALEnabled) {
+		return nil
+	}
+
+	dataDir := globalVariables.Config.GetString(constants.ConfigLocalStoragePath)
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return errors.New("unable to create directory for the write-ahead log: " + err.Error())
+	}
+
+	wal := &asyncWAL{
+		path:    filepath.Join(dataDir, constants.WALFileName),
+		pending: make(map[string][]walRecord),
+	}
+
+	records, err := readWALRecords(wal.path)
+	if err != nil {
+		return err
+	}
+	//the sequences start from the clock, so they stay above the ones of the previous runs once their records are compacted away.
+	wal.lastSeq = time.Now().UnixNano()
+	for _, record := range records {
+		if record.Seq > wal.lastSeq {
+			wal.lastSeq = record.Seq
+		}
+	}
+	wal.unreplayed = replayWALRecords(records)
+
+	//rewrite the log with the increments that could not be replayed.
+	if err := wal.compact(); err != nil {
+		return err
+	}
+
+	quotaWAL = wal
+	for _, record := range wal.unreplayed {
+		quotaSyncScheduler.scheduleReplay(record, constants.WALReplayRetryInterval)
+	}
+	return nil
+}
+
+func readWALRecords(path string) ([]walRecord, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("unable to open write-ahead log: " + err.Error())
+	}
+	defer file.Close()
+
+	records := make([]walRecord, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := walRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			//a torn write at the end of the log during a crash.
+			globalVariables.Log.Warn("ignoring invalid record in write-ahead log: ", err.Error())
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("unable to read write-ahead log: " + err.Error())
+	}
+	return records, nil
+}
+
+// replayWALRecords sends the increments not acknowledged in the records to the counter service,
+// for the period they belong to, and returns the ones that could not be sent.
+func replayWALRecords(records []walRecord) []walRecord {
+	pending := make(map[string][]walRecord)
+	keys := make([]string, 0)
+	for _, record := range records {
+		cacheKey := record.OrgID + constants.CacheKeyDelimiter + record.Key
+		switch record.Op {
+		case walOpIncrement:
+			if _, ok := pending[cacheKey]; !ok {
+				keys = append(keys, cacheKey)
+			}
+			pending[cacheKey] = append(pending[cacheKey], record)
+		case walOpAck:
+			pending[cacheKey] = consumeWALRecords(pending[cacheKey], record.Delta)
+		}
+	}
+
+	unreplayed := make([]walRecord, 0)
+	for _, cacheKey := range keys {
+		for _, record := range mergeWALRecordsByPeriod(pending[cacheKey]) {
+			if err := replayWALRecord(record); err != nil {
+				globalVariables.Log.Error("unable to replay pending increment from write-ahead log for quotaBucket: ", cacheKey, " : ", err.Error())
+				unreplayed = append(unreplayed, record)
+			}
+		}
+	}
+	return unreplayed
+}
+
+// replayWALRecord sends the increment with the same idempotency key on every replay,
+// so an increment counted before a crash during replay, or before a failed attempt, is not counted again.
+func replayWALRecord(record walRecord) error {
+	idempotencyKey := record.OrgID + constants.CacheKeyDelimiter + record.Key + constants.CacheKeyDelimiter +
+		strconv.FormatInt(record.StartTime, 10) + constants.CacheKeyDelimiter + strconv.FormatInt(record.EndTime, 10) +
+		constants.CacheKeyDelimiter + strconv.FormatInt(record.Seq, 10)
+	ctx := services.WithIdempotencyKey(context.Background(), idempotencyKey)
+	_, err := services.IncrementAndGetCount(ctx, record.OrgID, record.Key, record.Delta, record.StartTime, record.EndTime)
+	return err
+}
+
+// retryReplay sends an increment the counter service did not accept during replay again,
+// and removes it from the log once sent. it reports if the increment is still to be sent.
+func (wal *asyncWAL) retryReplay(record walRecord) bool {
+	if err := replayWALRecord(record); err != nil {
+		globalVariables.Log.Error("unable to replay pending increment from write-ahead log for quotaBucket: ",
+			record.OrgID+constants.CacheKeyDelimiter+record.Key, " : ", err.Error())
+		return true
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	for i, unreplayed := range wal.unreplayed {
+		if unreplayed == record {
+			wal.unreplayed = append(wal.unreplayed[:i], wal.unreplayed[i+1:]...)
+			break
+		}
+	}
+	if err := wal.compactLocked(); err != nil {
+		globalVariables.Log.Error("error compacting write-ahead log: ", err.Error())
+	}
+	return false
+}
+
+// consumeWALRecords removes weight from the oldest records.
+func consumeWALRecords(records []walRecord, weight int64) []walRecord {
+	for weight > 0 && len(records) > 0 {
+		if records[0].Delta > weight {
+			records[0].Delta -= weight
+			return records
+		}
+		weight -= records[0].Delta
+		records = records[1:]
+	}
+	return records
+}
+
+// mergeWALRecordsByPeriod sums up the consecutive records of a period. a merged record keeps the sequence of its
+// first record, so replaying the same log again merges to the same records, with the same idempotency keys.
+func mergeWALRecordsByPeriod(records []walRecord) []walRecord {
+	merged := make([]walRecord, 0)
+	for _, record := range records {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].StartTime == record.StartTime && merged[last].EndTime == record.EndTime {
+			merged[last].Delta += record.Delta
+			continue
+		}
+		merged = append(merged, record)
+	}
+	return merged
+}
+
+// append records an accepted increment. it must succeed before the increment is acknowledged.
+func (wal *asyncWAL) append(q *QuotaBucket, weight int64, period *quotaPeriod) error {
+	record := walRecord{
+		Op:        walOpIncrement,
+		OrgID:     q.GetEdgeOrgID(),
+		Key:       q.GetID(),
+		Delta:     weight,
+		StartTime: period.GetPeriodStartTime().Unix(),
+		EndTime:   period.GetPeriodEndTime().Unix(),
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	record.Seq = wal.lastSeq + 1
+	if err := wal.write(record); err != nil {
+		return err
+	}
+	wal.lastSeq = record.Seq
+	cacheKey := record.OrgID + constants.CacheKeyDelimiter + record.Key
+	wal.pending[cacheKey] = append(wal.pending[cacheKey], record)
+	return nil
+}
+
+// ack records weight of the bucket synced with the counter service. the log is compacted instead
+// once no increment is pending, or once enough records were appended.
+func (wal *asyncWAL) ack(q *QuotaBucket, weight int64) {
+	if weight == 0 {
+		return
+	}
+	record := walRecord{
+		Op:    walOpAck,
+		OrgID: q.GetEdgeOrgID(),
+		Key:   q.GetID(),
+		Delta: weight,
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	cacheKey := record.OrgID + constants.CacheKeyDelimiter + record.Key
+	if wal.pending[cacheKey] = consumeWALRecords(wal.pending[cacheKey], weight); len(wal.pending[cacheKey]) == 0 {
+		delete(wal.pending, cacheKey)
+	}
+
+	if wal.appendsSinceCompaction >= constants.WALCompactionThreshold || (len(wal.pending) == 0 && len(wal.unreplayed) == 0) {
+		if err := wal.compactLocked(); err != nil {
+			globalVariables.Log.Error("error compacting write-ahead log: ", err.Error())
+		}
+		return
+	}
+	if err := wal.write(record); err != nil {
+		globalVariables.Log.Error("error writing ack to write-ahead log: ", err.Error())
+	}
+}
+
+func (wal *asyncWAL) write(record walRecord) error {
+	if wal.file == nil {
+		return errors.New("write-ahead log is closed")
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return errors.New(constants.MarshalJSONError)
+	}
+	if _, err := wal.file.Write(append(recordBytes, '\n')); err != nil {
+		return errors.New("unable to write to write-ahead log: " + err.Error())
+	}
+	if err := wal.file.Sync(); err != nil {
+		return errors.New("unable to sync write-ahead log: " + err.Error())
+	}
+	wal.appendsSinceCompaction++
+	return nil
+}
+
+func (wal *asyncWAL) compact() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	return wal.compactLocked()
+}
+
+// compactLocked rewrites the log with just the pending increments. wal.lock must be held.
+func (wal *asyncWAL) compactLocked() error {
+	tmpPath := wal.path + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.New("unable to create write-ahead log: " + err.Error())
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	records := append([]walRecord{}, wal.unreplayed...)
+	for _, pending := range wal.pending {
+		records = append(records, pending...)
+	}
+	for _, record := range records {
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			tmpFile.Close()
+			return errors.New(constants.MarshalJSONError)
+		}
+		writer.Write(append(recordBytes, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmpFile.Close()
+		return errors.New("unable to write write-ahead log: " + err.Error())
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return errors.New("unable to sync write-ahead log: " + err.Error())
+	}
+	tmpFile.Close()
+
+	if err := os.Rename(tmpPath, wal.path); err != nil {
+		return errors.New("unable to replace write-ahead log: " + err.Error())
+	}
+
+	if wal.file != nil {
+		wal.file.Close()
+	}
+	wal.file, err = os.OpenFile(wal.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		wal.file = nil
+		return errors.New("unable to open write-ahead log: " + err.Error())
+	}
+	wal.appendsSinceCompaction = 0
+	return nil
+}
+
+func (wal *asyncWAL) close() error {
+	if err := wal.compact(); err != nil {
+		return err
+	}
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	if wal.file == nil {
+		return nil
+	}
+	err := wal.file.Close()
+	wal.file = nil
+	return err
+}
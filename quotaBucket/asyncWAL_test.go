@@ -0,0 +1,200 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket_test
+
+import (
+	"bufio"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Test write-ahead log", func() {
+	testUtil.UseConfig()
+
+	It("test write-ahead log which cannot be opened fails its init", func() {
+		file, err := ioutil.TempFile("", "apidQuotaWAL")
+		Expect(err).NotTo(HaveOccurred())
+		file.Close()
+		defer os.Remove(file.Name())
+
+		//the data directory would be under a regular file.
+		testUtil.GetConfig().Set(constants.ConfigLocalStoragePath, filepath.Join(file.Name(), "data"))
+		Expect(InitWAL()).To(Succeed())
+		testUtil.GetConfig().Set(constants.ConfigWALEnabled, true)
+		Expect(InitWAL()).NotTo(Succeed())
+	})
+
+	Context("against the counter service", func() {
+		service := useCounterService()
+		var dataDir string
+
+		walRecords := func() []string {
+			file, err := os.Open(filepath.Join(dataDir, constants.WALFileName))
+			Expect(err).NotTo(HaveOccurred())
+			defer file.Close()
+			records := make([]string, 0)
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				records = append(records, scanner.Text())
+			}
+			return records
+		}
+
+		BeforeEach(func() {
+			var err error
+			dataDir, err = ioutil.TempDir("", "apidQuotaWAL")
+			Expect(err).NotTo(HaveOccurred())
+			testUtil.GetConfig().Set(constants.ConfigWALEnabled, true)
+			testUtil.GetConfig().Set(constants.ConfigLocalStoragePath, dataDir)
+			Expect(InitWAL()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			CrashWAL()
+			ResetShutdown()
+			os.RemoveAll(dataDir)
+		})
+
+		It("test increments are written before they are synced, and the log is compacted once they are acked", func() {
+			qBucket := newAsyncBucket("walOrgAck", "app")
+			incrementTimes(qBucket, 3)
+			records := walRecords()
+			Expect(records).To(HaveLen(3))
+			Expect(records[0]).To(ContainSubstring(`"op":"inc"`))
+			Expect(records[0]).To(ContainSubstring(`"orgId":"walOrgAck"`))
+
+			Expect(SyncAsyncBucket(qBucket)).To(BeTrue())
+			Expect(service.countedFor("walOrgAck")).To(BeEquivalentTo(3))
+			Expect(walRecords()).To(BeEmpty())
+		})
+
+		It("test pending weight of an evicted quotaBucket is flushed and acked before it is unscheduled", func() {
+			qBucket := fromAPIRequest(quotaRequest("walOrgEvict", "app", map[string]interface{}{"synchronous": false, "syncTimeInSec": float64(3600)}))
+			incrementTimes(qBucket, 3)
+			Expect(walRecords()).To(HaveLen(3))
+
+			ExpireCachedBucket("walOrgEvict", "app")
+			Eventually(func() bool { return IsSyncScheduled(qBucket) }, 5*time.Second).Should(BeFalse())
+			Expect(walRecords()).To(BeEmpty())
+			Expect(service.countedFor("walOrgEvict")).To(BeEquivalentTo(3))
+
+			//a request still holding the evicted quotaBucket sends its weight right away.
+			incrementTimes(qBucket, 2)
+			Expect(PendingWeight(qBucket)).To(BeZero())
+			Expect(walRecords()).To(BeEmpty())
+			Expect(service.countedFor("walOrgEvict")).To(BeEquivalentTo(2))
+		})
+
+		It("test evicted quotaBucket whose flush failed stays scheduled until its weight is synced", func() {
+			qBucket := fromAPIRequest(quotaRequest("walOrgEvictRetry", "app", map[string]interface{}{"synchronous": false, "syncTimeInSec": float64(3600)}))
+			incrementTimes(qBucket, 3)
+
+			failed := make(chan struct{})
+			var failOnce sync.Once
+			service.server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusInternalServerError)
+				failOnce.Do(func() { close(failed) })
+			})
+			ExpireCachedBucket("walOrgEvictRetry", "app")
+			Eventually(failed, 5*time.Second).Should(BeClosed())
+			Eventually(func() int64 { return PendingWeight(qBucket) }, 5*time.Second).Should(BeEquivalentTo(3))
+			Expect(IsSyncScheduled(qBucket)).To(BeTrue())
+			Expect(walRecords()).To(HaveLen(3))
+
+			//once flushed, the evicted quotaBucket is not synced anymore.
+			service.server.Config.Handler = counterService.NewCounterService(service.store)
+			Expect(SyncAsyncBucket(qBucket)).To(BeFalse())
+			Expect(walRecords()).To(BeEmpty())
+			Expect(service.countedFor("walOrgEvictRetry")).To(BeEquivalentTo(3))
+		})
+
+		It("test increments not acked before a crash are replayed on the next start", func() {
+			qBucket := newAsyncBucket("walOrgCrash", "app")
+			incrementTimes(qBucket, 4)
+			CrashWAL()
+			Expect(walRecords()).To(HaveLen(4))
+
+			Expect(InitWAL()).To(Succeed())
+			Expect(service.countedFor("walOrgCrash")).To(BeEquivalentTo(4))
+			Expect(walRecords()).To(BeEmpty())
+			Expect(ScheduledWALReplays()).To(BeZero())
+		})
+
+		It("test increments replayed again after a crash during replay are counted once", func() {
+			qBucket := newAsyncBucket("walOrgReplayTwice", "app")
+			incrementTimes(qBucket, 2)
+			CrashWAL()
+			walPath := filepath.Join(dataDir, constants.WALFileName)
+			walBytes, err := ioutil.ReadFile(walPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(walRecords()[0]).To(ContainSubstring(`"seq":`))
+
+			Expect(InitWAL()).To(Succeed())
+			Expect(service.countedFor("walOrgReplayTwice")).To(BeEquivalentTo(2))
+
+			//the crash came before the log was compacted, so the same increments are replayed on the next start.
+			CrashWAL()
+			Expect(ioutil.WriteFile(walPath, walBytes, 0600)).To(Succeed())
+			Expect(InitWAL()).To(Succeed())
+			Expect(service.countedFor("walOrgReplayTwice")).To(BeZero())
+			Expect(walRecords()).To(BeEmpty())
+		})
+
+		It("test increments acked before a crash are not replayed", func() {
+			qBucket := newAsyncBucket("walOrgPartial", "app")
+			incrementTimes(qBucket, 2)
+			Expect(SyncAsyncBucket(qBucket)).To(BeTrue())
+			incrementTimes(qBucket, 3)
+			CrashWAL()
+			Expect(service.countedFor("walOrgPartial")).To(BeEquivalentTo(2))
+
+			Expect(InitWAL()).To(Succeed())
+			Expect(service.countedFor("walOrgPartial")).To(BeEquivalentTo(3))
+		})
+
+		It("test increments the counter service did not accept during replay are scheduled again", func() {
+			qBucket := newAsyncBucket("walOrgRetry", "app")
+			incrementTimes(qBucket, 2)
+			CrashWAL()
+
+			service.server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusInternalServerError)
+			})
+			Expect(InitWAL()).To(Succeed())
+			Expect(ScheduledWALReplays()).To(Equal(1))
+			records := walRecords()
+			Expect(records).To(HaveLen(1))
+			Expect(strings.Contains(records[0], `"delta":2`)).To(BeTrue())
+
+			service.server.Config.Handler = counterService.NewCounterService(service.store)
+			scheduler := NewSyncScheduler(1, 0)
+			defer scheduler.Shutdown(time.Second)
+			scheduler.ScheduleWALReplays(10 * time.Millisecond)
+			Eventually(walRecords, 5*time.Second).Should(BeEmpty())
+			Expect(service.countedFor("walOrgRetry")).To(BeEquivalentTo(2))
+		})
+	})
+})
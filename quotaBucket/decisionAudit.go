@@ -0,0 +1,64 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"github.com/apid/apidQuota/audit"
+	"github.com/apid/apidQuota/constants"
+)
+
+// getMode returns how the quotaBucket is counted, as recorded in the audit log and shown by the cache state.
+func (q *QuotaBucket) getMode() string {
+	switch {
+	case !q.IsDistrubuted():
+		return constants.AuditModeNonDistributed
+	case q.IsLeased():
+		return constants.AuditModeLeased
+	case q.IsSynchronous():
+		return constants.AuditModeSynchronous
+	default:
+		return constants.AuditModeAsynchronous
+	}
+}
+
+// audit records the decision in the audit log. admitted is set when the weight of the request was counted,
+// level names the level of a hierarchical quota, it is empty for single quotaBuckets.
+func (q *QuotaBucket) audit(results *QuotaBucketResults, level string, admitted bool) {
+	decision := constants.AuditDecisionDenied
+	countBefore := results.currentCount
+	if admitted {
+		decision = constants.AuditDecisionAllowed
+		countBefore -= q.GetWeight()
+	}
+	mode := q.getMode()
+	if level != "" {
+		mode = constants.AuditModeHierarchical
+	}
+
+	audit.Record(audit.Entry{
+		EdgeOrgID:        q.GetEdgeOrgID(),
+		ID:               q.GetID(),
+		Level:            level,
+		Decision:         decision,
+		Weight:           q.GetWeight(),
+		CountBefore:      countBefore,
+		CountAfter:       results.currentCount,
+		MaxCount:         q.GetMaxCount(),
+		StartTimestamp:   results.startTimestamp,
+		ExpiresTimestamp: results.expiresTimestamp,
+		Mode:             mode,
+		Degraded:         results.degraded,
+	})
+}
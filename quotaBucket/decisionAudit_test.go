@@ -0,0 +1,122 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket_test
+
+import (
+	"context"
+	"github.com/apid/apidQuota/audit"
+	. "github.com/apid/apidQuota/quotaBucket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sync"
+	"time"
+)
+
+// auditSink keeps the audit entries in memory.
+type auditSink struct {
+	lock    sync.Mutex
+	entries []audit.Entry
+}
+
+func (s *auditSink) Write(entries []audit.Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+func (s *auditSink) Close() error {
+	return nil
+}
+
+var _ = Describe("Test decision audit", func() {
+	useRedisCounterBackend()
+	var sink *auditSink
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		sink = &auditSink{}
+		audit.SetLogger(audit.NewLogger(sink, 100, 1, 1))
+	})
+
+	AfterEach(func() {
+		audit.SetLogger(nil)
+	})
+
+	It("test decisions are recorded with the counts before and after", func() {
+		qBucket, err := NewQuotaBucket("sampleOrg", "auditedID", 1, "hour", "calendar", false,
+			testStartTime, 4, 2, true, true, -1, -1)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			_, err = qBucket.IncrementQuotaLimit(ctx)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(audit.Shutdown(time.Second)).To(Succeed())
+
+		Expect(sink.entries).To(HaveLen(3))
+		for i, entry := range sink.entries {
+			Expect(entry.EdgeOrgID).To(Equal("sampleOrg"))
+			Expect(entry.ID).To(Equal("auditedID"))
+			Expect(entry.Weight).To(Equal(int64(2)))
+			Expect(entry.MaxCount).To(Equal(int64(4)))
+			Expect(entry.Mode).To(Equal("synchronous"))
+			Expect(entry.Degraded).To(BeFalse())
+			Expect(entry.ExpiresTimestamp).To(BeNumerically(">", entry.StartTimestamp))
+			if i < 2 {
+				Expect(entry.Decision).To(Equal("allowed"))
+				Expect(entry.CountBefore).To(Equal(int64(2 * i)))
+				Expect(entry.CountAfter).To(Equal(int64(2*i + 2)))
+			}
+		}
+		Expect(sink.entries[2].Decision).To(Equal("denied"))
+		Expect(sink.entries[2].CountBefore).To(Equal(int64(4)))
+		Expect(sink.entries[2].CountAfter).To(Equal(int64(4)))
+	})
+
+	It("test every level of a hierarchical quota is recorded", func() {
+		quotaMap := map[string]interface{}{
+			"edgeOrgID": "auditedOrg",
+			"weight":    float64(1),
+			"levels": []interface{}{
+				map[string]interface{}{"level": "org", "id": "auditedOrgLevel", "interval": float64(1), "timeUnit": "hour",
+					"type": "calendar", "preciseAtSecondsLevel": false, "startTimestamp": float64(testStartTime), "maxCount": float64(5)},
+				map[string]interface{}{"level": "app", "id": "auditedAppLevel", "interval": float64(1), "timeUnit": "hour",
+					"type": "calendar", "preciseAtSecondsLevel": false, "startTimestamp": float64(testStartTime), "maxCount": float64(1)},
+			},
+		}
+		for i := 0; i < 2; i++ {
+			hQuota := &HierarchicalQuota{}
+			Expect(hQuota.FromAPIRequest(quotaMap)).To(Succeed())
+			_, err := hQuota.IncrementQuotaLimit(ctx)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(audit.Shutdown(time.Second)).To(Succeed())
+
+		Expect(sink.entries).To(HaveLen(4))
+		Expect(sink.entries[0].Level).To(Equal("org"))
+		Expect(sink.entries[1].Level).To(Equal("app"))
+		for _, entry := range sink.entries {
+			Expect(entry.Mode).To(Equal("hierarchical"))
+		}
+		Expect(sink.entries[0].Decision).To(Equal("allowed"))
+		Expect(sink.entries[1].Decision).To(Equal("allowed"))
+		//the app level rejects the request, it is taken back at the org level too.
+		Expect(sink.entries[2].Decision).To(Equal("denied"))
+		Expect(sink.entries[2].CountBefore).To(Equal(int64(1)))
+		Expect(sink.entries[2].CountAfter).To(Equal(int64(1)))
+		Expect(sink.entries[3].Decision).To(Equal("denied"))
+		Expect(sink.entries[3].CountAfter).To(Equal(int64(1)))
+	})
+})
@@ -0,0 +1,192 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"context"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/services"
+	"sync"
+)
+
+var acceptedDegradationModeList = map[string]bool{constants.DegradationModeFailOpen: true,
+	constants.DegradationModeFailClosed: true, constants.DegradationModeLocalEstimate: true}
+
+func IsValidDegradationMode(mode string) bool {
+	if _, ok := acceptedDegradationModeList[mode]; ok {
+		return true
+	}
+	return false
+}
+
+// localQuotaEstimate keeps the count of a synchronous quotaBucket, so it can be
+// estimated locally while the counter service is unavailable.
+type localQuotaEstimate struct {
+	lock             sync.Mutex
+	lastKnownCount   int64 //last count received from the counter service.
+	lastKnownStart   int64 //period start of lastKnownCount.
+	localCount       int64 //weight admitted while degraded, not yet sent to the counter service.
+	localPeriodStart int64
+	localPeriodEnd   int64
+}
+
+// localEstimates keeps the localQuotaEstimate of each synchronous quotaBucket by cacheKey, apart from the cache,
+// so the weight admitted while degraded is still reconciled after the quotaBucket is evicted and looked up again.
+var localEstimates = struct {
+	sync.Mutex
+	byCacheKey map[string]*localQuotaEstimate
+}{byCacheKey: make(map[string]*localQuotaEstimate)}
+
+func getLocalEstimate(cacheKey string) *localQuotaEstimate {
+	localEstimates.Lock()
+	defer localEstimates.Unlock()
+	estimate, ok := localEstimates.byCacheKey[cacheKey]
+	if !ok {
+		estimate = &localQuotaEstimate{}
+		localEstimates.byCacheKey[cacheKey] = estimate
+	}
+	return estimate
+}
+
+// releaseLocalEstimate forgets the localQuotaEstimate of an evicted quotaBucket, unless it still has weight to reconcile.
+func releaseLocalEstimate(cacheKey string, estimate *localQuotaEstimate) {
+	localEstimates.Lock()
+	defer localEstimates.Unlock()
+	if localEstimates.byCacheKey[cacheKey] != estimate {
+		return
+	}
+	estimate.lock.Lock()
+	localCount := estimate.localCount
+	estimate.lock.Unlock()
+	if localCount == 0 {
+		delete(localEstimates.byCacheKey, cacheKey)
+	}
+}
+
+func (e *localQuotaEstimate) recordCount(period *quotaPeriod, count int64) {
+	e.lock.Lock()
+	e.lastKnownCount = count
+	e.lastKnownStart = period.GetPeriodStartTime().Unix()
+	e.lock.Unlock()
+}
+
+// getCount returns the estimated count for the period: the last known count plus the weight admitted locally.
+func (e *localQuotaEstimate) getCount(period *quotaPeriod) int64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	count := int64(0)
+	if e.lastKnownStart == period.GetPeriodStartTime().Unix() {
+		count += e.lastKnownCount
+	}
+	if e.localPeriodStart == period.GetPeriodStartTime().Unix() {
+		count += e.localCount
+	}
+	return count
+}
+
+func (e *localQuotaEstimate) addLocalCount(period *quotaPeriod, weight int64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.localPeriodStart != period.GetPeriodStartTime().Unix() {
+		//weight admitted locally in an old period can no longer affect any decision.
+		e.localCount = 0
+		e.localPeriodStart = period.GetPeriodStartTime().Unix()
+		e.localPeriodEnd = period.GetPeriodEndTime().Unix()
+	}
+	e.localCount += weight
+}
+
+// reconcile sends the weight admitted while degraded to the counter service.
+func (e *localQuotaEstimate) reconcile(ctx context.Context, q *QuotaBucket) error {
+	e.lock.Lock()
+	localCount, start, end := e.localCount, e.localPeriodStart, e.localPeriodEnd
+	e.localCount = 0
+	e.lock.Unlock()
+	if localCount == 0 {
+		return nil
+	}
+
+	if _, err := services.IncrementAndGetCount(ctx, q.GetEdgeOrgID(), q.GetID(), localCount, start, end); err != nil {
+		e.lock.Lock()
+		if e.localPeriodStart == start {
+			e.localCount += localCount
+		}
+		e.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// incrementDegraded decides on the increment as per the degradationMode of the quotaBucket,
+// while the counter service is unavailable. the results are flagged as degraded.
+func (q *QuotaBucket) incrementDegraded(period *quotaPeriod) (*QuotaBucketResults, error) {
+	estimate := q.getLocalEstimate()
+	if estimate == nil {
+		return nil, errors.New(constants.InvalidDegradationMode + " : quotaBucket has no local estimate")
+	}
+
+	maxCount := q.GetMaxCount()
+	limit := q.getAdmissionLimit()
+	weight := q.GetWeight()
+	currentCount := estimate.getCount(period)
+	exceeded := false
+	remainingCount := int64(0)
+	countedCount := int64(0)
+
+	if period.IsCurrentPeriod(q) {
+		countedCount = currentCount
+		switch q.GetDegradationMode() {
+		case constants.DegradationModeFailClosed:
+			exceeded = true
+			remainingCount = maxCount - currentCount
+		case constants.DegradationModeFailOpen:
+			estimate.addLocalCount(period, weight)
+			remainingCount = maxCount - (currentCount + weight)
+			countedCount = currentCount + weight
+		case constants.DegradationModeLocalEstimate:
+			if currentCount+weight <= limit {
+				estimate.addLocalCount(period, weight)
+				remainingCount = maxCount - (currentCount + weight)
+				countedCount = currentCount + weight
+			} else {
+				if weight != 0 {
+					exceeded = true
+				}
+				remainingCount = maxCount - currentCount
+			}
+		default:
+			return nil, errors.New(constants.InvalidDegradationMode + " : " + q.GetDegradationMode())
+		}
+	}
+
+	if remainingCount < 0 {
+		remainingCount = int64(0)
+	}
+
+	results := &QuotaBucketResults{
+		EdgeOrgID:        q.GetEdgeOrgID(),
+		ID:               q.GetID(),
+		exceeded:         exceeded,
+		remainingCount:   remainingCount,
+		MaxCount:         maxCount,
+		startTimestamp:   period.GetPeriodStartTime().Unix(),
+		expiresTimestamp: period.GetPeriodEndTime().Unix(),
+		degraded:         true,
+		currentCount:     countedCount,
+	}
+
+	return results, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket_test
+
+import (
+	"context"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+)
+
+var _ = Describe("Test degradation modes", func() {
+	testUtil.UseConfig()
+
+	Context("against the counter service", func() {
+		service := useCounterService()
+
+		degradedRequest := func(edgeOrgID string, maxCount int64, degradationMode string) *QuotaBucket {
+			fields := map[string]interface{}{"maxCount": float64(maxCount)}
+			if degradationMode != "" {
+				fields["degradationMode"] = degradationMode
+			}
+			return fromAPIRequest(quotaRequest(edgeOrgID, "app", fields))
+		}
+
+		unavailable := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.WriteHeader(http.StatusServiceUnavailable)
+		})
+
+		It("test failopen admits every request while the counter service is unavailable", func() {
+			qBucket := degradedRequest("degradedOrgOpen", 2, "failopen")
+			service.server.Config.Handler = unavailable
+			for i := 0; i < 3; i++ {
+				results := incrementQuota(qBucket)
+				Expect(results["degraded"]).To(BeTrue())
+				Expect(results["exceeded"]).To(BeFalse())
+			}
+		})
+
+		It("test failclosed rejects every request while the counter service is unavailable", func() {
+			qBucket := degradedRequest("degradedOrgClosed", 2, "failclosed")
+			service.server.Config.Handler = unavailable
+			results := incrementQuota(qBucket)
+			Expect(results["degraded"]).To(BeTrue())
+			Expect(results["exceeded"]).To(BeTrue())
+		})
+
+		It("test without degradationMode the error of the counter service is returned", func() {
+			qBucket := degradedRequest("degradedOrgNone", 2, "")
+			service.server.Config.Handler = unavailable
+			_, err := qBucket.IncrementQuotaLimit(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(services.IsUnavailable(err)).To(BeTrue())
+		})
+
+		It("test localestimate counts locally up to maxCount, and reconciles once the counter service is back", func() {
+			qBucket := degradedRequest("degradedOrgEstimate", 3, "localestimate")
+			Expect(incrementQuota(qBucket)["degraded"]).To(BeFalse())
+
+			service.server.Config.Handler = unavailable
+			for i := 0; i < 2; i++ {
+				results := incrementQuota(qBucket)
+				Expect(results["degraded"]).To(BeTrue())
+				Expect(results["exceeded"]).To(BeFalse())
+			}
+			results := incrementQuota(qBucket)
+			Expect(results["degraded"]).To(BeTrue())
+			Expect(results["exceeded"]).To(BeTrue())
+
+			service.server.Config.Handler = counterService.NewCounterService(service.store)
+			results = incrementQuota(qBucket)
+			Expect(results["degraded"]).To(BeFalse())
+			Expect(results["exceeded"]).To(BeTrue())
+			Expect(service.countedFor("degradedOrgEstimate")).To(BeEquivalentTo(3))
+		})
+
+		It("test weight reconciled before the increment of a request with a requestId is counted apart from it", func() {
+			request := quotaRequest("degradedOrgRequestID", "app", map[string]interface{}{
+				"maxCount":        float64(10),
+				"degradationMode": "localestimate",
+			})
+			service.server.Config.Handler = unavailable
+			for i := 0; i < 2; i++ {
+				Expect(incrementQuota(fromAPIRequest(request))["degraded"]).To(BeTrue())
+			}
+
+			service.server.Config.Handler = counterService.NewCounterService(service.store)
+			request["requestId"] = "request1"
+			results := incrementQuota(fromAPIRequest(request))
+			Expect(results["degraded"]).To(BeFalse())
+			Expect(results["remainingCount"]).To(BeEquivalentTo(7))
+			Expect(service.countedFor("degradedOrgRequestID")).To(BeEquivalentTo(3))
+		})
+
+		It("test weight counted locally is reconciled after the quotaBucket is evicted", func() {
+			qBucket := degradedRequest("degradedOrgEvict", 10, "localestimate")
+			service.server.Config.Handler = unavailable
+			for i := 0; i < 2; i++ {
+				Expect(incrementQuota(qBucket)["degraded"]).To(BeTrue())
+			}
+
+			ExpireCachedBucket("degradedOrgEvict", "app")
+			Expect(IsCached("degradedOrgEvict", "app")).To(BeFalse())
+
+			service.server.Config.Handler = counterService.NewCounterService(service.store)
+			results := incrementQuota(degradedRequest("degradedOrgEvict", 10, "localestimate"))
+			Expect(results["degraded"]).To(BeFalse())
+			Expect(results["remainingCount"]).To(BeEquivalentTo(7))
+			Expect(service.countedFor("degradedOrgEvict")).To(BeEquivalentTo(3))
+		})
+	})
+})
@@ -0,0 +1,167 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"github.com/apid/apidQuota/constants"
+	"sync/atomic"
+	"time"
+)
+
+// the hooks below let the tests of package quotaBucket_test reach the internals of the sync scheduler and the cache.
+
+// SyncScheduler is a syncScheduler of its own, apart from the one syncing the cached quotaBuckets.
+type SyncScheduler = syncScheduler
+
+func NewSyncScheduler(concurrency int, jitterPercent int64) *SyncScheduler {
+	s := newSyncScheduler()
+	s.startOnce.Do(func() {
+		s.run(concurrency, jitterPercent)
+	})
+	return s
+}
+
+func (s *syncScheduler) Schedule(q *QuotaBucket, interval time.Duration) {
+	s.schedule(q, interval)
+}
+
+func (s *syncScheduler) Unschedule(q *QuotaBucket) {
+	s.unschedule(q.GetAsyncQuotaBucket())
+}
+
+// ScheduledForOrg returns the number of buckets of the org the scheduler gathers pending weight from.
+func (s *syncScheduler) ScheduledForOrg(edgeOrgID string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.scheduledOrgs[edgeOrgID])
+}
+
+func (s *syncScheduler) IsScheduled(q *QuotaBucket) bool {
+	return s.syncState(q.GetAsyncQuotaBucket())["scheduled"].(bool)
+}
+
+func (s *syncScheduler) Jitter(interval time.Duration) time.Duration {
+	return s.jitter(interval)
+}
+
+func (s *syncScheduler) Shutdown(timeout time.Duration) bool {
+	return s.shutdown(timeout)
+}
+
+// IsSyncScheduled reports if the aSyncQuotaBucket is scheduled for sync with the counter service.
+func IsSyncScheduled(q *QuotaBucket) bool {
+	return quotaSyncScheduler.IsScheduled(q)
+}
+
+// SyncAsyncBucket syncs the aSyncQuotaBucket once, as the scheduler does, and reports if it stays scheduled.
+func SyncAsyncBucket(q *QuotaBucket) bool {
+	return syncAsyncBuckets([]*syncEntry{{qBucket: q}})[0]
+}
+
+func IsCached(edgeOrgID string, id string) bool {
+	quotaCachelock.Lock()
+	defer quotaCachelock.Unlock()
+	_, ok := quotaCache[edgeOrgID+constants.CacheKeyDelimiter+id]
+	return ok
+}
+
+// ExpireCachedBucket looks up the cached quotaBucket as if its ttl was over, which evicts it.
+func ExpireCachedBucket(edgeOrgID string, id string) {
+	cacheKey := edgeOrgID + constants.CacheKeyDelimiter + id
+	quotaCachelock.Lock()
+	qBucketCache, ok := quotaCache[cacheKey]
+	if !ok {
+		quotaCachelock.Unlock()
+		return
+	}
+	qBucketCache.expiryTime = 0
+	quotaCache[cacheKey] = qBucketCache
+	quotaCachelock.Unlock()
+	getFromCache(cacheKey, qBucketCache.qBucket.GetWeight())
+}
+
+// PendingWeight returns the weight of the aSyncQuotaBucket not yet synced with the counter service.
+func PendingWeight(q *QuotaBucket) int64 {
+	return q.GetAsyncQuotaBucket().getPendingWeight()
+}
+
+// BeginIncrement holds off Shutdown as an increment in flight does, until EndIncrement.
+func BeginIncrement() bool {
+	return beginIncrement()
+}
+
+func EndIncrement() {
+	endIncrement()
+}
+
+// AddPendingWeight counts weight in the aSyncQuotaBucket, to be synced with the counter service.
+func AddPendingWeight(q *QuotaBucket, weight int64) {
+	q.GetAsyncQuotaBucket().addToCounter(weight)
+}
+
+// ResetShutdown undoes Shutdown, with a new scheduler for the aSyncQuotaBuckets.
+func ResetShutdown() {
+	quotaSyncScheduler.shutdown(time.Second)
+	quotaSyncScheduler = newSyncScheduler()
+	atomic.StoreInt32(&shuttingDown, 0)
+}
+
+// CrashWAL closes the write-ahead log as a crash would, without compacting it.
+func CrashWAL() {
+	if quotaWAL == nil {
+		return
+	}
+	quotaWAL.lock.Lock()
+	if quotaWAL.file != nil {
+		quotaWAL.file.Close()
+		quotaWAL.file = nil
+	}
+	quotaWAL.lock.Unlock()
+	quotaWAL = nil
+}
+
+// ScheduledWALReplays returns the number of increments of the write-ahead log scheduled to be replayed again.
+func ScheduledWALReplays() int {
+	quotaSyncScheduler.lock.Lock()
+	defer quotaSyncScheduler.lock.Unlock()
+	replays := 0
+	for _, entry := range quotaSyncScheduler.entries {
+		if entry.replay != nil {
+			replays++
+		}
+	}
+	return replays
+}
+
+// ScheduleWALReplays schedules the increments of the write-ahead log not accepted during replay, to be retried every interval.
+func (s *syncScheduler) ScheduleWALReplays(interval time.Duration) {
+	quotaWAL.lock.Lock()
+	records := append([]walRecord{}, quotaWAL.unreplayed...)
+	quotaWAL.lock.Unlock()
+	for _, record := range records {
+		s.scheduleReplay(record, interval)
+	}
+}
+
+// RegisteredLeases returns the number of leases of the org registered to be released on shutdown.
+func RegisteredLeases(edgeOrgID string) int {
+	registered := 0
+	for _, q := range quotaLeases.all() {
+		if q.GetEdgeOrgID() == edgeOrgID {
+			registered++
+		}
+	}
+	return registered
+}
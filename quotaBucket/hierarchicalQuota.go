@@ -0,0 +1,290 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"context"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/tracing"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	reqLevels = "levels"
+	reqLevel  = "level"
+)
+
+// HierarchicalQuota is a chain of quotaBuckets with nested limits, from the outermost level to the innermost,
+// for example org, product, developer and app. a request is admitted only when every level admits it,
+// and then it is counted at every level.
+type HierarchicalQuota struct {
+	edgeOrgID  string
+	requestID  string
+	levelNames []string
+	levels     []*QuotaBucket
+}
+
+type HierarchicalQuotaResults struct {
+	EdgeOrgID     string
+	exceeded      bool
+	exceededLevel string //outermost level that did not admit the request, empty when admitted.
+	levelNames    []string
+	levels        []*QuotaBucketResults
+}
+
+// IsHierarchicalAPIRequest reports if the request names a chain of quotaBuckets instead of one.
+func IsHierarchicalAPIRequest(quotaBucketMap map[string]interface{}) bool {
+	_, ok := quotaBucketMap[reqLevels]
+	return ok
+}
+
+// FromAPIRequest reads the chain of levels of the request. edgeOrgID, weight and requestId are shared by all the levels,
+// each level has its own id, interval, timeUnit, type and maxCount, and an optional name.
+func (h *HierarchicalQuota) FromAPIRequest(quotaBucketMap map[string]interface{}) error {
+	value, ok := quotaBucketMap[reqEdgeOrgID]
+	if !ok {
+		return errors.New(`missing field: 'edgeOrgID' is required`)
+	}
+	if edgeOrgIDType := reflect.TypeOf(value); edgeOrgIDType.Kind() != reflect.String {
+		return errors.New(`invalid type : 'edgeOrgID' should be a string`)
+	}
+	h.edgeOrgID = value.(string)
+
+	value, ok = quotaBucketMap["weight"]
+	if !ok {
+		return errors.New(`missing field: 'weight' is required`)
+	}
+	if weightType := reflect.TypeOf(value); weightType.Kind() != reflect.Float64 {
+		return errors.New(`invalid type : 'weight' should be a number`)
+	}
+	weight := value
+
+	value, ok = quotaBucketMap[reqRequestID]
+	if ok {
+		if requestIDType := reflect.TypeOf(value); requestIDType.Kind() != reflect.String {
+			return errors.New(`invalid type : 'requestId' should be a string`)
+		}
+		h.requestID = value.(string)
+	}
+
+	value = quotaBucketMap[reqLevels]
+	levelMaps, ok := value.([]interface{})
+	if !ok {
+		return errors.New(`invalid type : 'levels' should be a list`)
+	}
+	if len(levelMaps) == 0 {
+		return errors.New(`invalid field : 'levels' cannot be empty`)
+	}
+
+	ids := make(map[string]bool)
+	for i, levelValue := range levelMaps {
+		levelMap, ok := levelValue.(map[string]interface{})
+		if !ok {
+			return errors.New(`invalid type : 'levels' should be a list of objects`)
+		}
+
+		//each level is counted synchronously and without leases, so the levels can be evaluated together.
+		bucketMap := make(map[string]interface{}, len(levelMap)+4)
+		for key, levelField := range levelMap {
+			bucketMap[key] = levelField
+		}
+		bucketMap[reqEdgeOrgID] = h.edgeOrgID
+		bucketMap["weight"] = weight
+		bucketMap["distributed"] = true
+		bucketMap["synchronous"] = true
+		delete(bucketMap, "leased")
+		delete(bucketMap, reqLevel)
+		delete(bucketMap, reqRequestID)
+
+		qBucket := &QuotaBucket{}
+		if err := qBucket.FromAPIRequest(bucketMap); err != nil {
+			return errors.New("error in level " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		if ids[qBucket.GetID()] {
+			return errors.New(`invalid field : 'id' ` + qBucket.GetID() + ` is used by more than one level`)
+		}
+		ids[qBucket.GetID()] = true
+
+		levelName := qBucket.GetID()
+		if nameValue, ok := levelMap[reqLevel]; ok {
+			if levelType := reflect.TypeOf(nameValue); levelType.Kind() != reflect.String {
+				return errors.New(`invalid type : 'level' should be a string`)
+			}
+			levelName = nameValue.(string)
+		}
+		h.levelNames = append(h.levelNames, levelName)
+		h.levels = append(h.levels, qBucket)
+	}
+	return nil
+}
+
+// IncrementQuotaLimit counts the request at every level with one batch increment. when a level goes over its maxCount,
+// the increments of all the levels are taken back, so once done a request is counted at every level or at none.
+// the increment and its rollback are two operations: until the rollback is counted, the weight of a rejected request
+// is seen by the requests counted meanwhile, which may be rejected too though they would fit. no level ever admits
+// more than its maxCount, as every admitted request is within it counting all the requests before it.
+func (h *HierarchicalQuota) IncrementQuotaLimit(ctx context.Context) (results *HierarchicalQuotaResults, err error) {
+	ctx, span := tracing.Start(ctx, "IncrementQuotaLimit", tracing.QuotaAttributes(h.edgeOrgID, strings.Join(h.levelNames, constants.CacheKeyDelimiter))...)
+	defer func() { tracing.End(span, err) }()
+
+	if !beginIncrement() {
+		return nil, errors.New(constants.QuotaShuttingDown)
+	}
+	defer endIncrement()
+
+	//levels outside their current period are not counted, like single quotaBuckets.
+	periods := make([]*quotaPeriod, 0, len(h.levels))
+	counted := make([]int, 0, len(h.levels))
+	entries := make([]services.CounterEntry, 0, len(h.levels))
+	for i, level := range h.levels {
+		period, err := level.GetPeriod()
+		if err != nil {
+			return nil, errors.New("error getting period for level " + h.levelNames[i] + ": " + err.Error())
+		}
+		periods = append(periods, period)
+		if !period.IsCurrentPeriod(level) {
+			continue
+		}
+		counted = append(counted, i)
+		entries = append(entries, services.CounterEntry{
+			OrgID:         level.GetEdgeOrgID(),
+			Key:           level.GetID(),
+			Delta:         level.GetWeight(),
+			StartTime:     period.GetPeriodStartTime().Unix(),
+			EndTime:       period.GetPeriodEndTime().Unix(),
+			SlidingWindow: level.GetType() == constants.QuotaTypeRollingWindow,
+		})
+	}
+
+	results = &HierarchicalQuotaResults{
+		EdgeOrgID:  h.edgeOrgID,
+		levelNames: h.levelNames,
+		levels:     make([]*QuotaBucketResults, 0, len(h.levels)),
+	}
+	counts := make([]int64, len(h.levels))
+	if len(entries) > 0 {
+		//retried requests are sent with the same idempotency key, so the counter service counts them once.
+		idempotencyKey := ""
+		if h.requestID != "" {
+			idempotencyKey = h.getIdempotencyKey()
+			ctx = services.WithIdempotencyKey(ctx, idempotencyKey)
+		}
+		entryCounts, err := services.BatchIncrementAndGetCount(ctx, entries)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range counted {
+			counts[i] = entryCounts[j]
+			if h.levels[i].GetWeight() != 0 && counts[i] > h.levels[i].getAdmissionLimit() && !results.exceeded {
+				results.exceeded = true
+				results.exceededLevel = h.levelNames[i]
+			}
+		}
+
+		if results.exceeded {
+			if rolledBack, err := h.rollback(entries, idempotencyKey); err != nil {
+				//the request is rejected either way, the levels keep its weight until their periods end.
+				globalVariables.Log.Error("error taking back the increments of hierarchical quota: ", h.edgeOrgID,
+					" rejected at level ", results.exceededLevel, " : ", err.Error())
+			} else {
+				for j, i := range counted {
+					counts[i] = rolledBack[j]
+				}
+			}
+		}
+	}
+
+	for i, level := range h.levels {
+		maxCount := level.GetMaxCount()
+		remainingCount := int64(0)
+		exceeded := false
+		if periods[i].IsCurrentPeriod(level) {
+			remainingCount = maxCount - counts[i]
+			exceeded = results.exceeded && counts[i]+level.GetWeight() > level.getAdmissionLimit()
+		}
+		if remainingCount < 0 {
+			remainingCount = 0
+		}
+		levelResults := &QuotaBucketResults{
+			EdgeOrgID:        level.GetEdgeOrgID(),
+			ID:               level.GetID(),
+			MaxCount:         maxCount,
+			exceeded:         exceeded,
+			remainingCount:   remainingCount,
+			startTimestamp:   periods[i].GetPeriodStartTime().Unix(),
+			expiresTimestamp: periods[i].GetPeriodEndTime().Unix(),
+			currentCount:     counts[i],
+		}
+		level.checkLimits(levelResults)
+		if periods[i].IsCurrentPeriod(level) {
+			level.audit(levelResults, h.levelNames[i], !results.exceeded)
+		}
+		results.levels = append(results.levels, levelResults)
+	}
+	return results, nil
+}
+
+// rollback takes back the increments of a rejected request. it does not run on the context of the request,
+// which may be done by now, but on its own timeout, so the levels are not left counting a rejected request.
+func (h *HierarchicalQuota) rollback(entries []services.CounterEntry, idempotencyKey string) ([]int64, error) {
+	rollback := make([]services.CounterEntry, len(entries))
+	for j, entry := range entries {
+		entry.Delta = -entry.Delta
+		rollback[j] = entry
+	}
+
+	timeout := constants.DefaultHierarchicalRollbackTimeout
+	if globalVariables.Config != nil {
+		if configured := globalVariables.Config.GetDuration(constants.ConfigHierarchicalRollbackTimeout); configured > 0 {
+			timeout = configured
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if idempotencyKey != "" {
+		ctx = services.WithIdempotencyKey(ctx, idempotencyKey+constants.CacheKeyDelimiter+"rollback")
+	}
+	return services.BatchIncrementAndGetCount(ctx, rollback)
+}
+
+func (h *HierarchicalQuota) getIdempotencyKey() string {
+	ids := make([]string, 0, len(h.levels))
+	for _, level := range h.levels {
+		ids = append(ids, level.GetID())
+	}
+	return h.edgeOrgID + constants.CacheKeyDelimiter + strings.Join(ids, constants.CacheKeyDelimiter) +
+		constants.CacheKeyDelimiter + h.requestID
+}
+
+func (hResults *HierarchicalQuotaResults) ToAPIResponse() map[string]interface{} {
+	resultsMap := make(map[string]interface{})
+	resultsMap[reqEdgeOrgID] = hResults.EdgeOrgID
+	resultsMap["exceeded"] = hResults.exceeded
+	resultsMap["exceededLevel"] = hResults.exceededLevel
+
+	levels := make([]map[string]interface{}, 0, len(hResults.levels))
+	for i, levelResults := range hResults.levels {
+		levelMap := levelResults.ToAPIResponse()
+		levelMap[reqLevel] = hResults.levelNames[i]
+		levels = append(levels, levelMap)
+	}
+	resultsMap[reqLevels] = levels
+	return resultsMap
+}
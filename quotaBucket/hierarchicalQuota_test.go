@@ -0,0 +1,268 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket_test
+
+import (
+	"context"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	. "github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rollbackCounterBackend cancels the context of the request once its increments are counted,
+// and fails the rollback when failRollback is set.
+type rollbackCounterBackend struct {
+	services.CounterBackend
+	cancel       context.CancelFunc
+	failRollback bool
+	rollbackErr  error
+	rollbackTTL  time.Duration
+}
+
+func (b *rollbackCounterBackend) BatchIncrementAndGetCount(ctx context.Context, entries []services.CounterEntry) ([]int64, error) {
+	if entries[0].Delta > 0 {
+		counts, err := b.CounterBackend.BatchIncrementAndGetCount(ctx, entries)
+		b.cancel()
+		return counts, err
+	}
+	b.rollbackErr = ctx.Err()
+	if deadline, ok := ctx.Deadline(); ok {
+		b.rollbackTTL = time.Until(deadline)
+	}
+	if b.failRollback {
+		return nil, errors.New("counter service unavailable")
+	}
+	return b.CounterBackend.BatchIncrementAndGetCount(ctx, entries)
+}
+
+var _ = Describe("Test HierarchicalQuota", func() {
+	testUtil.UseConfig()
+	redis := useRedisCounterBackend()
+	ctx := context.Background()
+	//quotaBuckets are cached by edgeOrgID and id, so every test uses its own org.
+	var edgeOrgID string
+	orgCount := 0
+
+	level := func(name string, id string, quotaType string, maxCount float64) map[string]interface{} {
+		return map[string]interface{}{
+			"level":                 name,
+			"id":                    id,
+			"interval":              float64(1),
+			"timeUnit":              "hour",
+			"type":                  quotaType,
+			"preciseAtSecondsLevel": false,
+			"startTimestamp":        float64(testStartTime),
+			"maxCount":              maxCount,
+		}
+	}
+
+	request := func(levels ...map[string]interface{}) map[string]interface{} {
+		levelList := make([]interface{}, 0, len(levels))
+		for _, l := range levels {
+			levelList = append(levelList, l)
+		}
+		return map[string]interface{}{
+			"edgeOrgID": edgeOrgID,
+			"weight":    float64(1),
+			"levels":    levelList,
+		}
+	}
+
+	increment := func(quotaMap map[string]interface{}) map[string]interface{} {
+		hQuota := &HierarchicalQuota{}
+		Expect(hQuota.FromAPIRequest(quotaMap)).To(Succeed())
+		results, err := hQuota.IncrementQuotaLimit(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		return results.ToAPIResponse()
+	}
+
+	levelResults := func(resp map[string]interface{}, i int) map[string]interface{} {
+		return resp["levels"].([]map[string]interface{})[i]
+	}
+
+	BeforeEach(func() {
+		orgCount++
+		edgeOrgID = "hierarchicalOrg" + strconv.Itoa(orgCount)
+	})
+
+	It("test invalid hierarchical requests", func() {
+		Expect(IsHierarchicalAPIRequest(request(level("org", "org1", "calendar", 10)))).To(BeTrue())
+		Expect(IsHierarchicalAPIRequest(map[string]interface{}{"edgeOrgID": "sampleOrg"})).To(BeFalse())
+
+		hQuota := &HierarchicalQuota{}
+		err := hQuota.FromAPIRequest(request())
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("cannot be empty"))
+
+		hQuota = &HierarchicalQuota{}
+		err = hQuota.FromAPIRequest(request(level("org", "sameID", "calendar", 10), level("app", "sameID", "calendar", 5)))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("more than one level"))
+
+		hQuota = &HierarchicalQuota{}
+		invalidLevel := level("app", "app1", "calendar", 5)
+		delete(invalidLevel, "maxCount")
+		err = hQuota.FromAPIRequest(request(level("org", "org1", "calendar", 10), invalidLevel))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("error in level 1"))
+
+		quotaMap := request(level("org", "org1", "calendar", 10))
+		quotaMap["levels"] = "org1"
+		hQuota = &HierarchicalQuota{}
+		Expect(hQuota.FromAPIRequest(quotaMap)).NotTo(Succeed())
+	})
+
+	It("test every level is counted, or none", func() {
+		app1 := request(level("org", "org1", "calendar", 5), level("app", "app1", "calendar", 3))
+		for i := 0; i < 3; i++ {
+			resp := increment(app1)
+			Expect(resp["exceeded"]).To(BeFalse())
+			Expect(resp["exceededLevel"]).To(Equal(""))
+		}
+		resp := increment(app1)
+		Expect(resp["exceeded"]).To(BeTrue())
+		Expect(resp["exceededLevel"]).To(Equal("app"))
+		Expect(levelResults(resp, 0)["level"]).To(Equal("org"))
+		Expect(levelResults(resp, 0)["exceeded"]).To(BeFalse())
+		Expect(levelResults(resp, 0)["remainingCount"]).To(Equal(int64(2)))
+		Expect(levelResults(resp, 1)["exceeded"]).To(BeTrue())
+		Expect(levelResults(resp, 1)["remainingCount"]).To(Equal(int64(0)))
+
+		//the org level was not counted for the rejected request, so another app still gets the rest of the org quota.
+		app2 := request(level("org", "org1", "calendar", 5), level("app", "app2", "calendar", 3))
+		for i := 0; i < 2; i++ {
+			Expect(increment(app2)["exceeded"]).To(BeFalse())
+		}
+		resp = increment(app2)
+		Expect(resp["exceeded"]).To(BeTrue())
+		Expect(resp["exceededLevel"]).To(Equal("org"))
+		Expect(levelResults(resp, 1)["exceeded"]).To(BeFalse())
+		Expect(levelResults(resp, 1)["remainingCount"]).To(Equal(int64(1)))
+	})
+
+	It("test the outermost exceeded level is reported", func() {
+		chain := request(level("org", "org1", "calendar", 1), level("product", "product1", "rollingwindow", 1),
+			level("app", "app1", "calendar", 1))
+		Expect(increment(chain)["exceeded"]).To(BeFalse())
+
+		resp := increment(chain)
+		Expect(resp["exceeded"]).To(BeTrue())
+		Expect(resp["exceededLevel"]).To(Equal("org"))
+		for i := 0; i < 3; i++ {
+			Expect(levelResults(resp, i)["exceeded"]).To(BeTrue())
+		}
+	})
+
+	It("test concurrent requests never admit more than a level maxCount, and rejected ones are taken back", func() {
+		apps := []string{"app1", "app2", "app3", "app4"}
+		admitted := make([]int64, len(apps))
+		var wg sync.WaitGroup
+		for a, app := range apps {
+			for worker := 0; worker < 5; worker++ {
+				wg.Add(1)
+				go func(a int, app string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for i := 0; i < 5; i++ {
+						if !increment(request(level("org", "org1", "calendar", 10), level("app", app, "calendar", 100)))["exceeded"].(bool) {
+							atomic.AddInt64(&admitted[a], 1)
+						}
+					}
+				}(a, app)
+			}
+		}
+		wg.Wait()
+
+		//a request of weight 0 reads the counts of the levels without counting.
+		totalAdmitted := int64(0)
+		for a, app := range apps {
+			query := request(level("org", "org1", "calendar", 10), level("app", app, "calendar", 100))
+			query["weight"] = float64(0)
+			resp := increment(query)
+			Expect(levelResults(resp, 1)["remainingCount"]).To(Equal(100 - admitted[a]))
+			totalAdmitted += admitted[a]
+		}
+		Expect(totalAdmitted).To(BeNumerically(">", 0))
+		Expect(totalAdmitted).To(BeNumerically("<=", 10))
+
+		query := request(level("org", "org1", "calendar", 10))
+		query["weight"] = float64(0)
+		Expect(levelResults(increment(query), 0)["remainingCount"]).To(Equal(10 - totalAdmitted))
+	})
+
+	It("test retried requests are counted once", func() {
+		chain := request(level("org", "org1", "calendar", 5), level("app", "app1", "calendar", 1))
+		chain["requestId"] = "request1"
+		for i := 0; i < 3; i++ {
+			resp := increment(chain)
+			Expect(resp["exceeded"]).To(BeFalse())
+			Expect(levelResults(resp, 0)["remainingCount"]).To(Equal(int64(4)))
+		}
+	})
+
+	Context("when the request is rejected", func() {
+		var backend *rollbackCounterBackend
+
+		reject := func(quotaMap map[string]interface{}) map[string]interface{} {
+			requestCtx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			backend.cancel = cancel
+			hQuota := &HierarchicalQuota{}
+			Expect(hQuota.FromAPIRequest(quotaMap)).To(Succeed())
+			results, err := hQuota.IncrementQuotaLimit(requestCtx)
+			Expect(err).NotTo(HaveOccurred())
+			return results.ToAPIResponse()
+		}
+
+		BeforeEach(func() {
+			backend = &rollbackCounterBackend{CounterBackend: redis.backend, cancel: func() {}}
+			services.SetCounterBackend(backend)
+			testUtil.GetConfig().Set(constants.ConfigHierarchicalRollbackTimeout, time.Minute)
+		})
+
+		It("test the rollback does not run on the context of the request", func() {
+			Expect(increment(request(level("org", "org1", "calendar", 5), level("app", "app1", "calendar", 1)))["exceeded"]).To(BeFalse())
+
+			resp := reject(request(level("org", "org1", "calendar", 5), level("app", "app1", "calendar", 1)))
+			Expect(resp["exceeded"]).To(BeTrue())
+			Expect(backend.rollbackErr).NotTo(HaveOccurred())
+			Expect(backend.rollbackTTL).To(BeNumerically(">", 50*time.Second))
+			Expect(levelResults(resp, 0)["remainingCount"]).To(Equal(int64(4)))
+		})
+
+		It("test a failed rollback still rejects the request, and the levels keep its weight", func() {
+			Expect(increment(request(level("org", "org1", "calendar", 5), level("app", "app1", "calendar", 1)))["exceeded"]).To(BeFalse())
+
+			backend.failRollback = true
+			resp := reject(request(level("org", "org1", "calendar", 5), level("app", "app1", "calendar", 1)))
+			Expect(resp["exceeded"]).To(BeTrue())
+			Expect(resp["exceededLevel"]).To(Equal("app"))
+			Expect(levelResults(resp, 0)["remainingCount"]).To(Equal(int64(3)))
+
+			backend.failRollback = false
+			resp = increment(request(level("org", "org1", "calendar", 5), level("app", "app2", "calendar", 5)))
+			Expect(resp["exceeded"]).To(BeFalse())
+			Expect(levelResults(resp, 0)["remainingCount"]).To(Equal(int64(2)))
+		})
+	})
+})
@@ -0,0 +1,103 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"container/list"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"sync"
+	"time"
+)
+
+// idempotencyCache remembers the results of recent increments by requestId, so a retried request
+// returns the original QuotaBucketResults instead of counting the weight again.
+// it holds at most maxSize ids, the least recently used are evicted first.
+type idempotencyCache struct {
+	lock    sync.Mutex
+	maxSize int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type idempotencyEntry struct {
+	key       string
+	expiresAt time.Time     //end of the period the request was counted in.
+	done      chan struct{} //closed once results are set.
+	results   *QuotaBucketResults
+}
+
+var requestIDCache = &idempotencyCache{
+	entries: make(map[string]*list.Element),
+	lru:     list.New(),
+}
+
+func (c *idempotencyCache) getMaxSize() int {
+	if c.maxSize == 0 {
+		c.maxSize = constants.DefaultIdempotencyCacheSize
+		if globalVariables.Config != nil {
+			if maxSize := globalVariables.Config.GetInt(constants.ConfigIdempotencyCacheSize); maxSize > 0 {
+				c.maxSize = maxSize
+			}
+		}
+	}
+	return c.maxSize
+}
+
+// reserve returns the entry for key and true if the key was already seen in the period.
+// otherwise it adds an entry, which the caller must complete with complete or release.
+func (c *idempotencyCache) reserve(key string, expiresAt time.Time) (*idempotencyEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*idempotencyEntry)
+		if entry.expiresAt.After(time.Now()) {
+			c.lru.MoveToFront(element)
+			return entry, true
+		}
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+
+	entry := &idempotencyEntry{
+		key:       key,
+		expiresAt: expiresAt,
+		done:      make(chan struct{}),
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.getMaxSize() {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*idempotencyEntry).key)
+	}
+	return entry, false
+}
+
+func (c *idempotencyCache) complete(entry *idempotencyEntry, results *QuotaBucketResults) {
+	entry.results = results
+	close(entry.done)
+}
+
+// release removes an entry whose increment failed, so a retry of the request is counted.
+func (c *idempotencyCache) release(entry *idempotencyEntry) {
+	c.lock.Lock()
+	if element, ok := c.entries[entry.key]; ok && element.Value.(*idempotencyEntry) == entry {
+		c.lru.Remove(element)
+		delete(c.entries, entry.key)
+	}
+	c.lock.Unlock()
+	close(entry.done)
+}
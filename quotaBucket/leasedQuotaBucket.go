@@ -0,0 +1,222 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"context"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/services"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// leasedQuotaBucket holds a chunk of the quota of a distributed quotaBucket, leased from the counter service.
+// the chunk is counted at the counter service when it is leased, so increments within it are decided locally
+// and all the nodes together never admit more than maxCount. unused weight is given back when the lease is released.
+type leasedQuotaBucket struct {
+	lock         sync.Mutex //held while leasing, so one request at a time talks to the counter service.
+	chunkPercent int64      //size of a chunk, as percentage of the quota left at the counter service.
+	periodStart  int64      //period of the lease.
+	periodEnd    int64
+	remaining    int64 //leased weight not used yet.
+	globalCount  int64 //count at the counter service after the last lease, including the chunks leased by all nodes.
+	exhausted    bool  //the last lease was short, only lease again once some weight was given back.
+}
+
+func newLeasedQuotaBucket(chunkPercent int64) (*leasedQuotaBucket, error) {
+	if chunkPercent <= 0 || chunkPercent > 100 {
+		return nil, errors.New(constants.InvalidLeaseChunkPercent + " : leaseChunkPercent should be between 1 and 100, got " +
+			strconv.FormatInt(chunkPercent, 10))
+	}
+	return &leasedQuotaBucket{chunkPercent: chunkPercent}, nil
+}
+
+// take uses weight from the lease, leasing another chunk when the lease is short.
+// it returns if weight was admitted, and the count left for the period across all the nodes.
+func (l *leasedQuotaBucket) take(ctx context.Context, q *QuotaBucket, period *quotaPeriod, weight int64) (bool, int64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	startTime := period.GetPeriodStartTime().Unix()
+	endTime := period.GetPeriodEndTime().Unix()
+	if l.periodStart != startTime {
+		//the unused weight of a past period no longer limits anyone, it is dropped with its period.
+		l.periodStart = startTime
+		l.periodEnd = endTime
+		l.remaining = 0
+		l.globalCount = 0
+		l.exhausted = false
+	}
+
+	if weight <= l.remaining {
+		l.remaining -= weight
+		return true, l.remainingCount(q), nil
+	}
+
+	//with a soft limit, the overage is leased as well.
+	maxCount := q.getAdmissionLimit()
+	need := weight - l.remaining
+	if l.exhausted {
+		count, err := services.GetCount(ctx, q.GetEdgeOrgID(), q.GetID(), startTime, endTime)
+		if err != nil {
+			return false, l.remainingCount(q), err
+		}
+		l.globalCount = count
+		if count+need > maxCount {
+			return false, l.remainingCount(q), nil
+		}
+	}
+
+	chunk := (maxCount - l.globalCount) * l.chunkPercent / 100
+	if chunk < need {
+		chunk = need
+	}
+	count, err := services.IncrementAndGetCount(ctx, q.GetEdgeOrgID(), q.GetID(), chunk, startTime, endTime)
+	if err != nil {
+		return false, l.remainingCount(q), err
+	}
+
+	//the count includes the chunks leased by the other nodes before this one, only the part within maxCount is granted.
+	granted := chunk
+	if over := count - maxCount; over > 0 {
+		if over > chunk {
+			over = chunk
+		}
+		granted -= over
+		//weight that can not be given back stays counted, it is never admitted.
+		if count, err = services.IncrementAndGetCount(ctx, q.GetEdgeOrgID(), q.GetID(), -over, startTime, endTime); err != nil {
+			l.remaining += granted
+			return false, l.remainingCount(q), err
+		}
+	}
+	l.globalCount = count
+	l.remaining += granted
+	if l.remaining > 0 {
+		quotaLeases.add(q)
+	}
+
+	l.exhausted = l.remaining < weight
+	if l.exhausted {
+		return false, l.remainingCount(q), nil
+	}
+	l.remaining -= weight
+	return true, l.remainingCount(q), nil
+}
+
+// remainingCount is the count left before the admission limit across all the nodes, it must be called with the lock held.
+func (l *leasedQuotaBucket) remainingCount(q *QuotaBucket) int64 {
+	remainingCount := q.getAdmissionLimit() - l.globalCount + l.remaining
+	if remainingCount < 0 {
+		return 0
+	}
+	return remainingCount
+}
+
+// release gives the unused weight of the lease back to the counter service, so the other nodes can lease it.
+func (l *leasedQuotaBucket) release(ctx context.Context, q *QuotaBucket) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.remaining == 0 {
+		return nil
+	}
+	if time.Now().UTC().Unix() >= l.periodEnd {
+		l.remaining = 0
+		return nil
+	}
+	count, err := services.IncrementAndGetCount(ctx, q.GetEdgeOrgID(), q.GetID(), -l.remaining, l.periodStart, l.periodEnd)
+	if err != nil {
+		return err
+	}
+	l.globalCount = count
+	l.remaining = 0
+	l.exhausted = false
+	return nil
+}
+
+func (l *leasedQuotaBucket) getRemaining() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.remaining
+}
+
+// leaseRegistry keeps the leases with unused weight, to release them on shutdown.
+// it is keyed by lease, as every request has its own quotaBucket sharing the lease of the cached one.
+type leaseRegistry struct {
+	lock   sync.Mutex
+	leases map[*leasedQuotaBucket]*QuotaBucket //a quotaBucket of the lease, to release it with.
+}
+
+var quotaLeases = &leaseRegistry{leases: make(map[*leasedQuotaBucket]*QuotaBucket)}
+
+func (r *leaseRegistry) add(q *QuotaBucket) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.leases[q.GetLeasedQuotaBucket()]; !ok {
+		r.leases[q.GetLeasedQuotaBucket()] = q
+	}
+}
+
+func (r *leaseRegistry) remove(q *QuotaBucket) {
+	r.lock.Lock()
+	delete(r.leases, q.GetLeasedQuotaBucket())
+	r.lock.Unlock()
+}
+
+func (r *leaseRegistry) all() []*QuotaBucket {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	qBuckets := make([]*QuotaBucket, 0, len(r.leases))
+	for _, q := range r.leases {
+		qBuckets = append(qBuckets, q)
+	}
+	return qBuckets
+}
+
+// ReleaseLease gives the unused weight leased by a leased quotaBucket back to the counter service.
+func (q *QuotaBucket) ReleaseLease(ctx context.Context) error {
+	lease := q.GetLeasedQuotaBucket()
+	if lease == nil {
+		return nil
+	}
+	if err := lease.release(ctx, q); err != nil {
+		return err
+	}
+	quotaLeases.remove(q)
+	return nil
+}
+
+// releaseEvictedLease releases the lease of a quotaBucket removed from the cache.
+func releaseEvictedLease(q *QuotaBucket) {
+	ctx, cancel := context.WithTimeout(context.Background(), constants.DefaultRequestTimeout)
+	defer cancel()
+	if err := q.ReleaseLease(ctx); err != nil {
+		globalVariables.Log.Error("error releasing lease for quotaBucket: ", q.GetEdgeOrgID()+constants.CacheKeyDelimiter+q.GetID(), " : ", err.Error())
+	}
+}
+
+// releaseLeases releases the leases of all the quotaBuckets holding one, and returns the ones that failed.
+func releaseLeases(ctx context.Context) []*QuotaBucket {
+	failed := make([]*QuotaBucket, 0)
+	for _, q := range quotaLeases.all() {
+		if err := q.ReleaseLease(ctx); err != nil {
+			failed = append(failed, q)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket_test
+
+import (
+	"context"
+	. "github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/services"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sync"
+)
+
+var _ = Describe("Test LeasedQuotaBucket", func() {
+	useRedisCounterBackend()
+	ctx := context.Background()
+
+	//each leased quotaBucket stands for one node.
+	newNode := func(maxCount int64, leaseChunkPercent int64) *QuotaBucket {
+		qBucket, err := NewLeasedQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, maxCount, 1, leaseChunkPercent)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.Validate()).To(Succeed())
+		return qBucket
+	}
+
+	globalCount := func(qBucket *QuotaBucket) int64 {
+		period, err := qBucket.GetPeriod()
+		Expect(err).NotTo(HaveOccurred())
+		count, err := services.GetCount(ctx, "sampleOrg", "sampleID", period.GetPeriodStartTime().Unix(), period.GetPeriodEndTime().Unix())
+		Expect(err).NotTo(HaveOccurred())
+		return count
+	}
+
+	It("test invalid leased quotaBucket", func() {
+		_, err := NewLeasedQuotaBucket("sampleOrg", "sampleID", 1, "hour", "rollingwindow", false,
+			testStartTime, 100, 1, 10)
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewLeasedQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, 100, 1, 0)
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewLeasedQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, 100, 1, 101)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("test chunks are leased and given back", func() {
+		node1 := newNode(100, 10)
+		Expect(node1.IsDistrubuted()).To(BeTrue())
+		Expect(node1.IsSynchronous()).To(BeFalse())
+		Expect(node1.IsLeased()).To(BeTrue())
+		Expect(node1.GetAsyncQuotaBucket()).To(BeNil())
+
+		//the first increment leases 10% of the quota, the next ones are decided locally.
+		Expect(isAdmitted(node1)).To(BeTrue())
+		Expect(globalCount(node1)).To(Equal(int64(10)))
+		for i := 0; i < 4; i++ {
+			Expect(isAdmitted(node1)).To(BeTrue())
+		}
+		Expect(globalCount(node1)).To(Equal(int64(10)))
+
+		//another node sizes its first chunk on maxCount, its next chunk on what is left.
+		node2 := newNode(100, 10)
+		Expect(isAdmitted(node2)).To(BeTrue())
+		Expect(globalCount(node2)).To(Equal(int64(20)))
+		for i := 0; i < 10; i++ {
+			Expect(isAdmitted(node2)).To(BeTrue())
+		}
+		Expect(globalCount(node2)).To(Equal(int64(28)))
+
+		//unused weight is given back.
+		Expect(node1.ReleaseLease(ctx)).To(Succeed())
+		Expect(globalCount(node1)).To(Equal(int64(23)))
+		Expect(node2.ReleaseLease(ctx)).To(Succeed())
+		Expect(globalCount(node2)).To(Equal(int64(16)))
+	})
+
+	It("test lease shared by the requests is registered once", func() {
+		request := quotaRequest("leaseRegistryOrg", "app", map[string]interface{}{
+			"leased":            true,
+			"leaseChunkPercent": float64(1),
+		})
+
+		//every request is a quotaBucket of its own, and leases a chunk of 1.
+		for i := 0; i < 5; i++ {
+			Expect(isAdmitted(fromAPIRequest(request))).To(BeTrue())
+		}
+		Expect(RegisteredLeases("leaseRegistryOrg")).To(Equal(1))
+
+		//which is released through any of them.
+		Expect(isAdmitted(fromAPIRequest(request))).To(BeTrue())
+		Expect(fromAPIRequest(request).ReleaseLease(ctx)).To(Succeed())
+		Expect(RegisteredLeases("leaseRegistryOrg")).To(BeZero())
+	})
+
+	It("test nodes never admit more than maxCount", func() {
+		nodes := []*QuotaBucket{newNode(100, 10), newNode(100, 10), newNode(100, 10)}
+
+		//one at a time, all the quota is admitted and not more.
+		admitted := 0
+		for i := 0; i < 60; i++ {
+			for _, node := range nodes {
+				if isAdmitted(node) {
+					admitted++
+				}
+			}
+		}
+		Expect(admitted).To(Equal(100))
+		Expect(globalCount(nodes[0])).To(Equal(int64(100)))
+	})
+
+	It("test concurrent nodes never admit more than maxCount", func() {
+		nodes := []*QuotaBucket{newNode(100, 25), newNode(100, 25), newNode(100, 25), newNode(100, 25)}
+
+		var admitted int64
+		var lock sync.Mutex
+		var wg sync.WaitGroup
+		for _, node := range nodes {
+			for worker := 0; worker < 5; worker++ {
+				wg.Add(1)
+				go func(node *QuotaBucket) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for i := 0; i < 20; i++ {
+						if isAdmitted(node) {
+							lock.Lock()
+							admitted++
+							lock.Unlock()
+						}
+					}
+				}(node)
+			}
+		}
+		wg.Wait()
+		Expect(admitted).To(BeNumerically("<=", 100))
+
+		//once the leases are given back, the global count is what was admitted.
+		for _, node := range nodes {
+			Expect(node.ReleaseLease(ctx)).To(Succeed())
+		}
+		Expect(globalCount(nodes[0])).To(Equal(admitted))
+	})
+})
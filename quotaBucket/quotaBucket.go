@@ -15,11 +15,14 @@
 package quotaBucket
 
 import (
+	"context"
 	"errors"
 	"github.com/apid/apidQuota/constants"
-	"github.com/apid/apidQuota/globalVariables"
 	"github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/tracing"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -76,7 +79,15 @@ type aSyncQuotaBucket struct {
 	asyncCounter           *[]int64
 	asyncGLobalCount       int64
 	initialized            bool
-	qTicker                *time.Ticker
+	idleSyncCount          int64         //number of syncs in a row without local traffic. guarded by counterLock.
+	adaptiveSyncPercent    int64         //when > 0, also sync once the weight not synced reaches this percentage of the headroom.
+	localShare             float64       //share of the weight counted at the last sync that came from this node, 0 until known.
+	maxStaleness           time.Duration //when > 0, the global count is refreshed before deciding once it is older than this.
+	lastSyncedAt           int64         //unix nanoseconds of the last refresh of the global count.
+	lastSyncError          string        //error of the last sync with the counter service, cleared once a sync succeeds.
+	lastSyncErrorAt        int64         //unix nanoseconds of the last failed sync.
+	evicted                bool          //set once removed from the cache, no weight is counted in it after that.
+	counterLock            sync.Mutex    //guards asyncCounter, asyncGLobalCount and evicted between the request path and the sync workers.
 }
 
 func (qAsync *aSyncQuotaBucket) getAsyncSyncTime() (int64, error) {
@@ -98,7 +109,7 @@ func (qAsync *aSyncQuotaBucket) getAsyncSyncMessageCount() (int64, error) {
 func (qAsync *aSyncQuotaBucket) getAsyncLocalMessageCount() (int64, error) {
 
 	if qAsync != nil {
-		return qAsync.asyncLocalMessageCount, nil
+		return atomic.LoadInt64(&qAsync.asyncLocalMessageCount), nil
 	}
 	return 0, errors.New(constants.AsyncQuotaBucketEmpty)
 }
@@ -114,6 +125,8 @@ func (qAsync *aSyncQuotaBucket) addToAsyncLocalMessageCount(count int64) error {
 func (qAsync *aSyncQuotaBucket) getAsyncGlobalCount() (int64, error) {
 
 	if qAsync != nil {
+		qAsync.counterLock.Lock()
+		defer qAsync.counterLock.Unlock()
 		return qAsync.asyncGLobalCount, nil
 	}
 	return 0, errors.New(constants.AsyncQuotaBucketEmpty)
@@ -127,14 +140,6 @@ func (qAsync *aSyncQuotaBucket) getAsyncIsInitialized() (bool, error) {
 	return false, errors.New(constants.AsyncQuotaBucketEmpty)
 }
 
-func (qAsync *aSyncQuotaBucket) getAsyncQTicker() (*time.Ticker, error) {
-
-	if qAsync != nil {
-		return qAsync.qTicker, nil
-	}
-	return nil, errors.New(constants.AsyncQuotaBucketEmpty)
-}
-
 func (qAsync *aSyncQuotaBucket) getAsyncCounter() (*[]int64, error) {
 
 	if qAsync != nil {
@@ -149,24 +154,178 @@ func (aSyncbucket *aSyncQuotaBucket) addToCounter(weight int64) error {
 		return errors.New(constants.AsyncQuotaBucketEmpty)
 	}
 
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	if aSyncbucket.evicted {
+		return errors.New(constants.AsyncQuotaBucketEvicted + " : weight cannot be counted in an evicted aSyncQuotaBucket.")
+	}
 	*aSyncbucket.asyncCounter = append(*aSyncbucket.asyncCounter, weight)
 	return nil
 }
 
-func (aSyncbucket *aSyncQuotaBucket) getCount(q *QuotaBucket, period *quotaPeriod) (int64, error) {
+//evict marks the aSyncQuotaBucket removed from the cache, and reports if it has weight to flush.
+func (aSyncbucket *aSyncQuotaBucket) evict() bool {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	aSyncbucket.evicted = true
+	return len(*aSyncbucket.asyncCounter) > 0
+}
+
+//evictIfIdle evicts the aSyncQuotaBucket only when it had no local traffic for more than MaxIdleSyncCount syncs
+//and has no weight to flush, and reports if it did.
+func (aSyncbucket *aSyncQuotaBucket) evictIfIdle() bool {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	if aSyncbucket.idleSyncCount <= constants.MaxIdleSyncCount || len(*aSyncbucket.asyncCounter) > 0 {
+		return false
+	}
+	aSyncbucket.evicted = true
+	return true
+}
+
+//countIdleSync counts a sync without weight to sync.
+func (aSyncbucket *aSyncQuotaBucket) countIdleSync() {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	if len(*aSyncbucket.asyncCounter) == 0 {
+		aSyncbucket.idleSyncCount++
+	}
+}
+
+//resetIdleSyncCount records local traffic, admitted or not.
+func (aSyncbucket *aSyncQuotaBucket) resetIdleSyncCount() {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	aSyncbucket.idleSyncCount = 0
+}
+
+func (aSyncbucket *aSyncQuotaBucket) isEvicted() bool {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	return aSyncbucket.evicted
+}
+
+func (aSyncbucket *aSyncQuotaBucket) getPendingCount() int {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	return len(*aSyncbucket.asyncCounter)
+}
+
+//getPendingWeight returns the sum of the weights not yet synced with the counter service.
+func (aSyncbucket *aSyncQuotaBucket) getPendingWeight() int64 {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+
+	weight := int64(0)
+	for _, counterEle := range *aSyncbucket.asyncCounter {
+		weight += counterEle
+	}
+	return weight
+}
+
+//takePendingWeight empties asyncCounter and returns the sum of the weights not yet synced with the counter service.
+func (aSyncbucket *aSyncQuotaBucket) takePendingWeight() int64 {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+
+	weight := int64(0)
+	for _, counterEle := range *aSyncbucket.asyncCounter {
+		weight += counterEle
+	}
+	counter := make([]int64, 0)
+	aSyncbucket.asyncCounter = &counter
+	return weight
+}
+
+//restorePendingWeight puts back a weight taken with takePendingWeight when the sync with the counter service failed.
+func (aSyncbucket *aSyncQuotaBucket) restorePendingWeight(weight int64) {
+	if weight == 0 {
+		return
+	}
+	aSyncbucket.counterLock.Lock()
+	counter := append([]int64{weight}, *aSyncbucket.asyncCounter...)
+	aSyncbucket.asyncCounter = &counter
+	aSyncbucket.counterLock.Unlock()
+}
+
+//setSyncedCount updates the global count after syncedWeight was sent to the counter service.
+func (aSyncbucket *aSyncQuotaBucket) setSyncedCount(globalCount int64, syncedWeight int64) {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	//the weight counted by the other nodes since the last sync tells how much of the traffic goes through this node.
+	if otherWeight := globalCount - aSyncbucket.asyncGLobalCount - syncedWeight; syncedWeight > 0 && otherWeight >= 0 {
+		aSyncbucket.localShare = float64(syncedWeight) / float64(syncedWeight+otherWeight)
+	}
+	aSyncbucket.asyncGLobalCount = globalCount
+	aSyncbucket.lastSyncError = ""
+	atomic.AddInt64(&aSyncbucket.asyncLocalMessageCount, -syncedWeight)
+	atomic.StoreInt64(&aSyncbucket.lastSyncedAt, time.Now().UnixNano())
+}
+
+//setSyncError records a failed sync with the counter service.
+func (aSyncbucket *aSyncQuotaBucket) setSyncError(err error) {
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	aSyncbucket.lastSyncError = err.Error()
+	aSyncbucket.lastSyncErrorAt = time.Now().UnixNano()
+}
+
+//isStale reports if the global count is older than maxStaleness.
+func (aSyncbucket *aSyncQuotaBucket) isStale() bool {
+	if aSyncbucket.maxStaleness <= 0 || !aSyncbucket.initialized {
+		return false
+	}
+	lastSyncedAt := time.Unix(0, atomic.LoadInt64(&aSyncbucket.lastSyncedAt))
+	return time.Since(lastSyncedAt) > aSyncbucket.maxStaleness
+}
+
+//syncLag is the age of the global count.
+func (aSyncbucket *aSyncQuotaBucket) syncLag() time.Duration {
+	lastSyncedAt := atomic.LoadInt64(&aSyncbucket.lastSyncedAt)
+	if lastSyncedAt == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, lastSyncedAt))
+}
+
+//needsAdaptiveSync reports if the weight not synced is large compared to the headroom left before maxCount,
+//so an adaptive aSyncQuotaBucket syncs rarely far below maxCount and on every request close to it.
+func (aSyncbucket *aSyncQuotaBucket) needsAdaptiveSync(maxCount int64) bool {
+	if aSyncbucket.adaptiveSyncPercent <= 0 {
+		return false
+	}
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	localCount := atomic.LoadInt64(&aSyncbucket.asyncLocalMessageCount)
+	headroom := maxCount - aSyncbucket.asyncGLobalCount - localCount
+	//the headroom is shared with the other nodes, each may use its share of it before syncing.
+	localShare := aSyncbucket.localShare
+	if localShare == 0 {
+		localShare = 1
+	}
+	return float64(localCount*100) >= float64(headroom*aSyncbucket.adaptiveSyncPercent)*localShare
+}
+
+func (aSyncbucket *aSyncQuotaBucket) getCount(ctx context.Context, q *QuotaBucket, period *quotaPeriod) (int64, error) {
 
 	var gcount int64
 	var err error
 	if !aSyncbucket.initialized {
-		gcount, err = services.IncrementAndGetCount(q.GetEdgeOrgID(), q.GetID(), 0, period.startTime.Unix(), period.endTime.Unix())
+		gcount, err = services.IncrementAndGetCount(ctx, q.GetEdgeOrgID(), q.GetID(), 0, period.startTime.Unix(), period.endTime.Unix())
 		if err != nil {
 			return 0, err
 		}
+		aSyncbucket.counterLock.Lock()
 		aSyncbucket.asyncGLobalCount = gcount
+		aSyncbucket.counterLock.Unlock()
 		aSyncbucket.initialized = true
+		atomic.StoreInt64(&aSyncbucket.lastSyncedAt, time.Now().UnixNano())
 	}
 
-	return aSyncbucket.asyncGLobalCount + aSyncbucket.asyncLocalMessageCount, nil
+	//the global count and the local count are updated together by the sync workers.
+	aSyncbucket.counterLock.Lock()
+	defer aSyncbucket.counterLock.Unlock()
+	return aSyncbucket.asyncGLobalCount + atomic.LoadInt64(&aSyncbucket.asyncLocalMessageCount), nil
 }
 
 type quotaBucketData struct {
@@ -182,10 +341,16 @@ type quotaBucketData struct {
 	Distributed           bool
 	Synchronous           bool
 	AsyncQuotaDetails     *aSyncQuotaBucket
+	DegradationMode       string              //how to decide while the counter service is unavailable {FAILOPEN, FAILCLOSED, LOCALESTIMATE}
+	LocalEstimate         *localQuotaEstimate //for synchronous quotaBucket, to count locally while the counter service is unavailable. shared by the quotaBuckets of a cacheKey.
+	LeaseQuotaDetails     *leasedQuotaBucket  //for leased quotaBucket, the chunk of the quota leased from the counter service.
+	SoftLimit             int64               //overage admitted over maxCount, as percentage of maxCount.
+	Thresholds            *quotaThresholds    //percentages of maxCount reported once per period when reached.
 }
 
 type QuotaBucket struct {
 	quotaBucketData
+	requestID string //optional id sent by the client to deduplicate retried requests.
 }
 
 func NewQuotaBucket(edgeOrgID string, id string, interval int,
@@ -218,19 +383,19 @@ func NewQuotaBucket(edgeOrgID string, id string, interval int,
 			return nil, errors.New("quota bucket cannot be both nonDistributed and synchronous.")
 		}
 	}
-	//for async set AsyncQuotaDetails and start the NewTicker
+	if distributed && synchronous {
+		quotaBucket.quotaBucketData.LocalEstimate = getLocalEstimate(edgeOrgID + constants.CacheKeyDelimiter + id)
+	}
+	//for async set AsyncQuotaDetails and schedule the periodic sync with the counter service
 	if distributed && !synchronous {
-		var quotaTicker int64
-		//ensure just one of syncTimeInSec and syncMessageCount is set.
-		if syncTimeInSec > -1 && syncMessageCount > -1 {
-			return nil,errors.New("both syncTimeInSec and syncMessageCount canot be set. only one of them should be set.")
-		}
+		var syncInterval int64
+		//syncTimeInSec and syncMessageCount can both be set, the bucket is synced on whichever fires first.
 		//set default syncTime for AsyncQuotaBucket.
-		//for aSyncQuotaBucket with 'syncMessageCount' the ticker is invoked with DefaultQuotaSyncTime
-		quotaTicker = constants.DefaultQuotaSyncTime
+		//for aSyncQuotaBucket with only 'syncMessageCount' the sync is scheduled with DefaultQuotaSyncTime
+		syncInterval = constants.DefaultQuotaSyncTime
 
 		if syncTimeInSec > 0 { //if sync with counter service periodically
-			quotaTicker = syncTimeInSec
+			syncInterval = syncTimeInSec
 		}
 
 		counter := make([]int64, 0)
@@ -241,51 +406,49 @@ func NewQuotaBucket(edgeOrgID string, id string, interval int,
 			asyncGLobalCount:       constants.DefaultCount,
 			asyncLocalMessageCount: constants.DefaultCount,
 			initialized:            false,
-			qTicker:                time.NewTicker(time.Duration(time.Second.Nanoseconds() * quotaTicker)),
 		}
 
 		quotaBucket.setAsyncQuotaBucket(newAsyncQuotaDetails)
-		go func() {
-			aSyncBucket := quotaBucket.GetAsyncQuotaBucket()
-			if aSyncBucket != nil {
-				exitCount := int64(0)
-				qticker, _ := aSyncBucket.getAsyncQTicker()
-				for t := range qticker.C {
-					globalVariables.Log.Debug("t: ", t.String())
-					if len(*aSyncBucket.asyncCounter) == 0 {
-						exitCount += 1
-					}
-					period, err := quotaBucket.GetPeriod()
-					if err != nil {
-						globalVariables.Log.Error("error getting period for: ", err.Error(), "for quotaBucket: ", quotaBucket)
-						qticker.Stop()
-						continue
-					}
-					//sync with counterService.
-					err = internalRefresh(quotaBucket, period)
-					if err != nil {
-						globalVariables.Log.Error("error during internalRefresh: ", err.Error(), "for quotaBucket: ", quotaBucket)
-						qticker.Stop()
-						continue
-					}
-
-					if exitCount > 3 {
-						removeFromCache( quotaBucket.GetEdgeOrgID()+
-								constants.CacheKeyDelimiter + quotaBucket.GetID(),
-						quotaCache[quotaBucket.GetEdgeOrgID()+constants.CacheKeyDelimiter + quotaBucket.GetID()])
-						qticker.Stop()
-					}
-				}
-			} else {
-				globalVariables.Log.Error("aSyncBucketDetails are empty for the given quotaBucket: ", quotaBucket)
-			}
-		}()
+		quotaSyncScheduler.schedule(quotaBucket, time.Duration(syncInterval)*time.Second)
 	}
 
 	return quotaBucket, nil
 
 }
 
+//NewLeasedQuotaBucket returns a distributed quotaBucket which leases chunks of leaseChunkPercent of the quota left
+//at the counter service, and decides locally within them.
+func NewLeasedQuotaBucket(edgeOrgID string, id string, interval int,
+	timeUnit string, quotaType string, preciseAtSecondsLevel bool,
+	startTime int64, maxCount int64, weight int64, leaseChunkPercent int64) (*QuotaBucket, error) {
+
+	if strings.ToLower(quotaType) == constants.QuotaTypeRollingWindow {
+		return nil, errors.New(constants.LeaseNotSupported + " : quota type " + quotaType + " cannot be leased.")
+	}
+	lease, err := newLeasedQuotaBucket(leaseChunkPercent)
+	if err != nil {
+		return nil, err
+	}
+
+	quotaBucket := &QuotaBucket{
+		quotaBucketData: quotaBucketData{
+			EdgeOrgID:             edgeOrgID,
+			ID:                    id,
+			Interval:              interval,
+			TimeUnit:              timeUnit,
+			QuotaType:             quotaType,
+			PreciseAtSecondsLevel: preciseAtSecondsLevel,
+			StartTime:             time.Unix(startTime, 0),
+			MaxCount:              maxCount,
+			Weight:                weight,
+			Distributed:           true,
+			Synchronous:           false,
+			LeaseQuotaDetails:     lease,
+		},
+	}
+	return quotaBucket, nil
+}
+
 func (q *QuotaBucket) Validate() error {
 
 	//check valid quotaTimeUnit
@@ -297,6 +460,10 @@ func (q *QuotaBucket) Validate() error {
 		return errors.New(constants.InvalidQuotaType)
 	}
 
+	if q.GetDegradationMode() != "" && !IsValidDegradationMode(q.GetDegradationMode()) {
+		return errors.New(constants.InvalidDegradationMode)
+	}
+
 	//check if the period is valid
 	period, err := q.GetPeriod()
 	if err != nil {
@@ -355,6 +522,55 @@ func (q *QuotaBucket) IsSynchronous() bool {
 	return q.quotaBucketData.Synchronous
 }
 
+func (q *QuotaBucket) IsLeased() bool {
+	return q.quotaBucketData.LeaseQuotaDetails != nil
+}
+
+func (q *QuotaBucket) GetLeasedQuotaBucket() *leasedQuotaBucket {
+	return q.quotaBucketData.LeaseQuotaDetails
+}
+
+//SetAdaptiveSync makes an aSyncQuotaBucket also sync once the weight not synced reaches headroomPercent of the headroom left before maxCount.
+func (q *QuotaBucket) SetAdaptiveSync(headroomPercent int64) error {
+	aSyncBucket := q.GetAsyncQuotaBucket()
+	if aSyncBucket == nil {
+		return errors.New(constants.AsyncQuotaBucketEmpty + " : adaptive sync is only for aSyncQuotaBucket.")
+	}
+	if headroomPercent <= 0 || headroomPercent > 100 {
+		return errors.New(constants.InvalidAdaptiveSync + " : headroom percent should be between 1 and 100, got " +
+			strconv.FormatInt(headroomPercent, 10))
+	}
+	aSyncBucket.adaptiveSyncPercent = headroomPercent
+	return nil
+}
+
+//SetMaxStaleness makes an aSyncQuotaBucket refresh its global count at least every maxStaleness,
+//with or without local traffic, and before deciding when the last refresh is older than that.
+func (q *QuotaBucket) SetMaxStaleness(maxStaleness time.Duration) error {
+	aSyncBucket := q.GetAsyncQuotaBucket()
+	if aSyncBucket == nil {
+		return errors.New(constants.AsyncQuotaBucketEmpty + " : max staleness is only for aSyncQuotaBucket.")
+	}
+	if maxStaleness <= 0 {
+		return errors.New(constants.InvalidMaxStaleness + " : max staleness should be positive, got " + maxStaleness.String())
+	}
+	aSyncBucket.maxStaleness = maxStaleness
+	quotaSyncScheduler.shortenInterval(aSyncBucket, maxStaleness)
+	return nil
+}
+
+func (q *QuotaBucket) GetDegradationMode() string {
+	return q.quotaBucketData.DegradationMode
+}
+
+func (q *QuotaBucket) setDegradationMode(mode string) {
+	q.quotaBucketData.DegradationMode = strings.ToLower(strings.TrimSpace(mode))
+}
+
+func (q *QuotaBucket) getLocalEstimate() *localQuotaEstimate {
+	return q.quotaBucketData.LocalEstimate
+}
+
 //setCurrentPeriod only for rolling window else just return the value of QuotaPeriod.
 func (q *QuotaBucket) GetPeriod() (*quotaPeriod, error) {
 
@@ -390,15 +606,74 @@ func (q *QuotaBucket) GetAsyncQuotaBucket() *aSyncQuotaBucket {
 	return q.quotaBucketData.AsyncQuotaDetails
 }
 
-func (q *QuotaBucket) IncrementQuotaLimit() (*QuotaBucketResults, error) {
+func (q *QuotaBucket) GetRequestID() string {
+	return q.requestID
+}
+
+//getIdempotencyKey identifies the request across retries, for the local dedup and for the counter service.
+func (q *QuotaBucket) getIdempotencyKey() string {
+	return q.GetEdgeOrgID() + constants.CacheKeyDelimiter + q.GetID() + constants.CacheKeyDelimiter + q.GetRequestID()
+}
+
+func (q *QuotaBucket) IncrementQuotaLimit(ctx context.Context) (results *QuotaBucketResults, err error) {
+	ctx, span := tracing.Start(ctx, "IncrementQuotaLimit", tracing.QuotaAttributes(q.GetEdgeOrgID(), q.GetID())...)
+	defer func() { tracing.End(span, err) }()
+
+	if !beginIncrement() {
+		return nil, errors.New(constants.QuotaShuttingDown)
+	}
+	defer endIncrement()
 
 	qBucketHandler, err := GetQuotaBucketHandler(q)
 	if err != nil {
 		return nil, errors.New("error getting quotaBucketHandler: " + err.Error())
 	}
 
-	return qBucketHandler.incrementQuotaCount(q)
+	if q.GetRequestID() == "" {
+		results, err := qBucketHandler.incrementQuotaCount(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		q.checkLimits(results)
+		q.audit(results, "", !results.exceeded)
+		return results, nil
+	}
+
+	//requestIds are deduplicated within the period they were counted in.
+	period, err := q.GetPeriod()
+	if err != nil {
+		return nil, errors.New("error getting period: " + err.Error())
+	}
+	expiresAt := period.GetPeriodEndTime()
+	if q.GetType() == constants.QuotaTypeRollingWindow {
+		expiresAt = expiresAt.Add(period.GetPeriodEndTime().Sub(period.GetPeriodStartTime()))
+	}
 
+	for {
+		entry, seen := requestIDCache.reserve(q.getIdempotencyKey(), expiresAt)
+		if !seen {
+			results, err := qBucketHandler.incrementQuotaCount(ctx, q)
+			if err != nil {
+				requestIDCache.release(entry)
+				return nil, err
+			}
+			q.checkLimits(results)
+			q.audit(results, "", !results.exceeded)
+			requestIDCache.complete(entry, results)
+			return results, nil
+		}
+
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if entry.results != nil {
+			results := *entry.results
+			return &results, nil
+		}
+		//the original request failed and was released, count this one.
+	}
 }
 
 func IsValidTimeUnit(timeUnit string) bool {
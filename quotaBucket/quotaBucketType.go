@@ -15,14 +15,18 @@
 package quotaBucket
 
 import (
+	"context"
 	"errors"
-	"github.com/apid/apidQuota/services"
 	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/metrics"
+	"github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/tracing"
 )
 
 type QuotaBucketType interface {
 	resetCount(bucket *QuotaBucket) error
-	incrementQuotaCount(qBucket *QuotaBucket) (*QuotaBucketResults, error)
+	incrementQuotaCount(ctx context.Context, qBucket *QuotaBucket) (*QuotaBucketResults, error)
 }
 
 type SynchronousQuotaBucketType struct{}
@@ -32,30 +36,60 @@ func (sQuotaBucket SynchronousQuotaBucketType) resetCount(qBucket *QuotaBucket)
 	return nil
 }
 
-func (sQuotaBucket SynchronousQuotaBucketType) incrementQuotaCount(q *QuotaBucket) (*QuotaBucketResults, error) {
+func (sQuotaBucket SynchronousQuotaBucketType) incrementQuotaCount(ctx context.Context, q *QuotaBucket) (*QuotaBucketResults, error) {
 	period, err := q.GetPeriod()
 	if err != nil {
 		return nil, errors.New("error getting period: " + err.Error())
 	}
 	maxCount := q.GetMaxCount()
+	//requests are admitted up to the soft limit, remainingCount is still counted down to maxCount.
+	limit := q.getAdmissionLimit()
 	exceeded := false
 	remainingCount := int64(0)
 
 	weight := q.GetWeight()
 
+	if q.GetType() == constants.QuotaTypeRollingWindow {
+		ctx = services.WithSlidingWindow(ctx)
+	}
+	//retried requests are sent with the same idempotency key, so the counter service counts them once.
+	//only the increment of the request carries it, the weight reconciled below is an increment of its own.
+	incrementCtx := ctx
+	if q.GetRequestID() != "" {
+		incrementCtx = services.WithIdempotencyKey(ctx, q.getIdempotencyKey())
+	}
+
+	//send the weight admitted while the counter service was unavailable.
+	estimate := q.getLocalEstimate()
+	if estimate != nil {
+		if err := estimate.reconcile(ctx, q); err != nil {
+			if services.IsUnavailable(err) && q.GetDegradationMode() != "" {
+				return q.incrementDegraded(period)
+			}
+			return nil, err
+		}
+	}
+
 	//first retrieve the count from counter service.
-	currentCount, err := services.GetCount(q.GetEdgeOrgID(), q.GetID(), period.GetPeriodStartTime().Unix(), period.GetPeriodEndTime().Unix())
+	currentCount, err := services.GetCount(ctx, q.GetEdgeOrgID(), q.GetID(), period.GetPeriodStartTime().Unix(), period.GetPeriodEndTime().Unix())
 	if err != nil {
+		if services.IsUnavailable(err) && q.GetDegradationMode() != "" {
+			return q.incrementDegraded(period)
+		}
 		return nil, err
 	}
 
+	countedCount := int64(0)
 	if period.IsCurrentPeriod(q) {
-		if currentCount < maxCount {
-			allowed := maxCount - currentCount
+		if currentCount < limit {
+			allowed := limit - currentCount
 			if allowed >= weight {
 				if weight != 0 {
-					currentCount, err = services.IncrementAndGetCount(q.GetEdgeOrgID(), q.GetID(), weight, period.GetPeriodStartTime().Unix(), period.GetPeriodEndTime().Unix())
+					currentCount, err = services.IncrementAndGetCount(incrementCtx, q.GetEdgeOrgID(), q.GetID(), weight, period.GetPeriodStartTime().Unix(), period.GetPeriodEndTime().Unix())
 					if err != nil {
+						if services.IsUnavailable(err) && q.GetDegradationMode() != "" {
+							return q.incrementDegraded(period)
+						}
 						return nil, err
 					}
 				}
@@ -71,6 +105,11 @@ func (sQuotaBucket SynchronousQuotaBucketType) incrementQuotaCount(q *QuotaBucke
 			exceeded = true
 			remainingCount = maxCount - currentCount
 		}
+		countedCount = currentCount
+	}
+
+	if estimate != nil {
+		estimate.recordCount(period, currentCount)
 	}
 
 	if remainingCount < 0 {
@@ -85,6 +124,7 @@ func (sQuotaBucket SynchronousQuotaBucketType) incrementQuotaCount(q *QuotaBucke
 		MaxCount:         maxCount,
 		startTimestamp:   period.GetPeriodStartTime().Unix(),
 		expiresTimestamp: period.GetPeriodEndTime().Unix(),
+		currentCount:     countedCount,
 	}
 
 	return results, nil
@@ -98,7 +138,7 @@ func (quotaBucketType AsynchronousQuotaBucketType) resetCount(q *QuotaBucket) er
 	return nil
 }
 
-func (quotaBucketType AsynchronousQuotaBucketType) incrementQuotaCount(q *QuotaBucket) (*QuotaBucketResults, error) {
+func (quotaBucketType AsynchronousQuotaBucketType) incrementQuotaCount(ctx context.Context, q *QuotaBucket) (*QuotaBucketResults, error) {
 	period, err := q.GetPeriod()
 	if err != nil {
 		return nil, errors.New("error getting period: " + err.Error())
@@ -107,28 +147,55 @@ func (quotaBucketType AsynchronousQuotaBucketType) incrementQuotaCount(q *QuotaB
 	if aSyncBucket == nil {
 		return nil, errors.New(constants.AsyncQuotaBucketEmpty + " : aSyncQuotaBucket to increment cannot be empty.")
 	}
-	currentCount, err := aSyncBucket.getCount(q, period)
+	aSyncBucket.resetIdleSyncCount()
+	//a global count older than maxStaleness is refreshed before deciding, even if the periodic sync is behind.
+	//if the refresh fails, the request is decided on the cached count, as it would be without maxStaleness.
+	if aSyncBucket.isStale() {
+		if err := internalRefresh(ctx, q, period); err != nil {
+			globalVariables.Log.Warn("deciding on the stale global count of quotaBucket: ", q.GetEdgeOrgID()+constants.CacheKeyDelimiter+q.GetID(),
+				", refresh failed: ", err.Error())
+			metrics.RecordStaleRefreshFailure()
+		}
+	}
+	currentCount, err := aSyncBucket.getCount(ctx, q, period)
 	if err != nil {
 		return nil, err
 	}
 
 	maxCount := q.GetMaxCount()
+	//requests are admitted up to the soft limit, remainingCount is still counted down to maxCount.
+	limit := q.getAdmissionLimit()
 	exceeded := false
 	remainingCount := int64(0)
 	weight := q.GetWeight()
+	countedCount := int64(0)
 
 	if period.IsCurrentPeriod(q) {
+		countedCount = currentCount
 
-		if currentCount < maxCount {
-			diffCount := (currentCount + weight) - maxCount
+		if currentCount < limit {
+			diffCount := (currentCount + weight) - limit
 			if diffCount > 0 {
 				exceeded = true
 				remainingCount = maxCount - currentCount
 
 			} else {
-				aSyncBucket.addToCounter(weight)
-				aSyncBucket.addToAsyncLocalMessageCount(weight)
+				//record the increment in the write-ahead log before it is acknowledged.
+				if quotaWAL != nil {
+					if err := quotaWAL.append(q, weight, period); err != nil {
+						return nil, err
+					}
+				}
+				if aSyncBucket.addToCounter(weight) != nil {
+					//the quotaBucket was removed from the cache meanwhile and is no longer synced, so its weight is sent now.
+					if err := syncEvictedWeight(ctx, q, weight, period); err != nil {
+						return nil, err
+					}
+				} else {
+					aSyncBucket.addToAsyncLocalMessageCount(weight)
+				}
 				remainingCount = maxCount - (currentCount + weight)
+				countedCount = currentCount + weight
 
 			}
 
@@ -142,9 +209,9 @@ func (quotaBucketType AsynchronousQuotaBucketType) incrementQuotaCount(q *QuotaB
 				return nil, err
 			}
 
-			if asyncMessageCount > 0 &&
-				asyncLocalMsgCount >= asyncMessageCount {
-				err = internalRefresh(q, period)
+			if (asyncMessageCount > 0 && asyncLocalMsgCount >= asyncMessageCount) ||
+				aSyncBucket.needsAdaptiveSync(limit) {
+				err = internalRefresh(ctx, q, period)
 				if err != nil {
 					return nil, err
 				}
@@ -166,62 +233,170 @@ func (quotaBucketType AsynchronousQuotaBucketType) incrementQuotaCount(q *QuotaB
 		MaxCount:         maxCount,
 		startTimestamp:   period.GetPeriodStartTime().Unix(),
 		expiresTimestamp: period.GetPeriodEndTime().Unix(),
+		currentCount:     countedCount,
 	}
 
 	return results, nil
 }
 
-func internalRefresh(q *QuotaBucket, period *quotaPeriod) error {
-	var err error
+func internalRefresh(ctx context.Context, q *QuotaBucket, period *quotaPeriod) (err error) {
+	ctx, span := tracing.Start(ctx, "internalRefresh", tracing.QuotaAttributes(q.GetEdgeOrgID(), q.GetID())...)
+	defer func() { tracing.End(span, err) }()
+
 	aSyncBucket := q.GetAsyncQuotaBucket()
 	if aSyncBucket == nil {
 		return errors.New(constants.AsyncQuotaBucketEmpty)
 	}
 
-	weight := int64(0)
-	countFromCounterService := int64(0)
-	globalCount,err := aSyncBucket.getAsyncGlobalCount()
+	if q.GetType() == constants.QuotaTypeRollingWindow {
+		ctx = services.WithSlidingWindow(ctx)
+	}
+	weight := aSyncBucket.takePendingWeight()
+	metrics.ObserveAsyncSync(aSyncBucket.syncLag(), weight)
+	countFromCounterService, err := services.IncrementAndGetCount(ctx, q.GetEdgeOrgID(), q.GetID(), weight, period.GetPeriodStartTime().Unix(), period.GetPeriodEndTime().Unix())
 	if err != nil {
+		aSyncBucket.restorePendingWeight(weight)
+		aSyncBucket.setSyncError(err)
 		return err
 	}
+	aSyncBucket.setSyncedCount(countFromCounterService, weight)
+	if quotaWAL != nil {
+		quotaWAL.ack(q, weight)
+	}
+	return nil
+}
 
-	maxCount := q.GetMaxCount()
-	for _, counterEle := range *aSyncBucket.asyncCounter {
-		weight += counterEle
-
-		//delete from asyncCounter
-		temp := *aSyncBucket.asyncCounter
-		temp = temp[1:]
-		aSyncBucket.asyncCounter = &temp
-
-		if (weight + globalCount) >= maxCount {
-			//clear asyncCounter
-			for range *aSyncBucket.asyncCounter {
-				//delete all elements from asyncCounter
-				temp := *aSyncBucket.asyncCounter
-				temp = temp[1:]
-				aSyncBucket.asyncCounter = &temp
-			}
+//syncEvictedWeight sends the weight of a request counted in an evicted aSyncQuotaBucket to the counter service.
+func syncEvictedWeight(ctx context.Context, q *QuotaBucket, weight int64, period *quotaPeriod) error {
+	if q.GetType() == constants.QuotaTypeRollingWindow {
+		ctx = services.WithSlidingWindow(ctx)
+	}
+	if _, err := services.IncrementAndGetCount(ctx, q.GetEdgeOrgID(), q.GetID(), weight, period.GetPeriodStartTime().Unix(), period.GetPeriodEndTime().Unix()); err != nil {
+		return err
+	}
+	if quotaWAL != nil {
+		quotaWAL.ack(q, weight)
+	}
+	return nil
+}
+
+//internalRefreshBatch syncs the pending weights of all the given aSyncQuotaBuckets with one request to the counter service.
+func internalRefreshBatch(ctx context.Context, qBuckets []*QuotaBucket) (err error) {
+	ctx, span := tracing.Start(ctx, "internalRefreshBatch")
+	defer func() { tracing.End(span, err) }()
+
+	synced := make([]*QuotaBucket, 0, len(qBuckets))
+	weights := make([]int64, 0, len(qBuckets))
+	entries := make([]services.CounterEntry, 0, len(qBuckets))
+	for _, q := range qBuckets {
+		aSyncBucket := q.GetAsyncQuotaBucket()
+		if aSyncBucket == nil {
+			continue
 		}
+		period, err := q.GetPeriod()
+		if err != nil {
+			globalVariables.Log.Error("error getting period for: ", err.Error(), "for quotaBucket: ", q)
+			continue
+		}
+
+		weight := aSyncBucket.takePendingWeight()
+		metrics.ObserveAsyncSync(aSyncBucket.syncLag(), weight)
+		synced = append(synced, q)
+		weights = append(weights, weight)
+		entries = append(entries, services.CounterEntry{
+			OrgID:         q.GetEdgeOrgID(),
+			Key:           q.GetID(),
+			Delta:         weight,
+			StartTime:     period.GetPeriodStartTime().Unix(),
+			EndTime:       period.GetPeriodEndTime().Unix(),
+			SlidingWindow: q.GetType() == constants.QuotaTypeRollingWindow,
+		})
+	}
+	if len(entries) == 0 {
+		return nil
 	}
 
-	countFromCounterService, err = services.IncrementAndGetCount(q.GetEdgeOrgID(), q.GetID(), weight, period.GetPeriodStartTime().Unix(), period.GetPeriodEndTime().Unix())
+	counts, err := services.BatchIncrementAndGetCount(ctx, entries)
 	if err != nil {
+		for i, q := range synced {
+			q.GetAsyncQuotaBucket().restorePendingWeight(weights[i])
+			q.GetAsyncQuotaBucket().setSyncError(err)
+		}
 		return err
 	}
-	aSyncBucket.asyncGLobalCount = countFromCounterService
 
-	aSyncBucket.asyncLocalMessageCount -= weight
+	for i, q := range synced {
+		q.GetAsyncQuotaBucket().setSyncedCount(counts[i], weights[i])
+		if quotaWAL != nil {
+			quotaWAL.ack(q, weights[i])
+		}
+	}
+	return nil
+}
+
+type LeasedQuotaBucketType struct{}
+
+func (lQuotaBucket LeasedQuotaBucketType) resetCount(q *QuotaBucket) error {
+	//yet to implement
 	return nil
 }
 
+func (lQuotaBucket LeasedQuotaBucketType) incrementQuotaCount(ctx context.Context, q *QuotaBucket) (*QuotaBucketResults, error) {
+	period, err := q.GetPeriod()
+	if err != nil {
+		return nil, errors.New("error getting period: " + err.Error())
+	}
+	lease := q.GetLeasedQuotaBucket()
+	if lease == nil {
+		return nil, errors.New(constants.LeaseNotSupported + " : quotaBucket has no lease")
+	}
+
+	maxCount := q.GetMaxCount()
+	exceeded := false
+	degraded := false
+	remainingCount := maxCount
+	countedCount := int64(0)
+
+	if period.IsCurrentPeriod(q) {
+		//chunks are leased up to the soft limit, the count left is counted down to it.
+		admitted, leaseRemainingCount, err := lease.take(ctx, q, period, q.GetWeight())
+		if err != nil {
+			//weight beyond the lease is never admitted without the counter service.
+			if !services.IsUnavailable(err) || q.GetDegradationMode() == "" {
+				return nil, err
+			}
+			degraded = true
+		}
+		exceeded = !admitted && q.GetWeight() != 0
+		countedCount = q.getAdmissionLimit() - leaseRemainingCount
+		remainingCount = maxCount - countedCount
+		if remainingCount < 0 {
+			remainingCount = 0
+		}
+	}
+
+	results := &QuotaBucketResults{
+		EdgeOrgID:        q.GetEdgeOrgID(),
+		ID:               q.GetID(),
+		exceeded:         exceeded,
+		remainingCount:   remainingCount,
+		MaxCount:         maxCount,
+		startTimestamp:   period.GetPeriodStartTime().Unix(),
+		expiresTimestamp: period.GetPeriodEndTime().Unix(),
+		degraded:         degraded,
+		currentCount:     countedCount,
+	}
+
+	return results, nil
+}
+
 type NonDistributedQuotaBucketType struct{}
 
 func (sQuotaBucket NonDistributedQuotaBucketType) resetCount(qBucket *QuotaBucket) error {
 	//yet to implement
 	return errors.New("methog not implemented")
 }
-func (sQuotaBucket NonDistributedQuotaBucketType) incrementQuotaCount(qBucket *QuotaBucket) (*QuotaBucketResults, error) {
+func (sQuotaBucket NonDistributedQuotaBucketType) incrementQuotaCount(ctx context.Context, qBucket *QuotaBucket) (*QuotaBucketResults, error) {
 
 	return nil, errors.New("methog not implemented")
 }
@@ -232,6 +407,10 @@ func GetQuotaBucketHandler(qBucket *QuotaBucket) (QuotaBucketType, error) {
 		quotaBucketType := &NonDistributedQuotaBucketType{}
 		return quotaBucketType, nil
 	} else {
+		if qBucket.IsLeased() {
+			quotaBucketType := &LeasedQuotaBucketType{}
+			return quotaBucketType, nil
+		}
 		if qBucket.IsSynchronous() {
 			quotaBucketType := &SynchronousQuotaBucketType{}
 			return quotaBucketType, nil
@@ -15,7 +15,14 @@
 package quotaBucket_test
 
 import (
+	"context"
+	. "github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"sync/atomic"
+	"time"
 )
 
 var _ = Describe("QuotaBucketType", func() {
@@ -23,3 +30,229 @@ var _ = Describe("QuotaBucketType", func() {
 		//fmt.Println("inside QuotaBucketType")
 	})
 })
+
+// countingCounterBackend counts the calls to the counter backend.
+type countingCounterBackend struct {
+	services.CounterBackend
+	calls int64
+}
+
+func (b *countingCounterBackend) IncrementAndGetCount(ctx context.Context, orgID string, quotaKey string, count int64, startTimeInt int64, endTimeInt int64) (int64, error) {
+	atomic.AddInt64(&b.calls, 1)
+	return b.CounterBackend.IncrementAndGetCount(ctx, orgID, quotaKey, count, startTimeInt, endTimeInt)
+}
+
+func (b *countingCounterBackend) BatchIncrementAndGetCount(ctx context.Context, entries []services.CounterEntry) ([]int64, error) {
+	atomic.AddInt64(&b.calls, 1)
+	return b.CounterBackend.BatchIncrementAndGetCount(ctx, entries)
+}
+
+var _ = Describe("Test adaptive sync", func() {
+	redis := useRedisCounterBackend()
+	var backend *countingCounterBackend
+	ctx := context.Background()
+
+	//each aSyncQuotaBucket stands for one node. the periodic sync is far enough not to run during the test.
+	newNode := func(maxCount int64, weight int64, headroomPercent int64) *QuotaBucket {
+		qBucket, err := NewQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, maxCount, weight, true, false, 3600, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetAdaptiveSync(headroomPercent)).To(Succeed())
+		return qBucket
+	}
+
+	BeforeEach(func() {
+		backend = &countingCounterBackend{CounterBackend: redis.backend}
+		services.SetCounterBackend(backend)
+	})
+
+	It("test invalid adaptive sync", func() {
+		qBucket, err := NewQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, 100, 1, true, true, -1, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetAdaptiveSync(10)).NotTo(Succeed())
+
+		qBucket, err = NewQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, 100, 1, true, false, 3600, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetAdaptiveSync(0)).NotTo(Succeed())
+		Expect(qBucket.SetAdaptiveSync(101)).NotTo(Succeed())
+	})
+
+	It("test syncs rarely far below maxCount and on every request close to it", func() {
+		node := newNode(1000, 1, 10)
+
+		//far below maxCount, the weight is synced in large chunks.
+		for i := 0; i < 500; i++ {
+			Expect(isAdmitted(node)).To(BeTrue())
+		}
+		Expect(backend.calls).To(BeNumerically("<=", 10))
+
+		//close to maxCount, every request is synced.
+		for i := 0; i < 490; i++ {
+			Expect(isAdmitted(node)).To(BeTrue())
+		}
+		calls := backend.calls
+		for i := 0; i < 10; i++ {
+			Expect(isAdmitted(node)).To(BeTrue())
+			Expect(backend.calls).To(Equal(calls + int64(i) + 1))
+		}
+		Expect(isAdmitted(node)).To(BeFalse())
+
+		period, err := node.GetPeriod()
+		Expect(err).NotTo(HaveOccurred())
+		count, err := services.GetCount(ctx, "sampleOrg", "sampleID", period.GetPeriodStartTime().Unix(), period.GetPeriodEndTime().Unix())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(1000)))
+	})
+
+	It("test overshoot of nodes sharing the quota is bounded", func() {
+		maxCount := int64(997)
+		//{nodes, weight, headroomPercent}
+		for _, testCase := range [][]int64{{5, 1, 10}, {3, 5, 20}, {4, 3, 50}, {8, 2, 5}, {2, 7, 100}, {10, 1, 1}} {
+			nodeCount, weight, headroomPercent := testCase[0], testCase[1], testCase[2]
+			nodes := make([]*QuotaBucket, 0, nodeCount)
+			for n := int64(0); n < nodeCount; n++ {
+				nodes = append(nodes, newNode(maxCount, weight, headroomPercent))
+			}
+
+			//the counts seen by the nodes only grow, once all of them are exceeded they stay exceeded.
+			admitted := int64(0)
+			for roundAdmitted := true; roundAdmitted; {
+				roundAdmitted = false
+				for _, node := range nodes {
+					if isAdmitted(node) {
+						admitted += weight
+						roundAdmitted = true
+					}
+				}
+			}
+
+			//a node admits as long as it sees room for the weight, what it sees is at most
+			//the weight the other nodes did not sync yet behind.
+			maxOvershoot := (nodeCount - 1) * (maxCount*headroomPercent/100 + weight)
+			Expect(admitted).To(BeNumerically(">", maxCount-weight), "for nodes, weight, headroomPercent: %v", testCase)
+			Expect(admitted).To(BeNumerically("<=", maxCount+maxOvershoot), "for nodes, weight, headroomPercent: %v", testCase)
+			redis.server.FlushAll()
+		}
+
+		//with small headroom percentages the overshoot is a few requests.
+		nodes := []*QuotaBucket{newNode(maxCount, 1, 1), newNode(maxCount, 1, 1), newNode(maxCount, 1, 1)}
+		admitted := int64(0)
+		for roundAdmitted := true; roundAdmitted; {
+			roundAdmitted = false
+			for _, node := range nodes {
+				if isAdmitted(node) {
+					admitted++
+					roundAdmitted = true
+				}
+			}
+		}
+		Expect(admitted).To(BeNumerically("<=", maxCount+int64(len(nodes)-1)))
+	})
+})
+
+var _ = Describe("Test hybrid sync", func() {
+	testUtil.UseConfig()
+	redis := useRedisCounterBackend()
+	var backend *countingCounterBackend
+	ctx := context.Background()
+
+	calls := func() int64 {
+		return atomic.LoadInt64(&backend.calls)
+	}
+
+	remainingCount := func(qBucket *QuotaBucket) int64 {
+		return incrementQuota(qBucket)["remainingCount"].(int64)
+	}
+
+	BeforeEach(func() {
+		backend = &countingCounterBackend{CounterBackend: redis.backend}
+		services.SetCounterBackend(backend)
+	})
+
+	It("test syncs with syncTimeInSec and syncMessageCount both set", func() {
+		qBucket, err := NewQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, 100, 1, true, false, 3600, 5)
+		Expect(err).NotTo(HaveOccurred())
+
+		//the message count fires long before the sync time.
+		for i := 0; i < 4; i++ {
+			Expect(remainingCount(qBucket)).To(Equal(int64(100 - i - 1)))
+		}
+		Expect(calls()).To(Equal(int64(1)))
+		Expect(remainingCount(qBucket)).To(Equal(int64(95)))
+		Expect(calls()).To(Equal(int64(2)))
+		count, err := services.GetCount(ctx, "sampleOrg", "sampleID", startTimeOfPeriod(qBucket), endTimeOfPeriod(qBucket))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(5)))
+	})
+
+	It("test max staleness", func() {
+		qBucket, err := NewQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, 100, 1, true, false, 3600, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetMaxStaleness(0)).NotTo(Succeed())
+		Expect(qBucket.SetMaxStaleness(100 * time.Millisecond)).To(Succeed())
+		otherNode, err := NewQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, 100, 1, true, false, 3600, 1)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(remainingCount(qBucket)).To(Equal(int64(99)))
+		for i := 0; i < 5; i++ {
+			remainingCount(otherNode)
+		}
+
+		//once the global count is older than max staleness, the other node's weight is seen.
+		time.Sleep(150 * time.Millisecond)
+		Expect(remainingCount(qBucket)).To(Equal(int64(93)))
+
+		//without local traffic the global count is still refreshed, until the bucket is idle for too long.
+		idleCalls := calls()
+		time.Sleep(150 * time.Millisecond)
+		Expect(calls()).To(BeNumerically(">", idleCalls))
+		Eventually(func() int64 {
+			before := calls()
+			time.Sleep(200 * time.Millisecond)
+			return calls() - before
+		}, 5*time.Second).Should(BeZero())
+	})
+
+	It("test max staleness falls back to the cached count when the refresh fails", func() {
+		qBucket, err := NewQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, 100, 1, true, false, 3600, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetMaxStaleness(100 * time.Millisecond)).To(Succeed())
+		Expect(remainingCount(qBucket)).To(Equal(int64(99)))
+
+		services.SetCounterBackend(&unavailableCounterBackend{})
+		time.Sleep(150 * time.Millisecond)
+		Expect(remainingCount(qBucket)).To(Equal(int64(98)))
+
+		//the weight counted meanwhile is sent with the next refresh.
+		services.SetCounterBackend(backend)
+		Expect(remainingCount(qBucket)).To(Equal(int64(97)))
+		count, err := services.GetCount(ctx, "sampleOrg", "sampleID", startTimeOfPeriod(qBucket), endTimeOfPeriod(qBucket))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(BeNumerically(">=", 2))
+
+		//the bucket is synced until it is idle for too long, so it does not outlive the test.
+		Eventually(func() int64 {
+			before := calls()
+			time.Sleep(200 * time.Millisecond)
+			return calls() - before
+		}, 5*time.Second).Should(BeZero())
+	})
+})
+
+func startTimeOfPeriod(qBucket *QuotaBucket) int64 {
+	period, err := qBucket.GetPeriod()
+	Expect(err).NotTo(HaveOccurred())
+	return period.GetPeriodStartTime().Unix()
+}
+
+func endTimeOfPeriod(qBucket *QuotaBucket) int64 {
+	period, err := qBucket.GetPeriod()
+	Expect(err).NotTo(HaveOccurred())
+	return period.GetPeriodEndTime().Unix()
+}
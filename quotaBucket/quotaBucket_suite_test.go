@@ -15,12 +15,138 @@
 package quotaBucket_test
 
 import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestQuotaBucket(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "QuotaBucket Suite")
 }
+
+// testStartTime is the start of the quotaBuckets of the tests, a month back.
+var testStartTime = time.Now().UTC().AddDate(0, -1, 0).Unix()
+
+// testRedis is the miniredis server the counter backend of a spec keeps its counts in.
+type testRedis struct {
+	server  *miniredis.Miniredis
+	backend services.CounterBackend //the redis counter backend on server, set for the spec.
+}
+
+// useRedisCounterBackend gives each spec of the enclosing container a redis counter backend on a miniredis server
+// of its own. the http counter backend, the default one, is set back after the spec.
+func useRedisCounterBackend() *testRedis {
+	redis := &testRedis{}
+	BeforeEach(func() {
+		var err error
+		redis.server, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		redis.backend = services.NewRedisCounterBackend(redis.server.Addr(), "", 0, "test:")
+		services.SetCounterBackend(redis.backend)
+	})
+	AfterEach(func() {
+		services.SetCounterBackend(services.NewHTTPCounterBackend())
+		redis.server.Close()
+	})
+	return redis
+}
+
+// testCounterService is the counter service the counter backend of a spec calls, keeping its counts in store.
+type testCounterService struct {
+	store  counterService.Store
+	server *httptest.Server
+}
+
+// useCounterService gives each spec of the enclosing container a counter service of its own, called by the http
+// counter backend. it needs the config set by testUtil.UseConfig.
+func useCounterService() *testCounterService {
+	service := &testCounterService{}
+	BeforeEach(func() {
+		service.store = counterService.NewMemoryStore()
+		service.server = httptest.NewServer(counterService.NewCounterService(service.store))
+		testUtil.UseCounterService(service.server.URL)
+		services.SetCounterBackend(services.NewHTTPCounterBackend())
+	})
+	AfterEach(func() {
+		testUtil.ResetCounterService()
+		service.server.Close()
+	})
+	return service
+}
+
+// countedFor takes the counters of the org out of the counter service, and returns the weight counted in them.
+func (s *testCounterService) countedFor(edgeOrgID string) int64 {
+	entries, err := s.store.Take(func(entry counterService.Entry) bool { return entry.OrgID == edgeOrgID })
+	Expect(err).NotTo(HaveOccurred())
+	counted := int64(0)
+	for _, entry := range entries {
+		counted += entry.Delta
+	}
+	return counted
+}
+
+// quotaRequest is the api request of a distributed synchronous quotaBucket with a maxCount of 100 per hour,
+// with fields set on top. cached quotaBuckets are keyed by edgeOrgID and id, so the tests use their own org.
+func quotaRequest(edgeOrgID string, id string, fields map[string]interface{}) map[string]interface{} {
+	quotaMap := map[string]interface{}{
+		"edgeOrgID":             edgeOrgID,
+		"id":                    id,
+		"interval":              float64(1),
+		"timeUnit":              "hour",
+		"type":                  "calendar",
+		"preciseAtSecondsLevel": false,
+		"startTimestamp":        float64(testStartTime),
+		"maxCount":              float64(100),
+		"weight":                float64(1),
+		"distributed":           true,
+		"synchronous":           true,
+	}
+	for field, value := range fields {
+		quotaMap[field] = value
+	}
+	return quotaMap
+}
+
+// fromAPIRequest returns the quotaBucket of the api request, as the quota api does.
+func fromAPIRequest(quotaMap map[string]interface{}) *QuotaBucket {
+	qBucket := &QuotaBucket{}
+	Expect(qBucket.FromAPIRequest(quotaMap)).To(Succeed())
+	return qBucket
+}
+
+// newAsyncBucket returns an aSyncQuotaBucket with a maxCount of 100 per hour.
+// its periodic sync is far enough not to run during the test.
+func newAsyncBucket(edgeOrgID string, id string) *QuotaBucket {
+	qBucket, err := NewQuotaBucket(edgeOrgID, id, 1, "hour", "calendar", false,
+		testStartTime, 100, 1, true, false, 3600, -1)
+	Expect(err).NotTo(HaveOccurred())
+	return qBucket
+}
+
+// incrementQuota increments the quotaBucket and returns the api response.
+func incrementQuota(qBucket *QuotaBucket) map[string]interface{} {
+	results, err := qBucket.IncrementQuotaLimit(context.Background())
+	Expect(err).NotTo(HaveOccurred())
+	return results.ToAPIResponse()
+}
+
+// isAdmitted increments the quotaBucket and returns if the request was admitted.
+func isAdmitted(qBucket *QuotaBucket) bool {
+	return !incrementQuota(qBucket)["exceeded"].(bool)
+}
+
+// incrementTimes increments the quotaBucket times times.
+func incrementTimes(qBucket *QuotaBucket, times int) {
+	for i := 0; i < times; i++ {
+		incrementQuota(qBucket)
+	}
+}
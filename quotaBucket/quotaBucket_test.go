@@ -67,6 +67,23 @@ var _ = Describe("Test AcceptedQuotaTypes", func() {
 	})
 })
 
+var _ = Describe("Test AcceptedDegradationModes", func() {
+	It("testDegradationMode", func() {
+		if !IsValidDegradationMode("failopen") {
+			Fail("Expected true: failopen is a valid degradationMode")
+		}
+		if !IsValidDegradationMode("failclosed") {
+			Fail("Expected true: failclosed is a valid degradationMode")
+		}
+		if !IsValidDegradationMode("localestimate") {
+			Fail("Expected true: localestimate is a valid degradationMode")
+		}
+		if IsValidDegradationMode("invalidMode") {
+			Fail("Expected false: invalidMode is not a valid degradationMode")
+		}
+	})
+})
+
 //Tests for QuotaBucket
 var _ = Describe("QuotaBucket", func() {
 
@@ -280,7 +297,7 @@ var _ = Describe("QuotaBucket", func() {
 			Fail("asyncBucket should be nil for synchronous request.")
 		}
 
-		//Testcase3 : InvalidTestCase - with syncTimeInSec and syncMessageCount
+		//Testcase3 : with syncTimeInSec and syncMessageCount, synced on whichever fires first.
 		syncTimeInSec = int64(10)
 		syncMessageCount = int64(10)
 		//start time is after now() -> should still set period.
@@ -288,7 +305,14 @@ var _ = Describe("QuotaBucket", func() {
 		quotaBucket, err = NewQuotaBucket(edgeOrgID, id, interval, timeUnit,
 			quotaType, preciseAtSecondsLevel, startTime, maxCount,
 			weight, distributed, synchronous, syncTimeInSec, syncMessageCount)
-		Expect(err).To(HaveOccurred())
+		Expect(err).NotTo(HaveOccurred())
+		err = quotaBucket.Validate()
+		Expect(err).NotTo(HaveOccurred())
+
+		asyncBucket = quotaBucket.GetAsyncQuotaBucket()
+		if asyncBucket == nil{
+			Fail("asyncBucket should not be nil for aSynchronous request.")
+		}
 
 	})
 
@@ -15,7 +15,10 @@
 package quotaBucket
 
 import (
+	"context"
 	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/metrics"
 	"sync"
 	"time"
 	"errors"
@@ -39,6 +42,7 @@ func getFromCache(cacheKey string, weight int64) (*QuotaBucket, bool) {
 	qBucketCache, ok := quotaCache[cacheKey]
 	quotaCachelock.Unlock()
 
+	metrics.RecordCacheLookup(ok)
 	if !ok {
 		return nil, false
 	}
@@ -64,26 +68,53 @@ func getFromCache(cacheKey string, weight int64) (*QuotaBucket, bool) {
 }
 
 func removeFromCache(cacheKey string, qBucketCache quotaBucketCache) error {
-	//for async Stop the scheduler.
+	//for async stop the periodic sync.
 
-	if qBucketCache.qBucket.Distributed && !qBucketCache.qBucket.IsSynchronous() {
+	//for leased give back the unused weight, so the other nodes can use it.
+	if qBucketCache.qBucket.IsLeased() {
+		go releaseEvictedLease(qBucketCache.qBucket)
+	} else if qBucketCache.qBucket.Distributed && !qBucketCache.qBucket.IsSynchronous() {
 		aSyncBucket := qBucketCache.qBucket.GetAsyncQuotaBucket()
 		if aSyncBucket == nil {
 			return errors.New(constants.AsyncQuotaBucketEmpty + " : aSyncQuotaBucket to increment cannot be empty.")
 		}
-		qticker, err := aSyncBucket.getAsyncQTicker()
-		if err != nil {
-			return err
-		}
-		qticker.Stop()
+		evictAsyncBucket(qBucketCache.qBucket, aSyncBucket)
+	} else if estimate := qBucketCache.qBucket.getLocalEstimate(); estimate != nil {
+		releaseLocalEstimate(cacheKey, estimate)
 	}
+	releaseThresholdReport(cacheKey)
 
 	quotaCachelock.Lock()
 	delete(quotaCache, cacheKey)
+	metrics.SetCacheSize(len(quotaCache))
 	quotaCachelock.Unlock()
+	metrics.RecordCacheEviction()
 	return nil
 }
 
+// evictAsyncBucket stops the periodic sync of an aSyncQuotaBucket removed from the cache, once its pending weight
+// is flushed to the counter service. when the flush fails, it stays scheduled until its weight is synced.
+func evictAsyncBucket(q *QuotaBucket, aSyncBucket *aSyncQuotaBucket) {
+	if !aSyncBucket.evict() {
+		quotaSyncScheduler.unschedule(aSyncBucket)
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), constants.DefaultRequestTimeout)
+		defer cancel()
+		period, err := q.GetPeriod()
+		if err == nil {
+			err = internalRefresh(ctx, q, period)
+		}
+		if err != nil {
+			globalVariables.Log.Error("error flushing pending weight of evicted quotaBucket: ", q.GetEdgeOrgID()+constants.CacheKeyDelimiter+q.GetID(),
+				" : ", err.Error(), ", it is synced again at its next sync")
+			return
+		}
+		quotaSyncScheduler.unschedule(aSyncBucket)
+	}()
+}
+
 func addToCache(qBucketToAdd *QuotaBucket) {
 
 	cacheKey := qBucketToAdd.GetEdgeOrgID() + constants.CacheKeyDelimiter + qBucketToAdd.GetID()
@@ -95,5 +126,6 @@ func addToCache(qBucketToAdd *QuotaBucket) {
 
 	quotaCachelock.Lock()
 	quotaCache[cacheKey] = qCacheData
+	metrics.SetCacheSize(len(quotaCache))
 	quotaCachelock.Unlock()
 }
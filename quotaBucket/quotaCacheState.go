@@ -0,0 +1,93 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// GetCachedBucketStates returns the definition and the live state of the cached quotaBuckets, grouped by edgeOrgID.
+// an empty edgeOrgID or idPrefix matches every quotaBucket.
+func GetCachedBucketStates(edgeOrgID string, idPrefix string) map[string][]map[string]interface{} {
+	quotaCachelock.Lock()
+	cached := make([]quotaBucketCache, 0, len(quotaCache))
+	for _, qBucketCache := range quotaCache {
+		q := qBucketCache.qBucket
+		if (edgeOrgID == "" || q.GetEdgeOrgID() == edgeOrgID) && strings.HasPrefix(q.GetID(), idPrefix) {
+			cached = append(cached, qBucketCache)
+		}
+	}
+	quotaCachelock.Unlock()
+
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].qBucket.GetID() < cached[j].qBucket.GetID()
+	})
+	states := make(map[string][]map[string]interface{})
+	for _, qBucketCache := range cached {
+		orgID := qBucketCache.qBucket.GetEdgeOrgID()
+		states[orgID] = append(states[orgID], qBucketCache.getState())
+	}
+	return states
+}
+
+func (qBucketCache quotaBucketCache) getState() map[string]interface{} {
+	q := qBucketCache.qBucket
+	state := make(map[string]interface{})
+	state["edgeOrgID"] = q.GetEdgeOrgID()
+	state["id"] = q.GetID()
+	state["interval"] = q.GetInterval()
+	state["timeUnit"] = q.GetTimeUnit()
+	state["type"] = q.GetType()
+	state["preciseAtSecondsLevel"] = q.GetIsPreciseAtSecondsLevel()
+	state["startTimestamp"] = q.GetStartTime().Unix()
+	state["maxCount"] = q.GetMaxCount()
+	state["weight"] = q.GetWeight()
+	state["distributed"] = q.IsDistrubuted()
+	state["synchronous"] = q.IsSynchronous()
+	state["degradationMode"] = q.GetDegradationMode()
+	state["softLimit"] = q.GetSoftLimit()
+	state["mode"] = q.getMode()
+	state["cacheExpiryTimestamp"] = qBucketCache.expiryTime
+	if aSyncBucket := q.GetAsyncQuotaBucket(); aSyncBucket != nil {
+		state["async"] = aSyncBucket.getState()
+	}
+	return state
+}
+
+func (aSyncbucket *aSyncQuotaBucket) getState() map[string]interface{} {
+	state := make(map[string]interface{})
+	state["syncTimeInSec"] = aSyncbucket.syncTimeInSec
+	state["syncMessageCount"] = aSyncbucket.syncMessageCount
+	state["asyncLocalMessageCount"] = atomic.LoadInt64(&aSyncbucket.asyncLocalMessageCount)
+
+	aSyncbucket.counterLock.Lock()
+	state["asyncGLobalCount"] = aSyncbucket.asyncGLobalCount
+	state["pendingAsyncCounterLength"] = len(*aSyncbucket.asyncCounter)
+	state["lastSyncError"] = aSyncbucket.lastSyncError
+	lastSyncErrorAt := aSyncbucket.lastSyncErrorAt
+	aSyncbucket.counterLock.Unlock()
+
+	if lastSyncedAt := atomic.LoadInt64(&aSyncbucket.lastSyncedAt); lastSyncedAt != 0 {
+		state["lastSyncTimestamp"] = time.Unix(0, lastSyncedAt).Unix()
+	}
+	if lastSyncErrorAt != 0 {
+		state["lastSyncErrorTimestamp"] = time.Unix(0, lastSyncErrorAt).Unix()
+	}
+	state["ticker"] = quotaSyncScheduler.syncState(aSyncbucket)
+	return state
+}
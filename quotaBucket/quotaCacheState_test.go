@@ -0,0 +1,117 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/services"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+// unavailableCounterBackend fails every increment.
+type unavailableCounterBackend struct {
+	services.CounterBackend
+}
+
+func (b *unavailableCounterBackend) IncrementAndGetCount(ctx context.Context, orgID string, quotaKey string, count int64, startTimeInt int64, endTimeInt int64) (int64, error) {
+	return 0, errors.New("counter service unavailable")
+}
+
+func (b *unavailableCounterBackend) BatchIncrementAndGetCount(ctx context.Context, entries []services.CounterEntry) ([]int64, error) {
+	return nil, errors.New("counter service unavailable")
+}
+
+var _ = Describe("Test cached quotaBucket states", func() {
+	useRedisCounterBackend()
+	ctx := context.Background()
+
+	stateRequest := func(edgeOrgID string, id string, synchronous bool) *QuotaBucket {
+		fields := map[string]interface{}{"maxCount": float64(10), "synchronous": synchronous}
+		if !synchronous {
+			fields["syncTimeInSec"] = float64(3600)
+			fields["syncMessageCount"] = float64(3)
+		}
+		return fromAPIRequest(quotaRequest(edgeOrgID, id, fields))
+	}
+
+	It("test cached quotaBuckets are filtered by org and id prefix", func() {
+		stateRequest("stateOrg1", "app1", true)
+		stateRequest("stateOrg1", "app2", true)
+		stateRequest("stateOrg1", "dev1", true)
+		stateRequest("stateOrg2", "app1", true)
+
+		states := GetCachedBucketStates("stateOrg1", "app")
+		Expect(states).To(HaveLen(1))
+		Expect(states["stateOrg1"]).To(HaveLen(2))
+		Expect(states["stateOrg1"][0]["id"]).To(Equal("app1"))
+		Expect(states["stateOrg1"][1]["id"]).To(Equal("app2"))
+		Expect(states["stateOrg1"][0]["mode"]).To(Equal("synchronous"))
+		Expect(states["stateOrg1"][0]["maxCount"]).To(Equal(int64(10)))
+		Expect(states["stateOrg1"][0]["cacheExpiryTimestamp"]).To(BeNumerically(">", time.Now().Unix()))
+		Expect(states["stateOrg1"][0]).NotTo(HaveKey("async"))
+
+		states = GetCachedBucketStates("", "app1")
+		Expect(states["stateOrg1"]).To(HaveLen(1))
+		Expect(states["stateOrg2"]).To(HaveLen(1))
+		Expect(GetCachedBucketStates("stateOrg3", "")).To(BeEmpty())
+	})
+
+	It("test aSyncQuotaBucket state shows the counts and the last sync", func() {
+		for i := 0; i < 2; i++ {
+			_, err := stateRequest("stateOrg3", "asyncApp", false).IncrementQuotaLimit(ctx)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		async := GetCachedBucketStates("stateOrg3", "")["stateOrg3"][0]["async"].(map[string]interface{})
+		Expect(async["asyncGLobalCount"]).To(Equal(int64(0)))
+		Expect(async["asyncLocalMessageCount"]).To(Equal(int64(2)))
+		Expect(async["pendingAsyncCounterLength"]).To(Equal(2))
+		Expect(async["lastSyncError"]).To(Equal(""))
+		Expect(async["lastSyncTimestamp"]).To(BeNumerically(">", 0))
+		ticker := async["ticker"].(map[string]interface{})
+		Expect(ticker["scheduled"]).To(BeTrue())
+		Expect(ticker["intervalInSec"]).To(Equal(float64(3600)))
+		Expect(ticker["nextSyncTimestamp"]).To(BeNumerically(">", time.Now().Unix()))
+
+		//the third request syncs, which fails without the counter service.
+		services.SetCounterBackend(&unavailableCounterBackend{})
+		_, err := stateRequest("stateOrg3", "asyncApp", false).IncrementQuotaLimit(ctx)
+		Expect(err).To(HaveOccurred())
+		async = GetCachedBucketStates("stateOrg3", "")["stateOrg3"][0]["async"].(map[string]interface{})
+		Expect(async["lastSyncError"]).To(Equal("counter service unavailable"))
+		Expect(async["lastSyncErrorTimestamp"]).To(BeNumerically(">", 0))
+		Expect(async["pendingAsyncCounterLength"]).To(Equal(1))
+		Expect(async["asyncLocalMessageCount"]).To(Equal(int64(3)))
+	})
+
+	It("test async sync backlog sums the weight not synced", func() {
+		//the other tests may leave aSyncQuotaBuckets with pending weights behind.
+		backlog := GetAsyncSyncBacklog()
+		for i := 0; i < 2; i++ {
+			_, err := stateRequest("stateOrg4", "asyncApp", false).IncrementQuotaLimit(ctx)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(GetAsyncSyncBacklog()).To(Equal(backlog + 2))
+
+		//synchronous quotaBuckets have no backlog.
+		_, err := stateRequest("stateOrg4", "syncApp", true).IncrementQuotaLimit(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(GetAsyncSyncBacklog()).To(Equal(backlog + 2))
+	})
+})
@@ -0,0 +1,152 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"context"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var shuttingDown int32
+
+// incrementGate is held for reading by the increments in flight. Shutdown takes it to wait for them,
+// so the weights they count are in the snapshot it flushes.
+var incrementGate sync.RWMutex
+
+// IsShuttingDown reports if Shutdown was invoked. no new increments are accepted after that.
+func IsShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// beginIncrement admits an increment, unless Shutdown was invoked. an admitted increment must call endIncrement.
+func beginIncrement() bool {
+	incrementGate.RLock()
+	if IsShuttingDown() {
+		incrementGate.RUnlock()
+		return false
+	}
+	return true
+}
+
+func endIncrement() {
+	incrementGate.RUnlock()
+}
+
+// waitForIncrements reports if the increments admitted before Shutdown finished within timeout.
+func waitForIncrements(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		incrementGate.Lock()
+		incrementGate.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Shutdown stops accepting new increments, stops the periodic syncs and flushes the pending weights
+// of all aSyncQuotaBuckets to the counter service, and releases the leases of leased quotaBuckets.
+// the first half of timeout is for the increments and syncs in flight to finish, the rest for the flush.
+// weights that could not be flushed or released within timeout are logged.
+func Shutdown(timeout time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&shuttingDown, 0, 1) {
+		return nil
+	}
+	stopDeadline := time.Now().Add(timeout / 2)
+	deadline := time.Now().Add(timeout)
+
+	if !waitForIncrements(time.Until(stopDeadline)) {
+		globalVariables.Log.Warn("in-flight increments did not finish before shutdown deadline, their weight may not be flushed")
+	}
+	qBuckets := quotaSyncScheduler.scheduledBuckets()
+	if !quotaSyncScheduler.shutdown(time.Until(stopDeadline)) {
+		globalVariables.Log.Warn("in-flight syncs with the counter service did not finish before shutdown deadline")
+	}
+
+	bucketsByOrg := make(map[string][]*QuotaBucket)
+	for _, q := range qBuckets {
+		aSyncBucket := q.GetAsyncQuotaBucket()
+		if aSyncBucket == nil || aSyncBucket.getPendingCount() == 0 {
+			continue
+		}
+		bucketsByOrg[q.GetEdgeOrgID()] = append(bucketsByOrg[q.GetEdgeOrgID()], q)
+	}
+
+	flushCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	done := make(chan struct{}, len(bucketsByOrg))
+	for orgID, orgBuckets := range bucketsByOrg {
+		go func(orgID string, orgBuckets []*QuotaBucket) {
+			if err := internalRefreshBatch(flushCtx, orgBuckets); err != nil {
+				globalVariables.Log.Error("error flushing pending weights for org: ", orgID, " : ", err.Error())
+			}
+			done <- struct{}{}
+		}(orgID, orgBuckets)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+wait:
+	for pending := len(bucketsByOrg); pending > 0; pending-- {
+		select {
+		case <-done:
+		case <-timer.C:
+			break wait
+		}
+	}
+
+	//leases are given back after the flush, the ones not given back stay counted until the end of their period.
+	unreleased := releaseLeases(flushCtx)
+	for _, q := range unreleased {
+		globalVariables.Log.Error("unable to release lease of ", q.GetLeasedQuotaBucket().getRemaining(), " to the counter service for quotaBucket: ",
+			q.GetEdgeOrgID()+constants.CacheKeyDelimiter+q.GetID())
+	}
+
+	unflushed := 0
+	for _, orgBuckets := range bucketsByOrg {
+		for _, q := range orgBuckets {
+			pendingCount := q.GetAsyncQuotaBucket().getPendingCount()
+			if pendingCount == 0 {
+				continue
+			}
+			unflushed++
+			globalVariables.Log.Error("unable to flush ", pendingCount, " pending increments to the counter service for quotaBucket: ",
+				q.GetEdgeOrgID()+constants.CacheKeyDelimiter+q.GetID())
+		}
+	}
+	if quotaWAL != nil {
+		//unflushed increments stay in the write-ahead log and are replayed on the next start.
+		if err := quotaWAL.close(); err != nil {
+			globalVariables.Log.Error("error closing write-ahead log: ", err.Error())
+		}
+	}
+	if unflushed > 0 {
+		return errors.New(strconv.Itoa(unflushed) + " quotaBuckets could not be flushed to the counter service")
+	}
+	if len(unreleased) > 0 {
+		return errors.New(strconv.Itoa(len(unreleased)) + " quotaBucket leases could not be released to the counter service")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket_test
+
+import (
+	"context"
+	"github.com/apid/apidQuota/constants"
+	. "github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"time"
+)
+
+var _ = Describe("Test Shutdown", func() {
+	testUtil.UseConfig()
+
+	Context("against the counter service", func() {
+		service := useCounterService()
+
+		asyncRequest := func(edgeOrgID string, id string) *QuotaBucket {
+			return fromAPIRequest(quotaRequest(edgeOrgID, id, map[string]interface{}{"synchronous": false, "syncTimeInSec": float64(3600)}))
+		}
+
+		//Shutdown flushes all the scheduled buckets, so each spec starts with a scheduler of its own.
+		BeforeEach(func() {
+			ResetShutdown()
+		})
+
+		AfterEach(func() {
+			ResetShutdown()
+		})
+
+		It("test pending weight is flushed to the counter service", func() {
+			qBucket := asyncRequest("shutdownOrg", "app")
+			for i := 0; i < 4; i++ {
+				_, err := qBucket.IncrementQuotaLimit(context.Background())
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(PendingWeight(qBucket)).To(BeEquivalentTo(4))
+
+			Expect(Shutdown(2 * time.Second)).To(Succeed())
+			Expect(PendingWeight(qBucket)).To(BeZero())
+			Expect(service.countedFor("shutdownOrg")).To(BeEquivalentTo(4))
+
+			_, err := qBucket.IncrementQuotaLimit(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(constants.QuotaShuttingDown))
+		})
+
+		It("test increments in flight are flushed once they finish", func() {
+			qBucket := asyncRequest("shutdownOrgInFlight", "app")
+			Expect(BeginIncrement()).To(BeTrue())
+
+			done := make(chan error, 1)
+			go func() {
+				done <- Shutdown(2 * time.Second)
+			}()
+			Consistently(done, 100*time.Millisecond).ShouldNot(Receive())
+			AddPendingWeight(qBucket, 3)
+			EndIncrement()
+
+			Eventually(done, time.Second).Should(Receive(BeNil()))
+			Expect(service.countedFor("shutdownOrgInFlight")).To(BeEquivalentTo(3))
+			Expect(BeginIncrement()).To(BeFalse())
+		})
+
+		It("test weight which could not be flushed is reported", func() {
+			qBucket := asyncRequest("shutdownOrgFailed", "app")
+			_, err := qBucket.IncrementQuotaLimit(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			service.server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusInternalServerError)
+			})
+			err = Shutdown(time.Second)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("1 quotaBuckets could not be flushed"))
+			Expect(PendingWeight(qBucket)).To(BeEquivalentTo(1))
+		})
+	})
+})
@@ -0,0 +1,474 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"container/heap"
+	"context"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/metrics"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// syncScheduler drives the periodic sync of all aSyncQuotaBuckets
+// from a single goroutine and a bounded pool of workers, instead of one goroutine and ticker per bucket.
+// when a bucket is due, all the buckets of its org with pending weight are synced with it, in one batch request.
+type syncScheduler struct {
+	lock          sync.Mutex
+	entries       syncEntryHeap
+	scheduled     map[*aSyncQuotaBucket]*syncEntry
+	scheduledOrgs map[string]map[*aSyncQuotaBucket]*syncEntry // scheduled, by org. the buckets of an org due are gathered from it.
+	wakeup        chan struct{}
+	jobs          chan []*syncEntry
+	concurrency   int
+	jitterPercent int64
+	startOnce     sync.Once
+	stopOnce      sync.Once
+	stop          chan struct{}
+	stopped       bool
+	workers       sync.WaitGroup
+}
+
+// syncEntry is a scheduled aSyncQuotaBucket, or an increment of the write-ahead log to replay when replay is set.
+type syncEntry struct {
+	qBucket  *QuotaBucket
+	replay   *walRecord
+	interval time.Duration
+	nextSync time.Time
+	index    int  // position in the heap, -1 when not queued.
+	removed  bool // set when the bucket is unscheduled while a worker is syncing it.
+}
+
+var quotaSyncScheduler = newSyncScheduler()
+
+func newSyncScheduler() *syncScheduler {
+	return &syncScheduler{
+		entries:       make(syncEntryHeap, 0),
+		scheduled:     make(map[*aSyncQuotaBucket]*syncEntry),
+		scheduledOrgs: make(map[string]map[*aSyncQuotaBucket]*syncEntry),
+		wakeup:        make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+}
+
+// start reads the scheduler configuration and starts the dispatcher and workers. it is invoked once, on the first schedule.
+func (s *syncScheduler) start() {
+	s.startOnce.Do(func() {
+		concurrency := constants.DefaultSyncConcurrency
+		jitterPercent := int64(constants.DefaultSyncJitterPercent)
+		if globalVariables.Config != nil {
+			if configConcurrency := globalVariables.Config.GetInt(constants.ConfigSyncConcurrency); configConcurrency > 0 {
+				concurrency = configConcurrency
+			}
+			if jitter := globalVariables.Config.GetInt(constants.ConfigSyncJitterPercent); jitter >= 0 && jitter <= 100 {
+				jitterPercent = int64(jitter)
+			}
+		}
+		s.run(concurrency, jitterPercent)
+	})
+}
+
+// run starts the dispatcher and concurrency workers.
+func (s *syncScheduler) run(concurrency int, jitterPercent int64) {
+	s.concurrency = concurrency
+	s.jitterPercent = jitterPercent
+	s.jobs = make(chan []*syncEntry, s.concurrency)
+	s.workers.Add(s.concurrency)
+	for i := 0; i < s.concurrency; i++ {
+		go s.worker()
+	}
+	go s.dispatch()
+}
+
+func (s *syncScheduler) schedule(q *QuotaBucket, interval time.Duration) {
+	aSyncBucket := q.GetAsyncQuotaBucket()
+	if aSyncBucket == nil {
+		return
+	}
+	s.start()
+
+	s.lock.Lock()
+	if _, ok := s.scheduled[aSyncBucket]; ok || s.stopped {
+		s.lock.Unlock()
+		return
+	}
+	entry := &syncEntry{
+		qBucket:  q,
+		interval: interval,
+		nextSync: time.Now().Add(interval + s.jitter(interval)),
+	}
+	s.addScheduled(aSyncBucket, entry)
+	heap.Push(&s.entries, entry)
+	metrics.SetAsyncScheduledBuckets(len(s.scheduled))
+	s.lock.Unlock()
+
+	s.notify()
+}
+
+func (s *syncScheduler) unschedule(aSyncBucket *aSyncQuotaBucket) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entry, ok := s.scheduled[aSyncBucket]
+	if !ok {
+		return
+	}
+	s.removeScheduled(aSyncBucket, entry)
+	metrics.SetAsyncScheduledBuckets(len(s.scheduled))
+	if entry.index >= 0 {
+		heap.Remove(&s.entries, entry.index)
+	}
+}
+
+// addScheduled adds the entry of the bucket to the scheduled ones. it is called with the lock held.
+func (s *syncScheduler) addScheduled(aSyncBucket *aSyncQuotaBucket, entry *syncEntry) {
+	s.scheduled[aSyncBucket] = entry
+	orgID := entry.qBucket.GetEdgeOrgID()
+	if s.scheduledOrgs[orgID] == nil {
+		s.scheduledOrgs[orgID] = make(map[*aSyncQuotaBucket]*syncEntry)
+	}
+	s.scheduledOrgs[orgID][aSyncBucket] = entry
+}
+
+// removeScheduled removes the entry of the bucket from the scheduled ones. it is called with the lock held.
+func (s *syncScheduler) removeScheduled(aSyncBucket *aSyncQuotaBucket, entry *syncEntry) {
+	delete(s.scheduled, aSyncBucket)
+	orgID := entry.qBucket.GetEdgeOrgID()
+	delete(s.scheduledOrgs[orgID], aSyncBucket)
+	if len(s.scheduledOrgs[orgID]) == 0 {
+		delete(s.scheduledOrgs, orgID)
+	}
+	entry.removed = true
+}
+
+// scheduleReplay retries an increment of the write-ahead log every interval, until the counter service accepts it.
+func (s *syncScheduler) scheduleReplay(record walRecord, interval time.Duration) {
+	s.start()
+
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return
+	}
+	heap.Push(&s.entries, &syncEntry{
+		replay:   &record,
+		interval: interval,
+		nextSync: time.Now().Add(interval + s.jitter(interval)),
+	})
+	s.lock.Unlock()
+
+	s.notify()
+}
+
+// shortenInterval syncs a scheduled bucket at least every interval, from now on.
+func (s *syncScheduler) shortenInterval(aSyncBucket *aSyncQuotaBucket, interval time.Duration) {
+	s.lock.Lock()
+	entry, ok := s.scheduled[aSyncBucket]
+	if !ok || entry.interval <= interval {
+		s.lock.Unlock()
+		return
+	}
+	entry.interval = interval
+	if nextSync := time.Now().Add(interval); entry.index >= 0 && nextSync.Before(entry.nextSync) {
+		entry.nextSync = nextSync
+		heap.Fix(&s.entries, entry.index)
+	}
+	s.lock.Unlock()
+
+	s.notify()
+}
+
+// scheduledBuckets returns all the buckets currently scheduled for sync.
+func (s *syncScheduler) scheduledBuckets() []*QuotaBucket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	qBuckets := make([]*QuotaBucket, 0, len(s.scheduled))
+	for _, entry := range s.scheduled {
+		qBuckets = append(qBuckets, entry.qBucket)
+	}
+	return qBuckets
+}
+
+// GetAsyncSyncBacklog returns the weight counted by the aSyncQuotaBuckets and not yet synced with the counter service.
+func GetAsyncSyncBacklog() int64 {
+	backlog := int64(0)
+	for _, q := range quotaSyncScheduler.scheduledBuckets() {
+		if aSyncBucket := q.GetAsyncQuotaBucket(); aSyncBucket != nil {
+			backlog += aSyncBucket.getPendingWeight()
+		}
+	}
+	return backlog
+}
+
+// syncState describes the periodic sync of a bucket. buckets being synced are off the heap until their sync is done.
+func (s *syncScheduler) syncState(aSyncBucket *aSyncQuotaBucket) map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.scheduled[aSyncBucket]
+	state := map[string]interface{}{"scheduled": ok}
+	if !ok {
+		return state
+	}
+	state["intervalInSec"] = entry.interval.Seconds()
+	state["syncing"] = entry.index < 0
+	if entry.index >= 0 {
+		state["nextSyncTimestamp"] = entry.nextSync.Unix()
+	}
+	return state
+}
+
+// shutdown stops dispatching syncs, unschedules all the buckets and waits up to timeout for the in-flight syncs to finish.
+func (s *syncScheduler) shutdown(timeout time.Duration) bool {
+	s.lock.Lock()
+	s.stopped = true
+	for aSyncBucket, entry := range s.scheduled {
+		s.removeScheduled(aSyncBucket, entry)
+	}
+	s.entries = make(syncEntryHeap, 0)
+	metrics.SetAsyncScheduledBuckets(0)
+	s.lock.Unlock()
+
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// jitter spreads syncs of buckets with the same interval so they don't reach the counter service in lockstep.
+func (s *syncScheduler) jitter(interval time.Duration) time.Duration {
+	maxJitter := int64(interval) * s.jitterPercent / 100
+	if maxJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(maxJitter))
+}
+
+func (s *syncScheduler) notify() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (s *syncScheduler) dispatch() {
+	//workers exit once the dispatcher stops sending them jobs.
+	defer close(s.jobs)
+	timer := time.NewTimer(time.Hour)
+	for {
+		s.lock.Lock()
+		wait := time.Hour
+		dueByOrg := make(map[string][]*syncEntry)
+		orgs := make([]string, 0)
+		jobs := make([][]*syncEntry, 0)
+		for len(s.entries) > 0 {
+			if wait = time.Until(s.entries[0].nextSync); wait > 0 {
+				break
+			}
+			due := heap.Pop(&s.entries).(*syncEntry)
+			if due.replay != nil {
+				jobs = append(jobs, []*syncEntry{due})
+				continue
+			}
+			orgID := due.qBucket.GetEdgeOrgID()
+			if _, ok := dueByOrg[orgID]; !ok {
+				orgs = append(orgs, orgID)
+			}
+			dueByOrg[orgID] = append(dueByOrg[orgID], due)
+		}
+		if len(s.entries) == 0 {
+			wait = time.Hour
+		}
+		s.gatherPending(dueByOrg)
+		s.lock.Unlock()
+
+		for _, orgID := range orgs {
+			jobs = append(jobs, dueByOrg[orgID])
+		}
+		if len(jobs) > 0 {
+			for _, job := range jobs {
+				//blocks while all workers are busy, which bounds the load on the counter service.
+				select {
+				case s.jobs <- job:
+				case <-s.stop:
+					return
+				}
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wakeup:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// gatherPending moves the buckets with pending weight of the orgs in dueByOrg off the heap and into their org's batch,
+// so their weight is synced before they are due. they are rescheduled from the time of this sync.
+// only the buckets of the due orgs are looked at. the ones being synced are off the heap already.
+func (s *syncScheduler) gatherPending(dueByOrg map[string][]*syncEntry) {
+	for orgID := range dueByOrg {
+		for aSyncBucket, entry := range s.scheduledOrgs[orgID] {
+			if entry.index >= 0 && aSyncBucket.getPendingCount() > 0 {
+				heap.Remove(&s.entries, entry.index)
+				dueByOrg[orgID] = append(dueByOrg[orgID], entry)
+			}
+		}
+	}
+}
+
+func (s *syncScheduler) worker() {
+	defer s.workers.Done()
+	for entries := range s.jobs {
+		var keepSyncing []bool
+		if replay := entries[0].replay; replay != nil {
+			keepSyncing = []bool{quotaWAL != nil && quotaWAL.retryReplay(*replay)}
+		} else {
+			keepSyncing = syncAsyncBuckets(entries)
+		}
+
+		s.lock.Lock()
+		for i, entry := range entries {
+			if entry.removed && !s.keepEvicted(entry, keepSyncing[i]) {
+				continue
+			}
+			if keepSyncing[i] {
+				entry.nextSync = time.Now().Add(entry.interval + s.jitter(entry.interval))
+				heap.Push(&s.entries, entry)
+			} else if entry.replay == nil {
+				s.removeScheduled(entry.qBucket.GetAsyncQuotaBucket(), entry)
+			}
+		}
+		metrics.SetAsyncScheduledBuckets(len(s.scheduled))
+		s.lock.Unlock()
+		s.notify()
+	}
+}
+
+// keepEvicted reschedules a bucket unscheduled on eviction during its sync, when the sync failed and gave the bucket
+// back weight to flush. it is called with the lock held, and reports if the bucket is scheduled again.
+func (s *syncScheduler) keepEvicted(entry *syncEntry, keepSyncing bool) bool {
+	if !keepSyncing || s.stopped || entry.replay != nil {
+		return false
+	}
+	aSyncBucket := entry.qBucket.GetAsyncQuotaBucket()
+	if _, ok := s.scheduled[aSyncBucket]; ok || aSyncBucket.getPendingCount() == 0 {
+		return false
+	}
+	entry.removed = false
+	s.addScheduled(aSyncBucket, entry)
+	return true
+}
+
+// syncAsyncBuckets syncs the buckets with the counter service and reports for each if it should stay scheduled.
+// buckets without local traffic for more than MaxIdleSyncCount syncs in a row are removed from the cache.
+func syncAsyncBuckets(entries []*syncEntry) []bool {
+	keepSyncing := make([]bool, len(entries))
+	qBuckets := make([]*QuotaBucket, 0, len(entries))
+	for _, entry := range entries {
+		aSyncBucket := entry.qBucket.GetAsyncQuotaBucket()
+		if aSyncBucket == nil {
+			continue
+		}
+		aSyncBucket.countIdleSync()
+		qBuckets = append(qBuckets, entry.qBucket)
+	}
+
+	//sync with counterService.
+	if err := internalRefreshBatch(context.Background(), qBuckets); err != nil {
+		globalVariables.Log.Error("error during internalRefreshBatch: ", err.Error(), " for org: ", entries[0].qBucket.GetEdgeOrgID())
+		for i := range entries {
+			keepSyncing[i] = entries[i].qBucket.GetAsyncQuotaBucket() != nil
+		}
+		return keepSyncing
+	}
+
+	for i, entry := range entries {
+		q := entry.qBucket
+		aSyncBucket := q.GetAsyncQuotaBucket()
+		if aSyncBucket == nil {
+			continue
+		}
+		//an evicted bucket is synced until its weight is flushed.
+		if aSyncBucket.isEvicted() {
+			keepSyncing[i] = aSyncBucket.getPendingCount() > 0
+			continue
+		}
+		//requests since the sync keep the bucket, weight counted after the eviction is sent by the request.
+		if !aSyncBucket.evictIfIdle() {
+			keepSyncing[i] = true
+			continue
+		}
+		cacheKey := q.GetEdgeOrgID() + constants.CacheKeyDelimiter + q.GetID()
+		quotaCachelock.Lock()
+		qBucketCache, ok := quotaCache[cacheKey]
+		quotaCachelock.Unlock()
+		if ok && qBucketCache.qBucket.GetAsyncQuotaBucket() == aSyncBucket {
+			removeFromCache(cacheKey, qBucketCache)
+		}
+	}
+	return keepSyncing
+}
+
+type syncEntryHeap []*syncEntry
+
+func (h syncEntryHeap) Len() int { return len(h) }
+
+func (h syncEntryHeap) Less(i, j int) bool { return h[i].nextSync.Before(h[j].nextSync) }
+
+func (h syncEntryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *syncEntryHeap) Push(x interface{}) {
+	entry := x.(*syncEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *syncEntryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
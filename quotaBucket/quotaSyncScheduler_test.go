@@ -0,0 +1,281 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowCounterBackend takes delay to answer each batch, and records how many batches were in flight at once.
+type slowCounterBackend struct {
+	services.CounterBackend
+	delay       time.Duration
+	batches     int64
+	inFlight    int64
+	maxInFlight int64
+}
+
+func (b *slowCounterBackend) BatchIncrementAndGetCount(ctx context.Context, entries []services.CounterEntry) ([]int64, error) {
+	inFlight := atomic.AddInt64(&b.inFlight, 1)
+	defer atomic.AddInt64(&b.inFlight, -1)
+	for {
+		maxInFlight := atomic.LoadInt64(&b.maxInFlight)
+		if inFlight <= maxInFlight || atomic.CompareAndSwapInt64(&b.maxInFlight, maxInFlight, inFlight) {
+			break
+		}
+	}
+	atomic.AddInt64(&b.batches, 1)
+	time.Sleep(b.delay)
+	return make([]int64, len(entries)), nil
+}
+
+var _ = Describe("Test sync scheduler", func() {
+	useRedisCounterBackend()
+
+	asyncRequest := func(edgeOrgID string, id string) *QuotaBucket {
+		return fromAPIRequest(quotaRequest(edgeOrgID, id, map[string]interface{}{"synchronous": false, "syncTimeInSec": float64(3600)}))
+	}
+
+	It("test syncs in flight are bounded by the concurrency", func() {
+		backend := &slowCounterBackend{delay: 50 * time.Millisecond}
+		services.SetCounterBackend(backend)
+		scheduler := NewSyncScheduler(2, 0)
+		defer scheduler.Shutdown(time.Second)
+
+		//buckets of different orgs are synced with a batch each.
+		for i := 0; i < 8; i++ {
+			scheduler.Schedule(newAsyncBucket("schedulerOrg"+strconv.Itoa(i), "app"), 10*time.Millisecond)
+		}
+		Eventually(func() int64 {
+			return atomic.LoadInt64(&backend.batches)
+		}, 5*time.Second).Should(BeNumerically(">=", 16))
+		Expect(atomic.LoadInt64(&backend.maxInFlight)).To(Equal(int64(2)))
+	})
+
+	It("test jitter is spread below the jitter percentage of the interval", func() {
+		scheduler := NewSyncScheduler(1, 20)
+		defer scheduler.Shutdown(time.Second)
+
+		interval := 10 * time.Second
+		minJitter, maxJitter := interval, time.Duration(0)
+		for i := 0; i < 1000; i++ {
+			jitter := scheduler.Jitter(interval)
+			Expect(jitter).To(BeNumerically(">=", 0))
+			Expect(jitter).To(BeNumerically("<", 2*time.Second))
+			if jitter < minJitter {
+				minJitter = jitter
+			}
+			if jitter > maxJitter {
+				maxJitter = jitter
+			}
+		}
+		Expect(minJitter).To(BeNumerically("<", 200*time.Millisecond))
+		Expect(maxJitter).To(BeNumerically(">", 1800*time.Millisecond))
+
+		Expect(NewSyncScheduler(1, 0).Jitter(interval)).To(BeZero())
+	})
+
+	It("test evicted aSyncQuotaBucket is unscheduled", func() {
+		qBucket := asyncRequest("schedulerOrgEvict", "app")
+		Expect(IsCached("schedulerOrgEvict", "app")).To(BeTrue())
+		Expect(IsSyncScheduled(qBucket)).To(BeTrue())
+
+		ExpireCachedBucket("schedulerOrgEvict", "app")
+		Expect(IsCached("schedulerOrgEvict", "app")).To(BeFalse())
+		Expect(IsSyncScheduled(qBucket)).To(BeFalse())
+	})
+
+	It("test aSyncQuotaBucket is evicted after MaxIdleSyncCount idle syncs", func() {
+		qBucket := asyncRequest("schedulerOrgIdle", "app")
+		_, err := qBucket.IncrementQuotaLimit(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		//the sync with pending weight is not idle.
+		Expect(SyncAsyncBucket(qBucket)).To(BeTrue())
+		for i := 0; i < constants.MaxIdleSyncCount; i++ {
+			Expect(SyncAsyncBucket(qBucket)).To(BeTrue())
+		}
+		Expect(IsCached("schedulerOrgIdle", "app")).To(BeTrue())
+
+		Expect(SyncAsyncBucket(qBucket)).To(BeFalse())
+		Expect(IsCached("schedulerOrgIdle", "app")).To(BeFalse())
+		Expect(IsSyncScheduled(qBucket)).To(BeFalse())
+	})
+
+	It("test idle syncs are counted again after any request", func() {
+		qBucket := asyncRequest("schedulerOrgActive", "app")
+		for i := 0; i < constants.MaxIdleSyncCount; i++ {
+			Expect(SyncAsyncBucket(qBucket)).To(BeTrue())
+		}
+
+		//a request over maxCount is not counted, but it is traffic all the same.
+		rejected := fromAPIRequest(quotaRequest("schedulerOrgActive", "app", map[string]interface{}{
+			"synchronous":   false,
+			"syncTimeInSec": float64(3600),
+			"weight":        float64(200),
+		}))
+		Expect(isAdmitted(rejected)).To(BeFalse())
+		for i := 0; i < constants.MaxIdleSyncCount; i++ {
+			Expect(SyncAsyncBucket(qBucket)).To(BeTrue())
+		}
+		Expect(IsCached("schedulerOrgActive", "app")).To(BeTrue())
+
+		Expect(SyncAsyncBucket(qBucket)).To(BeFalse())
+		Expect(IsCached("schedulerOrgActive", "app")).To(BeFalse())
+	})
+})
+
+// batchRecorder records the keys of each batch sent to the counter service, before passing it on to next.
+type batchRecorder struct {
+	next    http.Handler
+	lock    sync.Mutex
+	batches [][]string
+}
+
+func (h *batchRecorder) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	bodyBytes, _ := ioutil.ReadAll(req.Body)
+	batch := struct {
+		Entries []counterService.Entry `json:"entries"`
+	}{}
+	json.Unmarshal(bodyBytes, &batch)
+	keys := make([]string, 0, len(batch.Entries))
+	for _, entry := range batch.Entries {
+		keys = append(keys, entry.Key)
+	}
+	h.lock.Lock()
+	h.batches = append(h.batches, keys)
+	h.lock.Unlock()
+	req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	h.next.ServeHTTP(res, req)
+}
+
+// batchWith returns the first batch with key.
+func (h *batchRecorder) batchWith(key string) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, batch := range h.batches {
+		for _, batchKey := range batch {
+			if batchKey == key {
+				return batch
+			}
+		}
+	}
+	return nil
+}
+
+var _ = Describe("Test batch sync with the counter service", func() {
+	testUtil.UseConfig()
+
+	Context("against the counter service", func() {
+		service := useCounterService()
+		var recorder *batchRecorder
+
+		BeforeEach(func() {
+			recorder = &batchRecorder{next: service.server.Config.Handler}
+			service.server.Config.Handler = recorder
+		})
+
+		It("test due bucket is synced with the pending buckets of its org in one batch", func() {
+			due := newAsyncBucket("batchOrg", "due")
+			pendingA := newAsyncBucket("batchOrg", "pendingA")
+			pendingB := newAsyncBucket("batchOrg", "pendingB")
+			idle := newAsyncBucket("batchOrg", "idle")
+			otherOrg := newAsyncBucket("batchOtherOrg", "pending")
+			incrementTimes(pendingA, 2)
+			incrementTimes(pendingB, 3)
+			incrementTimes(otherOrg, 1)
+			Expect(PendingWeight(pendingA)).To(BeEquivalentTo(2))
+
+			scheduler := NewSyncScheduler(1, 0)
+			defer scheduler.Shutdown(time.Second)
+			scheduler.Schedule(pendingA, time.Hour)
+			scheduler.Schedule(pendingB, time.Hour)
+			scheduler.Schedule(idle, time.Hour)
+			scheduler.Schedule(otherOrg, time.Hour)
+			scheduler.Schedule(due, 10*time.Millisecond)
+
+			Eventually(func() []string {
+				return recorder.batchWith("due")
+			}, 5*time.Second).ShouldNot(BeNil())
+			Expect(recorder.batchWith("due")).To(ConsistOf("due", "pendingA", "pendingB"))
+			Expect(PendingWeight(pendingA)).To(BeZero())
+			Expect(PendingWeight(pendingB)).To(BeZero())
+			Expect(PendingWeight(otherOrg)).To(BeEquivalentTo(1))
+
+			//the synced buckets stay scheduled at their own interval.
+			Expect(scheduler.IsScheduled(pendingA)).To(BeTrue())
+			Expect(scheduler.IsScheduled(idle)).To(BeTrue())
+		})
+
+		It("test buckets are gathered by their org until unscheduled", func() {
+			first := newAsyncBucket("batchOrgIndex", "first")
+			second := newAsyncBucket("batchOrgIndex", "second")
+			other := newAsyncBucket("batchOtherOrgIndex", "app")
+
+			scheduler := NewSyncScheduler(1, 0)
+			defer scheduler.Shutdown(time.Second)
+			scheduler.Schedule(first, time.Hour)
+			scheduler.Schedule(second, time.Hour)
+			scheduler.Schedule(other, time.Hour)
+			Expect(scheduler.ScheduledForOrg("batchOrgIndex")).To(Equal(2))
+			Expect(scheduler.ScheduledForOrg("batchOtherOrgIndex")).To(Equal(1))
+
+			scheduler.Unschedule(first)
+			Expect(scheduler.ScheduledForOrg("batchOrgIndex")).To(Equal(1))
+			scheduler.Unschedule(second)
+			Expect(scheduler.ScheduledForOrg("batchOrgIndex")).To(BeZero())
+
+			scheduler.Shutdown(time.Second)
+			Expect(scheduler.ScheduledForOrg("batchOtherOrgIndex")).To(BeZero())
+		})
+
+		It("test failed batch keeps the pending weight for the next sync", func() {
+			qBucket := newAsyncBucket("batchOrgRetry", "app")
+			incrementTimes(qBucket, 3)
+			Expect(PendingWeight(qBucket)).To(BeEquivalentTo(3))
+
+			service.server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusInternalServerError)
+			})
+			Expect(SyncAsyncBucket(qBucket)).To(BeTrue())
+			Expect(PendingWeight(qBucket)).To(BeEquivalentTo(3))
+
+			service.server.Config.Handler = recorder
+			Expect(SyncAsyncBucket(qBucket)).To(BeTrue())
+			Expect(PendingWeight(qBucket)).To(BeZero())
+			Expect(recorder.batchWith("app")).To(Equal([]string{"app"}))
+
+			counted, err := service.store.Take(func(entry counterService.Entry) bool { return entry.OrgID == "batchOrgRetry" })
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counted).To(HaveLen(1))
+			Expect(counted[0].Delta).To(BeEquivalentTo(3))
+		})
+	})
+})
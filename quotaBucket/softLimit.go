@@ -0,0 +1,217 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket
+
+import (
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/metrics"
+	"github.com/apid/apidQuota/notifier"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotaThresholds reports when the count of a quotaBucket reaches percentages of maxCount,
+// each percentage once per period.
+type quotaThresholds struct {
+	percents []int64 //sorted, without duplicates.
+}
+
+// thresholdReport keeps the percentages of maxCount already reported for a period of a quotaBucket.
+type thresholdReport struct {
+	lock        sync.Mutex
+	periodStart int64
+	expires     int64 //after this the count of the period cannot matter any more.
+	reported    map[int64]bool
+}
+
+// thresholdReports keeps the thresholdReport of each quotaBucket by cacheKey, apart from the cache,
+// so a threshold is still reported once per period after the quotaBucket is evicted and looked up again.
+var thresholdReports = struct {
+	sync.Mutex
+	byCacheKey map[string]*thresholdReport
+}{byCacheKey: make(map[string]*thresholdReport)}
+
+func getThresholdReport(cacheKey string) *thresholdReport {
+	thresholdReports.Lock()
+	defer thresholdReports.Unlock()
+	report, ok := thresholdReports.byCacheKey[cacheKey]
+	if !ok {
+		report = &thresholdReport{reported: make(map[int64]bool)}
+		thresholdReports.byCacheKey[cacheKey] = report
+	}
+	return report
+}
+
+// releaseThresholdReport forgets the thresholdReport of an evicted quotaBucket once its period is over.
+// until then it is kept, in case the quotaBucket is looked up again in the same period.
+func releaseThresholdReport(cacheKey string) {
+	thresholdReports.Lock()
+	defer thresholdReports.Unlock()
+	report, ok := thresholdReports.byCacheKey[cacheKey]
+	if !ok {
+		return
+	}
+	report.lock.Lock()
+	expires := report.expires
+	report.lock.Unlock()
+	if remaining := time.Until(time.Unix(expires, 0)); remaining > 0 {
+		time.AfterFunc(remaining, func() {
+			releaseExpiredThresholdReport(cacheKey, report)
+		})
+		return
+	}
+	delete(thresholdReports.byCacheKey, cacheKey)
+}
+
+// releaseExpiredThresholdReport forgets the thresholdReport, unless the quotaBucket was used since in a later period.
+func releaseExpiredThresholdReport(cacheKey string, report *thresholdReport) {
+	thresholdReports.Lock()
+	defer thresholdReports.Unlock()
+	if thresholdReports.byCacheKey[cacheKey] != report {
+		return
+	}
+	report.lock.Lock()
+	expired := !time.Unix(report.expires, 0).After(time.Now())
+	report.lock.Unlock()
+	if expired {
+		delete(thresholdReports.byCacheKey, cacheKey)
+	}
+}
+
+func newQuotaThresholds(percents []int64) (*quotaThresholds, error) {
+	sorted := make([]int64, 0, len(percents))
+	seen := make(map[int64]bool, len(percents))
+	for _, percent := range percents {
+		if percent <= 0 {
+			return nil, errors.New(constants.InvalidThresholds + " : thresholds should be positive percentages of maxCount, got " +
+				strconv.FormatInt(percent, 10))
+		}
+		if !seen[percent] {
+			seen[percent] = true
+			sorted = append(sorted, percent)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &quotaThresholds{percents: sorted}, nil
+}
+
+// cross returns the percentages reached by count and not reported yet in the period.
+// rolling windows have no fixed period, their percentages are reported again once the count went back below them.
+func (t *quotaThresholds) cross(q *QuotaBucket, periodStart int64, periodEnd int64, count int64) []int64 {
+	report := getThresholdReport(q.GetEdgeOrgID() + constants.CacheKeyDelimiter + q.GetID())
+	report.lock.Lock()
+	defer report.lock.Unlock()
+
+	rollingWindow := q.GetType() == constants.QuotaTypeRollingWindow
+	if !rollingWindow && report.periodStart != periodStart {
+		report.periodStart = periodStart
+		report.reported = make(map[int64]bool)
+	}
+	report.expires = periodEnd
+	if rollingWindow {
+		report.expires = periodEnd + (periodEnd - periodStart)
+	}
+
+	crossed := make([]int64, 0)
+	maxCount := q.GetMaxCount()
+	for _, percent := range t.percents {
+		reached := count*100 >= maxCount*percent
+		if reached && !report.reported[percent] {
+			report.reported[percent] = true
+			crossed = append(crossed, percent)
+		}
+		if !reached && rollingWindow {
+			delete(report.reported, percent)
+		}
+	}
+	return crossed
+}
+
+// SetSoftLimit lets the quotaBucket admit overagePercent of maxCount over maxCount.
+// requests admitted over maxCount are flagged as overage.
+func (q *QuotaBucket) SetSoftLimit(overagePercent int64) error {
+	if overagePercent < 0 {
+		return errors.New(constants.InvalidSoftLimit + " : softLimit should be a percentage of maxCount of 0 or more, got " +
+			strconv.FormatInt(overagePercent, 10))
+	}
+	q.quotaBucketData.SoftLimit = overagePercent
+	return nil
+}
+
+func (q *QuotaBucket) GetSoftLimit() int64 {
+	return q.quotaBucketData.SoftLimit
+}
+
+// SetThresholds makes the quotaBucket report when its count reaches each of the given percentages of maxCount,
+// once per period.
+func (q *QuotaBucket) SetThresholds(percents []int64) error {
+	if len(percents) == 0 {
+		q.quotaBucketData.Thresholds = nil
+		return nil
+	}
+	thresholds, err := newQuotaThresholds(percents)
+	if err != nil {
+		return err
+	}
+	q.quotaBucketData.Thresholds = thresholds
+	return nil
+}
+
+func (q *QuotaBucket) setLimits(softLimit int64, thresholds []int64) error {
+	if err := q.SetSoftLimit(softLimit); err != nil {
+		return err
+	}
+	return q.SetThresholds(thresholds)
+}
+
+// getAdmissionLimit is the count up to which requests are admitted, maxCount and the overage allowed by the soft limit.
+func (q *QuotaBucket) getAdmissionLimit() int64 {
+	maxCount := q.GetMaxCount()
+	return maxCount + maxCount*q.GetSoftLimit()/100
+}
+
+// checkLimits flags the results of a request admitted over maxCount, and the thresholds its count reached.
+// the thresholds reached and the rejected requests are notified, once per period.
+func (q *QuotaBucket) checkLimits(results *QuotaBucketResults) {
+	metrics.RecordDecision(q.GetEdgeOrgID(), results.exceeded)
+	results.overage = !results.exceeded && results.currentCount > q.GetMaxCount()
+	if thresholds := q.quotaBucketData.Thresholds; thresholds != nil {
+		results.crossedThresholds = thresholds.cross(q, results.startTimestamp, results.expiresTimestamp, results.currentCount)
+	}
+
+	for _, threshold := range results.crossedThresholds {
+		notification := q.newNotification(constants.NotificationEventThreshold, results)
+		notification.Threshold = threshold
+		notifier.Notify(notification)
+	}
+	if results.exceeded {
+		notifier.Notify(q.newNotification(constants.NotificationEventExceeded, results))
+	}
+}
+
+func (q *QuotaBucket) newNotification(event string, results *QuotaBucketResults) notifier.Notification {
+	return notifier.Notification{
+		Event:            event,
+		EdgeOrgID:        q.GetEdgeOrgID(),
+		ID:               q.GetID(),
+		Count:            results.currentCount,
+		MaxCount:         q.GetMaxCount(),
+		StartTimestamp:   results.startTimestamp,
+		ExpiresTimestamp: results.expiresTimestamp,
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quotaBucket_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/apid/apidQuota/notifier"
+	. "github.com/apid/apidQuota/quotaBucket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Test soft limits and thresholds", func() {
+	useRedisCounterBackend()
+	ctx := context.Background()
+
+	It("test invalid soft limits and thresholds", func() {
+		qBucket, err := NewQuotaBucket("sampleOrg", "sampleID", 1, "hour", "calendar", false,
+			testStartTime, 10, 1, true, true, -1, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetSoftLimit(-1)).NotTo(Succeed())
+		Expect(qBucket.SetThresholds([]int64{50, 0})).NotTo(Succeed())
+		Expect(qBucket.SetThresholds(nil)).To(Succeed())
+
+		quotaMap := map[string]interface{}{
+			"edgeOrgID":             "sampleOrg",
+			"id":                    "invalidThresholds",
+			"interval":              float64(1),
+			"timeUnit":              "hour",
+			"type":                  "calendar",
+			"preciseAtSecondsLevel": false,
+			"maxCount":              float64(10),
+			"weight":                float64(1),
+			"distributed":           true,
+			"synchronous":           true,
+			"thresholds":            []interface{}{float64(50), "80"},
+		}
+		err = (&QuotaBucket{}).FromAPIRequest(quotaMap)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("'thresholds' should be a list of numbers"))
+
+		quotaMap["thresholds"] = []interface{}{float64(50)}
+		quotaMap["softLimit"] = float64(-10)
+		err = (&QuotaBucket{}).FromAPIRequest(quotaMap)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("test synchronous quotaBucket admits the overage and reports each threshold once", func() {
+		qBucket, err := NewQuotaBucket("sampleOrg", "syncSoftLimit", 1, "hour", "calendar", false,
+			testStartTime, 10, 1, true, true, -1, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetSoftLimit(20)).To(Succeed())
+		Expect(qBucket.SetThresholds([]int64{100, 50, 80})).To(Succeed())
+
+		crossed := make(map[int][]int64)
+		for i := 1; i <= 12; i++ {
+			resp := incrementQuota(qBucket)
+			Expect(resp["exceeded"]).To(BeFalse())
+			Expect(resp["overage"]).To(Equal(i > 10))
+			if len(resp["crossedThresholds"].([]int64)) > 0 {
+				crossed[i] = resp["crossedThresholds"].([]int64)
+			}
+			if i >= 10 {
+				Expect(resp["remainingCount"]).To(Equal(int64(0)))
+			}
+		}
+		Expect(crossed).To(Equal(map[int][]int64{5: {50}, 8: {80}, 10: {100}}))
+
+		//past the soft limit the requests are rejected.
+		resp := incrementQuota(qBucket)
+		Expect(resp["exceeded"]).To(BeTrue())
+		Expect(resp["overage"]).To(BeFalse())
+		Expect(resp["crossedThresholds"]).To(BeEmpty())
+	})
+
+	It("test weight over several thresholds reports all of them", func() {
+		qBucket, err := NewQuotaBucket("sampleOrg", "heavySoftLimit", 1, "hour", "calendar", false,
+			testStartTime, 10, 9, true, true, -1, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetThresholds([]int64{50, 80, 100})).To(Succeed())
+
+		resp := incrementQuota(qBucket)
+		Expect(resp["exceeded"]).To(BeFalse())
+		Expect(resp["crossedThresholds"]).To(Equal([]int64{50, 80}))
+		resp = incrementQuota(qBucket)
+		Expect(resp["exceeded"]).To(BeTrue())
+		Expect(resp["crossedThresholds"]).To(BeEmpty())
+	})
+
+	It("test thresholds are reported once per period after the quotaBucket is evicted", func() {
+		quotaMap := quotaRequest("thresholdEvictOrg", "app", map[string]interface{}{
+			"maxCount":   float64(4),
+			"thresholds": []interface{}{float64(50), float64(100)},
+		})
+		Expect(incrementQuota(fromAPIRequest(quotaMap))["crossedThresholds"]).To(BeEmpty())
+		Expect(incrementQuota(fromAPIRequest(quotaMap))["crossedThresholds"]).To(Equal([]int64{50}))
+
+		ExpireCachedBucket("thresholdEvictOrg", "app")
+		Expect(IsCached("thresholdEvictOrg", "app")).To(BeFalse())
+
+		Expect(incrementQuota(fromAPIRequest(quotaMap))["crossedThresholds"]).To(BeEmpty())
+		Expect(incrementQuota(fromAPIRequest(quotaMap))["crossedThresholds"]).To(Equal([]int64{100}))
+	})
+
+	It("test aSyncQuotaBucket admits the overage", func() {
+		qBucket, err := NewQuotaBucket("sampleOrg", "asyncSoftLimit", 1, "hour", "calendar", false,
+			testStartTime, 10, 1, true, false, 3600, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetSoftLimit(50)).To(Succeed())
+		Expect(qBucket.SetThresholds([]int64{100, 150})).To(Succeed())
+
+		for i := 1; i <= 15; i++ {
+			resp := incrementQuota(qBucket)
+			Expect(resp["exceeded"]).To(BeFalse())
+			Expect(resp["overage"]).To(Equal(i > 10))
+			switch i {
+			case 10:
+				Expect(resp["crossedThresholds"]).To(Equal([]int64{100}))
+			case 15:
+				Expect(resp["crossedThresholds"]).To(Equal([]int64{150}))
+			default:
+				Expect(resp["crossedThresholds"]).To(BeEmpty())
+			}
+		}
+		Expect(incrementQuota(qBucket)["exceeded"]).To(BeTrue())
+	})
+
+	It("test leased quotaBucket leases the overage", func() {
+		qBucket, err := NewLeasedQuotaBucket("sampleOrg", "leasedSoftLimit", 1, "hour", "calendar", false,
+			testStartTime, 10, 1, 50)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetSoftLimit(20)).To(Succeed())
+
+		for i := 1; i <= 12; i++ {
+			resp := incrementQuota(qBucket)
+			Expect(resp["exceeded"]).To(BeFalse())
+			Expect(resp["overage"]).To(Equal(i > 10))
+		}
+		Expect(incrementQuota(qBucket)["exceeded"]).To(BeTrue())
+		Expect(qBucket.ReleaseLease(ctx)).To(Succeed())
+	})
+
+	It("test thresholds and rejected requests are notified", func() {
+		received := make(chan notifier.Notification, 10)
+		webhook := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			notification := notifier.Notification{}
+			Expect(json.NewDecoder(req.Body).Decode(&notification)).To(Succeed())
+			received <- notification
+		}))
+		defer webhook.Close()
+		notifier.SetNotifier(notifier.NewWebhookNotifier(webhook.URL, "secret", 10, 0, 0, 0, 0))
+		defer notifier.SetNotifier(nil)
+
+		qBucket, err := NewQuotaBucket("sampleOrg", "notifiedSoftLimit", 1, "hour", "calendar", false,
+			testStartTime, 2, 1, true, true, -1, -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(qBucket.SetThresholds([]int64{100})).To(Succeed())
+		for i := 0; i < 4; i++ {
+			incrementQuota(qBucket)
+		}
+		Expect(notifier.Shutdown(time.Second)).To(Succeed())
+
+		Expect(received).To(HaveLen(2))
+		notification := <-received
+		Expect(notification.Event).To(Equal("threshold"))
+		Expect(notification.Threshold).To(Equal(int64(100)))
+		Expect(notification.Count).To(Equal(int64(2)))
+		notification = <-received
+		Expect(notification.Event).To(Equal("exceeded"))
+		Expect(notification.ID).To(Equal("notifiedSoftLimit"))
+	})
+})
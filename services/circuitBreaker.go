@@ -0,0 +1,133 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// UnavailableError is returned when the counter service could not be reached:
+// the circuit breaker is open, or the call failed after all retries.
+type UnavailableError struct {
+	message string
+}
+
+func (e *UnavailableError) Error() string {
+	return e.message
+}
+
+// IsUnavailable reports if err means the counter service could not be reached, as opposed to rejecting the request.
+func IsUnavailable(err error) bool {
+	_, ok := err.(*UnavailableError)
+	return ok
+}
+
+// circuitBreaker stops calls to the counter service after failureThreshold consecutive failures.
+// after openTimeout a single trial call is let through, which closes the circuit again if it succeeds.
+type circuitBreaker struct {
+	lock                sync.Mutex
+	state               int
+	consecutiveFailures int
+	openedAt            time.Time
+	trialInFlight       bool
+	now                 func() time.Time
+}
+
+var counterServiceBreaker = &circuitBreaker{now: time.Now}
+
+func (cb *circuitBreaker) getSettings() (int, time.Duration) {
+	failureThreshold := constants.DefaultCircuitBreakerFailureThreshold
+	openTimeout := constants.DefaultCircuitBreakerOpenTimeout
+	if globalVariables.Config != nil {
+		if threshold := globalVariables.Config.GetInt(constants.ConfigCircuitBreakerFailureThreshold); threshold > 0 {
+			failureThreshold = threshold
+		}
+		if timeout := globalVariables.Config.GetDuration(constants.ConfigCircuitBreakerOpenTimeout); timeout > 0 {
+			openTimeout = timeout
+		}
+	}
+	return failureThreshold, openTimeout
+}
+
+// allow returns an UnavailableError when calls to the counter service are not allowed.
+func (cb *circuitBreaker) allow() error {
+	_, openTimeout := cb.getSettings()
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if cb.now().Sub(cb.openedAt) < openTimeout {
+			return &UnavailableError{constants.CounterServiceCircuitOpen}
+		}
+		cb.state = circuitHalfOpen
+		cb.trialInFlight = true
+		return nil
+	case circuitHalfOpen:
+		if cb.trialInFlight {
+			return &UnavailableError{constants.CounterServiceCircuitOpen}
+		}
+		cb.trialInFlight = true
+		return nil
+	}
+	return nil
+}
+
+func (cb *circuitBreaker) recordSuccess() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.state = circuitClosed
+	cb.consecutiveFailures = 0
+	cb.trialInFlight = false
+}
+
+func (cb *circuitBreaker) recordFailure() {
+	failureThreshold, _ := cb.getSettings()
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.consecutiveFailures++
+	cb.trialInFlight = false
+	if cb.state == circuitHalfOpen || cb.consecutiveFailures >= failureThreshold {
+		if cb.state != circuitOpen {
+			globalVariables.Log.Warn("opening circuit breaker for counter service after ", cb.consecutiveFailures, " consecutive failures")
+		}
+		cb.state = circuitOpen
+		cb.openedAt = cb.now()
+	}
+}
+
+// releaseTrial lets another trial call through when the previous one ended without telling anything about the counter service.
+func (cb *circuitBreaker) releaseTrial() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.trialInFlight = false
+}
+
+// IsCircuitOpen reports if calls to the counter service are currently short-circuited.
+func IsCircuitOpen() bool {
+	counterServiceBreaker.lock.Lock()
+	defer counterServiceBreaker.lock.Unlock()
+	return counterServiceBreaker.state != circuitClosed
+}
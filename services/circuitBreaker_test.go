@@ -0,0 +1,107 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"github.com/apid/apidQuota/constants"
+	. "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Test circuit breaker", func() {
+	testUtil.UseConfig()
+
+	var now time.Time
+	var breaker *CircuitBreaker
+
+	BeforeEach(func() {
+		testUtil.GetConfig().Set(constants.ConfigCircuitBreakerFailureThreshold, 3)
+		testUtil.GetConfig().Set(constants.ConfigCircuitBreakerOpenTimeout, 10*time.Second)
+		now = time.Unix(1500000000, 0)
+		breaker = NewCircuitBreaker(func() time.Time { return now })
+	})
+
+	open := func() {
+		for i := 0; i < 3; i++ {
+			Expect(breaker.Allow()).To(Succeed())
+			breaker.RecordFailure()
+		}
+		Expect(breaker.IsOpen()).To(BeTrue())
+	}
+
+	It("test circuit opens after the failure threshold of consecutive failures", func() {
+		Expect(breaker.Allow()).To(Succeed())
+		breaker.RecordFailure()
+		breaker.RecordFailure()
+		breaker.RecordSuccess()
+		breaker.RecordFailure()
+		breaker.RecordFailure()
+		Expect(breaker.IsOpen()).To(BeFalse())
+		Expect(breaker.Allow()).To(Succeed())
+
+		breaker.RecordFailure()
+		Expect(breaker.IsOpen()).To(BeTrue())
+		err := breaker.Allow()
+		Expect(IsUnavailable(err)).To(BeTrue())
+		Expect(err.Error()).To(Equal(constants.CounterServiceCircuitOpen))
+	})
+
+	It("test open circuit lets a single trial through after the open timeout", func() {
+		open()
+		now = now.Add(9 * time.Second)
+		Expect(IsUnavailable(breaker.Allow())).To(BeTrue())
+
+		now = now.Add(time.Second)
+		Expect(breaker.Allow()).To(Succeed())
+		//the other calls wait for the outcome of the trial.
+		Expect(IsUnavailable(breaker.Allow())).To(BeTrue())
+		Expect(breaker.IsOpen()).To(BeTrue())
+	})
+
+	It("test successful trial closes the circuit", func() {
+		open()
+		now = now.Add(10 * time.Second)
+		Expect(breaker.Allow()).To(Succeed())
+		breaker.RecordSuccess()
+		Expect(breaker.IsOpen()).To(BeFalse())
+		Expect(breaker.Allow()).To(Succeed())
+		Expect(breaker.Allow()).To(Succeed())
+	})
+
+	It("test failed trial opens the circuit for another open timeout", func() {
+		open()
+		now = now.Add(10 * time.Second)
+		Expect(breaker.Allow()).To(Succeed())
+		breaker.RecordFailure()
+		Expect(breaker.IsOpen()).To(BeTrue())
+
+		now = now.Add(9 * time.Second)
+		Expect(IsUnavailable(breaker.Allow())).To(BeTrue())
+		now = now.Add(time.Second)
+		Expect(breaker.Allow()).To(Succeed())
+	})
+
+	It("test released trial lets the next call through as trial", func() {
+		open()
+		now = now.Add(10 * time.Second)
+		Expect(breaker.Allow()).To(Succeed())
+		breaker.ReleaseTrial()
+		Expect(breaker.Allow()).To(Succeed())
+		Expect(IsUnavailable(breaker.Allow())).To(BeTrue())
+	})
+})
@@ -0,0 +1,401 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/apid/apidQuota/cluster"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/tracing"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterCounterBackend keeps the counts on the apid nodes themselves, without a central counter service.
+// every edgeOrgID|id is owned by one node of the consistent hash ring: the owner counts it in its embedded
+// counter service, the other nodes forward their increments, batched for async buckets, to the owner.
+// when the membership changes, the counters a node no longer owns are handed off to their new owner.
+type ClusterCounterBackend struct {
+	self       string
+	basePath   string //of the embedded counter service on the peers
+	localStore counterService.Store
+	replicas   int
+
+	lock sync.RWMutex
+	ring *cluster.HashRing
+
+	stopLock sync.Mutex
+	stop     chan struct{}
+}
+
+func NewClusterCounterBackend(self string, peers []string, localStore counterService.Store, basePath string, replicas int) *ClusterCounterBackend {
+	self = strings.TrimSuffix(self, "/")
+	return &ClusterCounterBackend{
+		self:       self,
+		basePath:   basePath,
+		localStore: localStore,
+		replicas:   replicas,
+		ring:       cluster.NewHashRing(append(peers, self), replicas),
+	}
+}
+
+func newClusterCounterBackend(localStore counterService.Store) (CounterBackend, error) {
+	config := globalVariables.Config
+	if localStore == nil {
+		return nil, errors.New(constants.ClusterLocalStoreNotSet)
+	}
+	self := config.GetString(constants.ConfigClusterSelf)
+	if self == "" {
+		return nil, errors.New(constants.ClusterSelfNotSet)
+	}
+
+	peers, err := discoverClusterPeers()
+	if err != nil {
+		return nil, err
+	}
+	backend := NewClusterCounterBackend(self, peers, localStore,
+		config.GetString(constants.ConfigEmbeddedCounterServiceBasePath), config.GetInt(constants.ConfigClusterVirtualNodes))
+	globalVariables.Log.Info("apidQuota cluster members: ", backend.getRing().Nodes())
+
+	//counters left from a previous membership, e.g. in the file store, go to their owners.
+	go backend.logHandOff(backend.handOff(context.Background()))
+
+	if interval := config.GetDuration(constants.ConfigClusterRefreshInterval); interval > 0 {
+		backend.startMembershipRefresh(interval)
+	}
+	return backend, nil
+}
+
+func discoverClusterPeers() ([]string, error) {
+	config := globalVariables.Config
+	staticPeers := make([]string, 0)
+	if peers := config.GetString(constants.ConfigClusterPeers); peers != "" {
+		staticPeers = strings.Split(peers, ",")
+	}
+	return cluster.DiscoverPeers(staticPeers, config.GetString(constants.ConfigClusterDNSName),
+		config.GetString(constants.ConfigClusterDNSScheme), config.GetString(constants.ConfigClusterDNSPort))
+}
+
+func (b *ClusterCounterBackend) startMembershipRefresh(interval time.Duration) {
+	b.stopLock.Lock()
+	stop := make(chan struct{})
+	b.stop = stop
+	b.stopLock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				peers, err := discoverClusterPeers()
+				if err != nil {
+					globalVariables.Log.Error("error refreshing apidQuota cluster members: ", err.Error())
+					continue
+				}
+				if b.getRing().SameNodes(append(peers, b.self)) {
+					continue
+				}
+				globalVariables.Log.Info("apidQuota cluster members changed to: ", peers)
+				b.logHandOff(b.SetPeers(context.Background(), peers))
+			}
+		}
+	}()
+}
+
+func (b *ClusterCounterBackend) logHandOff(moved int, err error) {
+	if err != nil {
+		globalVariables.Log.Error("error handing off quota counters to their owners: ", err.Error())
+	}
+	if moved > 0 {
+		globalVariables.Log.Info("handed off ", moved, " quota counters to their owners")
+	}
+}
+
+// SetPeers changes the members of the cluster and hands off the counters this node no longer owns.
+// it returns the number of counters handed off.
+func (b *ClusterCounterBackend) SetPeers(ctx context.Context, peers []string) (int, error) {
+	b.lock.Lock()
+	b.ring = cluster.NewHashRing(append(peers, b.self), b.replicas)
+	b.lock.Unlock()
+	return b.handOff(ctx)
+}
+
+// Leave hands off all the counters of this node to the other members, before it shuts down.
+func (b *ClusterCounterBackend) Leave(ctx context.Context) (int, error) {
+	b.stopLock.Lock()
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+	b.stopLock.Unlock()
+
+	others := b.otherMembers()
+	if len(others) == 0 {
+		return 0, nil
+	}
+	b.lock.Lock()
+	b.ring = cluster.NewHashRing(others, b.replicas)
+	b.lock.Unlock()
+	return b.handOff(ctx)
+}
+
+func (b *ClusterCounterBackend) otherMembers() []string {
+	others := make([]string, 0)
+	for _, node := range b.getRing().Nodes() {
+		if node != b.self {
+			others = append(others, node)
+		}
+	}
+	return others
+}
+
+func (b *ClusterCounterBackend) getRing() *cluster.HashRing {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.ring
+}
+
+func (b *ClusterCounterBackend) owner(ring *cluster.HashRing, orgID string, quotaKey string) string {
+	return ring.Owner(orgID + constants.CacheKeyDelimiter + quotaKey)
+}
+
+// handOff sends the counters owned by other nodes to their owner. counters which could not be sent are kept.
+func (b *ClusterCounterBackend) handOff(ctx context.Context) (int, error) {
+	ring := b.getRing()
+	taken, err := b.localStore.Take(func(entry counterService.Entry) bool {
+		return b.owner(ring, entry.OrgID, entry.Key) != b.self
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	byOwner := make(map[string][]counterService.Entry)
+	for _, entry := range taken {
+		owner := b.owner(ring, entry.OrgID, entry.Key)
+		byOwner[owner] = append(byOwner[owner], entry)
+	}
+
+	moved := 0
+	var handOffErr error
+	for owner, entries := range byOwner {
+		idempotencyKey, err := newIdempotencyKey()
+		if err == nil {
+			_, err = b.forward(ctx, owner, entries, idempotencyKey, true)
+		}
+		if err != nil {
+			//keep them, the next hand off tries again.
+			if _, restoreErr := b.localStore.Adjust(entries); restoreErr != nil {
+				return moved, errors.New("unable to restore quota counters: " + restoreErr.Error())
+			}
+			handOffErr = errors.New("unable to hand off quota counters to: " + owner + ", error: " + err.Error())
+			continue
+		}
+		moved += len(entries)
+	}
+	return moved, handOffErr
+}
+
+func (b *ClusterCounterBackend) IncrementAndGetCount(ctx context.Context, orgID string, quotaKey string, count int64, startTimeInt int64, endTimeInt int64) (int64, error) {
+	counts, err := b.BatchIncrementAndGetCount(ctx, []CounterEntry{{
+		OrgID:     orgID,
+		Key:       quotaKey,
+		Delta:     count,
+		StartTime: startTimeInt,
+		EndTime:   endTimeInt,
+	}})
+	if err != nil {
+		return 0, err
+	}
+	return counts[0], nil
+}
+
+// BatchIncrementAndGetCount counts the entries owned by this node locally, and forwards the others to their owner.
+func (b *ClusterCounterBackend) BatchIncrementAndGetCount(ctx context.Context, entries []CounterEntry) ([]int64, error) {
+	ring := b.getRing()
+	byOwner := make(map[string][]counterService.Entry)
+	indexesByOwner := make(map[string][]int)
+	for i, entry := range entries {
+		owner := b.owner(ring, entry.OrgID, entry.Key)
+		byOwner[owner] = append(byOwner[owner], counterService.Entry{
+			OrgID:     entry.OrgID,
+			Key:       entry.Key,
+			Delta:     entry.Delta,
+			StartTime: entry.StartTime * int64(1000),
+			EndTime:   entry.EndTime * int64(1000),
+		})
+		indexesByOwner[owner] = append(indexesByOwner[owner], i)
+	}
+
+	idempotencyKey, err := getIdempotencyKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int64, len(entries))
+	for owner, ownerEntries := range byOwner {
+		var ownerCounts []int64
+		if owner == b.self {
+			ownerCounts, err = b.localStore.Adjust(ownerEntries)
+		} else {
+			ownerCounts, err = b.forward(ctx, owner, ownerEntries, idempotencyKey+constants.CacheKeyDelimiter+owner, hasNegativeDelta(ownerEntries))
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, index := range indexesByOwner[owner] {
+			counts[index] = ownerCounts[i]
+		}
+	}
+	return counts, nil
+}
+
+// ResetCount resets the counters owned by this node. the counter service protocol has no reset to forward.
+func (b *ClusterCounterBackend) ResetCount(ctx context.Context, orgID string, quotaKey string, startTimeInt int64, endTimeInt int64) error {
+	if b.owner(b.getRing(), orgID, quotaKey) != b.self {
+		return errors.New(constants.CounterResetNotSupported + " : for counters owned by other cluster members")
+	}
+	_, err := b.localStore.Take(func(entry counterService.Entry) bool {
+		return entry.OrgID == orgID && entry.Key == quotaKey &&
+			entry.StartTime == startTimeInt*int64(1000) && entry.EndTime == endTimeInt*int64(1000)
+	})
+	return err
+}
+
+// Ping calls the health path of the embedded counter service of the other members, within one health check timeout.
+// the counters owned by this node are kept in its local store, and a member which cannot be reached
+// only fails the keys it owns, so Ping only fails when none of the other members can be reached.
+func (b *ClusterCounterBackend) Ping(ctx context.Context) error {
+	others := b.otherMembers()
+	if len(others) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, getHealthCheckTimeout())
+	defer cancel()
+
+	results := make(chan error, len(others))
+	for _, member := range others {
+		go func(member string) {
+			results <- checkHealth(ctx, member+b.basePath+constants.EmbeddedCounterServiceHealthPath)
+		}(member)
+	}
+	var err error
+	for range others {
+		if err = <-results; err == nil {
+			return nil
+		}
+	}
+	return errors.New("no cluster member is reachable, last error: " + err.Error())
+}
+
+// forward sends the entries to the embedded counter service of the owner, retrying as per the retry policy.
+// the idempotency key makes the retries safe. a peer which cannot be reached is reported as unavailable.
+// adjust sends them to the adjust path, which takes negative deltas and the counters handed off.
+func (b *ClusterCounterBackend) forward(ctx context.Context, owner string, entries []counterService.Entry, idempotencyKey string, adjust bool) ([]int64, error) {
+	reqBytes, err := json.Marshal(map[string]interface{}{batchEntries: entries})
+	if err != nil {
+		return nil, errors.New(constants.MarshalJSONError)
+	}
+	batchURL := owner + b.basePath + constants.CounterServiceBatchPathDefault
+	if adjust {
+		batchURL = owner + b.basePath + constants.CounterServiceAdjustPath
+	}
+
+	policy := getRetryPolicy()
+	for attempt := 0; ; attempt++ {
+		counts, retryable, err := b.forwardOnce(ctx, policy.attemptTimeout, batchURL, reqBytes, idempotencyKey, len(entries))
+		if err == nil {
+			return counts, nil
+		}
+		if !retryable {
+			return nil, err
+		}
+		if attempt >= policy.maxRetries || policy.wait(ctx, attempt) != nil {
+			return nil, &UnavailableError{"cluster member: " + owner + " is unavailable, error: " + err.Error()}
+		}
+	}
+}
+
+func (b *ClusterCounterBackend) forwardOnce(ctx context.Context, attemptTimeout time.Duration, batchURL string, reqBytes []byte, idempotencyKey string, entryCount int) ([]int64, bool, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, attemptTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", batchURL, bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, false, errors.New(constants.URLCounterServiceInvalid + " : " + batchURL)
+	}
+	req = req.WithContext(attemptCtx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(constants.IdempotencyKeyHeader, idempotencyKey)
+	tracing.Inject(ctx, req.Header)
+	if err := getAuthProvider().authorize(req, reqBytes); err != nil {
+		return nil, false, errors.New("error authorizing request to cluster member: " + err.Error())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, errors.New("error calling cluster member: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, errors.New("unable to read response from cluster member, error: " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		retryable := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retryable, errors.New("response from cluster member: " + resp.Status + " and response body is: " + string(respBytes))
+	}
+
+	respBody := struct {
+		Entries []struct {
+			Count int64 `json:"count"`
+		} `json:"entries"`
+	}{}
+	if err := json.Unmarshal(respBytes, &respBody); err != nil {
+		return nil, false, errors.New("unable to parse response from cluster member, error: " + err.Error())
+	}
+	if len(respBody.Entries) != entryCount {
+		return nil, false, errors.New("invalid response from cluster member. expected " + strconv.Itoa(entryCount) +
+			" entries in the response, received: " + strconv.Itoa(len(respBody.Entries)))
+	}
+
+	counts := make([]int64, 0, entryCount)
+	for _, entry := range respBody.Entries {
+		counts = append(counts, entry.Count)
+	}
+	return counts, false, nil
+}
+
+func hasNegativeDelta(entries []counterService.Entry) bool {
+	for _, entry := range entries {
+		if entry.Delta < 0 {
+			return true
+		}
+	}
+	return false
+}
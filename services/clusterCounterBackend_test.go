@@ -0,0 +1,194 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"context"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const testClusterBasePath = "/counterService"
+
+func takeAll(store counterService.Store) map[string]int64 {
+	entries, err := store.Take(func(counterService.Entry) bool { return true })
+	Expect(err).NotTo(HaveOccurred())
+	counts := make(map[string]int64)
+	for _, entry := range entries {
+		counts[entry.Key] = entry.Delta
+	}
+	return counts
+}
+
+// newPeerService returns the embedded counter service of a cluster member, taking the peers' requests unauthenticated.
+func newPeerService(store counterService.Store) *counterService.CounterService {
+	service := counterService.NewCounterService(store)
+	service.SetPeerAuthenticator(counterService.NewOpenAuthenticator())
+	return service
+}
+
+var _ = Describe("Test ClusterCounterBackend", func() {
+	var storeA, storeB counterService.Store
+	var serverA, serverB *httptest.Server
+	var ctx context.Context
+	var now int64
+
+	BeforeEach(func() {
+		storeA = counterService.NewMemoryStore()
+		storeB = counterService.NewMemoryStore()
+		serverA = httptest.NewServer(newPeerService(storeA))
+		serverB = httptest.NewServer(newPeerService(storeB))
+		ctx = context.Background()
+		now = time.Now().Unix()
+	})
+
+	AfterEach(func() {
+		serverA.Close()
+		serverB.Close()
+	})
+
+	It("test every key is counted on its owner", func() {
+		backendA := NewClusterCounterBackend(serverA.URL, []string{serverB.URL}, storeA, testClusterBasePath, 100)
+		backendB := NewClusterCounterBackend(serverB.URL, []string{serverA.URL}, storeB, testClusterBasePath, 100)
+
+		for i := 0; i < 20; i++ {
+			key := "testKey" + strconv.Itoa(i)
+			count, err := backendA.IncrementAndGetCount(ctx, "testOrg", key, 1, now, now+3600)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(int64(1)))
+			count, err = backendB.IncrementAndGetCount(ctx, "testOrg", key, 2, now, now+3600)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(int64(3)))
+		}
+
+		countsA := takeAll(storeA)
+		countsB := takeAll(storeB)
+		Expect(len(countsA)).To(BeNumerically(">", 0))
+		Expect(len(countsB)).To(BeNumerically(">", 0))
+		Expect(len(countsA) + len(countsB)).To(Equal(20))
+		for key, count := range countsA {
+			Expect(countsB).NotTo(HaveKey(key))
+			Expect(count).To(Equal(int64(3)))
+		}
+	})
+
+	It("test batch increment across owners", func() {
+		backendA := NewClusterCounterBackend(serverA.URL, []string{serverB.URL}, storeA, testClusterBasePath, 100)
+		entries := make([]CounterEntry, 0)
+		for i := 0; i < 10; i++ {
+			entries = append(entries, CounterEntry{OrgID: "testOrg", Key: "testKey" + strconv.Itoa(i), Delta: int64(i), StartTime: now, EndTime: now + 3600})
+		}
+		counts, err := backendA.BatchIncrementAndGetCount(ctx, entries)
+		Expect(err).NotTo(HaveOccurred())
+		for i, count := range counts {
+			Expect(count).To(Equal(int64(i)))
+		}
+	})
+
+	It("test counters are handed off when members change", func() {
+		backendA := NewClusterCounterBackend(serverA.URL, nil, storeA, testClusterBasePath, 100)
+		for i := 0; i < 20; i++ {
+			_, err := backendA.IncrementAndGetCount(ctx, "testOrg", "testKey"+strconv.Itoa(i), 2, now, now+3600)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		handedOff, err := backendA.SetPeers(ctx, []string{serverB.URL})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(handedOff).To(BeNumerically(">", 0))
+		Expect(handedOff).To(BeNumerically("<", 20))
+
+		backendB := NewClusterCounterBackend(serverB.URL, []string{serverA.URL}, storeB, testClusterBasePath, 100)
+		for i := 0; i < 20; i++ {
+			count, err := backendB.IncrementAndGetCount(ctx, "testOrg", "testKey"+strconv.Itoa(i), 0, now, now+3600)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(int64(2)))
+		}
+
+		//leaving hands off everything to the remaining member.
+		moved, err := backendA.Leave(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(moved).To(Equal(20 - handedOff))
+		Expect(takeAll(storeA)).To(BeEmpty())
+		Expect(len(takeAll(storeB))).To(Equal(20))
+	})
+
+	It("test traceparent is forwarded to the owner", func() {
+		var lock sync.Mutex
+		traceparents := make([]string, 0)
+		serverB.Close()
+		serviceB := newPeerService(storeB)
+		serverB = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			lock.Lock()
+			traceparents = append(traceparents, req.Header.Get("traceparent"))
+			lock.Unlock()
+			serviceB.ServeHTTP(res, req)
+		}))
+		backendA := NewClusterCounterBackend(serverA.URL, []string{serverB.URL}, storeA, testClusterBasePath, 100)
+
+		incoming := http.Header{}
+		incoming.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		tracedCtx := tracing.Extract(ctx, incoming)
+		//enough keys for some of them to be owned by B, wherever the members land on the ring.
+		for i := 0; i < 50; i++ {
+			_, err := backendA.IncrementAndGetCount(tracedCtx, "testOrg", "testKey"+strconv.Itoa(i), 1, now, now+3600)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(traceparents).NotTo(BeEmpty())
+		for _, traceparent := range traceparents {
+			Expect(traceparent).To(Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+		}
+	})
+
+	It("test unreachable member is reported as unavailable", func() {
+		serverB.Close()
+		backendA := NewClusterCounterBackend(serverA.URL, []string{serverB.URL}, storeA, testClusterBasePath, 100)
+
+		//enough keys for each member to own some, wherever the members land on the ring.
+		unavailable := 0
+		for i := 0; i < 50; i++ {
+			_, err := backendA.IncrementAndGetCount(ctx, "testOrg", "testKey"+strconv.Itoa(i), 1, now, now+3600)
+			if err != nil {
+				Expect(IsUnavailable(err)).To(BeTrue())
+				unavailable++
+			}
+		}
+		Expect(unavailable).To(BeNumerically(">", 0))
+		Expect(unavailable).To(BeNumerically("<", 50))
+	})
+
+	It("test ping probes the other members", func() {
+		alone := NewClusterCounterBackend(serverA.URL, nil, storeA, testClusterBasePath, 100)
+		Expect(alone.Ping(ctx)).To(Succeed())
+
+		backendA := NewClusterCounterBackend(serverA.URL, []string{serverB.URL}, storeA, testClusterBasePath, 100)
+		Expect(backendA.Ping(ctx)).To(Succeed())
+
+		serverB.Close()
+		err := backendA.Ping(ctx)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("no cluster member is reachable"))
+	})
+})
@@ -0,0 +1,198 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/metrics"
+	"github.com/apid/apidQuota/tracing"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CounterBackend keeps the distributed counts. start and end times are in seconds.
+type CounterBackend interface {
+	IncrementAndGetCount(ctx context.Context, orgID string, quotaKey string, count int64, startTimeInt int64, endTimeInt int64) (int64, error)
+	BatchIncrementAndGetCount(ctx context.Context, entries []CounterEntry) ([]int64, error)
+	ResetCount(ctx context.Context, orgID string, quotaKey string, startTimeInt int64, endTimeInt int64) error
+	// Ping checks that the counts can be reached, without counting.
+	Ping(ctx context.Context) error
+}
+
+// CounterEntry is one {orgId, key, delta, startTime, endTime} entry of a batch increment.
+type CounterEntry struct {
+	OrgID         string
+	Key           string
+	Delta         int64
+	StartTime     int64
+	EndTime       int64
+	SlidingWindow bool //counted over the window ending at EndTime, instead of in a fixed period.
+}
+
+var backendLock sync.RWMutex
+var counterBackend CounterBackend = &httpCounterBackend{}
+
+func getCounterBackend() CounterBackend {
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+	return counterBackend
+}
+
+// InitCounterBackend sets the counter backend as per the config: the counter service, redis, or the cluster.
+// localStore is the store of the embedded counter service, needed by the cluster backend.
+func InitCounterBackend(localStore counterService.Store) error {
+	var backend CounterBackend
+	switch strings.ToLower(globalVariables.Config.GetString(constants.ConfigCounterBackend)) {
+	case constants.CounterBackendHTTP:
+		backend = &httpCounterBackend{}
+	case constants.CounterBackendRedis:
+		redisBackend, err := newRedisCounterBackend()
+		if err != nil {
+			return err
+		}
+		backend = redisBackend
+	case constants.CounterBackendCluster:
+		clusterBackend, err := newClusterCounterBackend(localStore)
+		if err != nil {
+			return err
+		}
+		backend = clusterBackend
+	default:
+		return errors.New(constants.InvalidCounterBackend + " : " + globalVariables.Config.GetString(constants.ConfigCounterBackend))
+	}
+
+	SetCounterBackend(backend)
+	return nil
+}
+
+// SetCounterBackend sets the counter backend in place of the configured one.
+func SetCounterBackend(backend CounterBackend) {
+	backendLock.Lock()
+	counterBackend = backend
+	backendLock.Unlock()
+}
+
+// ShutdownCounterBackend hands off the counters kept on this node to the other cluster members, in cluster mode.
+func ShutdownCounterBackend(timeout time.Duration) {
+	clusterBackend, ok := getCounterBackend().(*ClusterCounterBackend)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	clusterBackend.logHandOff(clusterBackend.Leave(ctx))
+}
+
+type slidingWindowCtxKey struct{}
+
+// WithSlidingWindow returns a context whose counts are over the window ending at the end time, instead of in a fixed period.
+func WithSlidingWindow(ctx context.Context) context.Context {
+	return context.WithValue(ctx, slidingWindowCtxKey{}, true)
+}
+
+func isSlidingWindow(ctx context.Context) bool {
+	slidingWindow, _ := ctx.Value(slidingWindowCtxKey{}).(bool)
+	return slidingWindow
+}
+
+func GetCount(ctx context.Context, orgID string, quotaKey string, startTimeInt int64, endTimeInt int64) (int64, error) {
+
+	return IncrementAndGetCount(ctx, orgID, quotaKey, 0, startTimeInt, endTimeInt)
+}
+
+func IncrementAndGetCount(ctx context.Context, orgID string, quotaKey string, count int64, startTimeInt int64, endTimeInt int64) (int64, error) {
+	ctx, span := tracing.Start(ctx, "IncrementAndGetCount", tracing.QuotaAttributes(orgID, quotaKey)...)
+	backend := getCounterBackend()
+	start := time.Now()
+	globalCount, err := backend.IncrementAndGetCount(ctx, orgID, quotaKey, count, startTimeInt, endTimeInt)
+	recordCounterBackendCall(ctx, backend, constants.MetricsOperationIncrement, time.Since(start), err)
+	tracing.End(span, err)
+	return globalCount, err
+}
+
+// BatchIncrementAndGetCount increments all the entries at once. the counts are returned in the same order as the entries.
+func BatchIncrementAndGetCount(ctx context.Context, entries []CounterEntry) ([]int64, error) {
+	ctx, span := tracing.Start(ctx, "BatchIncrementAndGetCount")
+	backend := getCounterBackend()
+	start := time.Now()
+	counts, err := backend.BatchIncrementAndGetCount(ctx, entries)
+	recordCounterBackendCall(ctx, backend, constants.MetricsOperationBatchIncrement, time.Since(start), err)
+	tracing.End(span, err)
+	return counts, err
+}
+
+// recordCounterBackendCall records the latency of a call to the counter backend, and its error if it failed.
+func recordCounterBackendCall(ctx context.Context, backend CounterBackend, operation string, latency time.Duration, err error) {
+	name := getCounterBackendName(backend)
+	metrics.ObserveCounterServiceRequest(name, operation, latency)
+	switch {
+	case err == nil:
+		return
+	case IsUnavailable(err):
+		metrics.RecordCounterServiceError(name, operation, constants.MetricsCounterServiceUnavailable)
+	case ctx.Err() != nil:
+		metrics.RecordCounterServiceError(name, operation, constants.MetricsCounterServiceCancelled)
+	default:
+		metrics.RecordCounterServiceError(name, operation, constants.MetricsCounterServiceFailed)
+	}
+}
+
+func getCounterBackendName(backend CounterBackend) string {
+	switch backend.(type) {
+	case *httpCounterBackend:
+		return constants.CounterBackendHTTP
+	case *redisCounterBackend:
+		return constants.CounterBackendRedis
+	case *ClusterCounterBackend:
+		return constants.CounterBackendCluster
+	}
+	return constants.MetricsCounterServiceOther
+}
+
+// ResetCount sets the count of the period back to zero.
+func ResetCount(ctx context.Context, orgID string, quotaKey string, startTimeInt int64, endTimeInt int64) error {
+	return getCounterBackend().ResetCount(ctx, orgID, quotaKey, startTimeInt, endTimeInt)
+}
+
+// PingCounterBackend checks that the counter backend can be reached.
+func PingCounterBackend(ctx context.Context) error {
+	return getCounterBackend().Ping(ctx)
+}
+
+// CheckCounterBackendConfig returns the config errors that would otherwise only show at request time,
+// like a counter service url which is not set or cannot be parsed.
+func CheckCounterBackendConfig() error {
+	if _, ok := getCounterBackend().(*httpCounterBackend); !ok {
+		//the other backends check their config when they are created.
+		return nil
+	}
+	endpointURLs := counterServiceEndpoints.urls()
+	if len(endpointURLs) == 0 {
+		return errors.New(constants.URLCounterServiceNotSet)
+	}
+	for _, endpointURL := range endpointURLs {
+		serviceURL, err := url.Parse(endpointURL)
+		if err != nil || serviceURL.Scheme == "" || serviceURL.Host == "" {
+			return errors.New(constants.URLCounterServiceInvalid + " : " + endpointURL)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"context"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Test weight given back to the counter service", func() {
+	testUtil.UseConfig()
+
+	Context("with hmac signed requests", func() {
+		var ctx context.Context
+		var now int64
+
+		newSignedService := func(store counterService.Store, secret string) *counterService.CounterService {
+			service := counterService.NewCounterService(store)
+			service.SetPeerAuthenticator(counterService.NewHMACAuthenticator("key1", []byte(secret)))
+			return service
+		}
+
+		BeforeEach(func() {
+			ctx = context.Background()
+			now = time.Now().Unix()
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceAuthType, constants.AuthTypeHMAC)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHMACKeyID, "key1")
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHMACSecret, "secret")
+			Expect(InitCounterServiceAuth()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceAuthType, constants.AuthTypeApigeeSync)
+			Expect(InitCounterServiceAuth()).To(Succeed())
+		})
+
+		It("test negative delta is sent to the increment path of the counter service", func() {
+			handler := &recordingHandler{next: newSignedService(counterService.NewMemoryStore(), "secret")}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			testUtil.UseCounterService(server.URL)
+			defer testUtil.ResetCounterService()
+			backend := NewHTTPCounterBackend()
+
+			count, err := backend.IncrementAndGetCount(ctx, "adjustOrg", "app", 3, now, now+3600)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeEquivalentTo(3))
+			count, err = backend.IncrementAndGetCount(ctx, "adjustOrg", "app", -2, now, now+3600)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeEquivalentTo(1))
+
+			counts, err := backend.BatchIncrementAndGetCount(ctx, []CounterEntry{{OrgID: "adjustOrg", Key: "app", Delta: -1, StartTime: now, EndTime: now + 3600}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counts).To(Equal([]int64{0}))
+
+			//a counter service other than the embedded one only serves the increment paths.
+			requests := handler.getRequests()
+			Expect(requests).To(HaveLen(3))
+			Expect(requests[0].path).To(Equal("/"))
+			Expect(requests[1].path).To(Equal("/"))
+			Expect(requests[2].path).To(Equal(constants.CounterServiceBatchPathDefault))
+		})
+
+		It("test weight is given back to the owner, and refused by a member with another secret", func() {
+			storeA, storeB := counterService.NewMemoryStore(), counterService.NewMemoryStore()
+			serverA := httptest.NewServer(newSignedService(storeA, "secret"))
+			defer serverA.Close()
+			serverB := httptest.NewServer(newSignedService(storeB, "secret"))
+			defer serverB.Close()
+			backendA := NewClusterCounterBackend(serverA.URL, []string{serverB.URL}, storeA, testClusterBasePath, 100)
+
+			//enough keys for some of them to be owned by B, wherever the members land on the ring.
+			for i := 0; i < 20; i++ {
+				key := "testKey" + strconv.Itoa(i)
+				_, err := backendA.IncrementAndGetCount(ctx, "adjustOrg", key, 3, now, now+3600)
+				Expect(err).NotTo(HaveOccurred())
+				count, err := backendA.IncrementAndGetCount(ctx, "adjustOrg", key, -2, now, now+3600)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(count).To(BeEquivalentTo(1))
+			}
+			Expect(takeAll(storeB)).NotTo(BeEmpty())
+
+			serverB.Config.Handler = newSignedService(storeB, "otherSecret")
+			refused := 0
+			for i := 0; i < 20; i++ {
+				if _, err := backendA.IncrementAndGetCount(ctx, "adjustOrg", "testKey"+strconv.Itoa(i), -1, now, now+3600); err != nil {
+					Expect(err.Error()).To(ContainSubstring(constants.Unauthorized))
+					refused++
+				}
+			}
+			Expect(refused).To(BeNumerically(">", 0))
+		})
+	})
+})
@@ -0,0 +1,305 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	"github.com/apid/apidQuota/globalVariables"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authProvider authorizes the requests to the counter service.
+type authProvider interface {
+	// authorize sets the credentials on req. body is the request body, for providers signing it.
+	authorize(req *http.Request, body []byte) error
+	// refresh is called after the counter service answered 401.
+	// it returns an error when there are no new credentials to retry with.
+	refresh(ctx context.Context) error
+}
+
+var authLock sync.RWMutex
+var counterServiceAuth authProvider = &apigeeSyncAuth{}
+
+func getAuthProvider() authProvider {
+	authLock.RLock()
+	defer authLock.RUnlock()
+	return counterServiceAuth
+}
+
+// InitCounterServiceAuth sets the auth provider for the counter service as per the config.
+func InitCounterServiceAuth() error {
+	config := globalVariables.Config
+	var provider authProvider
+
+	switch strings.ToLower(config.GetString(constants.ConfigCounterServiceAuthType)) {
+	case constants.AuthTypeApigeeSync:
+		provider = &apigeeSyncAuth{}
+	case constants.AuthTypeStatic:
+		token := config.GetString(constants.ConfigCounterServiceAuthToken)
+		if token == "" {
+			return errors.New(constants.ConfigCounterServiceAuthToken + " should be set for auth type: " + constants.AuthTypeStatic)
+		}
+		provider = &staticBearerAuth{token: token}
+	case constants.AuthTypeOAuth2:
+		oauth := &oauth2ClientCredentialsAuth{
+			tokenURL:     config.GetString(constants.ConfigCounterServiceOAuth2TokenURL),
+			clientID:     config.GetString(constants.ConfigCounterServiceOAuth2ClientID),
+			clientSecret: config.GetString(constants.ConfigCounterServiceOAuth2ClientSecret),
+			scopes:       config.GetString(constants.ConfigCounterServiceOAuth2Scopes),
+		}
+		if oauth.tokenURL == "" || oauth.clientID == "" || oauth.clientSecret == "" {
+			return errors.New("token url, client id and client secret should be set for auth type: " + constants.AuthTypeOAuth2)
+		}
+		provider = oauth
+	case constants.AuthTypeHMAC:
+		signer := &hmacAuth{
+			keyID:  config.GetString(constants.ConfigCounterServiceHMACKeyID),
+			secret: []byte(config.GetString(constants.ConfigCounterServiceHMACSecret)),
+		}
+		if signer.keyID == "" || len(signer.secret) == 0 {
+			return errors.New("key id and secret should be set for auth type: " + constants.AuthTypeHMAC)
+		}
+		provider = signer
+	case constants.AuthTypeNone:
+		provider = &noAuth{}
+	default:
+		return errors.New(constants.InvalidAuthType + " : " + config.GetString(constants.ConfigCounterServiceAuthType))
+	}
+
+	authLock.Lock()
+	counterServiceAuth = provider
+	authLock.Unlock()
+	return nil
+}
+
+type noAuth struct{}
+
+func (a *noAuth) authorize(req *http.Request, body []byte) error {
+	return nil
+}
+
+func (a *noAuth) refresh(ctx context.Context) error {
+	return errors.New("no credentials to refresh")
+}
+
+// staticBearerAuth sends the same bearer token with every request.
+type staticBearerAuth struct {
+	token string
+}
+
+func (a *staticBearerAuth) authorize(req *http.Request, body []byte) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+func (a *staticBearerAuth) refresh(ctx context.Context) error {
+	return errors.New("static bearer token cannot be refreshed")
+}
+
+// apigeeSyncAuth sends the bearer token managed by apidApigeeSync, which keeps it updated in the config.
+type apigeeSyncAuth struct {
+	lock  sync.RWMutex
+	token string
+}
+
+func (a *apigeeSyncAuth) authorize(req *http.Request, body []byte) error {
+	a.lock.RLock()
+	token := a.token
+	a.lock.RUnlock()
+	if token == "" {
+		token = a.readToken()
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *apigeeSyncAuth) readToken() string {
+	token := ""
+	if globalVariables.Config != nil {
+		token = globalVariables.Config.GetString(constants.ApigeeSyncBearerToken)
+	}
+	a.lock.Lock()
+	a.token = token
+	a.lock.Unlock()
+	return token
+}
+
+// refresh picks up the token from the config again. retrying only helps if apidApigeeSync has rotated it.
+func (a *apigeeSyncAuth) refresh(ctx context.Context) error {
+	a.lock.RLock()
+	oldToken := a.token
+	a.lock.RUnlock()
+	if a.readToken() == oldToken {
+		return errors.New("apigeesync bearer token has not changed")
+	}
+	return nil
+}
+
+// oauth2ClientCredentialsAuth gets its bearer token from the token url with the client credentials grant.
+// the token url is called without the lock held, once for all the requests needing a new token at the same time.
+type oauth2ClientCredentialsAuth struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       string
+
+	lock      sync.Mutex
+	token     string
+	expiresAt time.Time
+	fetching  *oauth2TokenFetch //the call to the token url in flight, nil when there is none.
+}
+
+// oauth2TokenFetch is a call to the token url, shared by the requests waiting for its token.
+type oauth2TokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+func (a *oauth2ClientCredentialsAuth) authorize(req *http.Request, body []byte) error {
+	a.lock.Lock()
+	token, expiresAt := a.token, a.expiresAt
+	a.lock.Unlock()
+	//renew a little before expiry, so the token does not expire in flight.
+	if token == "" || time.Now().Add(constants.OAuth2TokenExpiryMargin).After(expiresAt) {
+		var err error
+		if token, err = a.renewToken(req.Context(), token); err != nil {
+			return err
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *oauth2ClientCredentialsAuth) refresh(ctx context.Context) error {
+	a.lock.Lock()
+	token := a.token
+	a.lock.Unlock()
+	_, err := a.renewToken(ctx, token)
+	return err
+}
+
+// renewToken returns a token other than staleToken. it joins the call to the token url in flight,
+// or makes one when there is none and no other request has renewed the token meanwhile.
+func (a *oauth2ClientCredentialsAuth) renewToken(ctx context.Context, staleToken string) (string, error) {
+	a.lock.Lock()
+	if a.token != "" && a.token != staleToken {
+		token := a.token
+		a.lock.Unlock()
+		return token, nil
+	}
+	fetch := a.fetching
+	if fetch == nil {
+		fetch = &oauth2TokenFetch{done: make(chan struct{})}
+		a.fetching = fetch
+		a.lock.Unlock()
+
+		var expiresAt time.Time
+		fetch.token, expiresAt, fetch.err = a.fetchToken(ctx)
+		a.lock.Lock()
+		if fetch.err == nil {
+			a.token, a.expiresAt = fetch.token, expiresAt
+		}
+		a.fetching = nil
+		a.lock.Unlock()
+		close(fetch.done)
+		return fetch.token, fetch.err
+	}
+	a.lock.Unlock()
+
+	select {
+	case <-fetch.done:
+		return fetch.token, fetch.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// fetchToken calls the token url and returns the token with its expiry.
+func (a *oauth2ClientCredentialsAuth) fetchToken(ctx context.Context) (string, time.Time, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if a.scopes != "" {
+		form.Set("scope", a.scopes)
+	}
+
+	req, err := http.NewRequest("POST", a.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, errors.New("error creating oauth2 token request: " + err.Error())
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, errors.New("error getting oauth2 token: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	respBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, errors.New("unable to read oauth2 token response, error: " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, errors.New("response from oauth2 token url: " + resp.Status + " and response body is: " + string(respBodyBytes))
+	}
+
+	tokenResp := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err := json.Unmarshal(respBodyBytes, &tokenResp); err != nil {
+		return "", time.Time{}, errors.New("unable to parse oauth2 token response, error: " + err.Error())
+	}
+	if tokenResp.AccessToken == "" {
+		return "", time.Time{}, errors.New(`invalid oauth2 token response. field 'access_token' not sent in the response`)
+	}
+
+	expiresAt := time.Now().Add(constants.DefaultOAuth2TokenLifetime)
+	if tokenResp.ExpiresIn > 0 {
+		expiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+	return tokenResp.AccessToken, expiresAt, nil
+}
+
+// hmacAuth signs every request with a shared secret:
+// HMAC-SHA256 over the method, path, date header and the sha256 of the body.
+type hmacAuth struct {
+	keyID  string
+	secret []byte
+}
+
+func (a *hmacAuth) authorize(req *http.Request, body []byte) error {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	req.Header.Set(constants.HMACDateHeader, date)
+	signature := counterService.HMACSignature(a.secret, req.Method, req.URL.RequestURI(), date, body)
+	req.Header.Set("Authorization", constants.HMACAlgorithm+" keyId="+a.keyID+",signature="+signature)
+	return nil
+}
+
+func (a *hmacAuth) refresh(ctx context.Context) error {
+	return errors.New("hmac signature cannot be refreshed")
+}
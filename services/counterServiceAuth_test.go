@@ -0,0 +1,188 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Test counter service auth", func() {
+	testUtil.UseConfig()
+
+	Context("against the counter service", func() {
+		var counterServiceHandler http.Handler
+		var server *httptest.Server
+		var backend CounterBackend
+		var now int64
+
+		increment := func() (int64, error) {
+			return backend.IncrementAndGetCount(context.Background(), "authOrg", "app", 1, now-60, now+60)
+		}
+
+		BeforeEach(func() {
+			counterServiceHandler = counterService.NewCounterService(counterService.NewMemoryStore())
+			server = httptest.NewServer(counterServiceHandler)
+			testUtil.UseCounterService(server.URL)
+			backend = NewHTTPCounterBackend()
+			now = time.Now().Unix()
+		})
+
+		AfterEach(func() {
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceAuthType, constants.AuthTypeApigeeSync)
+			Expect(InitCounterServiceAuth()).To(Succeed())
+			testUtil.ResetCounterService()
+			server.Close()
+		})
+
+		It("test requests are signed with the hmac of the method, path, date and body", func() {
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceAuthType, constants.AuthTypeHMAC)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHMACKeyID, "key1")
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHMACSecret, "secret")
+			Expect(InitCounterServiceAuth()).To(Succeed())
+
+			var authorization, expected string
+			server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				bodyHash := sha256.Sum256(body)
+				mac := hmac.New(sha256.New, []byte("secret"))
+				mac.Write([]byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + req.Header.Get("X-Apid-Date") + "\n" + hex.EncodeToString(bodyHash[:])))
+				authorization = req.Header.Get("Authorization")
+				expected = "HMAC-SHA256 keyId=key1,signature=" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+				res.Write([]byte(`{"count":1}`))
+			})
+
+			_, err := increment()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(authorization).To(Equal(expected))
+		})
+
+		It("test hmac auth needs a key id and a secret", func() {
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceAuthType, constants.AuthTypeHMAC)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHMACKeyID, "key1")
+			Expect(InitCounterServiceAuth()).NotTo(Succeed())
+		})
+
+		Context("with oauth2 client credentials", func() {
+			var tokenServer *httptest.Server
+			var lock sync.Mutex
+			var tokensIssued int
+			var rejectedToken string
+
+			BeforeEach(func() {
+				tokensIssued, rejectedToken = 0, ""
+				tokenServer = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+					clientID, clientSecret, _ := req.BasicAuth()
+					if clientID != "client" || clientSecret != "secret" || req.FormValue("grant_type") != "client_credentials" {
+						res.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					//slow enough for concurrent requests to need the token at the same time.
+					time.Sleep(50 * time.Millisecond)
+					lock.Lock()
+					tokensIssued++
+					token := "token-" + strconv.Itoa(tokensIssued)
+					lock.Unlock()
+					res.Write([]byte(`{"access_token":"` + token + `","expires_in":3600}`))
+				}))
+				server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+					lock.Lock()
+					rejected := req.Header.Get("Authorization") == "Bearer "+rejectedToken
+					lock.Unlock()
+					if rejected || req.Header.Get("Authorization") == "" {
+						res.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					counterServiceHandler.ServeHTTP(res, req)
+				})
+
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceAuthType, constants.AuthTypeOAuth2)
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceOAuth2TokenURL, tokenServer.URL)
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceOAuth2ClientID, "client")
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceOAuth2ClientSecret, "secret")
+				Expect(InitCounterServiceAuth()).To(Succeed())
+			})
+
+			AfterEach(func() {
+				tokenServer.Close()
+			})
+
+			getTokensIssued := func() int {
+				lock.Lock()
+				defer lock.Unlock()
+				return tokensIssued
+			}
+
+			It("test token is fetched once for concurrent requests, and reused until it expires", func() {
+				var wg sync.WaitGroup
+				errs := make(chan error, 10)
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := increment()
+						errs <- err
+					}()
+				}
+				wg.Wait()
+				close(errs)
+				for err := range errs {
+					Expect(err).NotTo(HaveOccurred())
+				}
+				Expect(getTokensIssued()).To(Equal(1))
+
+				_, err := increment()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(getTokensIssued()).To(Equal(1))
+			})
+
+			It("test request rejected with 401 is sent again with a new token", func() {
+				_, err := increment()
+				Expect(err).NotTo(HaveOccurred())
+				lock.Lock()
+				rejectedToken = "token-1"
+				lock.Unlock()
+
+				count, err := increment()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(count).To(BeEquivalentTo(2))
+				Expect(getTokensIssued()).To(Equal(2))
+			})
+
+			It("test failed token request fails the request", func() {
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceOAuth2ClientSecret, "wrong")
+				Expect(InitCounterServiceAuth()).To(Succeed())
+				_, err := increment()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("oauth2 token"))
+			})
+		})
+	})
+})
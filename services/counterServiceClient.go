@@ -0,0 +1,89 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// InitCounterServiceClient builds the http client for the counter service from the config:
+// CA bundle and client certificate for TLS and mTLS, connection pooling, keep-alive, HTTP/2 and proxy.
+func InitCounterServiceClient() error {
+	config := globalVariables.Config
+
+	tlsConfig := &tls.Config{}
+	if caBundlePath := config.GetString(constants.ConfigCounterServiceCABundle); caBundlePath != "" {
+		caBundle, err := ioutil.ReadFile(caBundlePath)
+		if err != nil {
+			return errors.New("unable to read counter service CA bundle: " + err.Error())
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caBundle) {
+			return errors.New("no valid certificates in counter service CA bundle: " + caBundlePath)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	clientCertPath := config.GetString(constants.ConfigCounterServiceClientCert)
+	clientKeyPath := config.GetString(constants.ConfigCounterServiceClientKey)
+	if clientCertPath != "" || clientKeyPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+		if err != nil {
+			return errors.New("unable to load counter service client certificate: " + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if proxyURL := config.GetString(constants.ConfigCounterServiceProxyURL); proxyURL != "" {
+		parsedProxyURL, err := url.Parse(proxyURL)
+		if err != nil {
+			return errors.New("invalid counter service proxy url: " + err.Error())
+		}
+		proxy = http.ProxyURL(parsedProxyURL)
+	}
+
+	keepAlive := config.GetDuration(constants.ConfigCounterServiceKeepAlive)
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   constants.DefaultCounterServiceDialTimeout,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConns:        config.GetInt(constants.ConfigCounterServiceMaxIdleConns),
+		MaxIdleConnsPerHost: config.GetInt(constants.ConfigCounterServiceMaxIdleConnsPerHost),
+		IdleConnTimeout:     config.GetDuration(constants.ConfigCounterServiceIdleConnTimeout),
+		DisableKeepAlives:   keepAlive < 0,
+		ForceAttemptHTTP2:   config.GetBool(constants.ConfigCounterServiceHTTP2),
+	}
+	if !config.GetBool(constants.ConfigCounterServiceHTTP2) {
+		//a non-nil empty map disables HTTP/2.
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	client = &http.Client{
+		Transport: transport,
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// writeClientCertificate writes a self-signed client certificate and its key under dir, and returns the certificate.
+func writeClientCertificate(dir string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "apidQuota-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	Expect(ioutil.WriteFile(filepath.Join(dir, "client.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(filepath.Join(dir, "client.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+	cert, err := x509.ParseCertificate(certDER)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+var _ = Describe("Test counter service client", func() {
+	testUtil.UseConfig()
+
+	Context("with TLS settings", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "apidQuotaTLS")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			//back to a client without TLS settings.
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceCABundle, "")
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceClientCert, "")
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceClientKey, "")
+			Expect(InitCounterServiceClient()).To(Succeed())
+			os.RemoveAll(dir)
+		})
+
+		It("test invalid CA bundle is rejected", func() {
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceCABundle, filepath.Join(dir, "missing.pem"))
+			Expect(InitCounterServiceClient()).NotTo(Succeed())
+
+			Expect(ioutil.WriteFile(filepath.Join(dir, "invalid.pem"), []byte("not a certificate"), 0600)).To(Succeed())
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceCABundle, filepath.Join(dir, "invalid.pem"))
+			Expect(InitCounterServiceClient()).NotTo(Succeed())
+		})
+
+		It("test client certificate without its key is rejected", func() {
+			writeClientCertificate(dir)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceClientCert, filepath.Join(dir, "client.crt"))
+			Expect(InitCounterServiceClient()).NotTo(Succeed())
+		})
+
+		Context("against a counter service requiring client certificates", func() {
+			var server *httptest.Server
+			var backend CounterBackend
+			var lock sync.Mutex
+			var peerNames []string
+
+			BeforeEach(func() {
+				clientCert := writeClientCertificate(dir)
+				clientCAs := x509.NewCertPool()
+				clientCAs.AddCert(clientCert)
+
+				peerNames = nil
+				counterServiceHandler := counterService.NewCounterService(counterService.NewMemoryStore())
+				server = httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+					lock.Lock()
+					for _, peerCert := range req.TLS.PeerCertificates {
+						peerNames = append(peerNames, peerCert.Subject.CommonName)
+					}
+					lock.Unlock()
+					counterServiceHandler.ServeHTTP(res, req)
+				}))
+				server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+				server.StartTLS()
+				Expect(ioutil.WriteFile(filepath.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)).To(Succeed())
+
+				testUtil.UseCounterService(server.URL)
+				backend = NewHTTPCounterBackend()
+			})
+
+			AfterEach(func() {
+				testUtil.ResetCounterService()
+				server.Close()
+			})
+
+			increment := func() (int64, error) {
+				now := time.Now().Unix()
+				return backend.IncrementAndGetCount(context.Background(), "tlsOrg", "app", 1, now-60, now+60)
+			}
+
+			It("test counter service is reached with the CA bundle and the client certificate", func() {
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceCABundle, filepath.Join(dir, "ca.pem"))
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceClientCert, filepath.Join(dir, "client.crt"))
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceClientKey, filepath.Join(dir, "client.key"))
+				Expect(InitCounterServiceClient()).To(Succeed())
+
+				count, err := increment()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(count).To(BeEquivalentTo(1))
+				lock.Lock()
+				defer lock.Unlock()
+				Expect(peerNames).To(Equal([]string{"apidQuota-test"}))
+			})
+
+			It("test counter service rejects the client without a client certificate", func() {
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceCABundle, filepath.Join(dir, "ca.pem"))
+				Expect(InitCounterServiceClient()).To(Succeed())
+
+				_, err := increment()
+				Expect(err).To(HaveOccurred())
+				lock.Lock()
+				defer lock.Unlock()
+				Expect(peerNames).To(BeEmpty())
+			})
+
+			It("test counter service certificate is not trusted without the CA bundle", func() {
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceClientCert, filepath.Join(dir, "client.crt"))
+				testUtil.GetConfig().Set(constants.ConfigCounterServiceClientKey, filepath.Join(dir, "client.key"))
+				Expect(InitCounterServiceClient()).To(Succeed())
+
+				_, err := increment()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("certificate"))
+			})
+		})
+	})
+})
@@ -0,0 +1,281 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyWeight is the weight of the newest sample in the moving average of the latency.
+const latencyWeight = 0.2
+
+// counterServiceEndpoint is one of the counter service urls, with what is known about its health.
+type counterServiceEndpoint struct {
+	url                 string
+	healthy             bool
+	latency             time.Duration //moving average of the successful calls and health checks.
+	consecutiveFailures int
+	lastChecked         time.Time
+	lastError           string
+}
+
+// endpointPool routes the calls to the healthy counter service endpoint with the lowest latency.
+type endpointPool struct {
+	lock      sync.RWMutex
+	endpoints []*counterServiceEndpoint
+	stop      chan struct{}
+}
+
+var counterServiceEndpoints = &endpointPool{}
+
+// InitCounterServiceEndpoints sets the counter service urls and starts health checking them.
+func InitCounterServiceEndpoints(urls []string) error {
+	endpoints := make([]*counterServiceEndpoint, 0, len(urls))
+	for _, endpointURL := range urls {
+		endpointURL = strings.TrimSuffix(strings.TrimSpace(endpointURL), "/")
+		if endpointURL == "" {
+			continue
+		}
+		if _, err := url.Parse(endpointURL); err != nil {
+			return errors.New(constants.URLCounterServiceInvalid + " : " + endpointURL)
+		}
+		endpoints = append(endpoints, &counterServiceEndpoint{url: endpointURL, healthy: true})
+	}
+
+	counterServiceEndpoints.lock.Lock()
+	counterServiceEndpoints.endpoints = endpoints
+	counterServiceEndpoints.lock.Unlock()
+
+	interval := globalVariables.Config.GetDuration(constants.ConfigCounterServiceHealthCheckInterval)
+	if len(endpoints) > 0 && interval > 0 {
+		counterServiceEndpoints.startHealthChecks(interval)
+	}
+	return nil
+}
+
+// StopCounterServiceHealthChecks stops the periodic health checks of the counter service endpoints.
+func StopCounterServiceHealthChecks() {
+	counterServiceEndpoints.lock.Lock()
+	defer counterServiceEndpoints.lock.Unlock()
+	if counterServiceEndpoints.stop != nil {
+		close(counterServiceEndpoints.stop)
+		counterServiceEndpoints.stop = nil
+	}
+}
+
+func (p *endpointPool) startHealthChecks(interval time.Duration) {
+	p.lock.Lock()
+	if p.stop != nil {
+		close(p.stop)
+	}
+	stop := make(chan struct{})
+	p.stop = stop
+	p.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p.checkAll()
+			}
+		}
+	}()
+}
+
+func (p *endpointPool) checkAll() {
+	for _, endpointURL := range p.urls() {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), getHealthCheckTimeout())
+		err := checkEndpointHealth(ctx, endpointURL)
+		cancel()
+		p.recordResult(endpointURL, time.Since(start), err)
+	}
+}
+
+// getHealthCheckTimeout returns how long a health check may take, for one endpoint or for a Ping.
+func getHealthCheckTimeout() time.Duration {
+	if globalVariables.Config != nil {
+		if timeout := globalVariables.Config.GetDuration(constants.ConfigCounterServiceHealthCheckTimeout); timeout > 0 {
+			return timeout
+		}
+	}
+	return constants.DefaultCounterServiceHealthCheckTimeout
+}
+
+// checkEndpointHealth calls the health path of the endpoint.
+func checkEndpointHealth(ctx context.Context, endpointURL string) error {
+	return checkHealth(ctx, endpointURL+globalVariables.Config.GetString(constants.ConfigCounterServiceHealthCheckPath))
+}
+
+// checkHealth calls healthURL within the deadline of ctx. any answer below 500 means it is reachable.
+func checkHealth(ctx context.Context, healthURL string) error {
+	req, err := http.NewRequest("GET", healthURL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if err := getAuthProvider().authorize(req, nil); err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.New("health check response: " + resp.Status)
+	}
+	return nil
+}
+
+func (p *endpointPool) urls() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if len(p.endpoints) == 0 {
+		if globalVariables.CounterServiceURL == "" {
+			return nil
+		}
+		return []string{strings.TrimSuffix(globalVariables.CounterServiceURL, "/")}
+	}
+	urls := make([]string, 0, len(p.endpoints))
+	for _, endpoint := range p.endpoints {
+		urls = append(urls, endpoint.url)
+	}
+	return urls
+}
+
+// pick returns the healthy endpoint with the lowest latency which is not in tried.
+// when all of those are unhealthy, the one with the fewest failures is returned.
+func (p *endpointPool) pick(tried map[string]bool) string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if len(p.endpoints) == 0 {
+		return strings.TrimSuffix(globalVariables.CounterServiceURL, "/")
+	}
+
+	var best *counterServiceEndpoint
+	for _, endpoint := range p.endpoints {
+		if tried[endpoint.url] {
+			continue
+		}
+		if best == nil || isBetterEndpoint(endpoint, best) {
+			best = endpoint
+		}
+	}
+	if best == nil {
+		//every endpoint has been tried, start over.
+		for _, endpoint := range p.endpoints {
+			if best == nil || isBetterEndpoint(endpoint, best) {
+				best = endpoint
+			}
+		}
+	}
+	return best.url
+}
+
+func isBetterEndpoint(endpoint *counterServiceEndpoint, than *counterServiceEndpoint) bool {
+	if endpoint.healthy != than.healthy {
+		return endpoint.healthy
+	}
+	if !endpoint.healthy {
+		return endpoint.consecutiveFailures < than.consecutiveFailures
+	}
+	return endpoint.latency < than.latency
+}
+
+// allTried reports if every endpoint is in tried.
+func (p *endpointPool) allTried(tried map[string]bool) bool {
+	for _, endpointURL := range p.urls() {
+		if !tried[endpointURL] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordResult updates the health of the endpoint with the outcome of a call or a health check.
+func (p *endpointPool) recordResult(endpointURL string, latency time.Duration, err error) {
+	unhealthyThreshold := globalVariables.Config.GetInt(constants.ConfigCounterServiceUnhealthyThreshold)
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = constants.DefaultCounterServiceUnhealthyThreshold
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, endpoint := range p.endpoints {
+		if endpoint.url != endpointURL {
+			continue
+		}
+		endpoint.lastChecked = time.Now()
+		if err != nil {
+			endpoint.consecutiveFailures++
+			endpoint.lastError = err.Error()
+			if endpoint.healthy && endpoint.consecutiveFailures >= unhealthyThreshold {
+				globalVariables.Log.Warn("marking counter service endpoint: ", endpointURL, " unhealthy, error: ", err.Error())
+				endpoint.healthy = false
+			}
+			return
+		}
+		if !endpoint.healthy {
+			globalVariables.Log.Info("counter service endpoint: ", endpointURL, " is healthy again")
+		}
+		endpoint.healthy = true
+		endpoint.consecutiveFailures = 0
+		endpoint.lastError = ""
+		if endpoint.latency == 0 {
+			endpoint.latency = latency
+		} else {
+			endpoint.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(endpoint.latency))
+		}
+		return
+	}
+}
+
+// GetCounterServiceEndpointStates returns the state of the counter service endpoints, for diagnostics.
+func GetCounterServiceEndpointStates() []map[string]interface{} {
+	counterServiceEndpoints.lock.RLock()
+	defer counterServiceEndpoints.lock.RUnlock()
+	states := make([]map[string]interface{}, 0, len(counterServiceEndpoints.endpoints))
+	for _, endpoint := range counterServiceEndpoints.endpoints {
+		state := make(map[string]interface{})
+		state["url"] = endpoint.url
+		state["healthy"] = endpoint.healthy
+		state["latencyMs"] = float64(endpoint.latency) / float64(time.Millisecond)
+		state["consecutiveFailures"] = endpoint.consecutiveFailures
+		if !endpoint.lastChecked.IsZero() {
+			state["lastChecked"] = endpoint.lastChecked.Unix()
+		}
+		if endpoint.lastError != "" {
+			state["lastError"] = endpoint.lastError
+		}
+		states = append(states, state)
+	}
+	return states
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"context"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	"github.com/apid/apidQuota/globalVariables"
+	. "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// toggledHandler answers 500 while it is down, and passes the requests on to next otherwise.
+type toggledHandler struct {
+	next     http.Handler
+	lock     sync.Mutex
+	down     bool
+	requests map[string]int
+}
+
+func (h *toggledHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	h.lock.Lock()
+	h.requests[req.Method+" "+req.URL.Path]++
+	down := h.down
+	h.lock.Unlock()
+	if down {
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.next.ServeHTTP(res, req)
+}
+
+func (h *toggledHandler) setDown(down bool) {
+	h.lock.Lock()
+	h.down = down
+	h.lock.Unlock()
+}
+
+func (h *toggledHandler) getRequests(request string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.requests[request]
+}
+
+var _ = Describe("Test counter service endpoints", func() {
+	testUtil.UseConfig()
+
+	Context("with two counter service endpoints", func() {
+		var first, second *toggledHandler
+		var firstServer, secondServer *httptest.Server
+		var backend CounterBackend
+		var now int64
+
+		increment := func() (int64, error) {
+			return backend.IncrementAndGetCount(context.Background(), "endpointsOrg", "app", 1, now-60, now+60)
+		}
+
+		isHealthy := func(serverURL string) bool {
+			for _, state := range GetCounterServiceEndpointStates() {
+				if state["url"] == serverURL {
+					return state["healthy"].(bool)
+				}
+			}
+			Fail("no state for endpoint: " + serverURL)
+			return false
+		}
+
+		BeforeEach(func() {
+			//both endpoints share the store, as replicas of the counter service do.
+			store := counterService.NewMemoryStore()
+			first = &toggledHandler{next: counterService.NewCounterService(store), requests: make(map[string]int)}
+			second = &toggledHandler{next: counterService.NewCounterService(store), requests: make(map[string]int)}
+			firstServer = httptest.NewServer(first)
+			secondServer = httptest.NewServer(second)
+
+			testUtil.UseCounterService(firstServer.URL)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceMaxRetries, 1)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHealthCheckPath, constants.DefaultCounterServiceHealthCheckPath)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHealthCheckTimeout, time.Second)
+			backend = NewHTTPCounterBackend()
+			now = time.Now().Unix()
+		})
+
+		AfterEach(func() {
+			StopCounterServiceHealthChecks()
+			testUtil.ResetCounterService()
+			firstServer.Close()
+			secondServer.Close()
+		})
+
+		It("test failed request is retried on the other endpoint, which is used once the failing one is unhealthy", func() {
+			Expect(InitCounterServiceEndpoints([]string{firstServer.URL, secondServer.URL})).To(Succeed())
+			first.setDown(true)
+
+			for i := 1; i <= constants.DefaultCounterServiceUnhealthyThreshold; i++ {
+				count, err := increment()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(count).To(BeEquivalentTo(i))
+			}
+			Expect(first.getRequests("POST /")).To(Equal(constants.DefaultCounterServiceUnhealthyThreshold))
+			Expect(isHealthy(firstServer.URL)).To(BeFalse())
+			Expect(isHealthy(secondServer.URL)).To(BeTrue())
+
+			_, err := increment()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(first.getRequests("POST /")).To(Equal(constants.DefaultCounterServiceUnhealthyThreshold))
+			Expect(second.getRequests("POST /")).To(Equal(constants.DefaultCounterServiceUnhealthyThreshold + 1))
+		})
+
+		It("test health checks mark the endpoint unhealthy, and healthy again once it recovers", func() {
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHealthCheckInterval, 10*time.Millisecond)
+			Expect(InitCounterServiceEndpoints([]string{firstServer.URL, secondServer.URL})).To(Succeed())
+
+			first.setDown(true)
+			Eventually(func() bool {
+				return isHealthy(firstServer.URL)
+			}, 5*time.Second).Should(BeFalse())
+			Expect(isHealthy(secondServer.URL)).To(BeTrue())
+			Expect(first.getRequests("GET " + constants.DefaultCounterServiceHealthCheckPath)).To(BeNumerically(">=", 2))
+
+			//the unhealthy endpoint is not called while the other one answers.
+			_, err := increment()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(first.getRequests("POST /")).To(BeZero())
+
+			first.setDown(false)
+			Eventually(func() bool {
+				return isHealthy(firstServer.URL)
+			}, 5*time.Second).Should(BeTrue())
+		})
+
+		It("test all endpoints failing makes the counter service unavailable", func() {
+			Expect(InitCounterServiceEndpoints([]string{firstServer.URL, secondServer.URL})).To(Succeed())
+			first.setDown(true)
+			second.setDown(true)
+
+			_, err := increment()
+			Expect(IsUnavailable(err)).To(BeTrue())
+			Expect(first.getRequests("POST /")).To(Equal(1))
+			Expect(second.getRequests("POST /")).To(Equal(1))
+		})
+
+		It("test ping succeeds while one endpoint is healthy", func() {
+			Expect(InitCounterServiceEndpoints([]string{firstServer.URL, secondServer.URL})).To(Succeed())
+			Expect(backend.Ping(context.Background())).To(Succeed())
+
+			first.setDown(true)
+			Expect(backend.Ping(context.Background())).To(Succeed())
+			Expect(second.getRequests("GET " + constants.DefaultCounterServiceHealthCheckPath)).To(Equal(1))
+
+			second.setDown(true)
+			err := backend.Ping(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("no counter service endpoint is reachable"))
+		})
+
+		It("test ping of all the endpoints takes one health check timeout", func() {
+			release := make(chan struct{})
+			hanging := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				<-release
+			})
+			firstServer.Config.Handler = hanging
+			secondServer.Config.Handler = hanging
+			defer close(release)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceHealthCheckTimeout, 200*time.Millisecond)
+			Expect(InitCounterServiceEndpoints([]string{firstServer.URL, secondServer.URL})).To(Succeed())
+
+			start := time.Now()
+			Expect(backend.Ping(context.Background())).NotTo(Succeed())
+			Expect(time.Since(start)).To(BeNumerically("<", 350*time.Millisecond))
+		})
+	})
+
+	Context("checking the counter backend config", func() {
+		AfterEach(func() {
+			testUtil.ResetCounterService()
+		})
+
+		It("test counter service urls are checked", func() {
+			err := CheckCounterBackendConfig()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(constants.URLCounterServiceNotSet))
+
+			globalVariables.CounterServiceURL = "counterService:8080"
+			err = CheckCounterBackendConfig()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(constants.URLCounterServiceInvalid))
+
+			Expect(InitCounterServiceEndpoints([]string{"http://counterService1:8080", "http://counterService2:8080"})).To(Succeed())
+			Expect(CheckCounterBackendConfig()).To(Succeed())
+		})
+
+		It("test other backends are not checked", func() {
+			SetCounterBackend(NewRedisCounterBackend("localhost:6379", "", 0, "test:"))
+			defer SetCounterBackend(NewHTTPCounterBackend())
+			Expect(CheckCounterBackendConfig()).To(Succeed())
+		})
+	})
+})
@@ -16,13 +16,17 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/apid/apidQuota/constants"
 	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/tracing"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -32,40 +36,27 @@ const (
 	delta     = "delta"
 	startTime = "startTime"
 	endTime   = "endTime"
+
+	batchEntries = "entries"
 )
 
-var client *http.Client = &http.Client{
-	//setting the timeout to 60 sec for requests to counterService
-	Timeout: time.Duration(60 * time.Second),
-}
+// requests to counterService are bounded by the caller's context and the per-attempt timeout.
+var client *http.Client = &http.Client{}
 
-var token string
+// httpCounterBackend keeps the counts in the counter service, over http.
+type httpCounterBackend struct{}
 
-func addApigeeSyncTokenToHeader(req *http.Request) {
-	token = globalVariables.Config.GetString(constants.ApigeeSyncBearerToken)
-	req.Header.Set("Authorization", "Bearer "+token)
+// NewHTTPCounterBackend returns a CounterBackend keeping the counts in the counter service at the configured urls.
+func NewHTTPCounterBackend() CounterBackend {
+	return &httpCounterBackend{}
 }
 
-func GetCount(orgID string, quotaKey string, startTimeInt int64, endTimeInt int64) (int64, error) {
-
-	return IncrementAndGetCount(orgID, quotaKey, 0, startTimeInt, endTimeInt)
-}
-
-func IncrementAndGetCount(orgID string, quotaKey string, count int64, startTimeInt int64, endTimeInt int64) (int64, error) {
-	headers := http.Header{}
-	headers.Set("Accept", "application/json")
-	headers.Set("Content-Type", "application/json")
-	method := "POST"
+func (b *httpCounterBackend) IncrementAndGetCount(ctx context.Context, orgID string, quotaKey string, count int64, startTimeInt int64, endTimeInt int64) (int64, error) {
 
 	if globalVariables.CounterServiceURL == "" {
 		return 0, errors.New(constants.URLCounterServiceNotSet)
 	}
 
-	serviceURL, err := url.Parse(globalVariables.CounterServiceURL)
-	if err != nil {
-		return 0, errors.New(constants.URLCounterServiceInvalid)
-	}
-
 	//'{  "orgId": "test_org",  "delta": 1,  "key": "fixed-test-key" } '
 	reqBody := make(map[string]interface{})
 	reqBody[edgeOrgID] = orgID
@@ -74,59 +65,259 @@ func IncrementAndGetCount(orgID string, quotaKey string, count int64, startTimeI
 	reqBody[startTime] = startTimeInt * int64(1000)
 	reqBody[endTime] = endTimeInt * int64(1000)
 
-	reqBodyBytes, err := json.Marshal(reqBody)
+	respBody, err := postToCounterService(ctx, nil, reqBody, count != 0)
 	if err != nil {
-		return 0, errors.New(constants.MarshalJSONError)
+		return 0, err
 	}
 
-	contentLength := len(reqBodyBytes)
-	request := &http.Request{
-		Header:        headers,
-		Method:        method,
-		URL:           serviceURL,
-		Body:          ioutil.NopCloser(bytes.NewReader(reqBodyBytes)),
-		ContentLength: int64(contentLength),
+	respCount, ok := respBody["count"]
+	if !ok {
+		return 0, errors.New(`invalid response from counter service. field 'count' not sent in the response`)
 	}
-	addApigeeSyncTokenToHeader(request)
 
-	resp, err := client.Do(request)
+	globalVariables.Log.Debug("responseCount: ", respCount)
+
+	respCountInt, ok := respCount.(float64)
+	if !ok {
+		return 0, errors.New(`invalid response from counter service. field 'count' sent in the response is not float`)
+	}
+
+	return int64(respCountInt), nil
+
+}
 
+// BatchIncrementAndGetCount increments all the entries in a single request to the counter service.
+// the counts are returned in the same order as the entries.
+func (b *httpCounterBackend) BatchIncrementAndGetCount(ctx context.Context, entries []CounterEntry) ([]int64, error) {
+
+	if globalVariables.CounterServiceURL == "" {
+		return nil, errors.New(constants.URLCounterServiceNotSet)
+	}
+
+	//'{ "entries": [ {  "orgId": "test_org",  "delta": 1,  "key": "fixed-test-key" } ] }'
+	reqEntries := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		reqEntry := make(map[string]interface{})
+		reqEntry[edgeOrgID] = entry.OrgID
+		reqEntry[key] = entry.Key
+		reqEntry[delta] = entry.Delta
+		reqEntry[startTime] = entry.StartTime * int64(1000)
+		reqEntry[endTime] = entry.EndTime * int64(1000)
+		reqEntries = append(reqEntries, reqEntry)
+	}
+	reqBody := make(map[string]interface{})
+	reqBody[batchEntries] = reqEntries
+
+	respBody, err := postToCounterService(ctx, getCounterServiceBatchURL, reqBody, true)
 	if err != nil {
-		return 0, errors.New("error calling CounterService: " + err.Error())
+		return nil, err
 	}
 
-	globalVariables.Log.Debug("response: ", resp)
-	if resp.StatusCode != http.StatusOK {
-		respBodyBytes, err := ioutil.ReadAll(resp.Body)
-		if resp.StatusCode == http.StatusNotFound {
-			return 0, errors.New("response from counter service: " + resp.Status + " and response body is: " + string(respBodyBytes))
+	respEntries, ok := respBody[batchEntries].([]interface{})
+	if !ok {
+		return nil, errors.New(`invalid response from counter service. field 'entries' not sent in the response or is not a list`)
+	}
+	if len(respEntries) != len(entries) {
+		return nil, errors.New("invalid response from counter service. expected " + strconv.Itoa(len(entries)) +
+			" entries in the response, received: " + strconv.Itoa(len(respEntries)))
+	}
+
+	counts := make([]int64, 0, len(respEntries))
+	for _, respEntry := range respEntries {
+		respEntryMap, ok := respEntry.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(`invalid response from counter service. entries in the response should be objects`)
 		}
-		if err != nil {
+		respCount, ok := respEntryMap["count"].(float64)
+		if !ok {
+			return nil, errors.New(`invalid response from counter service. field 'count' not sent in the response entry or is not float`)
+		}
+		counts = append(counts, int64(respCount))
+	}
+
+	return counts, nil
+}
+
+// ResetCount is not part of the counter service protocol.
+func (b *httpCounterBackend) ResetCount(ctx context.Context, orgID string, quotaKey string, startTimeInt int64, endTimeInt int64) error {
+	return errors.New(constants.CounterResetNotSupported + " : by the counter service")
+}
 
+// Ping calls the health path of the counter service endpoints, and succeeds as soon as one of them answers.
+func (b *httpCounterBackend) Ping(ctx context.Context) error {
+	endpointURLs := counterServiceEndpoints.urls()
+	if len(endpointURLs) == 0 {
+		return errors.New(constants.URLCounterServiceNotSet)
+	}
+	//one timeout for all the endpoints, so a readiness probe is not held back by each endpoint in turn.
+	ctx, cancel := context.WithTimeout(ctx, getHealthCheckTimeout())
+	defer cancel()
+	var err error
+	for _, endpointURL := range endpointURLs {
+		if err = checkEndpointHealth(ctx, endpointURL); err == nil {
+			return nil
 		}
-		return 0, errors.New("response from counter service: " + resp.Status + " and response body is: " + string(respBodyBytes))
+	}
+	return errors.New("no counter service endpoint is reachable, last error: " + err.Error())
+}
 
+// getCounterServiceBatchURL returns the batch url of the endpoint, '/batch' under the endpoint url by default.
+// a configured path starting with '/' is relative to the endpoint, any other value is used as the batch url.
+func getCounterServiceBatchURL(endpointURL string) string {
+	if globalVariables.Config != nil {
+		if batchURL := globalVariables.Config.GetString(constants.ConfigCounterServiceBatchPath); batchURL != "" {
+			if strings.HasPrefix(batchURL, "/") {
+				return endpointURL + batchURL
+			}
+			return batchURL
+		}
 	}
+	return endpointURL + constants.CounterServiceBatchPathDefault
+}
 
-	respBodyBytes, err := ioutil.ReadAll(resp.Body)
-	respBody := make(map[string]interface{})
-	err = json.Unmarshal(respBodyBytes, &respBody)
+// postToCounterService posts reqBody to the counter service, retrying failed attempts as per the retry policy.
+// a failed attempt is retried on the next best endpoint. the backoff only applies once all the endpoints were tried.
+// increments carry an idempotency key, which stays the same across the retries of a call.
+// targetURL returns the url to post to for an endpoint. when it is nil, reqBody is posted to the endpoint url.
+func postToCounterService(ctx context.Context, targetURL func(endpointURL string) string, reqBody map[string]interface{}, isIncrement bool) (map[string]interface{}, error) {
+	reqBodyBytes, err := json.Marshal(reqBody)
 	if err != nil {
-		return 0, errors.New("unable to parse response from counter service, error: " + err.Error())
+		return nil, errors.New(constants.MarshalJSONError)
 	}
 
-	respCount, ok := respBody["count"]
-	if !ok {
-		return 0, errors.New(`invalid response from counter service. field 'count' not sent in the response`)
+	idempotencyKey := ""
+	if isIncrement {
+		if idempotencyKey, err = getIdempotencyKey(ctx); err != nil {
+			return nil, err
+		}
 	}
 
-	globalVariables.Log.Debug("responseCount: ", respCount)
+	if err := counterServiceBreaker.allow(); err != nil {
+		return nil, err
+	}
 
-	respCountInt, ok := respCount.(float64)
-	if !ok {
-		return 0, errors.New(`invalid response from counter service. field 'count' sent in the response is not float`)
+	policy := getRetryPolicy()
+	tried := make(map[string]bool)
+	backoffs := 0
+	for attempt := 0; ; attempt++ {
+		endpointURL := counterServiceEndpoints.pick(tried)
+		rawURL := endpointURL
+		if targetURL != nil {
+			rawURL = targetURL(endpointURL)
+		}
+		serviceURL, err := url.Parse(rawURL)
+		if err != nil {
+			counterServiceBreaker.releaseTrial()
+			return nil, errors.New(constants.URLCounterServiceInvalid)
+		}
+
+		start := time.Now()
+		respBody, retryable, err := doCounterServiceRequest(ctx, policy.attemptTimeout, serviceURL, reqBodyBytes, idempotencyKey)
+		if retryable && err != nil {
+			counterServiceEndpoints.recordResult(endpointURL, time.Since(start), err)
+		} else if ctx.Err() == nil {
+			counterServiceEndpoints.recordResult(endpointURL, time.Since(start), nil)
+		}
+
+		if err == nil || !retryable || attempt >= policy.maxRetries {
+			return respBody, recordCounterServiceResult(ctx, retryable, err)
+		}
+		tried[endpointURL] = true
+		if counterServiceEndpoints.allTried(tried) {
+			tried = make(map[string]bool)
+			if waitErr := policy.wait(ctx, backoffs); waitErr != nil {
+				return nil, recordCounterServiceResult(ctx, retryable, err)
+			}
+			backoffs++
+		}
+		globalVariables.Log.Debug("retrying request to counter service, attempt: ", attempt+1, " error: ", err.Error())
 	}
+}
 
-	return int64(respCountInt), nil
+// recordCounterServiceResult updates the circuit breaker with the outcome of a call.
+// failures that could have been retried mean the counter service is unavailable.
+func recordCounterServiceResult(ctx context.Context, retryable bool, err error) error {
+	switch {
+	case err == nil:
+		counterServiceBreaker.recordSuccess()
+		return nil
+	case retryable:
+		counterServiceBreaker.recordFailure()
+		return &UnavailableError{err.Error()}
+	case ctx.Err() != nil:
+		//cancelled by the caller, says nothing about the counter service.
+		counterServiceBreaker.releaseTrial()
+		return err
+	default:
+		//the counter service answered, but rejected the request.
+		counterServiceBreaker.recordSuccess()
+		return err
+	}
+}
+
+// doCounterServiceRequest makes one attempt and reports if a failed attempt can be retried.
+func doCounterServiceRequest(ctx context.Context, attemptTimeout time.Duration, serviceURL *url.URL, reqBodyBytes []byte, idempotencyKey string) (map[string]interface{}, bool, error) {
+	headers := http.Header{}
+	headers.Set("Accept", "application/json")
+	headers.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		headers.Set(constants.IdempotencyKeyHeader, idempotencyKey)
+	}
+	tracing.Inject(ctx, headers)
+	method := "POST"
+
+	attemptCtx, cancel := context.WithTimeout(ctx, attemptTimeout)
+	defer cancel()
+
+	auth := getAuthProvider()
+	contentLength := len(reqBodyBytes)
+	var resp *http.Response
+	//a request rejected with 401 is sent once more, after refreshing the credentials.
+	for authRefreshed := false; ; authRefreshed = true {
+		request := (&http.Request{
+			Header:        headers.Clone(),
+			Method:        method,
+			URL:           serviceURL,
+			Body:          ioutil.NopCloser(bytes.NewReader(reqBodyBytes)),
+			ContentLength: int64(contentLength),
+		}).WithContext(attemptCtx)
+		if err := auth.authorize(request, reqBodyBytes); err != nil {
+			return nil, false, errors.New("error authorizing request to CounterService: " + err.Error())
+		}
+
+		var err error
+		resp, err = client.Do(request)
+		if err != nil {
+			//the incoming request is gone or out of time, no point in retrying.
+			return nil, ctx.Err() == nil, errors.New("error calling CounterService: " + err.Error())
+		}
+		if resp.StatusCode != http.StatusUnauthorized || authRefreshed {
+			break
+		}
+		if err := auth.refresh(attemptCtx); err != nil {
+			globalVariables.Log.Debug("not retrying unauthorized request to counter service: ", err.Error())
+			break
+		}
+		resp.Body.Close()
+	}
+	defer resp.Body.Close()
+
+	globalVariables.Log.Debug("response: ", resp)
+	if resp.StatusCode != http.StatusOK {
+		respBodyBytes, _ := ioutil.ReadAll(resp.Body)
+		retryable := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retryable, errors.New("response from counter service: " + resp.Status + " and response body is: " + string(respBodyBytes))
+	}
+
+	respBodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, errors.New("unable to read response from counter service, error: " + err.Error())
+	}
+	respBody := make(map[string]interface{})
+	err = json.Unmarshal(respBodyBytes, &respBody)
+	if err != nil {
+		return nil, false, errors.New("unable to parse response from counter service, error: " + err.Error())
+	}
 
+	return respBody, false, nil
 }
@@ -0,0 +1,169 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// recordedRequest is a request received by the test counter service.
+type recordedRequest struct {
+	path           string
+	idempotencyKey string
+	body           map[string]interface{}
+}
+
+// recordingHandler records the requests before passing them on to next.
+type recordingHandler struct {
+	next     http.Handler
+	lock     sync.Mutex
+	requests []recordedRequest
+}
+
+func (h *recordingHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	bodyBytes, _ := ioutil.ReadAll(req.Body)
+	body := make(map[string]interface{})
+	json.Unmarshal(bodyBytes, &body)
+	h.lock.Lock()
+	h.requests = append(h.requests, recordedRequest{
+		path:           req.URL.Path,
+		idempotencyKey: req.Header.Get(constants.IdempotencyKeyHeader),
+		body:           body,
+	})
+	h.lock.Unlock()
+	req.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	h.next.ServeHTTP(res, req)
+}
+
+func (h *recordingHandler) getRequests() []recordedRequest {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]recordedRequest{}, h.requests...)
+}
+
+var _ = Describe("Test httpCounterBackend", func() {
+	testUtil.UseConfig()
+
+	Context("against the counter service", func() {
+		var store counterService.Store
+		var handler *recordingHandler
+		var server *httptest.Server
+		var backend CounterBackend
+		var ctx context.Context
+		var now int64
+
+		BeforeEach(func() {
+			store = counterService.NewMemoryStore()
+			handler = &recordingHandler{next: counterService.NewCounterService(store)}
+			server = httptest.NewServer(handler)
+			testUtil.UseCounterService(server.URL)
+			backend = NewHTTPCounterBackend()
+			ctx = context.Background()
+			now = time.Now().Unix()
+		})
+
+		AfterEach(func() {
+			testUtil.ResetCounterService()
+			server.Close()
+		})
+
+		It("sends all the entries in one batch request, and returns the counts in order", func() {
+			entries := []CounterEntry{
+				{OrgID: "batchOrg", Key: "a", Delta: 2, StartTime: now - 60, EndTime: now + 60},
+				{OrgID: "batchOrg", Key: "b", Delta: 5, StartTime: now - 60, EndTime: now + 60},
+				{OrgID: "batchOrg", Key: "a", Delta: 1, StartTime: now - 60, EndTime: now + 60},
+			}
+			counts, err := backend.BatchIncrementAndGetCount(ctx, entries)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counts).To(Equal([]int64{2, 5, 3}))
+
+			requests := handler.getRequests()
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].path).To(Equal(constants.CounterServiceBatchPathDefault))
+			Expect(requests[0].idempotencyKey).NotTo(BeEmpty())
+			reqEntries := requests[0].body["entries"].([]interface{})
+			Expect(reqEntries).To(HaveLen(3))
+			first := reqEntries[0].(map[string]interface{})
+			Expect(first["orgId"]).To(Equal("batchOrg"))
+			Expect(first["key"]).To(Equal("a"))
+			Expect(first["delta"]).To(BeEquivalentTo(2))
+			Expect(first["startTime"]).To(BeEquivalentTo((now - 60) * 1000))
+			Expect(first["endTime"]).To(BeEquivalentTo((now + 60) * 1000))
+		})
+
+		It("sends the batch to the configured batch url", func() {
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceBatchPath, server.URL+"/counters/batch")
+			_, err := backend.BatchIncrementAndGetCount(ctx, []CounterEntry{{OrgID: "batchOrg", Key: "a", Delta: 1, StartTime: now - 60, EndTime: now + 60}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handler.getRequests()[0].path).To(Equal("/counters/batch"))
+		})
+
+		It("sends a new idempotency key with each batch", func() {
+			entries := []CounterEntry{{OrgID: "batchOrg", Key: "a", Delta: 1, StartTime: now - 60, EndTime: now + 60}}
+			_, err := backend.BatchIncrementAndGetCount(ctx, entries)
+			Expect(err).NotTo(HaveOccurred())
+			counts, err := backend.BatchIncrementAndGetCount(ctx, entries)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(counts).To(Equal([]int64{2}))
+
+			requests := handler.getRequests()
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[0].idempotencyKey).NotTo(Equal(requests[1].idempotencyKey))
+		})
+
+		It("rejects a response with a different number of entries", func() {
+			server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.Write([]byte(`{"entries":[{"count":1}]}`))
+			})
+			entries := []CounterEntry{
+				{OrgID: "batchOrg", Key: "a", Delta: 1, StartTime: now - 60, EndTime: now + 60},
+				{OrgID: "batchOrg", Key: "b", Delta: 1, StartTime: now - 60, EndTime: now + 60},
+			}
+			_, err := backend.BatchIncrementAndGetCount(ctx, entries)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("expected 2 entries"))
+		})
+
+		It("reports the counter service as unavailable when the batch fails with 500", func() {
+			server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusInternalServerError)
+			})
+			entries := []CounterEntry{{OrgID: "batchOrg", Key: "a", Delta: 1, StartTime: now - 60, EndTime: now + 60}}
+			_, err := backend.BatchIncrementAndGetCount(ctx, entries)
+			Expect(err).To(HaveOccurred())
+			Expect(IsUnavailable(err)).To(BeTrue())
+		})
+
+		It("fails without a counter service url", func() {
+			testUtil.ResetCounterService()
+			_, err := backend.BatchIncrementAndGetCount(ctx, []CounterEntry{{OrgID: "batchOrg", Key: "a", Delta: 1}})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(constants.URLCounterServiceNotSet))
+		})
+	})
+})
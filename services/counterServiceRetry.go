@@ -0,0 +1,112 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	mathrand "math/rand"
+	"time"
+)
+
+type idempotencyKeyCtxKey struct{}
+
+// WithIdempotencyKey returns a context whose increments are sent to the counter service with the given idempotency key,
+// instead of one generated per call.
+func WithIdempotencyKey(ctx context.Context, idempotencyKey string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtxKey{}, idempotencyKey)
+}
+
+func getIdempotencyKey(ctx context.Context) (string, error) {
+	if idempotencyKey, ok := ctx.Value(idempotencyKeyCtxKey{}).(string); ok && idempotencyKey != "" {
+		return idempotencyKey, nil
+	}
+	return newIdempotencyKey()
+}
+
+type retryPolicy struct {
+	maxRetries     int
+	baseDelay      time.Duration
+	maxDelay       time.Duration
+	attemptTimeout time.Duration
+}
+
+func getRetryPolicy() retryPolicy {
+	policy := retryPolicy{
+		maxRetries:     constants.DefaultCounterServiceMaxRetries,
+		baseDelay:      constants.DefaultCounterServiceRetryBaseDelay,
+		maxDelay:       constants.DefaultCounterServiceRetryMaxDelay,
+		attemptTimeout: constants.DefaultCounterServiceAttemptTimeout,
+	}
+	if globalVariables.Config == nil {
+		return policy
+	}
+	if maxRetries := globalVariables.Config.GetInt(constants.ConfigCounterServiceMaxRetries); maxRetries >= 0 {
+		policy.maxRetries = maxRetries
+	}
+	if baseDelay := globalVariables.Config.GetDuration(constants.ConfigCounterServiceRetryBaseDelay); baseDelay > 0 {
+		policy.baseDelay = baseDelay
+	}
+	if maxDelay := globalVariables.Config.GetDuration(constants.ConfigCounterServiceRetryMaxDelay); maxDelay > 0 {
+		policy.maxDelay = maxDelay
+	}
+	if attemptTimeout := globalVariables.Config.GetDuration(constants.ConfigCounterServiceAttemptTimeout); attemptTimeout > 0 {
+		policy.attemptTimeout = attemptTimeout
+	}
+	return policy
+}
+
+// backoff returns the delay before retry number attempt+1: exponential in the attempt, capped at maxDelay, with full jitter.
+func (policy retryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.baseDelay
+	for i := 0; i < attempt && delay < policy.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.maxDelay {
+		delay = policy.maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(mathrand.Int63n(int64(delay)))
+}
+
+// wait sleeps for the backoff of the attempt. it fails without waiting when ctx would expire before the next attempt.
+func (policy retryPolicy) wait(ctx context.Context, attempt int) error {
+	delay := policy.backoff(attempt)
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		return context.DeadlineExceeded
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newIdempotencyKey() (string, error) {
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return "", errors.New("unable to generate idempotency key: " + err.Error())
+	}
+	return hex.EncodeToString(keyBytes), nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"context"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/counterService"
+	. "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// failingHandler answers the first failures requests with status, and passes the rest on to next.
+type failingHandler struct {
+	next            http.Handler
+	status          int
+	failures        int
+	lock            sync.Mutex
+	attempts        int
+	idempotencyKeys []string
+}
+
+func (h *failingHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	h.lock.Lock()
+	h.attempts++
+	h.idempotencyKeys = append(h.idempotencyKeys, req.Header.Get(constants.IdempotencyKeyHeader))
+	fail := h.attempts <= h.failures
+	h.lock.Unlock()
+	if fail {
+		res.WriteHeader(h.status)
+		return
+	}
+	h.next.ServeHTTP(res, req)
+}
+
+func (h *failingHandler) getAttempts() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.attempts
+}
+
+func (h *failingHandler) getIdempotencyKeys() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]string{}, h.idempotencyKeys...)
+}
+
+var _ = Describe("Test counter service retries", func() {
+	testUtil.UseConfig()
+
+	It("test backoff is below the exponential delay, capped at the max delay", func() {
+		baseDelay, maxDelay := 10*time.Millisecond, 80*time.Millisecond
+		for attempt, bound := range []time.Duration{10, 20, 40, 80, 80, 80} {
+			maxBackoff := time.Duration(0)
+			for i := 0; i < 500; i++ {
+				backoff := Backoff(baseDelay, maxDelay, attempt)
+				Expect(backoff).To(BeNumerically(">=", 0))
+				Expect(backoff).To(BeNumerically("<", bound*time.Millisecond))
+				if backoff > maxBackoff {
+					maxBackoff = backoff
+				}
+			}
+			//full jitter spreads the retries over the whole delay.
+			Expect(maxBackoff).To(BeNumerically(">", bound*time.Millisecond/2))
+		}
+		Expect(Backoff(0, maxDelay, 3)).To(BeZero())
+	})
+
+	Context("against the counter service", func() {
+		var handler *failingHandler
+		var server *httptest.Server
+		var backend CounterBackend
+		var now int64
+
+		BeforeEach(func() {
+			handler = &failingHandler{next: counterService.NewCounterService(counterService.NewMemoryStore())}
+			server = httptest.NewServer(handler)
+			testUtil.UseCounterService(server.URL)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceMaxRetries, 3)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceRetryBaseDelay, 5*time.Millisecond)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceRetryMaxDelay, 20*time.Millisecond)
+			backend = NewHTTPCounterBackend()
+			now = time.Now().Unix()
+		})
+
+		AfterEach(func() {
+			testUtil.ResetCounterService()
+			server.Close()
+		})
+
+		increment := func(ctx context.Context) (int64, error) {
+			return backend.IncrementAndGetCount(ctx, "retryOrg", "app", 1, now-60, now+60)
+		}
+
+		It("test failed attempts are retried with the same idempotency key until one succeeds", func() {
+			handler.status, handler.failures = http.StatusServiceUnavailable, 2
+			count, err := increment(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeEquivalentTo(1))
+			Expect(handler.getAttempts()).To(Equal(3))
+			idempotencyKeys := handler.getIdempotencyKeys()
+			Expect(idempotencyKeys[0]).NotTo(BeEmpty())
+			Expect(idempotencyKeys).To(Equal([]string{idempotencyKeys[0], idempotencyKeys[0], idempotencyKeys[0]}))
+		})
+
+		It("test each call has an idempotency key of its own", func() {
+			_, err := increment(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			_, err = increment(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			idempotencyKeys := handler.getIdempotencyKeys()
+			Expect(idempotencyKeys).To(HaveLen(2))
+			Expect(idempotencyKeys[0]).NotTo(Equal(idempotencyKeys[1]))
+		})
+
+		It("test too many requests is retried", func() {
+			handler.status, handler.failures = http.StatusTooManyRequests, 1
+			_, err := increment(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(handler.getAttempts()).To(Equal(2))
+		})
+
+		It("test retries stop after max retries and the counter service is reported unavailable", func() {
+			handler.status, handler.failures = http.StatusInternalServerError, 10
+			_, err := increment(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(IsUnavailable(err)).To(BeTrue())
+			Expect(handler.getAttempts()).To(Equal(4))
+		})
+
+		It("test rejected requests are not retried", func() {
+			handler.status, handler.failures = http.StatusBadRequest, 10
+			_, err := increment(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(IsUnavailable(err)).To(BeFalse())
+			Expect(handler.getAttempts()).To(Equal(1))
+		})
+
+		It("test a hung attempt times out and is retried", func() {
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceAttemptTimeout, 50*time.Millisecond)
+			release := make(chan struct{})
+			defer close(release)
+			attempts := 0
+			server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				handler.lock.Lock()
+				attempts++
+				hung := attempts == 1
+				handler.lock.Unlock()
+				if hung {
+					<-release
+					return
+				}
+				res.Write([]byte(`{"count":1}`))
+			})
+
+			start := time.Now()
+			count, err := increment(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(BeEquivalentTo(1))
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+		})
+
+		It("test no retry is made past the deadline of the caller", func() {
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceRetryBaseDelay, time.Second)
+			testUtil.GetConfig().Set(constants.ConfigCounterServiceRetryMaxDelay, time.Second)
+			handler.status, handler.failures = http.StatusInternalServerError, 10
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := increment(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+			Expect(handler.getAttempts()).To(BeNumerically("<", 4))
+		})
+
+		It("test a call is cancelled with the context of the caller", func() {
+			release := make(chan struct{})
+			defer close(release)
+			server.Config.Handler = http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				<-release
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+
+			start := time.Now()
+			_, err := increment(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(ctx.Err()).To(Equal(context.Canceled))
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+		})
+	})
+})
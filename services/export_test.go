@@ -0,0 +1,55 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"time"
+)
+
+// the hooks below let the tests of package services_test reach the internals of the counter service client.
+
+// Backoff returns the delay before retry number attempt+1, for the given delays.
+func Backoff(baseDelay time.Duration, maxDelay time.Duration, attempt int) time.Duration {
+	return retryPolicy{baseDelay: baseDelay, maxDelay: maxDelay}.backoff(attempt)
+}
+
+// CircuitBreaker is a circuitBreaker of its own, apart from the one guarding the counter service, on the clock now.
+type CircuitBreaker = circuitBreaker
+
+func NewCircuitBreaker(now func() time.Time) *CircuitBreaker {
+	return &circuitBreaker{now: now}
+}
+
+func (cb *circuitBreaker) Allow() error {
+	return cb.allow()
+}
+
+func (cb *circuitBreaker) RecordSuccess() {
+	cb.recordSuccess()
+}
+
+func (cb *circuitBreaker) RecordFailure() {
+	cb.recordFailure()
+}
+
+func (cb *circuitBreaker) ReleaseTrial() {
+	cb.releaseTrial()
+}
+
+func (cb *circuitBreaker) IsOpen() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.state != circuitClosed
+}
@@ -0,0 +1,295 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/gomodule/redigo/redis"
+	"strconv"
+	"time"
+)
+
+// fixedWindowScript increments the counter of a period, which expires at the end of the period.
+// KEYS[1]: counter, KEYS[2]: idempotency key or empty. ARGV: delta, period end (ms), idempotency key ttl (ms).
+var fixedWindowScript = redis.NewScript(2, `
+if KEYS[2] ~= '' then
+	local seen = redis.call('GET', KEYS[2])
+	if seen then
+		return tonumber(seen)
+	end
+end
+local count = redis.call('INCRBY', KEYS[1], ARGV[1])
+redis.call('PEXPIREAT', KEYS[1], ARGV[2])
+if KEYS[2] ~= '' then
+	redis.call('SET', KEYS[2], count, 'PX', ARGV[3])
+end
+return count
+`)
+
+// slidingWindowScript keeps the increments in a sorted set scored by time, as '<nonce>:<delta>' members,
+// and counts the ones within the window. increments older than the window are removed.
+// KEYS[1]: sorted set, KEYS[2]: idempotency key or empty. ARGV: delta, window start (ms), window end (ms), nonce, idempotency key ttl (ms).
+var slidingWindowScript = redis.NewScript(2, `
+if KEYS[2] ~= '' then
+	local seen = redis.call('GET', KEYS[2])
+	if seen then
+		return tonumber(seen)
+	end
+end
+local windowStart = tonumber(ARGV[2])
+local windowEnd = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[2])
+if tonumber(ARGV[1]) ~= 0 then
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[4] .. ':' .. ARGV[1])
+end
+local count = 0
+for _, member in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[2], ARGV[3])) do
+	count = count + tonumber(string.match(member, ':(%-?%d+)$'))
+end
+redis.call('PEXPIREAT', KEYS[1], windowEnd + (windowEnd - windowStart))
+if KEYS[2] ~= '' then
+	redis.call('SET', KEYS[2], count, 'PX', ARGV[5])
+end
+return count
+`)
+
+// redisCounterBackend keeps the counts in redis, or any store speaking the redis protocol.
+// increments carry an idempotency key, like with the counter service, so they can be retried.
+type redisCounterBackend struct {
+	pool      *redis.Pool
+	keyPrefix string
+}
+
+func newRedisCounterBackend() (CounterBackend, error) {
+	config := globalVariables.Config
+	address := config.GetString(constants.ConfigRedisAddress)
+	if address == "" {
+		return nil, errors.New(constants.RedisAddressNotSet)
+	}
+	options := redisDialOptions(config.GetString(constants.ConfigRedisPassword), config.GetInt(constants.ConfigRedisDB))
+	if config.GetBool(constants.ConfigRedisTLS) {
+		options = append(options, redis.DialUseTLS(true))
+	}
+	return &redisCounterBackend{
+		pool:      newRedisPool(address, config.GetInt(constants.ConfigRedisMaxIdle), options),
+		keyPrefix: config.GetString(constants.ConfigRedisKeyPrefix),
+	}, nil
+}
+
+// NewRedisCounterBackend returns a CounterBackend keeping the counts in the redis server at address.
+func NewRedisCounterBackend(address string, password string, db int, keyPrefix string) CounterBackend {
+	return &redisCounterBackend{
+		pool:      newRedisPool(address, constants.DefaultRedisMaxIdle, redisDialOptions(password, db)),
+		keyPrefix: keyPrefix,
+	}
+}
+
+func newRedisPool(address string, maxIdle int, options []redis.DialOption) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: constants.DefaultCounterServiceIdleConnTimeout,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return redis.DialContext(ctx, "tcp", address, options...)
+		},
+	}
+}
+
+func redisDialOptions(password string, db int) []redis.DialOption {
+	attemptTimeout := getRetryPolicy().attemptTimeout
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(attemptTimeout),
+		redis.DialReadTimeout(attemptTimeout),
+		redis.DialWriteTimeout(attemptTimeout),
+		redis.DialDatabase(db),
+	}
+	if password != "" {
+		options = append(options, redis.DialPassword(password))
+	}
+	return options
+}
+
+func (b *redisCounterBackend) IncrementAndGetCount(ctx context.Context, orgID string, quotaKey string, count int64, startTimeInt int64, endTimeInt int64) (int64, error) {
+	entry := CounterEntry{
+		OrgID:         orgID,
+		Key:           quotaKey,
+		Delta:         count,
+		StartTime:     startTimeInt,
+		EndTime:       endTimeInt,
+		SlidingWindow: isSlidingWindow(ctx),
+	}
+
+	idempotencyKey := ""
+	if count != 0 {
+		var err error
+		if idempotencyKey, err = getIdempotencyKey(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	return redis.Int64(b.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		script, args, err := b.scriptArgs(entry, idempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+		return script.Do(conn, args...)
+	}))
+}
+
+// BatchIncrementAndGetCount pipelines the increments of all the entries on one connection.
+func (b *redisCounterBackend) BatchIncrementAndGetCount(ctx context.Context, entries []CounterEntry) ([]int64, error) {
+	idempotencyKey, err := getIdempotencyKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := b.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		for i, entry := range entries {
+			script, args, err := b.scriptArgs(entry, idempotencyKey+constants.CacheKeyDelimiter+strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			if err := script.Send(conn, args...); err != nil {
+				return nil, err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return nil, err
+		}
+		counts := make([]int64, 0, len(entries))
+		for range entries {
+			count, err := redis.Int64(conn.Receive())
+			if err != nil {
+				return nil, err
+			}
+			counts = append(counts, count)
+		}
+		return counts, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.([]int64), nil
+}
+
+func (b *redisCounterBackend) ResetCount(ctx context.Context, orgID string, quotaKey string, startTimeInt int64, endTimeInt int64) error {
+	entry := CounterEntry{OrgID: orgID, Key: quotaKey, StartTime: startTimeInt, EndTime: endTimeInt}
+	counterKey := b.counterKey(entry)
+	if isSlidingWindow(ctx) {
+		counterKey = b.windowKey(entry)
+	}
+	_, err := b.do(ctx, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("DEL", counterKey)
+	})
+	return err
+}
+
+// Ping sends a PING to the redis server, once, without the retries and the circuit breaker of the increments.
+func (b *redisCounterBackend) Ping(ctx context.Context) error {
+	_, _, err := b.doOnce(ctx, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do("PING")
+	})
+	return err
+}
+
+// the keys of a quota key start with the same hash tag, so its counters and idempotency keys are in the same
+// redis cluster slot, as a script touching several keys needs.
+func (b *redisCounterBackend) hashTag(entry CounterEntry) string {
+	return b.keyPrefix + "{" + entry.OrgID + constants.CacheKeyDelimiter + entry.Key + "}"
+}
+
+// counterKey is the key of the counter of a fixed period.
+func (b *redisCounterBackend) counterKey(entry CounterEntry) string {
+	return b.hashTag(entry) + constants.CacheKeyDelimiter +
+		strconv.FormatInt(entry.StartTime, 10) + constants.CacheKeyDelimiter + strconv.FormatInt(entry.EndTime, 10)
+}
+
+// windowKey is the key of the sorted set of a sliding window. it is shared by all the windows of the quota key.
+func (b *redisCounterBackend) windowKey(entry CounterEntry) string {
+	return b.hashTag(entry) + constants.CacheKeyDelimiter + "window"
+}
+
+// redisIdempotencyKey is the key the count of an increment is kept at, for its retries.
+func (b *redisCounterBackend) redisIdempotencyKey(entry CounterEntry, idempotencyKey string) string {
+	return b.hashTag(entry) + constants.CacheKeyDelimiter + "idempotency" + constants.CacheKeyDelimiter + idempotencyKey
+}
+
+func (b *redisCounterBackend) scriptArgs(entry CounterEntry, idempotencyKey string) (*redis.Script, []interface{}, error) {
+	startMillis := entry.StartTime * int64(1000)
+	endMillis := entry.EndTime * int64(1000)
+
+	//idempotency keys are kept as long as the count they were used for.
+	idempotencyTTL := endMillis - time.Now().UnixNano()/int64(time.Millisecond)
+	if entry.SlidingWindow {
+		idempotencyTTL += endMillis - startMillis
+	}
+	if idempotencyTTL < int64(time.Second/time.Millisecond) {
+		idempotencyTTL = int64(time.Second / time.Millisecond)
+	}
+	redisIdempotencyKey := ""
+	if idempotencyKey != "" {
+		redisIdempotencyKey = b.redisIdempotencyKey(entry, idempotencyKey)
+	}
+
+	if entry.SlidingWindow {
+		nonce, err := newIdempotencyKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		return slidingWindowScript, []interface{}{b.windowKey(entry), redisIdempotencyKey,
+			entry.Delta, startMillis, endMillis, nonce, idempotencyTTL}, nil
+	}
+	return fixedWindowScript, []interface{}{b.counterKey(entry), redisIdempotencyKey,
+		entry.Delta, endMillis, idempotencyTTL}, nil
+}
+
+// do runs command on a pooled connection, retrying failed connections as per the retry policy.
+// connection failures count towards the circuit breaker, errors replied by redis do not.
+func (b *redisCounterBackend) do(ctx context.Context, command func(conn redis.Conn) (interface{}, error)) (interface{}, error) {
+	if err := counterServiceBreaker.allow(); err != nil {
+		return nil, err
+	}
+
+	policy := getRetryPolicy()
+	for attempt := 0; ; attempt++ {
+		reply, retryable, err := b.doOnce(ctx, command)
+		if err == nil || !retryable || attempt >= policy.maxRetries {
+			return reply, recordCounterServiceResult(ctx, retryable, err)
+		}
+		if waitErr := policy.wait(ctx, attempt); waitErr != nil {
+			return nil, recordCounterServiceResult(ctx, retryable, err)
+		}
+		globalVariables.Log.Debug("retrying request to redis, attempt: ", attempt+1, " error: ", err.Error())
+	}
+}
+
+func (b *redisCounterBackend) doOnce(ctx context.Context, command func(conn redis.Conn) (interface{}, error)) (interface{}, bool, error) {
+	conn, err := b.pool.GetContext(ctx)
+	if err != nil {
+		return nil, ctx.Err() == nil, errors.New("error connecting to redis: " + err.Error())
+	}
+	defer conn.Close()
+
+	reply, err := command(conn)
+	if err != nil {
+		if _, ok := err.(redis.Error); ok {
+			return nil, false, errors.New("error from redis: " + err.Error())
+		}
+		return nil, ctx.Err() == nil, errors.New("error calling redis: " + err.Error())
+	}
+	return reply, false, nil
+}
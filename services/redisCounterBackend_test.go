@@ -0,0 +1,189 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package services_test
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/apid/apidQuota/metrics"
+	. "github.com/apid/apidQuota/services"
+	"github.com/apid/apidQuota/testUtil"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Test RedisCounterBackend", func() {
+	var server *miniredis.Miniredis
+	var backend CounterBackend
+	var ctx context.Context
+	var now int64
+
+	BeforeEach(func() {
+		var err error
+		server, err = miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		backend = NewRedisCounterBackend(server.Addr(), "", 0, "test:")
+		ctx = context.Background()
+		now = time.Now().Unix()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("test increment and get count", func() {
+		count, err := backend.IncrementAndGetCount(ctx, "testOrg", "testKey", 2, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(2)))
+
+		count, err = backend.IncrementAndGetCount(ctx, "testOrg", "testKey", 3, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(5)))
+
+		//delta 0 only gets the count.
+		count, err = backend.IncrementAndGetCount(ctx, "testOrg", "testKey", 0, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(5)))
+
+		//the counter expires at the end of the period.
+		Expect(server.Exists("test:{testOrg|testKey}|" + strconv.FormatInt(now, 10) + "|" + strconv.FormatInt(now+3600, 10))).To(BeTrue())
+		server.FastForward(time.Hour + time.Second)
+		count, err = backend.IncrementAndGetCount(ctx, "testOrg", "testKey", 0, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(0)))
+
+		//another period has its own count.
+		count, err = backend.IncrementAndGetCount(ctx, "testOrg", "testKey", 1, now+3600, now+7200)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(1)))
+	})
+
+	It("test retried increment is counted once", func() {
+		retryCtx := WithIdempotencyKey(ctx, "testIdempotencyKey")
+		count, err := backend.IncrementAndGetCount(retryCtx, "testOrg", "testKey", 2, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(2)))
+
+		count, err = backend.IncrementAndGetCount(retryCtx, "testOrg", "testKey", 2, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(2)))
+
+		count, err = backend.IncrementAndGetCount(ctx, "testOrg", "testKey", 2, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(4)))
+	})
+
+	It("test keys of a quota key share its hash tag, to be in the same redis cluster slot", func() {
+		retryCtx := WithIdempotencyKey(ctx, "testIdempotencyKey")
+		_, err := backend.IncrementAndGetCount(retryCtx, "testOrg", "testKey", 2, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		windowCtx := WithSlidingWindow(WithIdempotencyKey(ctx, "windowIdempotencyKey"))
+		_, err = backend.IncrementAndGetCount(windowCtx, "testOrg", "testKey", 2, now-60, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		keys := server.Keys()
+		Expect(keys).To(HaveLen(4))
+		for _, key := range keys {
+			Expect(key).To(HavePrefix("test:{testOrg|testKey}|"))
+		}
+	})
+
+	It("test batch increment", func() {
+		entries := []CounterEntry{
+			{OrgID: "testOrg", Key: "testKey1", Delta: 1, StartTime: now, EndTime: now + 3600},
+			{OrgID: "testOrg", Key: "testKey2", Delta: 3, StartTime: now, EndTime: now + 3600},
+			{OrgID: "testOrg", Key: "testKey1", Delta: 2, StartTime: now, EndTime: now + 3600},
+			{OrgID: "testOrg", Key: "testKey3", Delta: 4, StartTime: now - 60, EndTime: now, SlidingWindow: true},
+		}
+		counts, err := backend.BatchIncrementAndGetCount(ctx, entries)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counts).To(Equal([]int64{1, 3, 3, 4}))
+	})
+
+	It("test sliding window", func() {
+		windowCtx := WithSlidingWindow(ctx)
+		count, err := backend.IncrementAndGetCount(windowCtx, "testOrg", "testKey", 2, now-60, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(2)))
+
+		//30 seconds later, the first increment is still in the window.
+		count, err = backend.IncrementAndGetCount(windowCtx, "testOrg", "testKey", 3, now-30, now+30)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(5)))
+
+		//61 seconds later, the first increment has left the window.
+		count, err = backend.IncrementAndGetCount(windowCtx, "testOrg", "testKey", 0, now+1, now+61)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(3)))
+
+		members, err := server.ZMembers("test:{testOrg|testKey}|window")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(members)).To(Equal(1))
+	})
+
+	It("test reset count", func() {
+		_, err := backend.IncrementAndGetCount(ctx, "testOrg", "testKey", 2, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.ResetCount(ctx, "testOrg", "testKey", now, now+3600)).To(Succeed())
+		count, err := backend.IncrementAndGetCount(ctx, "testOrg", "testKey", 0, now, now+3600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(0)))
+
+		windowCtx := WithSlidingWindow(ctx)
+		_, err = backend.IncrementAndGetCount(windowCtx, "testOrg", "testKey", 2, now-60, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.ResetCount(windowCtx, "testOrg", "testKey", now-60, now)).To(Succeed())
+		count, err = backend.IncrementAndGetCount(windowCtx, "testOrg", "testKey", 0, now-60, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(count).To(Equal(int64(0)))
+	})
+
+	Context("through the services layer", func() {
+		testUtil.UseConfig()
+
+		It("test calls report the counter service metrics", func() {
+			SetCounterBackend(backend)
+			defer SetCounterBackend(NewHTTPCounterBackend())
+
+			_, err := IncrementAndGetCount(ctx, "testOrg", "testKey", 1, now, now+3600)
+			Expect(err).NotTo(HaveOccurred())
+			server.Close()
+			_, err = BatchIncrementAndGetCount(ctx, []CounterEntry{{OrgID: "testOrg", Key: "testKey", Delta: 1, StartTime: now, EndTime: now + 3600}})
+			Expect(err).To(HaveOccurred())
+
+			metricsServer := httptest.NewServer(metrics.Handler())
+			defer metricsServer.Close()
+			res, err := metricsServer.Client().Get(metricsServer.URL)
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(ContainSubstring(`apidquota_counter_service_request_duration_seconds_count{backend="redis",operation="increment"} 1`))
+			Expect(string(body)).To(ContainSubstring(`apidquota_counter_service_request_duration_seconds_count{backend="redis",operation="batch_increment"} 1`))
+			Expect(string(body)).To(ContainSubstring(`apidquota_counter_service_errors_total{backend="redis",operation="batch_increment",status="unavailable"} 1`))
+		})
+	})
+
+	It("test ping", func() {
+		Expect(backend.Ping(ctx)).To(Succeed())
+
+		server.Close()
+		Expect(backend.Ping(ctx)).NotTo(Succeed())
+	})
+})
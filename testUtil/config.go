@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testUtil has in-memory stand-ins for the apid services, for the tests of the other packages.
+package testUtil
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is an in-memory apid.ConfigService. values are returned as set, converted like the apid config does.
+type Config struct {
+	lock     sync.RWMutex
+	values   map[string]interface{}
+	defaults map[string]interface{}
+}
+
+func NewConfig() *Config {
+	return &Config{
+		values:   make(map[string]interface{}),
+		defaults: make(map[string]interface{}),
+	}
+}
+
+func (c *Config) SetDefault(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.defaults[strings.ToLower(key)] = value
+}
+
+func (c *Config) Set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[strings.ToLower(key)] = value
+}
+
+func (c *Config) Get(key string) interface{} {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	key = strings.ToLower(key)
+	if value, ok := c.values[key]; ok {
+		return value
+	}
+	return c.defaults[key]
+}
+
+func (c *Config) IsSet(key string) bool {
+	return c.Get(key) != nil
+}
+
+func (c *Config) GetBool(key string) bool {
+	value, _ := c.Get(key).(bool)
+	return value
+}
+
+func (c *Config) GetFloat64(key string) float64 {
+	switch value := c.Get(key).(type) {
+	case float64:
+		return value
+	case int:
+		return float64(value)
+	case int64:
+		return float64(value)
+	}
+	return 0
+}
+
+func (c *Config) GetInt(key string) int {
+	return int(c.GetInt64(key))
+}
+
+func (c *Config) GetInt64(key string) int64 {
+	switch value := c.Get(key).(type) {
+	case int:
+		return int64(value)
+	case int64:
+		return value
+	case float64:
+		return int64(value)
+	case time.Duration:
+		return int64(value)
+	}
+	return 0
+}
+
+func (c *Config) GetString(key string) string {
+	value, _ := c.Get(key).(string)
+	return value
+}
+
+func (c *Config) GetDuration(key string) time.Duration {
+	switch value := c.Get(key).(type) {
+	case time.Duration:
+		return value
+	case string:
+		duration, _ := time.ParseDuration(value)
+		return duration
+	case int:
+		return time.Duration(value)
+	case int64:
+		return time.Duration(value)
+	}
+	return 0
+}
+
+func (c *Config) GetStringSlice(key string) []string {
+	switch value := c.Get(key).(type) {
+	case []string:
+		return value
+	case string:
+		return strings.Fields(value)
+	}
+	return nil
+}
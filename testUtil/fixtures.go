@@ -0,0 +1,61 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testUtil
+
+import (
+	"github.com/apid/apid-core"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"github.com/apid/apidQuota/services"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+// UseConfig gives each spec of the enclosing container an in-memory config and a silent log.
+// they are restored after the AfterEach of the nested containers, which may still need them.
+func UseConfig() {
+	var config apid.ConfigService
+	var log apid.LogService
+	BeforeEach(func() {
+		config, log = globalVariables.Config, globalVariables.Log
+		globalVariables.Config = NewConfig()
+		globalVariables.Log = Log{}
+	})
+	AfterEach(func() {
+		globalVariables.Config, globalVariables.Log = config, log
+	})
+}
+
+// GetConfig returns the config set by UseConfig.
+func GetConfig() *Config {
+	return globalVariables.Config.(*Config)
+}
+
+// UseCounterService points the counter service urls at serverURL, with a single attempt per call
+// and a circuit breaker which stays closed. it needs the config set by UseConfig.
+func UseCounterService(serverURL string) {
+	GetConfig().Set(constants.ConfigCounterServiceMaxRetries, 0)
+	GetConfig().Set(constants.ConfigCounterServiceAttemptTimeout, time.Second)
+	GetConfig().Set(constants.ConfigCircuitBreakerFailureThreshold, 1000)
+	globalVariables.CounterServiceURL = serverURL
+	Expect(services.InitCounterServiceEndpoints([]string{serverURL})).To(Succeed())
+}
+
+// ResetCounterService unsets the counter service urls set by UseCounterService.
+func ResetCounterService() {
+	Expect(services.InitCounterServiceEndpoints(nil)).To(Succeed())
+	globalVariables.CounterServiceURL = ""
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testUtil
+
+import (
+	"fmt"
+
+	"github.com/apid/apid-core"
+)
+
+// Log is an apid.LogService which drops the debug and info messages and panics on fatal ones.
+type Log struct{}
+
+func (l Log) Debugf(format string, args ...interface{})   {}
+func (l Log) Infof(format string, args ...interface{})    {}
+func (l Log) Printf(format string, args ...interface{})   {}
+func (l Log) Warnf(format string, args ...interface{})    {}
+func (l Log) Warningf(format string, args ...interface{}) {}
+func (l Log) Errorf(format string, args ...interface{})   {}
+func (l Log) Fatalf(format string, args ...interface{})   { panic(fmt.Sprintf(format, args...)) }
+func (l Log) Panicf(format string, args ...interface{})   { panic(fmt.Sprintf(format, args...)) }
+
+func (l Log) Debug(args ...interface{})   {}
+func (l Log) Info(args ...interface{})    {}
+func (l Log) Print(args ...interface{})   {}
+func (l Log) Warn(args ...interface{})    {}
+func (l Log) Warning(args ...interface{}) {}
+func (l Log) Error(args ...interface{})   {}
+func (l Log) Fatal(args ...interface{})   { panic(fmt.Sprint(args...)) }
+func (l Log) Panic(args ...interface{})   { panic(fmt.Sprint(args...)) }
+
+func (l Log) Debugln(args ...interface{})   {}
+func (l Log) Infoln(args ...interface{})    {}
+func (l Log) Println(args ...interface{})   {}
+func (l Log) Warnln(args ...interface{})    {}
+func (l Log) Warningln(args ...interface{}) {}
+func (l Log) Errorln(args ...interface{})   {}
+func (l Log) Fatalln(args ...interface{})   { panic(fmt.Sprintln(args...)) }
+func (l Log) Panicln(args ...interface{})   { panic(fmt.Sprintln(args...)) }
+
+func (l Log) ForModule(name string) apid.LogService                   { return l }
+func (l Log) WithField(key string, value interface{}) apid.LogService { return l }
@@ -0,0 +1,150 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"github.com/apid/apidQuota/constants"
+	"github.com/apid/apidQuota/globalVariables"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the spans of apidQuota have their own tracer provider, so they do not depend on how other apid plugins trace.
+// spans are not recorded until a provider is set, but the trace context of the callers is still propagated.
+var providerLock sync.RWMutex
+var provider trace.TracerProvider = noop.NewTracerProvider()
+
+// traceparent and tracestate headers, as per W3C trace context.
+var propagator = propagation.TraceContext{}
+
+func getTracer() trace.Tracer {
+	providerLock.RLock()
+	defer providerLock.RUnlock()
+	return provider.Tracer(constants.TracerName)
+}
+
+// Init sets up the span exporter as per the config. tracing is disabled when no exporter is set.
+func Init() error {
+	config := globalVariables.Config
+	sampleRatio := config.GetFloat64(constants.ConfigTracingSampleRatio)
+	if sampleRatio < 0 || sampleRatio > 1 {
+		return errors.New(constants.InvalidTracingConfig + " : " + constants.ConfigTracingSampleRatio + " should be between 0 and 1, got: " +
+			strconv.FormatFloat(sampleRatio, 'f', -1, 64))
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterType := config.GetString(constants.ConfigTracingExporter); exporterType {
+	case "", constants.TracingExporterNone:
+		SetTracerProvider(nil)
+		return nil
+	case constants.TracingExporterOTLP:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.GetString(constants.ConfigTracingOTLPEndpoint))}
+		if config.GetBool(constants.ConfigTracingOTLPInsecure) {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case constants.TracingExporterStdout:
+		exporter, err = stdouttrace.New()
+	default:
+		return errors.New(constants.InvalidTracingConfig + " : unknown " + constants.ConfigTracingExporter + ": " + exporterType)
+	}
+	if err != nil {
+		return errors.New(constants.InvalidTracingConfig + " : " + err.Error())
+	}
+
+	SetTracerProvider(NewTracerProvider(exporter, sampleRatio))
+	return nil
+}
+
+// NewTracerProvider returns a provider exporting the spans in batches. sampleRatio applies to the traces started here,
+// the spans of a traced request follow the sampling decision of the caller.
+func NewTracerProvider(exporter sdktrace.SpanExporter, sampleRatio float64) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", constants.TracingServiceName))),
+	)
+}
+
+// SetTracerProvider replaces the tracer provider, nil disables the spans. the replaced provider is not shut down.
+func SetTracerProvider(tracerProvider trace.TracerProvider) {
+	if tracerProvider == nil {
+		tracerProvider = noop.NewTracerProvider()
+	}
+	providerLock.Lock()
+	provider = tracerProvider
+	providerLock.Unlock()
+}
+
+// Shutdown exports the spans not yet exported, waiting at most timeout, and stops the tracer provider.
+func Shutdown(timeout time.Duration) error {
+	providerLock.RLock()
+	tracerProvider := provider
+	providerLock.RUnlock()
+
+	sdkProvider, ok := tracerProvider.(*sdktrace.TracerProvider)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return sdkProvider.Shutdown(ctx)
+}
+
+// Start starts a span as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return getTracer().Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End ends the span, marking it as failed when err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// QuotaAttributes identify the quotaBucket a span works on.
+func QuotaAttributes(orgID string, id string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("quota.org", orgID),
+		attribute.String("quota.id", id),
+	}
+}
+
+// Extract returns ctx with the trace context of the incoming request headers, so its spans join the caller's trace.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Inject adds the trace context of ctx to the headers of an outgoing request.
+func Inject(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
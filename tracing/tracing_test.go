@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/apid/apidQuota/quotaBucket"
+	"github.com/apid/apidQuota/services"
+	. "github.com/apid/apidQuota/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"time"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceparent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+var _ = Describe("Test tracing", func() {
+	var exporter *tracetest.InMemoryExporter
+	var provider *sdktrace.TracerProvider
+
+	BeforeEach(func() {
+		exporter = tracetest.NewInMemoryExporter()
+		provider = NewTracerProvider(exporter, 1)
+		SetTracerProvider(provider)
+	})
+
+	AfterEach(func() {
+		Expect(Shutdown(time.Second)).To(Succeed())
+		SetTracerProvider(nil)
+	})
+
+	// spans returns the exported spans by name.
+	spans := func() map[string]tracetest.SpanStub {
+		Expect(provider.ForceFlush(context.Background())).To(Succeed())
+		byName := make(map[string]tracetest.SpanStub)
+		for _, span := range exporter.GetSpans() {
+			byName[span.Name] = span
+		}
+		return byName
+	}
+
+	It("test spans are nested and failures are recorded", func() {
+		ctx, parent := Start(context.Background(), "parent", QuotaAttributes("sampleOrg", "sampleID")...)
+		_, child := Start(ctx, "child")
+		End(child, errors.New("counter service unavailable"))
+		End(parent, nil)
+
+		exported := spans()
+		Expect(exported).To(HaveLen(2))
+		Expect(exported["child"].Parent.SpanID()).To(Equal(exported["parent"].SpanContext.SpanID()))
+		Expect(exported["child"].Status.Code).To(Equal(codes.Error))
+		Expect(exported["child"].Status.Description).To(Equal("counter service unavailable"))
+		Expect(exported["parent"].Status.Code).To(Equal(codes.Unset))
+		Expect(exported["parent"].Attributes).To(ContainElement(attribute.String("quota.org", "sampleOrg")))
+		Expect(exported["parent"].Attributes).To(ContainElement(attribute.String("quota.id", "sampleID")))
+	})
+
+	It("test traceparent of the caller is propagated", func() {
+		incoming := http.Header{}
+		incoming.Set("traceparent", testTraceparent)
+		ctx, span := Start(Extract(context.Background(), incoming), "checkQuotaLimitExceeded")
+
+		outgoing := http.Header{}
+		Inject(ctx, outgoing)
+		End(span, nil)
+		Expect(outgoing.Get("traceparent")).To(Equal("00-" + testTraceID + "-" + span.SpanContext().SpanID().String() + "-01"))
+		Expect(spans()["checkQuotaLimitExceeded"].SpanContext.TraceID().String()).To(Equal(testTraceID))
+	})
+
+	It("test traceparent is propagated when tracing is disabled", func() {
+		SetTracerProvider(nil)
+		incoming := http.Header{}
+		incoming.Set("traceparent", testTraceparent)
+		ctx, span := Start(Extract(context.Background(), incoming), "checkQuotaLimitExceeded")
+		defer span.End()
+
+		outgoing := http.Header{}
+		Inject(ctx, outgoing)
+		Expect(outgoing.Get("traceparent")).To(Equal(testTraceparent))
+		Expect(span.IsRecording()).To(BeFalse())
+	})
+
+	It("test quota check spans include the counter service call", func() {
+		server, err := miniredis.Run()
+		Expect(err).NotTo(HaveOccurred())
+		defer server.Close()
+		services.SetCounterBackend(services.NewRedisCounterBackend(server.Addr(), "", 0, "test:"))
+
+		qBucket, err := quotaBucket.NewQuotaBucket("sampleOrg", "tracedID", 1, "hour", "calendar", false,
+			time.Now().UTC().AddDate(0, -1, 0).Unix(), 10, 1, true, true, -1, -1)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = qBucket.IncrementQuotaLimit(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+
+		exported := spans()
+		Expect(exported).To(HaveKey("IncrementQuotaLimit"))
+		Expect(exported).To(HaveKey("IncrementAndGetCount"))
+		Expect(exported["IncrementAndGetCount"].Parent.SpanID()).To(Equal(exported["IncrementQuotaLimit"].SpanContext.SpanID()))
+		Expect(exported["IncrementAndGetCount"].Attributes).To(ContainElement(attribute.String("quota.id", "tracedID")))
+	})
+})
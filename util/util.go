@@ -15,8 +15,11 @@
 package util
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"github.com/apid/apidQuota/constants"
 	"net/http"
+	"strings"
 )
 
 // WriteErrorResponse will write the HTTP header and payload for the HTTP ResponseWriter provided
@@ -32,3 +35,16 @@ func WriteErrorResponse(status int, errorType string, errorDescription string, r
 	res.WriteHeader(status)
 	res.Write(responseJson)
 }
+
+// RequireAdminToken only lets through the requests carrying token as their bearer token. an empty token lets nothing through.
+func RequireAdminToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		authorization := req.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(authorization, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) != 1 {
+			WriteErrorResponse(http.StatusUnauthorized, constants.Unauthorized, "a valid admin bearer token is required", res, req)
+			return
+		}
+		handler(res, req)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util_test
+
+import (
+	. "github.com/apid/apidQuota/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Test RequireAdminToken", func() {
+	ok := func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	}
+
+	status := func(handler http.HandlerFunc, authorization string) int {
+		req := httptest.NewRequest("GET", "/quota/admin/buckets", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res.Code
+	}
+
+	It("test only the requests with the admin token are let through", func() {
+		handler := RequireAdminToken("secretToken", ok)
+		Expect(status(handler, "Bearer secretToken")).To(Equal(http.StatusOK))
+		Expect(status(handler, "Bearer otherToken")).To(Equal(http.StatusUnauthorized))
+		Expect(status(handler, "secretToken")).To(Equal(http.StatusUnauthorized))
+		Expect(status(handler, "")).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("test empty admin token lets nothing through", func() {
+		handler := RequireAdminToken("", ok)
+		Expect(status(handler, "Bearer ")).To(Equal(http.StatusUnauthorized))
+		Expect(status(handler, "")).To(Equal(http.StatusUnauthorized))
+	})
+})